@@ -37,8 +37,8 @@ type VersionPortal struct {
 
 // ListAllAPIVersions ...
 func (portal *VersionPortal) ListAllAPIVersions() {
-	NewClient(portal.Ctx)
-	versions, err := opensdsClient.ListVersions()
+	client := NewClient(portal.Ctx)
+	versions, err := client.ListVersions()
 	if err != nil {
 		reason := fmt.Sprintf("List All Api Versions failed: %v", err)
 		portal.Ctx.Output.SetStatus(model.ErrorInternalServer)
@@ -22,6 +22,7 @@ import (
 	"testing"
 
 	"github.com/astaxie/beego"
+	bctx "github.com/astaxie/beego/context"
 	c "github.com/opensds/opensds/client"
 	"github.com/opensds/nbp/cindercompatibleapi/converter"
 )
@@ -30,7 +31,9 @@ func init() {
 	beego.Router("/", &VersionPortal{},
 		"get:ListAllAPIVersions")
 
-	opensdsClient = c.NewFakeClient(&c.Config{Endpoint: c.TestEp})
+	clientFactory = func(*bctx.Context) *c.Client {
+		return c.NewFakeClient(&c.Config{Endpoint: c.TestEp})
+	}
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -51,7 +54,11 @@ func TestListAllAPIVersions(t *testing.T) {
 			"status": "CURRENT",
 			"updated": "2017-07-10T14:36:58.014Z",
 			"min_version": "3.0",
-			"id": "v3.0"
+			"id": "v3.0",
+			"links": [{
+				"href": "http://127.0.0.1:8777/v3/",
+				"rel": "self"
+			}]
 		}]
 	}`
 
@@ -39,8 +39,8 @@ type AttachmentPortal struct {
 func (portal *AttachmentPortal) DeleteAttachment() {
 	id := portal.Ctx.Input.Param(":attachmentId")
 	attachment := model.VolumeAttachmentSpec{}
-	NewClient(portal.Ctx)
-	err := opensdsClient.DeleteVolumeAttachment(id, &attachment)
+	client := NewClient(portal.Ctx)
+	err := client.DeleteVolumeAttachment(id, &attachment)
 
 	if err != nil {
 		reason := fmt.Sprintf("Delete attachment failed: %v", err)
@@ -57,8 +57,8 @@ func (portal *AttachmentPortal) DeleteAttachment() {
 // GetAttachment ...
 func (portal *AttachmentPortal) GetAttachment() {
 	id := portal.Ctx.Input.Param(":attachmentId")
-	NewClient(portal.Ctx)
-	attachment, err := opensdsClient.GetVolumeAttachment(id)
+	client := NewClient(portal.Ctx)
+	attachment, err := client.GetVolumeAttachment(id)
 
 	if err != nil {
 		reason := fmt.Sprintf("Show attachment details failed: %v", err)
@@ -85,8 +85,8 @@ func (portal *AttachmentPortal) GetAttachment() {
 
 // ListAttachmentsDetails ...
 func (portal *AttachmentPortal) ListAttachmentsDetails() {
-	NewClient(portal.Ctx)
-	attachments, err := opensdsClient.ListVolumeAttachments()
+	client := NewClient(portal.Ctx)
+	attachments, err := client.ListVolumeAttachments()
 	if err != nil {
 		reason := fmt.Sprintf("List attachments with details failed: %v", err)
 		portal.Ctx.Output.SetStatus(model.ErrorInternalServer)
@@ -112,8 +112,8 @@ func (portal *AttachmentPortal) ListAttachmentsDetails() {
 
 // ListAttachments ...
 func (portal *AttachmentPortal) ListAttachments() {
-	NewClient(portal.Ctx)
-	attachments, err := opensdsClient.ListVolumeAttachments()
+	client := NewClient(portal.Ctx)
+	attachments, err := client.ListVolumeAttachments()
 	if err != nil {
 		reason := fmt.Sprintf("List attachments failed: %v", err)
 		portal.Ctx.Output.SetStatus(model.ErrorInternalServer)
@@ -150,8 +150,8 @@ func (portal *AttachmentPortal) CreateAttachment() {
 	}
 
 	attachment := converter.CreateAttachmentReq(&cinderReq)
-	NewClient(portal.Ctx)
-	attachment, err := opensdsClient.CreateVolumeAttachment(attachment)
+	client := NewClient(portal.Ctx)
+	attachment, err := client.CreateVolumeAttachment(attachment)
 
 	if err != nil {
 		reason := fmt.Sprintf("Create attachment failed: %s", err.Error())
@@ -190,8 +190,8 @@ func (portal *AttachmentPortal) UpdateAttachment() {
 	}
 
 	attachment := converter.UpdateAttachmentReq(&cinderReq)
-	NewClient(portal.Ctx)
-	attachment, err := opensdsClient.UpdateVolumeAttachment(id, attachment)
+	client := NewClient(portal.Ctx)
+	attachment, err := client.UpdateVolumeAttachment(id, attachment)
 
 	if err != nil {
 		reason := fmt.Sprintf("Update an attachment failed: %s", err.Error())
@@ -0,0 +1,487 @@
+// Copyright (c) 2018 Huawei Technologies Co., Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+This module implements a entry into the OpenSDS northbound service.
+
+A backup is an OpenSDS snapshot which OpenSDS uploads to the bucket of the
+profile of the volume. The snapshot is polled in the background until it is
+available, then the record of the backup is written to the backup target. A
+restore creates a volume from the snapshot in the cloud, a restore into an
+existing volume copies the data of such a volume into it on this host.
+
+*/
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/astaxie/beego"
+	log "github.com/golang/glog"
+	"github.com/opensds/nbp/cindercompatibleapi/backup"
+	"github.com/opensds/nbp/cindercompatibleapi/converter"
+	"github.com/opensds/nbp/cindercompatibleapi/message"
+	c "github.com/opensds/opensds/client"
+	"github.com/opensds/opensds/pkg/model"
+	"github.com/opensds/opensds/pkg/utils/constants"
+)
+
+// BackupPortal ...
+type BackupPortal struct {
+	beego.Controller
+}
+
+// CreateBackup ...
+func (portal *BackupPortal) CreateBackup() {
+	projectID := portal.Ctx.Input.Param(":projectId")
+	var cinderReq = converter.CreateBackupReqSpec{}
+	if err := json.NewDecoder(portal.Ctx.Request.Body).Decode(&cinderReq); err != nil {
+		reason := fmt.Sprintf("Create a backup, parse request body failed: %s", err.Error())
+		portal.Ctx.Output.SetStatus(model.ErrorBadRequest)
+		portal.Ctx.Output.Body(model.ErrorBadRequestStatus(reason))
+		log.Error(reason)
+		return
+	}
+
+	b, err := converter.CreateBackupReq(&cinderReq, projectID, backupContainer)
+	if err != nil {
+		reason := fmt.Sprintf("Create a backup failed: %s", err.Error())
+		portal.Ctx.Output.SetStatus(model.ErrorBadRequest)
+		portal.Ctx.Output.Body(model.ErrorBadRequestStatus(reason))
+		log.Error(reason)
+		return
+	}
+
+	client := NewClient(portal.Ctx)
+	volume, err := client.GetVolume(b.VolumeID)
+	if err != nil {
+		reason := fmt.Sprintf("Create a backup, get volume %s failed: %v", b.VolumeID, err)
+		portal.Ctx.Output.SetStatus(model.ErrorBadRequest)
+		portal.Ctx.Output.Body(model.ErrorBadRequestStatus(reason))
+		log.Error(reason)
+		return
+	}
+	b.Size = volume.Size
+	b.AvailabilityZone = volume.AvailabilityZone
+
+	b, err = backupStore.Create(b, cinderReq.Backup.Incremental)
+	if err != nil {
+		reason := fmt.Sprintf("Create a backup failed: %v", err)
+		portal.Ctx.Output.SetStatus(backupErrorStatus(err))
+		portal.Ctx.Output.Body(backupErrorBody(err, reason))
+		log.Error(reason)
+		return
+	}
+
+	// OpenSDS uploads the snapshot to the bucket of the profile of the
+	// volume, the container is only recorded with it.
+	snapshot := &model.VolumeSnapshotSpec{
+		BaseModel:   &model.BaseModel{},
+		Name:        "backup-" + b.ID,
+		Description: "snapshot of backup " + b.ID,
+		VolumeId:    b.VolumeID,
+		Metadata: map[string]string{
+			"bucket":   b.Container,
+			"backupId": b.ID,
+		},
+	}
+	snapshot, err = client.CreateVolumeSnapshot(snapshot)
+	if err != nil {
+		reason := fmt.Sprintf("Create a backup, create snapshot failed: %v", err)
+		backupStore.Fail(b.ID, reason)
+		portal.Ctx.Output.SetStatus(model.ErrorInternalServer)
+		portal.Ctx.Output.Body(model.ErrorInternalServerStatus(reason))
+		log.Error(reason)
+		recordMessage(portal.Ctx, message.ResourceVolumeBackup, b.ID,
+			message.ActionBackupCreate, message.DetailUnknownError)
+		return
+	}
+	backupStore.SetSnapshot(b.ID, snapshot.Id)
+
+	go waitBackupCreated(client, b.ID, snapshot.Id, projectID, RequestID(portal.Ctx))
+
+	result := converter.CreateBackupResp(b)
+	body, err := json.Marshal(result)
+	if err != nil {
+		reason := fmt.Sprintf("Create a backup, marshal result failed: %v", err)
+		portal.Ctx.Output.SetStatus(model.ErrorInternalServer)
+		portal.Ctx.Output.Body(model.ErrorInternalServerStatus(reason))
+		log.Error(reason)
+		return
+	}
+
+	portal.Ctx.Output.SetStatus(http.StatusAccepted)
+	portal.Ctx.Output.Body(body)
+	return
+}
+
+// ListBackups ...
+func (portal *BackupPortal) ListBackups() {
+	projectID := portal.Ctx.Input.Param(":projectId")
+	result := converter.ListBackupsResp(backupStore.List(projectID))
+	body, err := json.Marshal(result)
+	if err != nil {
+		reason := fmt.Sprintf("List backups, marshal result failed: %v", err)
+		portal.Ctx.Output.SetStatus(model.ErrorInternalServer)
+		portal.Ctx.Output.Body(model.ErrorInternalServerStatus(reason))
+		log.Error(reason)
+		return
+	}
+
+	portal.Ctx.Output.SetStatus(http.StatusOK)
+	portal.Ctx.Output.Body(body)
+	return
+}
+
+// ListBackupsDetails ...
+func (portal *BackupPortal) ListBackupsDetails() {
+	projectID := portal.Ctx.Input.Param(":projectId")
+	result := converter.ListBackupsDetailsResp(backupStore.List(projectID))
+	body, err := json.Marshal(result)
+	if err != nil {
+		reason := fmt.Sprintf("List backups with details, marshal result failed: %v", err)
+		portal.Ctx.Output.SetStatus(model.ErrorInternalServer)
+		portal.Ctx.Output.Body(model.ErrorInternalServerStatus(reason))
+		log.Error(reason)
+		return
+	}
+
+	portal.Ctx.Output.SetStatus(http.StatusOK)
+	portal.Ctx.Output.Body(body)
+	return
+}
+
+// GetBackup ...
+func (portal *BackupPortal) GetBackup() {
+	projectID := portal.Ctx.Input.Param(":projectId")
+	id := portal.Ctx.Input.Param(":backupId")
+	b, err := backupStore.Get(projectID, id)
+	if err != nil {
+		reason := fmt.Sprintf("Show backup details failed: %v", err)
+		portal.Ctx.Output.SetStatus(model.ErrorNotFound)
+		portal.Ctx.Output.Body(model.ErrorNotFoundStatus(reason))
+		log.Error(reason)
+		return
+	}
+
+	result := converter.ShowBackupResp(b)
+	body, err := json.Marshal(result)
+	if err != nil {
+		reason := fmt.Sprintf("Show backup details, marshal result failed: %v", err)
+		portal.Ctx.Output.SetStatus(model.ErrorInternalServer)
+		portal.Ctx.Output.Body(model.ErrorInternalServerStatus(reason))
+		log.Error(reason)
+		return
+	}
+
+	portal.Ctx.Output.SetStatus(http.StatusOK)
+	portal.Ctx.Output.Body(body)
+	return
+}
+
+// DeleteBackup ...
+func (portal *BackupPortal) DeleteBackup() {
+	projectID := portal.Ctx.Input.Param(":projectId")
+	id := portal.Ctx.Input.Param(":backupId")
+	b, err := backupStore.BeginDelete(projectID, id)
+	if err != nil {
+		reason := fmt.Sprintf("Delete a backup failed: %v", err)
+		portal.Ctx.Output.SetStatus(backupErrorStatus(err))
+		portal.Ctx.Output.Body(backupErrorBody(err, reason))
+		log.Error(reason)
+		return
+	}
+
+	if "" != b.SnapshotID {
+		client := NewClient(portal.Ctx)
+		if err := client.DeleteVolumeSnapshot(b.SnapshotID, &model.VolumeSnapshotSpec{}); err != nil {
+			reason := fmt.Sprintf("Delete a backup, delete snapshot %s failed: %v", b.SnapshotID, err)
+			backupStore.FailDelete(id, reason)
+			portal.Ctx.Output.SetStatus(model.ErrorInternalServer)
+			portal.Ctx.Output.Body(model.ErrorInternalServerStatus(reason))
+			log.Error(reason)
+			recordMessage(portal.Ctx, message.ResourceVolumeBackup, id,
+				message.ActionBackupDelete, message.DetailUnknownError)
+			return
+		}
+	}
+
+	if err := backupStore.FinishDelete(id); err != nil {
+		reason := fmt.Sprintf("Delete a backup failed: %v", err)
+		backupStore.FailDelete(id, reason)
+		portal.Ctx.Output.SetStatus(model.ErrorInternalServer)
+		portal.Ctx.Output.Body(model.ErrorInternalServerStatus(reason))
+		log.Error(reason)
+		recordMessage(portal.Ctx, message.ResourceVolumeBackup, id,
+			message.ActionBackupDelete, message.DetailUnknownError)
+		return
+	}
+
+	portal.Ctx.Output.SetStatus(http.StatusAccepted)
+	return
+}
+
+// RestoreBackup restores a backup to a new volume, or to an existing one
+// when volume_id is given.
+func (portal *BackupPortal) RestoreBackup() {
+	projectID := portal.Ctx.Input.Param(":projectId")
+	id := portal.Ctx.Input.Param(":backupId")
+	var cinderReq = converter.RestoreBackupReqSpec{}
+	if err := json.NewDecoder(portal.Ctx.Request.Body).Decode(&cinderReq); err != nil {
+		reason := fmt.Sprintf("Restore a backup, parse request body failed: %s", err.Error())
+		portal.Ctx.Output.SetStatus(model.ErrorBadRequest)
+		portal.Ctx.Output.Body(model.ErrorBadRequestStatus(reason))
+		log.Error(reason)
+		return
+	}
+
+	b, err := backupStore.BeginRestore(projectID, id)
+	if err != nil {
+		reason := fmt.Sprintf("Restore a backup failed: %v", err)
+		portal.Ctx.Output.SetStatus(backupErrorStatus(err))
+		portal.Ctx.Output.Body(backupErrorBody(err, reason))
+		log.Error(reason)
+		return
+	}
+
+	client := NewClient(portal.Ctx)
+	var volume *model.VolumeSpec
+	if "" == cinderReq.Restore.VolumeID {
+		volume, err = restoreToNewVolume(client, b, cinderReq.Restore.Name)
+	} else {
+		volume, err = getRestoreVolume(client, b, cinderReq.Restore.VolumeID)
+	}
+	if err != nil {
+		reason := fmt.Sprintf("Restore a backup failed: %v", err)
+		backupStore.FinishRestore(id)
+		portal.Ctx.Output.SetStatus(backupErrorStatus(err))
+		portal.Ctx.Output.Body(backupErrorBody(err, reason))
+		log.Error(reason)
+		if backupErrorStatus(err) == model.ErrorInternalServer {
+			recordMessage(portal.Ctx, message.ResourceVolumeBackup, id,
+				message.ActionBackupRestore, message.DetailUnknownError)
+		}
+		return
+	}
+
+	if "" == cinderReq.Restore.VolumeID {
+		go waitBackupRestored(client, id, volume.Id, projectID, RequestID(portal.Ctx))
+	} else {
+		go restoreToVolume(client, b, volume, projectID, RequestID(portal.Ctx))
+	}
+
+	result := converter.RestoreBackupResp(id, volume.Id, volume.Name)
+	body, err := json.Marshal(result)
+	if err != nil {
+		reason := fmt.Sprintf("Restore a backup, marshal result failed: %v", err)
+		portal.Ctx.Output.SetStatus(model.ErrorInternalServer)
+		portal.Ctx.Output.Body(model.ErrorInternalServerStatus(reason))
+		log.Error(reason)
+		return
+	}
+
+	portal.Ctx.Output.SetStatus(http.StatusAccepted)
+	portal.Ctx.Output.Body(body)
+	return
+}
+
+// restoreToNewVolume creates a volume from the snapshot of the backup in
+// the cloud.
+func restoreToNewVolume(client *c.Client, b *backup.Backup, name string) (*model.VolumeSpec, error) {
+	if "" == name {
+		name = "restore_backup_" + b.ID
+	}
+
+	volume := &model.VolumeSpec{
+		BaseModel:         &model.BaseModel{},
+		Name:              name,
+		Description:       "restored from backup " + b.ID,
+		Size:              b.Size,
+		AvailabilityZone:  b.AvailabilityZone,
+		SnapshotId:        b.SnapshotID,
+		SnapshotFromCloud: true,
+	}
+	volume, err := client.CreateVolume(volume)
+	if err != nil {
+		return nil, fmt.Errorf("create volume from snapshot %s failed: %v", b.SnapshotID, err)
+	}
+
+	return volume, nil
+}
+
+// getRestoreVolume gets an existing volume to restore a backup to, which must
+// be available and large enough.
+func getRestoreVolume(client *c.Client, b *backup.Backup, volumeID string) (*model.VolumeSpec, error) {
+	volume, err := client.GetVolume(volumeID)
+	if err != nil {
+		return nil, &backup.InvalidError{Reason: fmt.Sprintf("get volume %s failed: %v", volumeID, err)}
+	}
+	if model.VolumeAvailable != volume.Status {
+		return nil, &backup.InvalidError{Reason: fmt.Sprintf(
+			"volume %s status must be available, but current status is %s", volumeID, volume.Status)}
+	}
+	if volume.Size < b.Size {
+		return nil, &backup.InvalidError{Reason: fmt.Sprintf(
+			"volume %s size %dGB is smaller than backup size %dGB", volumeID, volume.Size, b.Size)}
+	}
+
+	return volume, nil
+}
+
+// restoreToVolume restores a backup into an existing volume in the
+// background, the backup is available again once it is done.
+func restoreToVolume(client *c.Client, b *backup.Backup, volume *model.VolumeSpec, projectID, requestID string) {
+	defer backupStore.FinishRestore(b.ID)
+
+	if err := copyBackupToVolume(client, b, volume); err != nil {
+		log.Errorf("Restore backup %s to volume %s failed: %v", b.ID, volume.Id, err)
+		recordProjectMessage(projectID, requestID, message.ResourceVolumeBackup, b.ID,
+			message.ActionBackupRestore, message.DetailUnknownError)
+		return
+	}
+
+	log.Infof("Backup %s is restored to volume %s", b.ID, volume.Id)
+}
+
+// copyBackupToVolume restores the snapshot of a backup in the cloud to a
+// staging volume, as OpenSDS only restores it by creating a volume, and
+// copies the data of the staging volume into the existing one.
+func copyBackupToVolume(client *c.Client, b *backup.Backup, volume *model.VolumeSpec) error {
+	staging, err := restoreToNewVolume(client, b, "restore_backup_"+b.ID+"_staging")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := client.DeleteVolume(staging.Id, &model.VolumeSpec{}); err != nil {
+			log.Errorf("Restore backup %s, delete staging volume %s failed: %v", b.ID, staging.Id, err)
+		}
+	}()
+
+	if staging, err = waitVolumeAvailable(client, staging.Id); err != nil {
+		return err
+	}
+
+	return copyVolumeData(client, staging, volume)
+}
+
+// waitBackupCreated polls the snapshot of a backup until it is uploaded,
+// the backup becomes available or error.
+func waitBackupCreated(client *c.Client, backupID, snapshotID, projectID, requestID string) {
+	start := time.Now()
+	reason := ""
+
+	for {
+		time.Sleep(SleepDuration)
+		snapshot, err := client.GetVolumeSnapshot(snapshotID)
+		if err != nil {
+			log.V(5).Infof("Create backup %s, get snapshot %s failed: %v", backupID, snapshotID, err)
+		} else if model.VolumeSnapAvailable == snapshot.Status {
+			err := backupStore.Complete(backupID, snapshot.Size, snapshotCreatedAt(snapshot))
+			if err == nil {
+				log.Infof("Backup %s is available", backupID)
+				return
+			}
+			reason = err.Error()
+			break
+		} else if model.VolumeSnapError == snapshot.Status {
+			reason = fmt.Sprintf("snapshot %s is in error", snapshotID)
+			break
+		}
+
+		if time.Since(start) >= backupTimeout {
+			reason = fmt.Sprintf("snapshot %s is not available after %v", snapshotID, backupTimeout)
+			break
+		}
+	}
+
+	log.Errorf("Create backup %s failed: %s", backupID, reason)
+	backupStore.Fail(backupID, reason)
+	recordProjectMessage(projectID, requestID, message.ResourceVolumeBackup, backupID,
+		message.ActionBackupCreate, message.DetailUnknownError)
+}
+
+// waitBackupRestored polls the volume being restored, the backup is
+// available again once the volume is available or error.
+func waitBackupRestored(client *c.Client, backupID, volumeID, projectID, requestID string) {
+	defer backupStore.FinishRestore(backupID)
+
+	if _, err := waitVolumeAvailable(client, volumeID); err != nil {
+		log.Errorf("Restore backup %s to volume %s failed: %v", backupID, volumeID, err)
+		recordProjectMessage(projectID, requestID, message.ResourceVolumeBackup, backupID,
+			message.ActionBackupRestore, message.DetailUnknownError)
+		return
+	}
+
+	log.Infof("Backup %s is restored to volume %s", backupID, volumeID)
+}
+
+// waitVolumeAvailable polls a volume created from a snapshot in the cloud
+// until it is available, error or not available within the backup timeout.
+func waitVolumeAvailable(client *c.Client, volumeID string) (*model.VolumeSpec, error) {
+	start := time.Now()
+
+	for {
+		time.Sleep(SleepDuration)
+		volume, err := client.GetVolume(volumeID)
+		if err != nil {
+			log.V(5).Infof("Get volume %s failed: %v", volumeID, err)
+		} else if model.VolumeAvailable == volume.Status {
+			return volume, nil
+		} else if model.VolumeError == volume.Status {
+			return nil, fmt.Errorf("volume %s is in error", volumeID)
+		}
+
+		if time.Since(start) >= backupTimeout {
+			return nil, fmt.Errorf("volume %s is not available after %v", volumeID, backupTimeout)
+		}
+	}
+}
+
+// The data of a backup is the data of its snapshot at the time the
+// snapshot was created.
+func snapshotCreatedAt(snapshot *model.VolumeSnapshotSpec) time.Time {
+	if nil != snapshot.BaseModel {
+		t, err := time.Parse(constants.TimeFormat, snapshot.CreatedAt)
+		if err == nil {
+			return t
+		}
+	}
+	return time.Now()
+}
+
+func backupErrorStatus(err error) int {
+	switch err.(type) {
+	case *backup.NotFoundError:
+		return model.ErrorNotFound
+	case *backup.InvalidError:
+		return model.ErrorBadRequest
+	default:
+		return model.ErrorInternalServer
+	}
+}
+
+func backupErrorBody(err error, reason string) []byte {
+	switch err.(type) {
+	case *backup.NotFoundError:
+		return model.ErrorNotFoundStatus(reason)
+	case *backup.InvalidError:
+		return model.ErrorBadRequestStatus(reason)
+	default:
+		return model.ErrorInternalServerStatus(reason)
+	}
+}
@@ -0,0 +1,233 @@
+// Copyright (c) 2018 Huawei Technologies Co., Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/astaxie/beego"
+	bctx "github.com/astaxie/beego/context"
+	c "github.com/opensds/opensds/client"
+	"github.com/opensds/nbp/cindercompatibleapi/backup"
+	"github.com/opensds/nbp/cindercompatibleapi/converter"
+	"github.com/opensds/opensds/pkg/model"
+)
+
+func init() {
+	beego.Router("/V3/backups", &BackupPortal{},
+		"post:CreateBackup;get:ListBackups")
+	beego.Router("/V3/backups/detail", &BackupPortal{},
+		"get:ListBackupsDetails")
+	beego.Router("/V3/backups/:backupId", &BackupPortal{},
+		"get:GetBackup;delete:DeleteBackup")
+	beego.Router("/V3/backups/:backupId/restore", &BackupPortal{},
+		"post:RestoreBackup")
+
+	clientFactory = func(*bctx.Context) *c.Client {
+		return c.NewFakeClient(&c.Config{Endpoint: c.TestEp})
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+//                             Tests for Backup                               //
+////////////////////////////////////////////////////////////////////////////////
+func serveBackup(method, url, body string) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+	w := httptest.NewRecorder()
+	beego.BeeApp.Handlers.ServeHTTP(w, r)
+	return w
+}
+
+// createBackup creates a backup and waits for it to be uploaded.
+func createBackup(t *testing.T, incremental bool) string {
+	body := `{"backup": {"volume_id": "bd5b12a8-a101-11e7-941e-d77981b584d8", "name": "backup-01"}}`
+	if incremental {
+		body = `{"backup": {"volume_id": "bd5b12a8-a101-11e7-941e-d77981b584d8", "incremental": true}}`
+	}
+
+	w := serveBackup("POST", "/V3/backups", body)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Expected %v, actual %v %s", http.StatusAccepted, w.Code, w.Body.String())
+	}
+
+	var output converter.CreateBackupRespSpec
+	json.Unmarshal(w.Body.Bytes(), &output)
+
+	for i := 0; i < 100; i++ {
+		b, err := backupStore.Get("", output.Backup.ID)
+		if err == nil && b.Status == backup.StatusAvailable {
+			return b.ID
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Fatalf("Expected backup %v to become available", output.Backup.ID)
+	return ""
+}
+
+func TestCreateBackup(t *testing.T) {
+	SleepDuration = time.Nanosecond
+	backupStore = backup.NewStore(backup.NewMemoryTarget())
+
+	w := serveBackup("POST", "/V3/backups",
+		`{"backup": {"volume_id": "bd5b12a8-a101-11e7-941e-d77981b584d8", "incremental": true}}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected %v, actual %v", http.StatusBadRequest, w.Code)
+	}
+
+	full := createBackup(t, false)
+	incr := createBackup(t, true)
+
+	w = serveBackup("GET", "/V3/backups/"+incr, "")
+	var output converter.ShowBackupRespSpec
+	json.Unmarshal(w.Body.Bytes(), &output)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected %v, actual %v", http.StatusOK, w.Code)
+	}
+	if !output.Backup.IsIncremental || output.Backup.Container != backupContainer ||
+		output.Backup.Size != 1 || output.Backup.ObjectCount != 1 {
+		t.Errorf("Expected an incremental backup of 1GB in %v, actual %+v", backupContainer, output.Backup)
+	}
+
+	w = serveBackup("GET", "/V3/backups/detail", "")
+	var list converter.ListBackupsDetailsRespSpec
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if len(list.Backups) != 2 || list.Backups[0].ID != full || !list.Backups[0].HasDependentBackups {
+		t.Errorf("Expected backup %v with dependent backups first, actual %+v", full, list.Backups)
+	}
+
+	w = serveBackup("DELETE", "/V3/backups/"+full, "")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected %v, actual %v", http.StatusBadRequest, w.Code)
+	}
+
+	for _, id := range []string{incr, full} {
+		w = serveBackup("DELETE", "/V3/backups/"+id, "")
+		if w.Code != http.StatusAccepted {
+			t.Errorf("Expected %v, actual %v", http.StatusAccepted, w.Code)
+		}
+	}
+
+	w = serveBackup("GET", "/V3/backups/"+full, "")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected %v, actual %v", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestCreateBackupWithBadRequest(t *testing.T) {
+	w := serveBackup("POST", "/V3/backups",
+		`{"backup": {"volume_id": "bd5b12a8-a101-11e7-941e-d77981b584d8", "snapshot_id": "3769855c-a102-11e7-b772-17b880d2f537"}}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected %v, actual %v", http.StatusBadRequest, w.Code)
+	}
+
+	var output ErrorSpec
+	json.Unmarshal(w.Body.Bytes(), &output)
+	expected := "Create a backup failed: OpenSDS does not support the parameter: snapshot_id/metadata"
+	if expected != output.Message {
+		t.Errorf("Expected %v, actual %v", expected, output.Message)
+	}
+
+	w = serveBackup("POST", "/V3/backups",
+		`{"backup": {"volume_id": "bd5b12a8-a101-11e7-941e-d77981b584d8", "container": "../etc"}}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected %v, actual %v", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestRestoreBackup(t *testing.T) {
+	SleepDuration = time.Nanosecond
+	backupStore = backup.NewStore(backup.NewMemoryTarget())
+	id := createBackup(t, false)
+
+	testCases := []struct {
+		body     string
+		expected converter.RestoreRespBackup
+	}{
+		{`{"restore": {"name": "restored"}}`, converter.RestoreRespBackup{
+			BackupID:   id,
+			VolumeID:   "bd5b12a8-a101-11e7-941e-d77981b584d8",
+			VolumeName: "sample-volume",
+		}},
+	}
+
+	for _, tc := range testCases {
+		w := serveBackup("POST", "/V3/backups/"+id+"/restore", tc.body)
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("Expected %v, actual %v %s", http.StatusAccepted, w.Code, w.Body.String())
+		}
+
+		var output converter.RestoreBackupRespSpec
+		json.Unmarshal(w.Body.Bytes(), &output)
+		if output.Restore != tc.expected {
+			t.Errorf("Expected %+v, actual %+v", tc.expected, output.Restore)
+		}
+
+		// The backup is available again once the volume is.
+		restored := false
+		for i := 0; i < 100 && !restored; i++ {
+			b, _ := backupStore.Get("", id)
+			restored = b.Status == backup.StatusAvailable
+			time.Sleep(time.Millisecond)
+		}
+		if !restored {
+			t.Fatalf("Expected backup %v to become available after the restore", id)
+		}
+	}
+
+	// The data of a staging volume restored from the snapshot in the cloud
+	// is copied into an existing volume.
+	copied := make(chan string, 1)
+	copyVolumeData = func(client *c.Client, src, dst *model.VolumeSpec) error {
+		copied <- dst.Id
+		return nil
+	}
+	defer func() { copyVolumeData = copyVolumeLocally }()
+
+	w := serveBackup("POST", "/V3/backups/"+id+"/restore",
+		`{"restore": {"volume_id": "bd5b12a8-a101-11e7-941e-d77981b584d8"}}`)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Expected %v, actual %v %s", http.StatusAccepted, w.Code, w.Body.String())
+	}
+
+	select {
+	case volumeID := <-copied:
+		if volumeID != "bd5b12a8-a101-11e7-941e-d77981b584d8" {
+			t.Errorf("Expected %v, actual %v", "bd5b12a8-a101-11e7-941e-d77981b584d8", volumeID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the backup to be copied into the volume")
+	}
+
+	restored := false
+	for i := 0; i < 100 && !restored; i++ {
+		b, _ := backupStore.Get("", id)
+		restored = b.Status == backup.StatusAvailable
+		time.Sleep(time.Millisecond)
+	}
+	if !restored {
+		t.Fatalf("Expected backup %v to become available after the restore", id)
+	}
+
+	w = serveBackup("POST", "/V3/backups/not-a-backup/restore", `{"restore": {}}`)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected %v, actual %v", http.StatusNotFound, w.Code)
+	}
+}
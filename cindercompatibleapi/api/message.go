@@ -0,0 +1,120 @@
+// Copyright (c) 2018 Huawei Technologies Co., Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+This module implements a entry into the OpenSDS northbound service.
+
+*/
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/astaxie/beego"
+	bctx "github.com/astaxie/beego/context"
+	log "github.com/golang/glog"
+	"github.com/opensds/nbp/cindercompatibleapi/converter"
+	"github.com/opensds/nbp/cindercompatibleapi/message"
+	"github.com/opensds/opensds/pkg/model"
+)
+
+// MessagePortal ...
+type MessagePortal struct {
+	beego.Controller
+}
+
+// ListMessages ...
+func (portal *MessagePortal) ListMessages() {
+	projectID := portal.Ctx.Input.Param(":projectId")
+	msgs := messageStore.List(projectID)
+
+	result := converter.ListMessagesResp(msgs)
+	body, err := json.Marshal(result)
+	if err != nil {
+		reason := fmt.Sprintf("List messages, marshal result failed: %v", err)
+		portal.Ctx.Output.SetStatus(model.ErrorInternalServer)
+		portal.Ctx.Output.Body(model.ErrorInternalServerStatus(reason))
+		log.Error(reason)
+		return
+	}
+
+	portal.Ctx.Output.SetStatus(http.StatusOK)
+	portal.Ctx.Output.Body(body)
+	return
+}
+
+// GetMessage ...
+func (portal *MessagePortal) GetMessage() {
+	projectID := portal.Ctx.Input.Param(":projectId")
+	id := portal.Ctx.Input.Param(":messageId")
+	msg, err := messageStore.Get(projectID, id)
+	if err != nil {
+		reason := fmt.Sprintf("Show message details failed: %v", err)
+		portal.Ctx.Output.SetStatus(model.ErrorNotFound)
+		portal.Ctx.Output.Body(model.ErrorNotFoundStatus(reason))
+		log.Error(reason)
+		return
+	}
+
+	result := converter.ShowMessageResp(msg)
+	body, err := json.Marshal(result)
+	if err != nil {
+		reason := fmt.Sprintf("Show message details, marshal result failed: %v", err)
+		portal.Ctx.Output.SetStatus(model.ErrorInternalServer)
+		portal.Ctx.Output.Body(model.ErrorInternalServerStatus(reason))
+		log.Error(reason)
+		return
+	}
+
+	portal.Ctx.Output.SetStatus(http.StatusOK)
+	portal.Ctx.Output.Body(body)
+	return
+}
+
+// DeleteMessage ...
+func (portal *MessagePortal) DeleteMessage() {
+	projectID := portal.Ctx.Input.Param(":projectId")
+	id := portal.Ctx.Input.Param(":messageId")
+	if err := messageStore.Delete(projectID, id); err != nil {
+		reason := fmt.Sprintf("Delete message failed: %v", err)
+		portal.Ctx.Output.SetStatus(model.ErrorNotFound)
+		portal.Ctx.Output.Body(model.ErrorNotFoundStatus(reason))
+		log.Error(reason)
+		return
+	}
+
+	portal.Ctx.Output.SetStatus(http.StatusNoContent)
+	return
+}
+
+// recordMessage keeps a user message for a failure that the cinder client
+// can only learn about later through the messages api.
+func recordMessage(ctx *bctx.Context, resourceType, resourceUUID string,
+	action, detail message.Field) {
+	recordProjectMessage(ctx.Input.Param(":projectId"), RequestID(ctx),
+		resourceType, resourceUUID, action, detail)
+}
+
+// recordProjectMessage keeps a user message for a failure found after the
+// response was sent, when the request context is no longer available.
+func recordProjectMessage(projectID, requestID, resourceType, resourceUUID string,
+	action, detail message.Field) {
+	msg := messageStore.Create(projectID, requestID,
+		resourceType, resourceUUID, action, detail)
+	log.V(5).Infof("Recorded user message %s for %s %s: %s", msg.ID,
+		resourceType, resourceUUID, msg.UserMessage)
+}
@@ -0,0 +1,95 @@
+// Copyright (c) 2018 Huawei Technologies Co., Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/astaxie/beego"
+	"github.com/opensds/nbp/cindercompatibleapi/converter"
+	"github.com/opensds/nbp/cindercompatibleapi/message"
+)
+
+func init() {
+	beego.Router("/v3/messages/:messageId", &MessagePortal{},
+		"get:GetMessage;delete:DeleteMessage")
+	beego.Router("/v3/messages", &MessagePortal{},
+		"get:ListMessages")
+}
+
+////////////////////////////////////////////////////////////////////////////////
+//                            Tests for Message                               //
+////////////////////////////////////////////////////////////////////////////////
+func TestGetAndDeleteMessage(t *testing.T) {
+	msg := messageStore.Create("", "", message.ResourceVolumeSnapshot,
+		"3769855c-a102-11e7-b772-17b880d2f537", message.ActionSnapshotDelete,
+		message.DetailUnknownError)
+
+	r, _ := http.NewRequest("GET", "/v3/messages/"+msg.ID, nil)
+	w := httptest.NewRecorder()
+	beego.BeeApp.Handlers.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected %v, actual %v", http.StatusOK, w.Code)
+	}
+
+	var output converter.ShowMessageRespSpec
+	json.Unmarshal(w.Body.Bytes(), &output)
+
+	if output.Message.EventID != "VOLUME_VOLUME_SNAPSHOT_010_001" {
+		t.Errorf("Expected %v, actual %v", "VOLUME_VOLUME_SNAPSHOT_010_001", output.Message.EventID)
+	}
+
+	expectedUserMessage := "delete snapshot: An unknown error occurred."
+	if output.Message.UserMessage != expectedUserMessage {
+		t.Errorf("Expected %v, actual %v", expectedUserMessage, output.Message.UserMessage)
+	}
+
+	r, _ = http.NewRequest("GET", "/v3/messages", nil)
+	w = httptest.NewRecorder()
+	beego.BeeApp.Handlers.ServeHTTP(w, r)
+
+	var list converter.ListMessagesRespSpec
+	json.Unmarshal(w.Body.Bytes(), &list)
+
+	found := false
+	for _, m := range list.Messages {
+		if m.ID == msg.ID {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected message %v in %v", msg.ID, list.Messages)
+	}
+
+	r, _ = http.NewRequest("DELETE", "/v3/messages/"+msg.ID, nil)
+	w = httptest.NewRecorder()
+	beego.BeeApp.Handlers.ServeHTTP(w, r)
+
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Expected %v, actual %v", http.StatusNoContent, w.Code)
+	}
+
+	r, _ = http.NewRequest("GET", "/v3/messages/"+msg.ID, nil)
+	w = httptest.NewRecorder()
+	beego.BeeApp.Handlers.ServeHTTP(w, r)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected %v, actual %v", http.StatusNotFound, w.Code)
+	}
+}
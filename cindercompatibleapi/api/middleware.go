@@ -0,0 +1,178 @@
+// Copyright (c) 2018 Huawei Technologies Co., Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+This module implements the middleware which assigns the request ids, writes
+the access logs and records the metrics of the cinder requests.
+
+*/
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	bctx "github.com/astaxie/beego/context"
+	log "github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/satori/go.uuid"
+)
+
+// RequestIDHeader is the header carrying the request id, in the requests
+// and the responses of cinder and in the requests sent to OpenSDS.
+const RequestIDHeader = "X-Openstack-Request-Id"
+
+// unmatchedRoute is the route label of the requests which match no route.
+const unmatchedRoute = "unmatched"
+
+var (
+	requestIDPattern  = regexp.MustCompile(`^req-[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	resourceIDPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{12}$`)
+)
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cinder_compatible_api",
+		Name:      "requests_total",
+		Help:      "Number of cinder requests by method, route and status code.",
+	}, []string{"method", "route", "code"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "cinder_compatible_api",
+		Name:      "request_duration_seconds",
+		Help:      "Latency of cinder requests by method and route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	opensdsRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cinder_compatible_api",
+		Name:      "opensds_requests_total",
+		Help:      "Number of OpenSDS calls by method, operation and status code.",
+	}, []string{"method", "operation", "code"})
+
+	opensdsRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "cinder_compatible_api",
+		Name:      "opensds_request_duration_seconds",
+		Help:      "Latency of OpenSDS calls by method and operation.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "operation"})
+)
+
+func init() {
+	prometheus.MustRegister(requestsTotal, requestDuration,
+		opensdsRequestsTotal, opensdsRequestDuration)
+}
+
+// accessLog is the structured access log of a cinder request.
+type accessLog struct {
+	RequestID string  `json:"request_id"`
+	Method    string  `json:"method"`
+	Path      string  `json:"path"`
+	Route     string  `json:"route"`
+	Status    int     `json:"status"`
+	LatencyMs float64 `json:"latency_ms"`
+	Remote    string  `json:"remote"`
+}
+
+// statusWriter remembers the status code written to the response, and the
+// route the request matched once RecordRoute sets it.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	route  string
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Middleware assigns an id to every request, or keeps the one sent by the
+// client if it is well formed, and returns it in the response. It writes an
+// access log and records the metrics of the request.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := r.Header.Get(RequestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			id = "req-" + uuid.NewV4().String()
+		}
+		r.Header.Set(RequestIDHeader, id)
+		w.Header().Set(RequestIDHeader, id)
+
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		latency := time.Since(start)
+		route := sw.route
+		if route == "" {
+			route = unmatchedRoute
+		}
+
+		requestsTotal.WithLabelValues(r.Method, route, strconv.Itoa(status)).Inc()
+		requestDuration.WithLabelValues(r.Method, route).Observe(latency.Seconds())
+
+		entry, _ := json.Marshal(&accessLog{
+			RequestID: id,
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Route:     route,
+			Status:    status,
+			LatencyMs: float64(latency) / float64(time.Millisecond),
+			Remote:    r.RemoteAddr,
+		})
+		log.Info(string(entry))
+	})
+}
+
+// RequestID returns the id assigned to the request by the middleware.
+func RequestID(ctx *bctx.Context) string {
+	return ctx.Input.Header(RequestIDHeader)
+}
+
+// RecordRoute is a beego filter, run once the router finished, which gives
+// the middleware the pattern of the route the request matched, for example
+// /v3/:projectId/volumes/:volumeId/action. Labelling the metrics with the
+// patterns keeps the number of label values small.
+func RecordRoute(ctx *bctx.Context) {
+	sw, ok := ctx.ResponseWriter.ResponseWriter.(*statusWriter)
+	if !ok {
+		return
+	}
+	if pattern, ok := ctx.Input.GetData("RouterPattern").(string); ok {
+		sw.route = pattern
+	}
+}
+
+func isResourceID(word string) bool {
+	return resourceIDPattern.MatchString(word)
+}
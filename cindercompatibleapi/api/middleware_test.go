@@ -0,0 +1,205 @@
+// Copyright (c) 2018 Huawei Technologies Co., Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/astaxie/beego"
+	bctx "github.com/astaxie/beego/context"
+	"github.com/opensds/nbp/cindercompatibleapi/config"
+	"github.com/opensds/opensds/pkg/model"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// //////////////////////////////////////////////////////////////////////////////
+//
+//	Tests for Middleware                            //
+//
+// //////////////////////////////////////////////////////////////////////////////
+func counterValue(t *testing.T, c interface {
+	Write(*dto.Metric) error
+}) float64 {
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestMiddlewareRequestID(t *testing.T) {
+	var seen string
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header.Get(RequestIDHeader)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+
+	// A plain handler does not record the route.
+	route := unmatchedRoute
+	counter := requestsTotal.WithLabelValues("DELETE", route, "202")
+	before := counterValue(t, counter)
+
+	r, _ := http.NewRequest("DELETE", "/v3/e93b4c0934da416eb9c8d120c5d04d96/volumes/bd5b12a8-a101-11e7-941e-d77981b584d8", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	id := w.Header().Get(RequestIDHeader)
+	if !requestIDPattern.MatchString(id) {
+		t.Errorf("Expected a request id like req-<uuid>, actual %q", id)
+	}
+	if seen != id {
+		t.Errorf("Expected the handler to see request id %v, actual %v", id, seen)
+	}
+	if after := counterValue(t, counter); after != before+1 {
+		t.Errorf("Expected %v requests on %v, actual %v", before+1, route, after)
+	}
+
+	// A well formed request id sent by the client is kept.
+	clientID := "req-8d2f3d46-0dc1-4cbd-9f4c-2b8d1d6c7a10"
+	r, _ = http.NewRequest("GET", "/v3/volumes", nil)
+	r.Header.Set(RequestIDHeader, clientID)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if id := w.Header().Get(RequestIDHeader); id != clientID {
+		t.Errorf("Expected %v, actual %v", clientID, id)
+	}
+
+	r, _ = http.NewRequest("GET", "/v3/volumes", nil)
+	r.Header.Set(RequestIDHeader, "not-a-request-id")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if id := w.Header().Get(RequestIDHeader); id == "not-a-request-id" {
+		t.Errorf("Expected a malformed request id to be replaced")
+	}
+}
+
+func TestReceiverForwardsRequestID(t *testing.T) {
+	var seenID, seenToken string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seenID = r.Header.Get(RequestIDHeader)
+		seenToken = r.Header.Get("X-Auth-Token")
+		w.Write([]byte(`{"id": "bd5b12a8-a101-11e7-941e-d77981b584d8", "size": 1}`))
+	}))
+	defer server.Close()
+
+	rcv := &receiver{requestID: "req-8d2f3d46-0dc1-4cbd-9f4c-2b8d1d6c7a10", authToken: "token"}
+	var volume model.VolumeSpec
+	err := rcv.Recv(server.URL+"/v1beta/e93b4c0934da416eb9c8d120c5d04d96/block/volumes/bd5b12a8-a101-11e7-941e-d77981b584d8",
+		"get", nil, &volume)
+	if err != nil {
+		t.Fatalf("Expected no error, actual %v", err)
+	}
+
+	if seenID != rcv.requestID || seenToken != rcv.authToken {
+		t.Errorf("Expected headers %v and %v, actual %v and %v", rcv.requestID, rcv.authToken, seenID, seenToken)
+	}
+	if volume.Size != 1 {
+		t.Errorf("Expected %v, actual %v", 1, volume.Size)
+	}
+
+	counter := opensdsRequestsTotal.WithLabelValues("GET", "/v1beta/:tenantId/block/volumes/:id", "200")
+	if v := counterValue(t, counter); v < 1 {
+		t.Errorf("Expected the OpenSDS call to be counted, actual %v", v)
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	handlers := beego.NewControllerRegister()
+	reply := func(ctx *bctx.Context) {
+		ctx.Output.SetStatus(http.StatusAccepted)
+	}
+	handlers.Get("/", reply)
+	handlers.Get("/v3/:projectId/volumes/detail", reply)
+	handlers.Post("/v3/:projectId/volumes/:volumeId/action", reply)
+	handlers.Get("/v3/:projectId/types/:volumeTypeId/extra_specs/:key", reply)
+	handlers.InsertFilter("*", beego.FinishRouter, RecordRoute, false)
+	handler := Middleware(handlers)
+
+	testCases := []struct {
+		method, path, route, code string
+	}{
+		{"GET", "/", "/", "202"},
+		{"GET", "/v3/project/volumes/detail", "/v3/:projectId/volumes/detail", "202"},
+		{"POST", "/v3/project/volumes/bd5b12a8-a101-11e7-941e-d77981b584d8/action", "/v3/:projectId/volumes/:volumeId/action", "202"},
+		{"GET", "/v3/project/types/1106b972-66ef-11e7-b172-db03f3689c9c/extra_specs/diskType", "/v3/:projectId/types/:volumeTypeId/extra_specs/:key", "202"},
+		{"GET", "/v3/project/volumes/../../../etc/passwd", unmatchedRoute, "404"},
+		{"GET", "/v3/project/no-such-resource/name-1", unmatchedRoute, "404"},
+	}
+
+	for _, tc := range testCases {
+		counter := requestsTotal.WithLabelValues(tc.method, tc.route, tc.code)
+		before := counterValue(t, counter)
+
+		r, _ := http.NewRequest(tc.method, tc.path, nil)
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+
+		if after := counterValue(t, counter); after != before+1 {
+			t.Errorf("Expected %v %v to be counted on %v %v, actual %v", tc.method, tc.path, tc.route, tc.code, after-before)
+		}
+	}
+
+	expected := "/v1beta/:tenantId/block/attachments/:id"
+	if op := opensdsOperation("http://127.0.0.1:50040/v1beta/e93b4c0934da416eb9c8d120c5d04d96/block/attachments/f2dda3d2-bf79-11e7-8665-f750b088f63e"); op != expected {
+		t.Errorf("Expected %v, actual %v", expected, op)
+	}
+}
+
+func TestApplyListenAddress(t *testing.T) {
+	listen := beego.BConfig.Listen
+	defer func() {
+		beego.BConfig.Listen = listen
+	}()
+
+	testCases := []struct {
+		listenAddress, tlsCertFile, addr string
+		port                             int
+	}{
+		{"127.0.0.1:8776", "", "127.0.0.1", 8776},
+		{":8776", "", "", 8776},
+		{"[::]:8776", "", "[::]", 8776},
+		{"[fe80::1]:8443", "/etc/cinder/cert.pem", "[fe80::1]", 8443},
+	}
+
+	for _, tc := range testCases {
+		beego.BConfig.Listen = listen
+		cfg := &config.Config{ListenAddress: tc.listenAddress, TLSCertFile: tc.tlsCertFile}
+		if err := applyListenAddress(cfg); err != nil {
+			t.Fatalf("Expected no error for %v, actual %v", tc.listenAddress, err)
+		}
+
+		addr, port := beego.BConfig.Listen.HTTPAddr, beego.BConfig.Listen.HTTPPort
+		if tc.tlsCertFile != "" {
+			addr, port = beego.BConfig.Listen.HTTPSAddr, beego.BConfig.Listen.HTTPSPort
+		}
+		if addr != tc.addr || port != tc.port {
+			t.Errorf("Expected %v %v, actual %v %v", tc.addr, tc.port, addr, port)
+		}
+
+		// beego listens on the host and the port it joins
+		if _, _, err := net.SplitHostPort(fmt.Sprintf("%s:%d", addr, port)); err != nil {
+			t.Errorf("Expected %v to be listened on, actual %v", tc.listenAddress, err)
+		}
+	}
+
+	if err := applyListenAddress(&config.Config{ListenAddress: "::8776"}); err == nil {
+		t.Errorf("Expected an error for a listen address without a port")
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright (c) 2018 Huawei Technologies Co., Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+This module implements the receiver which sends the requests of the
+OpenSDS client.
+
+*/
+
+package api
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/golang/glog"
+	c "github.com/opensds/opensds/client"
+	"github.com/opensds/opensds/pkg/utils/constants"
+)
+
+// opensdsRequestTimeout is the same as the one of the OpenSDS client, it is
+// long enough to upload a snapshot to the cloud.
+const opensdsRequestTimeout = 6 * time.Minute
+
+var httpClient = &http.Client{Timeout: opensdsRequestTimeout}
+
+// newHTTPClient creates the http client for the OpenSDS endpoint, the CA
+// certificate is only needed by an https endpoint.
+func newHTTPClient(caCertFile string) (*http.Client, error) {
+	if caCertFile == "" {
+		return &http.Client{Timeout: opensdsRequestTimeout}, nil
+	}
+
+	caCert, err := ioutil.ReadFile(caCertFile)
+	if err != nil {
+		return nil, fmt.Errorf("read CA certificate file %s failed: %v", caCertFile, err)
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("no certificate found in CA certificate file %s", caCertFile)
+	}
+
+	return &http.Client{
+		Timeout: opensdsRequestTimeout,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: roots},
+		},
+	}, nil
+}
+
+// receiver sends the OpenSDS requests made while serving one cinder
+// request. It forwards the request id and the keystone token, and records
+// the metrics of every call.
+type receiver struct {
+	requestID string
+	authToken string
+}
+
+// Recv implements the Receiver interface of the OpenSDS client.
+func (r *receiver) Recv(urlStr string, method string, input interface{}, output interface{}) error {
+	start := time.Now()
+	code, err := r.request(urlStr, strings.ToUpper(method), input, output)
+
+	status := strconv.Itoa(code)
+	if code == 0 {
+		status = "error"
+	}
+	operation := opensdsOperation(urlStr)
+	opensdsRequestsTotal.WithLabelValues(strings.ToUpper(method), operation, status).Inc()
+	opensdsRequestDuration.WithLabelValues(strings.ToUpper(method), operation).Observe(time.Since(start).Seconds())
+
+	return err
+}
+
+func (r *receiver) request(urlStr string, method string, input interface{}, output interface{}) (int, error) {
+	var body io.Reader
+	if input != nil {
+		b, err := json.Marshal(input)
+		if err != nil {
+			return 0, err
+		}
+		log.V(5).Infof("[%s] %s %s request body: %s", r.requestID, method, urlStr, b)
+		body = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, urlStr, body)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if r.requestID != "" {
+		req.Header.Set(RequestIDHeader, r.requestID)
+	}
+	if r.authToken != "" {
+		req.Header.Set(constants.AuthTokenHeader, r.authToken)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	rbody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+
+	log.V(5).Infof("[%s] %s %s response %s: %s", r.requestID, method, urlStr, resp.Status, rbody)
+	if 400 <= resp.StatusCode && resp.StatusCode <= 599 {
+		return resp.StatusCode, c.NewHttpError(resp.StatusCode, string(rbody))
+	}
+
+	// If the format of output is nil, skip unmarshaling the result.
+	if output == nil {
+		return resp.StatusCode, nil
+	}
+	if err = json.Unmarshal(rbody, output); err != nil {
+		return resp.StatusCode, fmt.Errorf("failed to unmarshal result message: %v", err)
+	}
+
+	return resp.StatusCode, nil
+}
+
+// opensdsOperation turns the url of an OpenSDS request into a metric label,
+// the tenant and the resource ids are replaced so that the label has a small
+// number of values, for example /v1beta/:tenantId/block/volumes/:id.
+func opensdsOperation(urlStr string) string {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return "unknown"
+	}
+
+	// /{apiVersion}/{tenantId}/...
+	words := strings.Split(u.Path, "/")
+	if len(words) > 2 && words[2] != "" {
+		words[2] = ":tenantId"
+	}
+	for i := 3; i < len(words); i++ {
+		if isResourceID(words[i]) {
+			words[i] = ":id"
+		}
+	}
+
+	return strings.Join(words, "/")
+}
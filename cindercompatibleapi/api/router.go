@@ -22,21 +22,33 @@ package api
 import (
 	"fmt"
 	"net/url"
-	"os"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/astaxie/beego"
 	bctx "github.com/astaxie/beego/context"
 	log "github.com/golang/glog"
 	c "github.com/opensds/opensds/client"
+	"github.com/opensds/nbp/cindercompatibleapi/backup"
+	"github.com/opensds/nbp/cindercompatibleapi/config"
 	"github.com/opensds/nbp/cindercompatibleapi/converter"
+	"github.com/opensds/nbp/cindercompatibleapi/message"
 	"github.com/opensds/opensds/pkg/utils/constants"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
 	opensdsEndpoint string
-	opensdsClient   *c.Client
 	authStrategy    string
+	noauthTenantId  = constants.DefaultTenantId
+	clientFactory   = newRequestClient
+	attachTimeout   = config.DefaultAttachTimeout
+	messageStore    = message.NewStore(message.DefaultTTL)
+	backupStore     = backup.NewStore(backup.NewMemoryTarget())
+	backupContainer = config.DefaultBackupContainer
+	backupTimeout   = config.DefaultBackupTimeout
+	routesOnce      sync.Once
 )
 
 // ErrorSpec describes Detailed HTTP error response, which consists of a HTTP
@@ -46,50 +58,91 @@ type ErrorSpec struct {
 	Message string `json:"message,omitempty"`
 }
 
-// Run ...
-func Run(cinderEndpoint string) {
-	var ok bool
-	opensdsEndpointFromEnv, ok := os.LookupEnv(c.OpensdsEndpoint)
-	if !ok {
-		fmt.Println("ERROR: You must provide the endpoint by setting " +
-			"the environment variable " + c.OpensdsEndpoint)
-		return
-	}
+// Init applies the configuration and registers the routes of the cinder
+// api, the routes are only registered once.
+func Init(cfg *config.Config) error {
+	opensdsEndpoint = cfg.OpensdsEndpoint
+	authStrategy = cfg.OpensdsAuthStrategy
+	attachTimeout = cfg.AttachTimeout
+	converter.Endpoint = strings.TrimSuffix(cfg.PublicURL, "/")
 
-	if "" == opensdsEndpointFromEnv {
-		opensdsEndpoint = constants.DefaultOpensdsEndpoint
-		fmt.Println("Warnning: OpenSDS Endpoint is not specified using the default value:" + opensdsEndpoint)
+	log.Info("authStrategy: " + authStrategy)
+	noauthTenantId = c.LoadNoAuthOptionsFromEnv().GetTenantId()
+	client, err := newHTTPClient(cfg.OpensdsCACertFile)
+	if err != nil {
+		return err
+	}
+	httpClient = client
+
+	backupContainer = cfg.BackupContainer
+	backupTimeout = cfg.BackupTimeout
+	var target backup.ObjectTarget
+	if cfg.BackupTargetDir != "" {
+		if target, err = backup.NewLocalTarget(cfg.BackupTargetDir); err != nil {
+			return err
+		}
 	} else {
-		opensdsEndpoint = opensdsEndpointFromEnv
+		log.Warning("backupTargetDir is not set, the backups are lost when the service restarts")
+		target = backup.NewMemoryTarget()
+	}
+	backupStore = backup.NewStore(target)
+	if err := backupStore.Load(); err != nil {
+		return err
 	}
 
-	// cinderEndpoint: http://127.0.0.1:8777/v3
-	words := strings.Split(cinderEndpoint, "/")
-	if (len(words) < 4) || (words[3] != converter.APIVersion) {
-		fmt.Println("The environment variable CINDER_ENDPOINT is set incorrectly")
-		return
+	routesOnce.Do(registerRoutes)
+	return nil
+}
+
+// Run starts the service with the given configuration, it returns when the
+// service stops.
+func Run(cfg *config.Config) error {
+	if err := Init(cfg); err != nil {
+		return err
 	}
 
-	authStrategy, ok = os.LookupEnv(c.OpensdsAuthStrategy)
-	if !ok {
-		authStrategy = c.Noauth
-		fmt.Println("WARNING: Not found Env " + c.OpensdsAuthStrategy + ", use default(noauth)")
+	if err := applyListenAddress(cfg); err != nil {
+		return err
 	}
 
-	log.Info("authStrategy: " + authStrategy)
-	cfg := &c.Config{Endpoint: opensdsEndpoint}
-	switch authStrategy {
-	case c.Keystone:
-		// opensdsClient is generated by NewClient later
-		break
-	case c.Noauth:
-		cfg.AuthOptions = c.LoadNoAuthOptionsFromEnv()
-		opensdsClient = c.NewClient(cfg)
-	default:
-		cfg.AuthOptions = c.NewNoauthOptions(constants.DefaultTenantId)
-		opensdsClient = c.NewClient(cfg)
+	// start service, beego listens on the address of its configuration
+	log.Infof("Listen on %s, public url is %s", cfg.ListenAddress, converter.Endpoint)
+	beego.RunWithMiddleWares("", Middleware)
+
+	return fmt.Errorf("the service listening on %s stopped", cfg.ListenAddress)
+}
+
+// applyListenAddress makes the listen address and the TLS files those beego
+// serves on. beego joins the host and the port itself, so an IPv6 host is
+// kept in brackets.
+func applyListenAddress(cfg *config.Config) error {
+	host, port, err := config.SplitListenAddress(cfg.ListenAddress)
+	if err != nil {
+		return err
 	}
 
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+
+	beego.BConfig.Listen.ServerTimeOut = int64(cfg.ServerTimeout / time.Second)
+	if cfg.TLSCertFile != "" {
+		beego.BConfig.Listen.EnableHTTP = false
+		beego.BConfig.Listen.EnableHTTPS = true
+		beego.BConfig.Listen.HTTPSAddr = host
+		beego.BConfig.Listen.HTTPSPort = port
+		beego.BConfig.Listen.HTTPSCertFile = cfg.TLSCertFile
+		beego.BConfig.Listen.HTTPSKeyFile = cfg.TLSKeyFile
+	} else {
+		beego.BConfig.Listen.HTTPAddr = host
+		beego.BConfig.Listen.HTTPPort = port
+	}
+
+	return nil
+}
+
+// registerRoutes adds the routes of the cinder api to the beego application.
+func registerRoutes() {
 	ns :=
 		beego.NewNamespace("/"+converter.APIVersion,
 			beego.NSCond(func(ctx *bctx.Context) bool {
@@ -107,6 +160,7 @@ func Run(cinderEndpoint string) {
 
 				beego.NSRouter("/volumes", &VolumePortal{}, "post:CreateVolume;get:ListVolumes"),
 				beego.NSRouter("/volumes/detail", &VolumePortal{}, "get:ListVolumesDetails"),
+				beego.NSRouter("/volumes/summary", &VolumePortal{}, "get:GetVolumeSummary"),
 				beego.NSRouter("/volumes/:volumeId", &VolumePortal{}, "get:GetVolume;delete:DeleteVolume;put:UpdateVolume"),
 				beego.NSRouter("/volumes/:volumeId/action", &VolumePortal{}, "post:VolumeAction"),
 
@@ -117,46 +171,53 @@ func Run(cinderEndpoint string) {
 				beego.NSRouter("/snapshots", &SnapshotPortal{}, "post:CreateSnapshot;get:ListSnapshots"),
 				beego.NSRouter("/snapshots/detail", &SnapshotPortal{}, "get:ListSnapshotsDetails"),
 				beego.NSRouter("/snapshots/:snapshotId", &SnapshotPortal{}, "get:GetSnapshot;delete:DeleteSnapshot;put:UpdateSnapshot"),
+
+				beego.NSRouter("/backups", &BackupPortal{}, "post:CreateBackup;get:ListBackups"),
+				beego.NSRouter("/backups/detail", &BackupPortal{}, "get:ListBackupsDetails"),
+				beego.NSRouter("/backups/:backupId", &BackupPortal{}, "get:GetBackup;delete:DeleteBackup"),
+				beego.NSRouter("/backups/:backupId/restore", &BackupPortal{}, "post:RestoreBackup"),
+
+				beego.NSRouter("/messages", &MessagePortal{}, "get:ListMessages"),
+				beego.NSRouter("/messages/:messageId", &MessagePortal{}, "get:GetMessage;delete:DeleteMessage"),
 			),
 		)
 
 	beego.AddNamespace(ns)
 	beego.Router("/", &VersionPortal{}, "get:ListAllAPIVersions")
+	beego.Handler("/metrics", promhttp.Handler())
+	beego.InsertFilter("*", beego.FinishRouter, RecordRoute, false)
+}
 
-	// start service
-	beego.Run(words[2])
+// NewClient creates the OpenSDS client which serves a cinder request, it
+// forwards the request id and, with keystone, the token of the request.
+func NewClient(ctx *bctx.Context) *c.Client {
+	return clientFactory(ctx)
 }
 
-// NewClient Recreate the client only when authStrategy == c.Keystone
-// and copy it to the global variable opensdsClient
-func NewClient(ctx *bctx.Context) {
+func newRequestClient(ctx *bctx.Context) *c.Client {
+	r := &receiver{requestID: RequestID(ctx)}
+	tenantId := noauthTenantId
+
 	if authStrategy == c.Keystone {
 		reqURL := strings.TrimSpace(ctx.Request.URL.String())
 
 		// When "List Api Versions", the URL has no project_id,
 		// so no authentication
-		if "/" == reqURL {
-			cfg := &c.Config{Endpoint: opensdsEndpoint}
-			cfg.AuthOptions = c.LoadNoAuthOptionsFromEnv()
-			opensdsClient = c.NewClient(cfg)
-		} else {
-			tenantId := GetProjectId(reqURL)
-			tokenID := ctx.Input.Header(constants.AuthTokenHeader)
-			log.V(5).Info("TenantId:" + tenantId + ", " + "TokenID:" + tokenID + "!!!")
-
-			r := &c.KeystoneReciver{Auth: &c.KeystoneAuthOptions{TenantID: tokenID,
-				TokenID: tokenID}}
-
-			opensdsClient = &c.Client{
-				ProfileMgr:     c.NewProfileMgr(r, opensdsEndpoint, tenantId),
-				DockMgr:        c.NewDockMgr(r, opensdsEndpoint, tenantId),
-				PoolMgr:        c.NewPoolMgr(r, opensdsEndpoint, tenantId),
-				VolumeMgr:      c.NewVolumeMgr(r, opensdsEndpoint, tenantId),
-				VersionMgr:     c.NewVersionMgr(r, opensdsEndpoint, tenantId),
-				ReplicationMgr: c.NewReplicationMgr(r, opensdsEndpoint, tenantId),
-			}
+		if "/" != reqURL {
+			tenantId = GetProjectId(reqURL)
+			r.authToken = ctx.Input.Header(constants.AuthTokenHeader)
+			log.V(5).Info("TenantId:" + tenantId)
 		}
 	}
+
+	return &c.Client{
+		ProfileMgr:     c.NewProfileMgr(r, opensdsEndpoint, tenantId),
+		DockMgr:        c.NewDockMgr(r, opensdsEndpoint, tenantId),
+		PoolMgr:        c.NewPoolMgr(r, opensdsEndpoint, tenantId),
+		VolumeMgr:      c.NewVolumeMgr(r, opensdsEndpoint, tenantId),
+		VersionMgr:     c.NewVersionMgr(r, opensdsEndpoint, tenantId),
+		ReplicationMgr: c.NewReplicationMgr(r, opensdsEndpoint, tenantId),
+	}
 }
 
 // GetProjectId Get the value of project_id
@@ -27,6 +27,7 @@ import (
 	"github.com/astaxie/beego"
 	log "github.com/golang/glog"
 	"github.com/opensds/nbp/cindercompatibleapi/converter"
+	"github.com/opensds/nbp/cindercompatibleapi/message"
 	"github.com/opensds/opensds/pkg/model"
 )
 
@@ -37,8 +38,8 @@ type SnapshotPortal struct {
 
 // ListSnapshotsDetails ...
 func (portal *SnapshotPortal) ListSnapshotsDetails() {
-	NewClient(portal.Ctx)
-	snapshots, err := opensdsClient.ListVolumeSnapshots()
+	client := NewClient(portal.Ctx)
+	snapshots, err := client.ListVolumeSnapshots()
 	if err != nil {
 		reason := fmt.Sprintf("List snapshots and details failed: %v", err)
 		portal.Ctx.Output.SetStatus(model.ErrorInternalServer)
@@ -82,13 +83,15 @@ func (portal *SnapshotPortal) CreateSnapshot() {
 		return
 	}
 
-	NewClient(portal.Ctx)
-	snapshot, err = opensdsClient.CreateVolumeSnapshot(snapshot)
+	client := NewClient(portal.Ctx)
+	snapshot, err = client.CreateVolumeSnapshot(snapshot)
 	if err != nil {
 		reason := fmt.Sprintf("Create a snapshot failed: %s", err.Error())
 		portal.Ctx.Output.SetStatus(model.ErrorInternalServer)
 		portal.Ctx.Output.Body(model.ErrorInternalServerStatus(reason))
 		log.Error(reason)
+		recordMessage(portal.Ctx, message.ResourceVolume, cinderReq.Snapshot.VolumeID,
+			message.ActionSnapshotCreate, message.DetailUnknownError)
 		return
 	}
 
@@ -109,8 +112,8 @@ func (portal *SnapshotPortal) CreateSnapshot() {
 
 // ListSnapshots ...
 func (portal *SnapshotPortal) ListSnapshots() {
-	NewClient(portal.Ctx)
-	snapshots, err := opensdsClient.ListVolumeSnapshots()
+	client := NewClient(portal.Ctx)
+	snapshots, err := client.ListVolumeSnapshots()
 	if err != nil {
 		reason := fmt.Sprintf("List accessible snapshots failed: %v", err)
 		portal.Ctx.Output.SetStatus(model.ErrorInternalServer)
@@ -137,8 +140,8 @@ func (portal *SnapshotPortal) ListSnapshots() {
 // GetSnapshot ...
 func (portal *SnapshotPortal) GetSnapshot() {
 	id := portal.Ctx.Input.Param(":snapshotId")
-	NewClient(portal.Ctx)
-	snapshot, err := opensdsClient.GetVolumeSnapshot(id)
+	client := NewClient(portal.Ctx)
+	snapshot, err := client.GetVolumeSnapshot(id)
 
 	if err != nil {
 		reason := fmt.Sprintf("Show a snapshot's details failed: %v", err)
@@ -177,8 +180,8 @@ func (portal *SnapshotPortal) UpdateSnapshot() {
 	}
 
 	snapshot := converter.UpdateSnapshotReq(&cinderUpdateReq)
-	NewClient(portal.Ctx)
-	snapshot, err := opensdsClient.UpdateVolumeSnapshot(id, snapshot)
+	client := NewClient(portal.Ctx)
+	snapshot, err := client.UpdateVolumeSnapshot(id, snapshot)
 
 	if err != nil {
 		reason := fmt.Sprintf("Update a snapshot failed: %s", err.Error())
@@ -206,14 +209,16 @@ func (portal *SnapshotPortal) UpdateSnapshot() {
 // DeleteSnapshot ...
 func (portal *SnapshotPortal) DeleteSnapshot() {
 	id := portal.Ctx.Input.Param(":snapshotId")
-	NewClient(portal.Ctx)
-	err := opensdsClient.DeleteVolumeSnapshot(id, nil)
+	client := NewClient(portal.Ctx)
+	err := client.DeleteVolumeSnapshot(id, nil)
 
 	if err != nil {
 		reason := fmt.Sprintf("Delete a snapshot failed: %v", err)
 		portal.Ctx.Output.SetStatus(model.ErrorInternalServer)
 		portal.Ctx.Output.Body(model.ErrorInternalServerStatus(reason))
 		log.Error(reason)
+		recordMessage(portal.Ctx, message.ResourceVolumeSnapshot, id,
+			message.ActionSnapshotDelete, message.DetailUnknownError)
 		return
 	}
 
@@ -23,6 +23,7 @@ import (
 	"testing"
 
 	"github.com/astaxie/beego"
+	bctx "github.com/astaxie/beego/context"
 	c "github.com/opensds/opensds/client"
 	"github.com/opensds/nbp/cindercompatibleapi/converter"
 )
@@ -35,7 +36,9 @@ func init() {
 	beego.Router("/V3/snapshots/detail", &SnapshotPortal{},
 		"get:ListSnapshotsDetails")
 
-	opensdsClient = c.NewFakeClient(&c.Config{Endpoint: c.TestEp})
+	clientFactory = func(*bctx.Context) *c.Client {
+		return c.NewFakeClient(&c.Config{Endpoint: c.TestEp})
+	}
 }
 
 ////////////////////////////////////////////////////////////////////////////////
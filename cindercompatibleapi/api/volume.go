@@ -30,6 +30,7 @@ import (
 	"github.com/astaxie/beego"
 	log "github.com/golang/glog"
 	"github.com/opensds/nbp/cindercompatibleapi/converter"
+	"github.com/opensds/nbp/cindercompatibleapi/message"
 	"github.com/opensds/opensds/pkg/model"
 )
 
@@ -45,8 +46,8 @@ var (
 
 // ListVolumesDetails ...
 func (portal *VolumePortal) ListVolumesDetails() {
-	NewClient(portal.Ctx)
-	volumes, err := opensdsClient.ListVolumes()
+	client := NewClient(portal.Ctx)
+	volumes, err := client.ListVolumes()
 	if err != nil {
 		reason := fmt.Sprintf("List accessible volumes with details failed: %v", err)
 		portal.Ctx.Output.SetStatus(model.ErrorInternalServer)
@@ -70,6 +71,33 @@ func (portal *VolumePortal) ListVolumesDetails() {
 	return
 }
 
+// GetVolumeSummary ...
+func (portal *VolumePortal) GetVolumeSummary() {
+	client := NewClient(portal.Ctx)
+	volumes, err := client.ListVolumes()
+	if err != nil {
+		reason := fmt.Sprintf("Get volumes summary failed: %v", err)
+		portal.Ctx.Output.SetStatus(model.ErrorInternalServer)
+		portal.Ctx.Output.Body(model.ErrorInternalServerStatus(reason))
+		log.Error(reason)
+		return
+	}
+
+	result := converter.VolumeSummaryResp(volumes)
+	body, err := json.Marshal(result)
+	if err != nil {
+		reason := fmt.Sprintf("Get volumes summary, marshal result failed: %v", err)
+		portal.Ctx.Output.SetStatus(model.ErrorInternalServer)
+		portal.Ctx.Output.Body(model.ErrorInternalServerStatus(reason))
+		log.Error(reason)
+		return
+	}
+
+	portal.Ctx.Output.SetStatus(http.StatusOK)
+	portal.Ctx.Output.Body(body)
+	return
+}
+
 // CreateVolume ...
 func (portal *VolumePortal) CreateVolume() {
 	var cinderReq = converter.CreateVolumeReqSpec{}
@@ -91,8 +119,8 @@ func (portal *VolumePortal) CreateVolume() {
 		return
 	}
 
-	NewClient(portal.Ctx)
-	volume, err = opensdsClient.CreateVolume(volume)
+	client := NewClient(portal.Ctx)
+	volume, err = client.CreateVolume(volume)
 	if err != nil {
 		reason := fmt.Sprintf("Create a volume failed: %s", err.Error())
 		portal.Ctx.Output.SetStatus(model.ErrorInternalServer)
@@ -118,8 +146,8 @@ func (portal *VolumePortal) CreateVolume() {
 
 // ListVolumes ...
 func (portal *VolumePortal) ListVolumes() {
-	NewClient(portal.Ctx)
-	volumes, err := opensdsClient.ListVolumes()
+	client := NewClient(portal.Ctx)
+	volumes, err := client.ListVolumes()
 	if err != nil {
 		reason := fmt.Sprintf("List accessible volumes failed: %v", err)
 		portal.Ctx.Output.SetStatus(model.ErrorInternalServer)
@@ -146,8 +174,8 @@ func (portal *VolumePortal) ListVolumes() {
 // GetVolume ...
 func (portal *VolumePortal) GetVolume() {
 	id := portal.Ctx.Input.Param(":volumeId")
-	NewClient(portal.Ctx)
-	volume, err := opensdsClient.GetVolume(id)
+	client := NewClient(portal.Ctx)
+	volume, err := client.GetVolume(id)
 
 	if err != nil {
 		reason := fmt.Sprintf("Show a volume's details failed: %v", err)
@@ -194,8 +222,8 @@ func (portal *VolumePortal) UpdateVolume() {
 		return
 	}
 
-	NewClient(portal.Ctx)
-	volume, err = opensdsClient.UpdateVolume(id, volume)
+	client := NewClient(portal.Ctx)
+	volume, err = client.UpdateVolume(id, volume)
 
 	if err != nil {
 		reason := fmt.Sprintf("Update a volume failed: %s", err.Error())
@@ -224,14 +252,16 @@ func (portal *VolumePortal) UpdateVolume() {
 func (portal *VolumePortal) DeleteVolume() {
 	id := portal.Ctx.Input.Param(":volumeId")
 	volume := model.VolumeSpec{}
-	NewClient(portal.Ctx)
-	err := opensdsClient.DeleteVolume(id, &volume)
+	client := NewClient(portal.Ctx)
+	err := client.DeleteVolume(id, &volume)
 
 	if err != nil {
 		reason := fmt.Sprintf("Delete a volume failed: %v", err)
 		portal.Ctx.Output.SetStatus(model.ErrorInternalServer)
 		portal.Ctx.Output.Body(model.ErrorInternalServerStatus(reason))
 		log.Error(reason)
+		recordMessage(portal.Ctx, message.ResourceVolume, id,
+			message.ActionVolumeDelete, message.DetailUnknownError)
 		return
 	}
 
@@ -272,24 +302,25 @@ func (portal *VolumePortal) VolumeAction() {
 		}
 
 		attachment := converter.InitializeConnectionReq(&cinderReq, id)
-		NewClient(portal.Ctx)
-		attachment, err := opensdsClient.CreateVolumeAttachment(attachment)
+		client := NewClient(portal.Ctx)
+		attachment, err := client.CreateVolumeAttachment(attachment)
 
 		if err != nil {
 			reason := fmt.Sprintf("Initialize connection failed: %s", err.Error())
 			portal.Ctx.Output.SetStatus(model.ErrorInternalServer)
 			portal.Ctx.Output.Body(model.ErrorInternalServerStatus(reason))
 			log.Error(reason)
+			recordMessage(portal.Ctx, message.ResourceVolume, id,
+				message.ActionAttachVolume, message.DetailUnknownError)
 			return
 		}
 
 		isAvailable := false
-		sum := 0
+		start := time.Now()
 
 		for {
-			sum++
 			time.Sleep(SleepDuration)
-			attachment, _ = opensdsClient.GetVolumeAttachment(attachment.Id)
+			attachment, _ = client.GetVolumeAttachment(attachment.Id)
 			if ("available" == attachment.Status) && ("" != attachment.ConnectionInfo.DriverVolumeType) &&
 				//(nil != attachment.ConnectionInfo.ConnectionData["authPassword"]) &&
 				(nil != attachment.ConnectionInfo.ConnectionData["targetDiscovered"]) &&
@@ -305,8 +336,8 @@ func (portal *VolumePortal) VolumeAction() {
 				break
 			}
 
-			//The maximum waiting time is 10 seconds
-			if 10 == sum {
+			// The maximum waiting time is the configured attach timeout
+			if time.Since(start) >= attachTimeout {
 				break
 			}
 		}
@@ -314,10 +345,12 @@ func (portal *VolumePortal) VolumeAction() {
 		if false == isAvailable {
 			reason := fmt.Sprintf("Initialize connection, attachment is not available or connectionInfo is incorrect")
 			attachmentByts, _ := json.Marshal(attachment)
-			fmt.Println(string(attachmentByts))
+			log.V(5).Infof("Initialize connection, the last attachment: %s", attachmentByts)
 			portal.Ctx.Output.SetStatus(model.ErrorInternalServer)
 			portal.Ctx.Output.Body(model.ErrorInternalServerStatus(reason))
 			log.Error(reason)
+			recordMessage(portal.Ctx, message.ResourceVolume, id,
+				message.ActionAttachVolume, message.DetailAttachTimeout)
 			return
 		}
 
@@ -25,8 +25,11 @@ import (
 	"time"
 
 	"github.com/astaxie/beego"
+	bctx "github.com/astaxie/beego/context"
 	c "github.com/opensds/opensds/client"
 	"github.com/opensds/nbp/cindercompatibleapi/converter"
+	"github.com/opensds/nbp/cindercompatibleapi/message"
+	"github.com/opensds/opensds/pkg/model"
 )
 
 func init() {
@@ -36,10 +39,14 @@ func init() {
 		"get:GetVolume;delete:DeleteVolume;put:UpdateVolume")
 	beego.Router("/v3/volumes/detail", &VolumePortal{},
 		"get:ListVolumesDetails")
+	beego.Router("/v3/volumes/summary", &VolumePortal{},
+		"get:GetVolumeSummary")
 	beego.Router("/v3/volumes", &VolumePortal{},
 		"post:CreateVolume;get:ListVolumes")
 
-	opensdsClient = c.NewFakeClient(&c.Config{Endpoint: c.TestEp})
+	clientFactory = func(*bctx.Context) *c.Client {
+		return c.NewFakeClient(&c.Config{Endpoint: c.TestEp})
+	}
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -152,6 +159,62 @@ func TestListVolumesDetails(t *testing.T) {
 	}
 }
 
+func TestGetVolumeSummary(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/v3/volumes/summary", nil)
+
+	w := httptest.NewRecorder()
+	beego.BeeApp.Handlers.ServeHTTP(w, r)
+
+	var output converter.VolumeSummaryRespSpec
+	json.Unmarshal(w.Body.Bytes(), &output)
+
+	expectedJSON := `
+    {
+        "volume-summary": {
+            "total_size": 1,
+            "total_count": 1,
+            "metadata": {
+                
+            }
+        }
+    }`
+
+	var expected converter.VolumeSummaryRespSpec
+	json.Unmarshal([]byte(expectedJSON), &expected)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected %v, actual %v", http.StatusOK, w.Code)
+	}
+
+	if !reflect.DeepEqual(expected, output) {
+		t.Errorf("Expected %v, actual %v", expected, output)
+	}
+}
+
+func TestVolumeSummaryResp(t *testing.T) {
+	volumes := []*model.VolumeSpec{
+		{Size: 2, Metadata: map[string]string{"key1": "value2", "key2": "value2"}},
+		{Size: 3, Metadata: map[string]string{"key1": "value1"}},
+		{Size: 4, Metadata: map[string]string{"key1": "value2"}},
+	}
+
+	expected := &converter.VolumeSummaryRespSpec{
+		VolumeSummary: converter.VolumeSummary{
+			TotalSize:  9,
+			TotalCount: 3,
+			Metadata: map[string][]string{
+				"key1": {"value1", "value2"},
+				"key2": {"value2"},
+			},
+		},
+	}
+
+	output := converter.VolumeSummaryResp(volumes)
+	if !reflect.DeepEqual(expected, output) {
+		t.Errorf("Expected %v, actual %v", expected, output)
+	}
+}
+
 func TestCreateVolume(t *testing.T) {
 	RequestBodyStr := `
     {
@@ -382,6 +445,7 @@ func TestVolumeAction(t *testing.T) {
 
 func TestVolumeActionInitializeConnectionWithError(t *testing.T) {
 	SleepDuration = time.Nanosecond
+	attachTimeout = time.Millisecond
 	Req := converter.InitializeConnectionReqSpec{}
 
 	Req.InitializeConnection.Connector.Platform = "x86_64"
@@ -416,4 +480,18 @@ func TestVolumeActionInitializeConnectionWithError(t *testing.T) {
 	if expected != output.Message {
 		t.Errorf("Expected %v, actual %v", expected, output.Message)
 	}
+
+	expectedEventID := message.EventID(message.ResourceVolume,
+		message.ActionAttachVolume, message.DetailAttachTimeout)
+	found := false
+	for _, msg := range messageStore.List("") {
+		if msg.ResourceUUID == "bd5b12a8-a101-11e7-941e-d77981b584d8" &&
+			msg.EventID == expectedEventID {
+			found = true
+		}
+	}
+
+	if !found {
+		t.Errorf("Expected a user message with event id %v", expectedEventID)
+	}
 }
@@ -0,0 +1,242 @@
+// Copyright (c) 2018 Huawei Technologies Co., Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+This module copies the data of a volume into another one, both volumes are
+attached to the host running this service for the time of the copy, the way
+cinder-backup restores a backup into an existing volume.
+
+*/
+
+package api
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	log "github.com/golang/glog"
+	sdsdevice "github.com/opensds/nbp/client/device"
+	c "github.com/opensds/opensds/client"
+	"github.com/opensds/opensds/contrib/connector"
+	"github.com/opensds/opensds/pkg/model"
+)
+
+// copyBufferSize the size of the blocks the data of a volume is copied by
+const copyBufferSize = 1 << 20
+
+// copyVolumeData copies the data of a volume into another one at least as
+// large, tests replace it as no volume can be attached where they run
+var copyVolumeData = copyVolumeLocally
+
+// copyVolumeLocally attaches both volumes to this host and copies the device
+// of src into the device of dst
+func copyVolumeLocally(client *c.Client, src, dst *model.VolumeSpec) error {
+	srcDevice, detachSrc, err := attachLocally(client, src)
+	if err != nil {
+		return err
+	}
+	defer detachSrc()
+
+	dstDevice, detachDst, err := attachLocally(client, dst)
+	if err != nil {
+		return err
+	}
+	defer detachDst()
+
+	if err := copyDevice(srcDevice, dstDevice); err != nil {
+		return fmt.Errorf("copy volume %s to volume %s failed: %v", src.Id, dst.Id, err)
+	}
+
+	log.Infof("Volume %s is copied to volume %s", src.Id, dst.Id)
+	return nil
+}
+
+// attachLocally attaches a volume to this host and returns its device and a
+// function which detaches it again. A single path is enough for a copy, the
+// device is resolved and verified against the identity of the LUN as the
+// device the connector returns may be another disk.
+func attachLocally(client *c.Client, volume *model.VolumeSpec) (string, func(), error) {
+	protocol, err := getPoolProtocol(client, volume.PoolId)
+	if err != nil {
+		return "", nil, err
+	}
+
+	hostInfo, err := getLocalHostInfo(protocol)
+	if err != nil {
+		return "", nil, err
+	}
+
+	attachment, err := client.CreateVolumeAttachment(&model.VolumeAttachmentSpec{
+		BaseModel:      &model.BaseModel{},
+		VolumeId:       volume.Id,
+		HostInfo:       hostInfo,
+		AccessProtocol: protocol,
+	})
+	if err != nil {
+		return "", nil, fmt.Errorf("create attachment of volume %s failed: %v", volume.Id, err)
+	}
+
+	deleteAttachment := func() {
+		if err := client.DeleteVolumeAttachment(attachment.Id, &model.VolumeAttachmentSpec{}); err != nil {
+			log.Errorf("Delete attachment %s of volume %s failed: %v", attachment.Id, volume.Id, err)
+		}
+	}
+
+	attachment, err = waitAttachmentAvailable(client, attachment.Id)
+	if err != nil {
+		deleteAttachment()
+		return "", nil, err
+	}
+
+	volConnector := connector.NewConnector(attachment.DriverVolumeType)
+	if nil == volConnector {
+		deleteAttachment()
+		return "", nil, fmt.Errorf("unsupport driverVolumeType: %s", attachment.DriverVolumeType)
+	}
+
+	pathData := sdsdevice.PathConnectionData(attachment.DriverVolumeType, attachment.ConnectionData)[0]
+	detach := func() {
+		if err := volConnector.Detach(pathData); err != nil {
+			log.Errorf("Detach volume %s from this host failed: %v", volume.Id, err)
+		}
+		deleteAttachment()
+	}
+
+	device, err := volConnector.Attach(pathData)
+	if err == nil {
+		device, err = sdsdevice.Resolve(attachment.DriverVolumeType, pathData, device)
+	}
+	if err == nil {
+		err = sdsdevice.Verify(device, sdsdevice.IdentityOf(attachment.ConnectionData))
+	}
+	if err != nil {
+		detach()
+		return "", nil, fmt.Errorf("attach volume %s to this host failed: %v", volume.Id, err)
+	}
+
+	log.V(5).Infof("Volume %s is attached to this host as %s", volume.Id, device)
+	return device, detach, nil
+}
+
+// getPoolProtocol gets the access protocol of the pool a volume is in, which
+// is iscsi by default
+func getPoolProtocol(client *c.Client, poolID string) (string, error) {
+	if "" == poolID {
+		return connector.IscsiDriver, nil
+	}
+
+	pool, err := client.GetPool(poolID)
+	if err != nil {
+		return "", fmt.Errorf("get pool %s failed: %v", poolID, err)
+	}
+
+	protocol := strings.ToLower(pool.Extras.IOConnectivity.AccessProtocol)
+	if "" == protocol {
+		protocol = connector.IscsiDriver
+	}
+
+	return protocol, nil
+}
+
+// getLocalHostInfo gets the host information of this host for an attachment
+// by the protocol, with its IQN or WWPNs as the initiator
+func getLocalHostInfo(protocol string) (model.HostInfo, error) {
+	hostName, err := connector.GetHostName()
+	if err != nil {
+		return model.HostInfo{}, err
+	}
+
+	hostInfo := model.HostInfo{
+		Host:     hostName,
+		Ip:       connector.GetHostIp(),
+		Platform: runtime.GOARCH,
+		OsType:   runtime.GOOS,
+	}
+
+	if connector.RbdDriver == protocol {
+		return hostInfo, nil
+	}
+
+	volConnector := connector.NewConnector(protocol)
+	if nil == volConnector {
+		return model.HostInfo{}, fmt.Errorf("protocol cannot be %v", protocol)
+	}
+
+	initiator, err := volConnector.GetInitiatorInfo()
+	if err != nil {
+		return model.HostInfo{}, fmt.Errorf("get the %s initiator of this host failed: %v", protocol, err)
+	}
+
+	switch protocol {
+	case connector.IscsiDriver:
+		hostInfo.Initiator, _ = initiator.InitiatorData[connector.Iqn].(string)
+	case connector.FcDriver:
+		wwpns, _ := initiator.InitiatorData[connector.Wwpn].([]string)
+		hostInfo.Initiator = strings.Join(wwpns, ",")
+	}
+
+	if "" == hostInfo.Initiator {
+		return model.HostInfo{}, fmt.Errorf("protocol is %v, but this host has no initiator", protocol)
+	}
+
+	return hostInfo, nil
+}
+
+// waitAttachmentAvailable polls an attachment until it is available with its
+// connection information, error or not available within the attach timeout.
+func waitAttachmentAvailable(client *c.Client, id string) (*model.VolumeAttachmentSpec, error) {
+	start := time.Now()
+
+	for {
+		time.Sleep(SleepDuration)
+		attachment, err := client.GetVolumeAttachment(id)
+		if err != nil {
+			log.V(5).Infof("Get attachment %s failed: %v", id, err)
+		} else if "available" == attachment.Status && "" != attachment.DriverVolumeType {
+			return attachment, nil
+		} else if "error" == attachment.Status {
+			return nil, fmt.Errorf("attachment %s is in error", id)
+		}
+
+		if time.Since(start) >= attachTimeout {
+			return nil, fmt.Errorf("attachment %s is not available after %v", id, attachTimeout)
+		}
+	}
+}
+
+// copyDevice copies a device into another one at least as large, the data
+// is synced to the target before it is detached.
+func copyDevice(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := io.CopyBuffer(out, in, make([]byte, copyBufferSize)); err != nil {
+		return err
+	}
+
+	return out.Sync()
+}
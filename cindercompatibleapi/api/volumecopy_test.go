@@ -0,0 +1,113 @@
+// Copyright (c) 2018 Huawei Technologies Co., Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	c "github.com/opensds/opensds/client"
+	"github.com/opensds/opensds/contrib/connector"
+)
+
+// fakeConnector attaches a volume as a file of a directory
+type fakeConnector struct {
+	device   string
+	detached int
+}
+
+func (fc *fakeConnector) Attach(map[string]interface{}) (string, error) {
+	return fc.device, ioutil.WriteFile(fc.device, []byte("data"), 0600)
+}
+
+func (fc *fakeConnector) Detach(map[string]interface{}) error {
+	fc.detached++
+	return nil
+}
+
+func (fc *fakeConnector) GetInitiatorInfo() (connector.InitiatorInfo, error) {
+	return connector.InitiatorInfo{
+		InitiatorData: map[string]interface{}{connector.Iqn: "iqn.1993-08.org.debian:01:fake"},
+	}, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+//                            Tests for Volume Copy                           //
+////////////////////////////////////////////////////////////////////////////////
+func TestAttachLocally(t *testing.T) {
+	SleepDuration = time.Nanosecond
+	dir, err := ioutil.TempDir("", "volume-copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fc := &fakeConnector{device: filepath.Join(dir, "sdb")}
+	connector.RegisterConnector(connector.IscsiDriver, fc)
+	defer connector.UnregisterConnector(connector.IscsiDriver)
+
+	client := c.NewFakeClient(&c.Config{Endpoint: c.TestEp})
+	volume, _ := client.GetVolume("bd5b12a8-a101-11e7-941e-d77981b584d8")
+	device, detach, err := attachLocally(client, volume)
+	if err != nil {
+		t.Fatalf("Expected no error, actual %v", err)
+	}
+	if device != fc.device {
+		t.Errorf("Expected %v, actual %v", fc.device, device)
+	}
+
+	detach()
+	if fc.detached != 1 {
+		t.Errorf("Expected %v, actual %v", 1, fc.detached)
+	}
+
+	// A volume can not be attached without its connector.
+	connector.UnregisterConnector(connector.IscsiDriver)
+	if _, _, err := attachLocally(client, volume); err == nil {
+		t.Errorf("Expected an error without the iscsi connector")
+	}
+}
+
+func TestCopyDevice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "volume-copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	data := bytes.Repeat([]byte("backup"), copyBufferSize/3)
+	ioutil.WriteFile(src, data, 0600)
+	ioutil.WriteFile(dst, bytes.Repeat([]byte("x"), len(data)+10), 0600)
+
+	if err := copyDevice(src, dst); err != nil {
+		t.Fatalf("Expected no error, actual %v", err)
+	}
+
+	// The target is written over, not truncated.
+	copied, _ := ioutil.ReadFile(dst)
+	expected := append(data, bytes.Repeat([]byte("x"), 10)...)
+	if !bytes.Equal(copied, expected) {
+		t.Errorf("Expected %d bytes of the source, actual %d bytes", len(expected), len(copied))
+	}
+
+	if err := copyDevice(filepath.Join(dir, "missing"), dst); err == nil {
+		t.Errorf("Expected an error for a missing source")
+	}
+}
@@ -60,8 +60,8 @@ func (portal *TypePortal) UpdateType() {
 		return
 	}
 
-	NewClient(portal.Ctx)
-	profile, err = opensdsClient.UpdateProfile(id, profile)
+	client := NewClient(portal.Ctx)
+	profile, err = client.UpdateProfile(id, profile)
 	if err != nil {
 		reason := fmt.Sprintf("Update a volume type failed: %s", err.Error())
 		portal.Ctx.Output.SetStatus(model.ErrorInternalServer)
@@ -98,8 +98,8 @@ func (portal *TypePortal) AddExtraProperty() {
 	}
 
 	profileExtra := converter.AddExtraReq(&cinderReq)
-	NewClient(portal.Ctx)
-	profileExtra, err := opensdsClient.AddCustomProperty(id, profileExtra)
+	client := NewClient(portal.Ctx)
+	profileExtra, err := client.AddCustomProperty(id, profileExtra)
 	if err != nil {
 		reason := fmt.Sprintf("Create or update extra specs for volume type failed: %s", err.Error())
 		portal.Ctx.Output.SetStatus(model.ErrorInternalServer)
@@ -127,8 +127,8 @@ func (portal *TypePortal) AddExtraProperty() {
 // ListExtraProperties ...
 func (portal *TypePortal) ListExtraProperties() {
 	id := portal.Ctx.Input.Param(":volumeTypeId")
-	NewClient(portal.Ctx)
-	profileExtra, err := opensdsClient.ListCustomProperties(id)
+	client := NewClient(portal.Ctx)
+	profileExtra, err := client.ListCustomProperties(id)
 
 	if err != nil {
 		reason := fmt.Sprintf("Show all extra specifications for volume type failed: %s", err.Error())
@@ -156,8 +156,8 @@ func (portal *TypePortal) ListExtraProperties() {
 // ShowExtraProperty ...
 func (portal *TypePortal) ShowExtraProperty() {
 	id := portal.Ctx.Input.Param(":volumeTypeId")
-	NewClient(portal.Ctx)
-	profileExtra, err := opensdsClient.ListCustomProperties(id)
+	client := NewClient(portal.Ctx)
+	profileExtra, err := client.ListCustomProperties(id)
 
 	if err != nil {
 		reason := fmt.Sprintf("Show extra specification for volume type failed: %s", err.Error())
@@ -215,8 +215,8 @@ func (portal *TypePortal) UpdateExtraProperty() {
 		return
 	}
 
-	NewClient(portal.Ctx)
-	profileExtra, err = opensdsClient.AddCustomProperty(id, profileExtra)
+	client := NewClient(portal.Ctx)
+	profileExtra, err = client.AddCustomProperty(id, profileExtra)
 	if err != nil {
 		reason := fmt.Sprintf("Update extra specification for volume type failed: %s", err.Error())
 		portal.Ctx.Output.SetStatus(model.ErrorInternalServer)
@@ -245,8 +245,8 @@ func (portal *TypePortal) UpdateExtraProperty() {
 func (portal *TypePortal) DeleteExtraProperty() {
 	id := portal.Ctx.Input.Param(":volumeTypeId")
 	key := portal.Ctx.Input.Param(":key")
-	NewClient(portal.Ctx)
-	err := opensdsClient.RemoveCustomProperty(id, key)
+	client := NewClient(portal.Ctx)
+	err := client.RemoveCustomProperty(id, key)
 
 	if err != nil {
 		reason := fmt.Sprintf("Delete extra specification for volume type failed: %s", err.Error())
@@ -270,10 +270,10 @@ func (portal *TypePortal) GetType() {
 	}
 
 	var profile *model.ProfileSpec
-	NewClient(portal.Ctx)
+	client := NewClient(portal.Ctx)
 
 	if "default" != id {
-		foundProfile, err := opensdsClient.GetProfile(id)
+		foundProfile, err := client.GetProfile(id)
 
 		if err != nil {
 			reason := fmt.Sprintf("Get profile failed: %v", err)
@@ -285,7 +285,7 @@ func (portal *TypePortal) GetType() {
 
 		profile = foundProfile
 	} else {
-		profiles, err := opensdsClient.ListProfiles()
+		profiles, err := client.ListProfiles()
 		if err != nil {
 			reason := fmt.Sprintf("List profiles failed: %v", err)
 			portal.Ctx.Output.SetStatus(model.ErrorInternalServer)
@@ -327,8 +327,8 @@ func (portal *TypePortal) GetType() {
 // DeleteType ...
 func (portal *TypePortal) DeleteType() {
 	id := portal.Ctx.Input.Param(":volumeTypeId")
-	NewClient(portal.Ctx)
-	err := opensdsClient.DeleteProfile(id)
+	client := NewClient(portal.Ctx)
+	err := client.DeleteProfile(id)
 
 	if err != nil {
 		reason := fmt.Sprintf("Delete a volume type failed: %v", err)
@@ -344,8 +344,8 @@ func (portal *TypePortal) DeleteType() {
 
 // ListTypes ...
 func (portal *TypePortal) ListTypes() {
-	NewClient(portal.Ctx)
-	profiles, err := opensdsClient.ListProfiles()
+	client := NewClient(portal.Ctx)
+	profiles, err := client.ListProfiles()
 	if err != nil {
 		reason := fmt.Sprintf("List all volume types failed: %v", err)
 		portal.Ctx.Output.SetStatus(model.ErrorInternalServer)
@@ -389,8 +389,8 @@ func (portal *TypePortal) CreateType() {
 		return
 	}
 
-	NewClient(portal.Ctx)
-	profile, err = opensdsClient.CreateProfile(profile)
+	client := NewClient(portal.Ctx)
+	profile, err = client.CreateProfile(profile)
 	if err != nil {
 		reason := fmt.Sprintf("Create a volume type failed: %s", err.Error())
 		portal.Ctx.Output.SetStatus(model.ErrorInternalServer)
@@ -23,6 +23,7 @@ import (
 	"testing"
 
 	"github.com/astaxie/beego"
+	bctx "github.com/astaxie/beego/context"
 	c "github.com/opensds/opensds/client"
 	"github.com/opensds/nbp/cindercompatibleapi/converter"
 )
@@ -37,7 +38,9 @@ func init() {
 	beego.Router("/v3/types/:volumeTypeId/extra_specs/:key", &TypePortal{},
 		"get:ShowExtraProperty;put:UpdateExtraProperty;delete:DeleteExtraProperty")
 
-	opensdsClient = c.NewFakeClient(&c.Config{Endpoint: c.TestEp})
+	clientFactory = func(*bctx.Context) *c.Client {
+		return c.NewFakeClient(&c.Config{Endpoint: c.TestEp})
+	}
 }
 
 ////////////////////////////////////////////////////////////////////////////////
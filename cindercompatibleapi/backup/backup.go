@@ -0,0 +1,388 @@
+// Copyright (c) 2018 Huawei Technologies Co., Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+This module implements the cinder backups. A backup is an OpenSDS snapshot
+uploaded to an object container, its status is tracked here, separately
+from the status of the snapshot. The record of an uploaded backup is kept
+in the container next to the data, so the backups are found again after a
+restart.
+
+*/
+
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+// Backup status, the same as in cinder.
+const (
+	StatusCreating      = "creating"
+	StatusAvailable     = "available"
+	StatusDeleting      = "deleting"
+	StatusRestoring     = "restoring"
+	StatusError         = "error"
+	StatusErrorDeleting = "error_deleting"
+)
+
+// Backup describes a backup of a volume.
+type Backup struct {
+	ID               string    `json:"id"`
+	ProjectID        string    `json:"projectId,omitempty"`
+	Name             string    `json:"name,omitempty"`
+	Description      string    `json:"description,omitempty"`
+	AvailabilityZone string    `json:"availabilityZone,omitempty"`
+	VolumeID         string    `json:"volumeId"`
+	SnapshotID       string    `json:"snapshotId,omitempty"`
+	ParentID         string    `json:"parentId,omitempty"`
+	Container        string    `json:"container"`
+	Size             int64     `json:"size"`
+	Status           string    `json:"status"`
+	FailReason       string    `json:"failReason,omitempty"`
+	ObjectCount      int64     `json:"objectCount"`
+	CreatedAt        time.Time `json:"createdAt"`
+	UpdatedAt        time.Time `json:"updatedAt"`
+	DataTimestamp    time.Time `json:"dataTimestamp"`
+
+	// HasDependentBackups is set on the copies returned by the store.
+	HasDependentBackups bool `json:"-"`
+}
+
+// IsIncremental tells whether the backup is based on another one.
+func (b *Backup) IsIncremental() bool {
+	return b.ParentID != ""
+}
+
+// NotFoundError means the backup does not exist.
+type NotFoundError struct {
+	ID string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("backup %s could not be found", e.ID)
+}
+
+// InvalidError means the operation is not allowed in the current state of
+// the backup.
+type InvalidError struct {
+	Reason string
+}
+
+func (e *InvalidError) Error() string {
+	return e.Reason
+}
+
+// Store keeps the backups and uploads the record of the available ones to
+// the object target.
+type Store struct {
+	sync.Mutex
+	target  ObjectTarget
+	backups map[string]*Backup
+	now     func() time.Time
+}
+
+// NewStore creates an empty store on an object target.
+func NewStore(target ObjectTarget) *Store {
+	return &Store{
+		target:  target,
+		backups: make(map[string]*Backup),
+		now:     time.Now,
+	}
+}
+
+// Load reads the records of the backups uploaded to the object target.
+func (s *Store) Load() error {
+	objects, err := s.target.List()
+	if err != nil {
+		return fmt.Errorf("list backup objects failed: %v", err)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	for container, names := range objects {
+		for _, name := range names {
+			data, err := s.target.Get(container, name)
+			if err != nil {
+				return fmt.Errorf("read backup object %s/%s failed: %v", container, name, err)
+			}
+
+			b := &Backup{}
+			if err := json.Unmarshal(data, b); err != nil {
+				return fmt.Errorf("parse backup object %s/%s failed: %v", container, name, err)
+			}
+			b.Status = StatusAvailable
+			s.backups[b.ID] = b
+		}
+	}
+
+	return nil
+}
+
+// Create records a new backup in creating status. An incremental backup is
+// based on the latest available backup of the volume in the container.
+func (s *Store) Create(b *Backup, incremental bool) (*Backup, error) {
+	if err := ValidateContainer(b.Container); err != nil {
+		return nil, &InvalidError{Reason: err.Error()}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	nb := *b
+	if incremental {
+		parent := s.latestLocked(b.ProjectID, b.VolumeID, b.Container)
+		if parent == nil {
+			return nil, &InvalidError{Reason: "No backups available to do an incremental backup."}
+		}
+		nb.ParentID = parent.ID
+	}
+
+	now := s.now()
+	nb.ID = uuid.NewV4().String()
+	nb.Status = StatusCreating
+	nb.CreatedAt = now
+	nb.UpdatedAt = now
+	s.backups[nb.ID] = &nb
+
+	return s.copyLocked(&nb), nil
+}
+
+// Get returns the backup with the given id.
+func (s *Store) Get(projectID, id string) (*Backup, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	b, err := s.getLocked(projectID, id)
+	if err != nil {
+		return nil, err
+	}
+	return s.copyLocked(b), nil
+}
+
+// List returns the backups of a project, oldest first.
+func (s *Store) List(projectID string) []*Backup {
+	s.Lock()
+	defer s.Unlock()
+
+	var backups []*Backup
+	for _, b := range s.backups {
+		if matchProject(b, projectID) {
+			backups = append(backups, s.copyLocked(b))
+		}
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].CreatedAt.Before(backups[j].CreatedAt)
+	})
+
+	return backups
+}
+
+// SetSnapshot records the OpenSDS snapshot holding the data of a backup.
+func (s *Store) SetSnapshot(id, snapshotID string) error {
+	return s.update(id, func(b *Backup) error {
+		b.SnapshotID = snapshotID
+		return nil
+	})
+}
+
+// Complete uploads the record of a backup whose snapshot is available, the
+// backup becomes available.
+func (s *Store) Complete(id string, size int64, dataTimestamp time.Time) error {
+	s.Lock()
+	defer s.Unlock()
+
+	b, ok := s.backups[id]
+	if !ok {
+		return &NotFoundError{ID: id}
+	}
+	if b.Status != StatusCreating {
+		return &InvalidError{Reason: fmt.Sprintf("backup %s is %s, not %s", id, b.Status, StatusCreating)}
+	}
+
+	done := *b
+	done.Size = size
+	done.DataTimestamp = dataTimestamp
+	done.Status = StatusAvailable
+	done.ObjectCount = 1
+	done.FailReason = ""
+	done.UpdatedAt = s.now()
+
+	data, err := json.Marshal(&done)
+	if err != nil {
+		return err
+	}
+	if err := s.target.Put(done.Container, done.ID, data); err != nil {
+		return fmt.Errorf("upload backup %s to container %s failed: %v", id, done.Container, err)
+	}
+
+	*b = done
+	return nil
+}
+
+// Fail sets a backup in error with the reason of the failure.
+func (s *Store) Fail(id, reason string) error {
+	return s.update(id, func(b *Backup) error {
+		b.Status = StatusError
+		b.FailReason = reason
+		return nil
+	})
+}
+
+// BeginDelete checks that a backup can be deleted and sets it deleting.
+// A backup with incremental backups based on it can not be deleted.
+func (s *Store) BeginDelete(projectID, id string) (*Backup, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	b, err := s.getLocked(projectID, id)
+	if err != nil {
+		return nil, err
+	}
+	if b.Status != StatusAvailable && b.Status != StatusError && b.Status != StatusErrorDeleting {
+		return nil, &InvalidError{Reason: fmt.Sprintf(
+			"Backup status must be available or error, but current status is %s.", b.Status)}
+	}
+	if s.hasDependentsLocked(b.ID) {
+		return nil, &InvalidError{Reason: "Incremental backups exist for this backup."}
+	}
+
+	b.Status = StatusDeleting
+	b.UpdatedAt = s.now()
+	return s.copyLocked(b), nil
+}
+
+// FinishDelete removes a deleting backup and its object.
+func (s *Store) FinishDelete(id string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	b, ok := s.backups[id]
+	if !ok {
+		return &NotFoundError{ID: id}
+	}
+	if err := s.target.Delete(b.Container, b.ID); err != nil {
+		return fmt.Errorf("delete backup %s from container %s failed: %v", id, b.Container, err)
+	}
+
+	delete(s.backups, id)
+	return nil
+}
+
+// FailDelete sets a backup in error_deleting with the reason of the failure.
+func (s *Store) FailDelete(id, reason string) error {
+	return s.update(id, func(b *Backup) error {
+		b.Status = StatusErrorDeleting
+		b.FailReason = reason
+		return nil
+	})
+}
+
+// BeginRestore checks that a backup can be restored and sets it restoring.
+func (s *Store) BeginRestore(projectID, id string) (*Backup, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	b, err := s.getLocked(projectID, id)
+	if err != nil {
+		return nil, err
+	}
+	if b.Status != StatusAvailable {
+		return nil, &InvalidError{Reason: fmt.Sprintf(
+			"Backup status must be available, but current status is %s.", b.Status)}
+	}
+
+	b.Status = StatusRestoring
+	b.UpdatedAt = s.now()
+	return s.copyLocked(b), nil
+}
+
+// FinishRestore makes a restoring backup available again, whether the
+// restore succeeded or not.
+func (s *Store) FinishRestore(id string) error {
+	return s.update(id, func(b *Backup) error {
+		if b.Status == StatusRestoring {
+			b.Status = StatusAvailable
+		}
+		return nil
+	})
+}
+
+func (s *Store) update(id string, fn func(*Backup) error) error {
+	s.Lock()
+	defer s.Unlock()
+
+	b, ok := s.backups[id]
+	if !ok {
+		return &NotFoundError{ID: id}
+	}
+	if err := fn(b); err != nil {
+		return err
+	}
+	b.UpdatedAt = s.now()
+	return nil
+}
+
+func (s *Store) getLocked(projectID, id string) (*Backup, error) {
+	b, ok := s.backups[id]
+	if !ok || !matchProject(b, projectID) {
+		return nil, &NotFoundError{ID: id}
+	}
+	return b, nil
+}
+
+// latestLocked returns the latest available backup of a volume in a
+// container, by the time of its data.
+func (s *Store) latestLocked(projectID, volumeID, container string) *Backup {
+	var latest *Backup
+	for _, b := range s.backups {
+		if b.VolumeID != volumeID || b.Container != container ||
+			b.Status != StatusAvailable || !matchProject(b, projectID) {
+			continue
+		}
+		if latest == nil || b.DataTimestamp.After(latest.DataTimestamp) {
+			latest = b
+		}
+	}
+	return latest
+}
+
+func (s *Store) hasDependentsLocked(id string) bool {
+	for _, b := range s.backups {
+		if b.ParentID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Store) copyLocked(b *Backup) *Backup {
+	c := *b
+	c.HasDependentBackups = s.hasDependentsLocked(b.ID)
+	return &c
+}
+
+// An empty project id matches every backup, that is the case when the
+// request url does not carry a project id.
+func matchProject(b *Backup, projectID string) bool {
+	return "" == projectID || "" == b.ProjectID || b.ProjectID == projectID
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2018 Huawei Technologies Co., Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backup
+
+import (
+	"testing"
+	"time"
+)
+
+const volumeID = "bd5b12a8-a101-11e7-941e-d77981b584d8"
+
+func createAvailable(t *testing.T, store *Store, incremental bool, dataTimestamp time.Time) *Backup {
+	b, err := store.Create(&Backup{ProjectID: "project-a", VolumeID: volumeID,
+		Container: "backups"}, incremental)
+	if err != nil {
+		t.Fatalf("Expected no error, actual %v", err)
+	}
+	if err := store.Complete(b.ID, 1, dataTimestamp); err != nil {
+		t.Fatalf("Expected no error, actual %v", err)
+	}
+	return b
+}
+
+func TestStoreIncremental(t *testing.T) {
+	store := NewStore(NewMemoryTarget())
+
+	_, err := store.Create(&Backup{VolumeID: volumeID, Container: "backups"}, true)
+	if _, ok := err.(*InvalidError); !ok {
+		t.Errorf("Expected an invalid error without a full backup, actual %v", err)
+	}
+
+	now := time.Now()
+	full := createAvailable(t, store, false, now)
+	incr := createAvailable(t, store, true, now.Add(time.Minute))
+	if incr.ParentID != full.ID {
+		t.Errorf("Expected parent %v, actual %v", full.ID, incr.ParentID)
+	}
+
+	// The next incremental backup is based on the latest one.
+	next := createAvailable(t, store, true, now.Add(2*time.Minute))
+	if next.ParentID != incr.ID {
+		t.Errorf("Expected parent %v, actual %v", incr.ID, next.ParentID)
+	}
+
+	if b, _ := store.Get("project-a", full.ID); !b.HasDependentBackups {
+		t.Errorf("Expected backup %v to have dependent backups", full.ID)
+	}
+
+	if _, err := store.BeginDelete("project-a", full.ID); err == nil {
+		t.Errorf("Expected an error when deleting backup %v with dependent backups", full.ID)
+	}
+
+	for _, id := range []string{next.ID, incr.ID, full.ID} {
+		if _, err := store.BeginDelete("project-a", id); err != nil {
+			t.Fatalf("Expected no error, actual %v", err)
+		}
+		if err := store.FinishDelete(id); err != nil {
+			t.Fatalf("Expected no error, actual %v", err)
+		}
+	}
+
+	if backups := store.List(""); len(backups) != 0 {
+		t.Errorf("Expected no backups, actual %v", backups)
+	}
+}
+
+func TestStoreStatus(t *testing.T) {
+	store := NewStore(NewMemoryTarget())
+	b, _ := store.Create(&Backup{ProjectID: "project-a", VolumeID: volumeID,
+		Container: "backups"}, false)
+
+	if _, err := store.BeginRestore("project-a", b.ID); err == nil {
+		t.Errorf("Expected an error when restoring a creating backup")
+	}
+	if _, err := store.BeginDelete("project-a", b.ID); err == nil {
+		t.Errorf("Expected an error when deleting a creating backup")
+	}
+	if _, err := store.Get("project-b", b.ID); err == nil {
+		t.Errorf("Expected backup %v to be hidden from another project", b.ID)
+	}
+
+	store.Fail(b.ID, "snapshot is in error")
+	if got, _ := store.Get("project-a", b.ID); got.Status != StatusError || got.FailReason == "" {
+		t.Errorf("Expected status %v with a reason, actual %+v", StatusError, got)
+	}
+	if err := store.Complete(b.ID, 1, time.Now()); err == nil {
+		t.Errorf("Expected an error when completing a backup in error")
+	}
+
+	b = createAvailable(t, store, false, time.Now())
+	if _, err := store.BeginRestore("project-a", b.ID); err != nil {
+		t.Fatalf("Expected no error, actual %v", err)
+	}
+	if _, err := store.BeginRestore("project-a", b.ID); err == nil {
+		t.Errorf("Expected an error when restoring a restoring backup")
+	}
+	store.FinishRestore(b.ID)
+	if got, _ := store.Get("project-a", b.ID); got.Status != StatusAvailable {
+		t.Errorf("Expected status %v, actual %v", StatusAvailable, got.Status)
+	}
+}
+
+func TestStoreLoad(t *testing.T) {
+	target := NewMemoryTarget()
+	store := NewStore(target)
+	b := createAvailable(t, store, false, time.Now())
+	store.Create(&Backup{VolumeID: volumeID, Container: "backups"}, false)
+
+	// Only the uploaded backups are found again.
+	reloaded := NewStore(target)
+	if err := reloaded.Load(); err != nil {
+		t.Fatalf("Expected no error, actual %v", err)
+	}
+	backups := reloaded.List("")
+	if len(backups) != 1 || backups[0].ID != b.ID || backups[0].Status != StatusAvailable {
+		t.Errorf("Expected backup %v, actual %v", b.ID, backups)
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright (c) 2018 Huawei Technologies Co., Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+This module implements the object targets which keep the uploaded backups.
+The local target is a stand-in for the object storage used by OpenSDS
+multi-cloud, every container is a directory and every object a file.
+
+*/
+
+package backup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ObjectTarget stores the objects of the backups in containers.
+type ObjectTarget interface {
+	// Put creates or replaces an object.
+	Put(container, name string, data []byte) error
+	// Get returns the content of an object.
+	Get(container, name string) ([]byte, error)
+	// Delete removes an object, removing a missing object is not an error.
+	Delete(container, name string) error
+	// List returns the names of the objects of every container.
+	List() (map[string][]string, error)
+}
+
+// ValidateContainer checks that a container name can be used as a bucket
+// name and as a directory name.
+func ValidateContainer(container string) error {
+	if container == "" || container == "." || container == ".." ||
+		strings.ContainsAny(container, `/\`) {
+		return fmt.Errorf("container name %q is invalid", container)
+	}
+
+	return nil
+}
+
+// LocalTarget keeps the objects in a local directory.
+type LocalTarget struct {
+	dir string
+}
+
+// NewLocalTarget creates the directory of a local target if needed.
+func NewLocalTarget(dir string) (*LocalTarget, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, fmt.Errorf("create backup target directory %s failed: %v", dir, err)
+	}
+
+	return &LocalTarget{dir: dir}, nil
+}
+
+// Put implements ObjectTarget. The object is written to a temporary file
+// first so that a crash never leaves a partial object.
+func (t *LocalTarget) Put(container, name string, data []byte) error {
+	if err := ValidateContainer(container); err != nil {
+		return err
+	}
+
+	dir := filepath.Join(t.dir, container)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, "."+name)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(dir, name))
+}
+
+// Get implements ObjectTarget.
+func (t *LocalTarget) Get(container, name string) ([]byte, error) {
+	if err := ValidateContainer(container); err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadFile(filepath.Join(t.dir, container, name))
+}
+
+// Delete implements ObjectTarget.
+func (t *LocalTarget) Delete(container, name string) error {
+	if err := ValidateContainer(container); err != nil {
+		return err
+	}
+
+	err := os.Remove(filepath.Join(t.dir, container, name))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// List implements ObjectTarget, the temporary files are skipped.
+func (t *LocalTarget) List() (map[string][]string, error) {
+	containers, err := ioutil.ReadDir(t.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	objects := make(map[string][]string)
+	for _, container := range containers {
+		if !container.IsDir() {
+			continue
+		}
+
+		files, err := ioutil.ReadDir(filepath.Join(t.dir, container.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+				continue
+			}
+			objects[container.Name()] = append(objects[container.Name()], file.Name())
+		}
+	}
+
+	return objects, nil
+}
+
+// MemoryTarget keeps the objects in memory, the backups do not survive a
+// restart of the service.
+type MemoryTarget struct {
+	sync.Mutex
+	objects map[string]map[string][]byte
+}
+
+// NewMemoryTarget creates an empty memory target.
+func NewMemoryTarget() *MemoryTarget {
+	return &MemoryTarget{objects: make(map[string]map[string][]byte)}
+}
+
+// Put implements ObjectTarget.
+func (t *MemoryTarget) Put(container, name string, data []byte) error {
+	if err := ValidateContainer(container); err != nil {
+		return err
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	if t.objects[container] == nil {
+		t.objects[container] = make(map[string][]byte)
+	}
+	t.objects[container][name] = append([]byte(nil), data...)
+	return nil
+}
+
+// Get implements ObjectTarget.
+func (t *MemoryTarget) Get(container, name string) ([]byte, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	data, ok := t.objects[container][name]
+	if !ok {
+		return nil, fmt.Errorf("object %s/%s not found", container, name)
+	}
+	return append([]byte(nil), data...), nil
+}
+
+// Delete implements ObjectTarget.
+func (t *MemoryTarget) Delete(container, name string) error {
+	t.Lock()
+	defer t.Unlock()
+
+	delete(t.objects[container], name)
+	return nil
+}
+
+// List implements ObjectTarget.
+func (t *MemoryTarget) List() (map[string][]string, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	objects := make(map[string][]string)
+	for container, names := range t.objects {
+		for name := range names {
+			objects[container] = append(objects[container], name)
+		}
+		sort.Strings(objects[container])
+	}
+	return objects, nil
+}
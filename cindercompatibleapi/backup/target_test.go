@@ -0,0 +1,65 @@
+// Copyright (c) 2018 Huawei Technologies Co., Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLocalTarget(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backup-target")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	target, err := NewLocalTarget(filepath.Join(dir, "objects"))
+	if err != nil {
+		t.Fatalf("Expected no error, actual %v", err)
+	}
+
+	if err := target.Put("../escape", "a", []byte("data")); err == nil {
+		t.Errorf("Expected an error with an invalid container")
+	}
+
+	if err := target.Put("backups", "a", []byte("data")); err != nil {
+		t.Fatalf("Expected no error, actual %v", err)
+	}
+	if data, err := target.Get("backups", "a"); err != nil || string(data) != "data" {
+		t.Errorf("Expected data, actual %q %v", data, err)
+	}
+
+	// A temporary file left by a crash is not an object.
+	ioutil.WriteFile(filepath.Join(dir, "objects", "backups", ".b123"), nil, 0640)
+	objects, err := target.List()
+	if err != nil {
+		t.Fatalf("Expected no error, actual %v", err)
+	}
+	expected := map[string][]string{"backups": {"a"}}
+	if !reflect.DeepEqual(expected, objects) {
+		t.Errorf("Expected %v, actual %v", expected, objects)
+	}
+
+	if err := target.Delete("backups", "a"); err != nil {
+		t.Errorf("Expected no error, actual %v", err)
+	}
+	if err := target.Delete("backups", "a"); err != nil {
+		t.Errorf("Expected no error when deleting a missing object, actual %v", err)
+	}
+}
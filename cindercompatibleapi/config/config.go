@@ -0,0 +1,296 @@
+// Copyright (c) 2018 Huawei Technologies Co., Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+This module implements the configuration of the cinder compatible api
+service. The value of an option is taken from, in increasing priority, the
+default, the config file, the environment variables and the command line
+flags.
+
+*/
+
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/opensds/nbp/cindercompatibleapi/backup"
+	"github.com/opensds/nbp/cindercompatibleapi/converter"
+	c "github.com/opensds/opensds/client"
+	"github.com/opensds/opensds/pkg/utils/constants"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// CinderEndpoint is the environment variable kept for compatibility,
+	// it sets both the listen address and the public url.
+	CinderEndpoint = "CINDER_ENDPOINT"
+
+	// DefaultListenAddress ...
+	DefaultListenAddress = "0.0.0.0:8777"
+	// DefaultPublicURL ...
+	DefaultPublicURL = "http://127.0.0.1:8777/v3"
+	// DefaultServerTimeout ...
+	DefaultServerTimeout = 60 * time.Second
+	// DefaultAttachTimeout ...
+	DefaultAttachTimeout = 10 * time.Second
+	// DefaultBackupContainer ...
+	DefaultBackupContainer = "backups"
+	// DefaultBackupTimeout ...
+	DefaultBackupTimeout = 10 * time.Minute
+)
+
+// Config holds the options of the cinder compatible api service.
+type Config struct {
+	// The address the service binds to, in the form host:port.
+	ListenAddress string `yaml:"listenAddress"`
+
+	// The url advertised to the clients, for example the address of a load
+	// balancer. It must end with the api version.
+	PublicURL string `yaml:"publicURL"`
+
+	// Serve https with the certificate and the key if both are set.
+	TLSCertFile string `yaml:"tlsCertFile"`
+	TLSKeyFile  string `yaml:"tlsKeyFile"`
+
+	OpensdsEndpoint     string `yaml:"opensdsEndpoint"`
+	OpensdsAuthStrategy string `yaml:"opensdsAuthStrategy"`
+	// The CA certificate is required when the OpenSDS endpoint is https.
+	OpensdsCACertFile string `yaml:"opensdsCACertFile"`
+
+	// The read and write timeout of the http server.
+	ServerTimeout time.Duration `yaml:"serverTimeout"`
+	// The time to wait for an attachment to become available.
+	AttachTimeout time.Duration `yaml:"attachTimeout"`
+
+	// The container of the backups created without one, OpenSDS uploads
+	// the snapshots to the bucket of the same name.
+	BackupContainer string `yaml:"backupContainer"`
+	// The directory which keeps the records of the backups, they are kept
+	// in memory and lost at restart when it is not set.
+	BackupTargetDir string `yaml:"backupTargetDir"`
+	// The time to wait for a backup to be uploaded or restored.
+	BackupTimeout time.Duration `yaml:"backupTimeout"`
+
+	// The glog verbosity.
+	LogLevel int `yaml:"logLevel"`
+}
+
+// NewDefault returns the configuration with the default values.
+func NewDefault() *Config {
+	return &Config{
+		ListenAddress:       DefaultListenAddress,
+		PublicURL:           DefaultPublicURL,
+		OpensdsEndpoint:     constants.DefaultOpensdsEndpoint,
+		OpensdsAuthStrategy: c.Noauth,
+		ServerTimeout:       DefaultServerTimeout,
+		AttachTimeout:       DefaultAttachTimeout,
+		BackupContainer:     DefaultBackupContainer,
+		BackupTimeout:       DefaultBackupTimeout,
+	}
+}
+
+// Parse builds the configuration from the default, the config file given by
+// the --config flag, the environment variables and the command line flags.
+// The result is validated.
+func Parse(fs *flag.FlagSet, args []string) (*Config, error) {
+	var configFile string
+	flags := NewDefault()
+
+	fs.StringVar(&configFile, "config", "", "use '--config' option to specify the config file in yaml format")
+	fs.StringVar(&flags.ListenAddress, "listenAddress", flags.ListenAddress, "use '--listenAddress' option to specify the address the service binds to")
+	fs.StringVar(&flags.PublicURL, "publicURL", flags.PublicURL, "use '--publicURL' option to specify the url advertised to the clients")
+	fs.StringVar(&flags.TLSCertFile, "tlsCertFile", "", "use '--tlsCertFile' option to specify the certificate file for https, '--tlsKeyFile' must also be used")
+	fs.StringVar(&flags.TLSKeyFile, "tlsKeyFile", "", "use '--tlsKeyFile' option to specify the private key file for https, '--tlsCertFile' must also be used")
+	fs.StringVar(&flags.OpensdsEndpoint, "opensdsEndpoint", flags.OpensdsEndpoint, "use '--opensdsEndpoint' option to specify the OpenSDS endpoint")
+	fs.StringVar(&flags.OpensdsAuthStrategy, "opensdsAuthStrategy", flags.OpensdsAuthStrategy, "use '--opensdsAuthStrategy' option to specify the OpenSDS auth strategy, noauth or keystone")
+	fs.StringVar(&flags.OpensdsCACertFile, "opensdsCACertFile", "", "use '--opensdsCACertFile' option to specify the CA certificate of an https OpenSDS endpoint")
+	fs.DurationVar(&flags.ServerTimeout, "serverTimeout", flags.ServerTimeout, "use '--serverTimeout' option to specify the read and write timeout of the server")
+	fs.DurationVar(&flags.AttachTimeout, "attachTimeout", flags.AttachTimeout, "use '--attachTimeout' option to specify the time to wait for an attachment")
+	fs.StringVar(&flags.BackupContainer, "backupContainer", flags.BackupContainer, "use '--backupContainer' option to specify the default container of the backups")
+	fs.StringVar(&flags.BackupTargetDir, "backupTargetDir", "", "use '--backupTargetDir' option to specify the directory which keeps the records of the backups")
+	fs.DurationVar(&flags.BackupTimeout, "backupTimeout", flags.BackupTimeout, "use '--backupTimeout' option to specify the time to wait for a backup to be uploaded or restored")
+	fs.IntVar(&flags.LogLevel, "logLevel", flags.LogLevel, "use '--logLevel' option to specify the log verbosity")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := NewDefault()
+	if configFile != "" {
+		if err := cfg.LoadFile(configFile); err != nil {
+			return nil, err
+		}
+	}
+
+	cfg.LoadEnv()
+
+	// Only the flags given on the command line override the other sources.
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listenAddress":
+			cfg.ListenAddress = flags.ListenAddress
+		case "publicURL":
+			cfg.PublicURL = flags.PublicURL
+		case "tlsCertFile":
+			cfg.TLSCertFile = flags.TLSCertFile
+		case "tlsKeyFile":
+			cfg.TLSKeyFile = flags.TLSKeyFile
+		case "opensdsEndpoint":
+			cfg.OpensdsEndpoint = flags.OpensdsEndpoint
+		case "opensdsAuthStrategy":
+			cfg.OpensdsAuthStrategy = flags.OpensdsAuthStrategy
+		case "opensdsCACertFile":
+			cfg.OpensdsCACertFile = flags.OpensdsCACertFile
+		case "serverTimeout":
+			cfg.ServerTimeout = flags.ServerTimeout
+		case "attachTimeout":
+			cfg.AttachTimeout = flags.AttachTimeout
+		case "backupContainer":
+			cfg.BackupContainer = flags.BackupContainer
+		case "backupTargetDir":
+			cfg.BackupTargetDir = flags.BackupTargetDir
+		case "backupTimeout":
+			cfg.BackupTimeout = flags.BackupTimeout
+		case "logLevel":
+			cfg.LogLevel = flags.LogLevel
+		}
+	})
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// LoadFile reads the options set in a yaml config file.
+func (cfg *Config) LoadFile(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("read config file %s failed: %v", file, err)
+	}
+
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return fmt.Errorf("parse config file %s failed: %v", file, err)
+	}
+
+	return nil
+}
+
+// LoadEnv reads the options set by the environment variables.
+func (cfg *Config) LoadEnv() {
+	if ep, ok := os.LookupEnv(CinderEndpoint); ok && ep != "" {
+		cfg.PublicURL = ep
+		if u, err := url.Parse(ep); err == nil && u.Host != "" {
+			cfg.ListenAddress = u.Host
+		}
+	}
+
+	if ep, ok := os.LookupEnv(c.OpensdsEndpoint); ok && ep != "" {
+		cfg.OpensdsEndpoint = ep
+	}
+
+	if auth, ok := os.LookupEnv(c.OpensdsAuthStrategy); ok && auth != "" {
+		cfg.OpensdsAuthStrategy = auth
+	}
+}
+
+// Validate checks the options and reports the first incorrect one.
+func (cfg *Config) Validate() error {
+	if _, _, err := SplitListenAddress(cfg.ListenAddress); err != nil {
+		return err
+	}
+
+	u, err := url.Parse(cfg.PublicURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("public url %q must be an absolute http or https url", cfg.PublicURL)
+	}
+	if !strings.HasSuffix(strings.TrimSuffix(u.Path, "/"), "/"+converter.APIVersion) {
+		return fmt.Errorf("public url %q must end with the api version /%s", cfg.PublicURL, converter.APIVersion)
+	}
+
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return fmt.Errorf("to use TLS, both the certificate file and the key file must be set")
+	}
+	for _, file := range []string{cfg.TLSCertFile, cfg.TLSKeyFile} {
+		if file == "" {
+			continue
+		}
+		if _, err := os.Stat(file); err != nil {
+			return fmt.Errorf("TLS file %s is not accessible: %v", file, err)
+		}
+	}
+
+	u, err = url.Parse(cfg.OpensdsEndpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("OpenSDS endpoint %q must be an absolute http or https url", cfg.OpensdsEndpoint)
+	}
+	if u.Scheme == "https" {
+		if cfg.OpensdsCACertFile == "" {
+			return fmt.Errorf("OpenSDS endpoint %q is https, the CA certificate file must be set", cfg.OpensdsEndpoint)
+		}
+		if _, err := os.Stat(cfg.OpensdsCACertFile); err != nil {
+			return fmt.Errorf("CA certificate file %s is not accessible: %v", cfg.OpensdsCACertFile, err)
+		}
+	}
+
+	if cfg.OpensdsAuthStrategy != c.Noauth && cfg.OpensdsAuthStrategy != c.Keystone {
+		return fmt.Errorf("OpenSDS auth strategy %q is not supported, it must be %s or %s",
+			cfg.OpensdsAuthStrategy, c.Noauth, c.Keystone)
+	}
+
+	if cfg.ServerTimeout < time.Second {
+		return fmt.Errorf("server timeout %v must be at least 1s", cfg.ServerTimeout)
+	}
+	if cfg.AttachTimeout <= 0 {
+		return fmt.Errorf("attach timeout %v must be positive", cfg.AttachTimeout)
+	}
+
+	if err := backup.ValidateContainer(cfg.BackupContainer); err != nil {
+		return fmt.Errorf("backup container: %v", err)
+	}
+	if cfg.BackupTimeout <= 0 {
+		return fmt.Errorf("backup timeout %v must be positive", cfg.BackupTimeout)
+	}
+
+	if cfg.LogLevel < 0 {
+		return fmt.Errorf("log level %d must not be negative", cfg.LogLevel)
+	}
+
+	return nil
+}
+
+// SplitListenAddress splits a listen address into its host and port.
+func SplitListenAddress(addr string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, fmt.Errorf("listen address %q must be in the form host:port: %v", addr, err)
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return "", 0, fmt.Errorf("listen address %q has an invalid port", addr)
+	}
+
+	return host, port, nil
+}
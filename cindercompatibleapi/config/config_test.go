@@ -0,0 +1,144 @@
+// Copyright (c) 2018 Huawei Technologies Co., Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	c "github.com/opensds/opensds/client"
+)
+
+func unsetEnv() {
+	os.Unsetenv(CinderEndpoint)
+	os.Unsetenv(c.OpensdsEndpoint)
+	os.Unsetenv(c.OpensdsAuthStrategy)
+}
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	file := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestParsePriority(t *testing.T) {
+	unsetEnv()
+	defer unsetEnv()
+
+	dir, err := ioutil.TempDir("", "cinder-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := writeFile(t, dir, "config.yaml", `
+listenAddress: 0.0.0.0:9000
+publicURL: https://cinder.example.com/v3
+opensdsEndpoint: http://10.0.0.1:50040
+attachTimeout: 30s
+backupTargetDir: /var/lib/backups
+logLevel: 3
+`)
+	os.Setenv(c.OpensdsEndpoint, "http://10.0.0.2:50040")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg, err := Parse(fs, []string{"--config", file, "--logLevel", "5", "--backupContainer", "dr"})
+	if err != nil {
+		t.Fatalf("Expected no error, actual %v", err)
+	}
+
+	expected := NewDefault()
+	expected.ListenAddress = "0.0.0.0:9000"
+	expected.PublicURL = "https://cinder.example.com/v3"
+	expected.OpensdsEndpoint = "http://10.0.0.2:50040"
+	expected.AttachTimeout = 30 * time.Second
+	expected.BackupContainer = "dr"
+	expected.BackupTargetDir = "/var/lib/backups"
+	expected.LogLevel = 5
+
+	if *cfg != *expected {
+		t.Errorf("Expected %+v, actual %+v", expected, cfg)
+	}
+}
+
+func TestParseCinderEndpointEnv(t *testing.T) {
+	unsetEnv()
+	defer unsetEnv()
+
+	os.Setenv(CinderEndpoint, "http://127.0.0.1:8776/v3")
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg, err := Parse(fs, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, actual %v", err)
+	}
+
+	if cfg.ListenAddress != "127.0.0.1:8776" || cfg.PublicURL != "http://127.0.0.1:8776/v3" {
+		t.Errorf("Expected the listen address and public url from %s, actual %+v", CinderEndpoint, cfg)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	testCases := []struct {
+		modify   func(cfg *Config)
+		expected string
+	}{
+		{func(cfg *Config) { cfg.ListenAddress = "0.0.0.0" }, "listen address"},
+		{func(cfg *Config) { cfg.ListenAddress = "0.0.0.0:http" }, "invalid port"},
+		{func(cfg *Config) { cfg.PublicURL = "127.0.0.1:8777/v3" }, "absolute http or https url"},
+		{func(cfg *Config) { cfg.PublicURL = "http://127.0.0.1:8777/v2" }, "must end with the api version"},
+		{func(cfg *Config) { cfg.TLSCertFile = "cert.pem" }, "both the certificate file and the key file"},
+		{func(cfg *Config) { cfg.TLSCertFile, cfg.TLSKeyFile = "/no/cert.pem", "/no/key.pem" }, "not accessible"},
+		{func(cfg *Config) { cfg.OpensdsEndpoint = "https://127.0.0.1:50040" }, "CA certificate file must be set"},
+		{func(cfg *Config) { cfg.OpensdsAuthStrategy = "basic" }, "not supported"},
+		{func(cfg *Config) { cfg.ServerTimeout = time.Millisecond }, "server timeout"},
+		{func(cfg *Config) { cfg.AttachTimeout = 0 }, "attach timeout"},
+		{func(cfg *Config) { cfg.BackupContainer = "a/b" }, "backup container"},
+		{func(cfg *Config) { cfg.BackupTimeout = 0 }, "backup timeout"},
+		{func(cfg *Config) { cfg.LogLevel = -1 }, "log level"},
+	}
+
+	if err := NewDefault().Validate(); err != nil {
+		t.Errorf("Expected the default configuration to be valid, actual %v", err)
+	}
+
+	for _, tc := range testCases {
+		cfg := NewDefault()
+		tc.modify(cfg)
+		err := cfg.Validate()
+		if err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Errorf("Expected error containing %q, actual %v", tc.expected, err)
+		}
+	}
+}
+
+func TestLoadFileUnknownOption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cinder-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := writeFile(t, dir, "config.yaml", "listenAdress: 0.0.0.0:8777\n")
+	if err := NewDefault().LoadFile(file); err == nil {
+		t.Errorf("Expected an error for the misspelt option in %s", file)
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright (c) 2018 Huawei Technologies Co., Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conformance
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/astaxie/beego"
+	"github.com/opensds/nbp/cindercompatibleapi/api"
+	"github.com/opensds/nbp/cindercompatibleapi/config"
+	"github.com/opensds/opensds/contrib/connector"
+)
+
+var report = flag.String("conformance.report", "",
+	"write the field level gaps of every step to this file in json format")
+
+const projectID = "89afd400b6464bbcb12bc0a4d63e5bd3"
+
+func TestConformance(t *testing.T) {
+	fixtures, err := LoadFixtures("testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fixtures) == 0 {
+		t.Fatal("no fixture found in testdata")
+	}
+
+	api.SleepDuration = time.Millisecond
+	var all []*StepResult
+
+	// A backup is restored into an existing volume on this host.
+	dir, err := ioutil.TempDir("", "conformance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	connector.RegisterConnector(connector.IscsiDriver, &FakeConnector{Dir: dir})
+	defer connector.UnregisterConnector(connector.IscsiDriver)
+
+	for _, fixture := range fixtures {
+		t.Run(fixture.Name, func(t *testing.T) {
+			// Every fixture starts with an empty OpenSDS.
+			fake := NewFakeOpenSDS()
+			opensds := httptest.NewServer(fake)
+			defer opensds.Close()
+
+			cfg := config.NewDefault()
+			cfg.OpensdsEndpoint = opensds.URL
+			cfg.AttachTimeout = 5 * time.Second
+			if err := api.Init(cfg); err != nil {
+				t.Fatal(err)
+			}
+
+			cinder := httptest.NewServer(api.Middleware(beego.BeeApp.Handlers))
+			defer cinder.Close()
+
+			runner := &Runner{
+				BaseURL: cinder.URL,
+				Vars: map[string]string{
+					"project_id":      projectID,
+					"default_type_id": fake.DefaultProfileID(),
+				},
+			}
+			results, err := runner.Run(fixture)
+			all = append(all, results...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, result := range results {
+				if n := len(result.Gaps) - len(result.Unexpected); n > 0 {
+					t.Logf("%s: %d known gaps", result.Step, n)
+				}
+				for _, gap := range result.Unexpected {
+					t.Errorf("%s: unexpected gap %q: %s", result.Step, gap.Key(), gap.Detail)
+				}
+				for _, key := range result.Fixed {
+					t.Errorf("%s: known gap %q is fixed, remove it from the fixture", result.Step, key)
+				}
+			}
+		})
+	}
+
+	if *report != "" {
+		body, _ := json.MarshalIndent(all, "", "    ")
+		if err := ioutil.WriteFile(*report, body, 0644); err != nil {
+			t.Errorf("write report %s failed: %v", *report, err)
+		}
+	}
+}
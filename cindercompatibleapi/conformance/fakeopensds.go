@@ -0,0 +1,581 @@
+// Copyright (c) 2018 Huawei Technologies Co., Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+This module implements a fake OpenSDS REST server which keeps the profiles,
+volumes, snapshots and attachments in memory across calls.
+
+*/
+
+package conformance
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opensds/opensds/contrib/connector"
+	"github.com/opensds/opensds/pkg/model"
+	"github.com/opensds/opensds/pkg/utils/constants"
+	"github.com/satori/go.uuid"
+)
+
+const (
+	// DefaultProfileName is the name of the profile every fake server
+	// starts with, volumes created without a volume type use it.
+	DefaultProfileName = "default"
+
+	statusCreating  = "creating"
+	statusAvailable = "available"
+)
+
+// FakeOpenSDS serves the part of the OpenSDS REST api used by the cinder
+// compatible api. Like OpenSDS, it creates the resources asynchronously:
+// a new volume, snapshot or attachment is returned as creating and becomes
+// available the next time it is read.
+type FakeOpenSDS struct {
+	sync.Mutex
+	profiles    map[string]*model.ProfileSpec
+	volumes     map[string]*model.VolumeSpec
+	snapshots   map[string]*model.VolumeSnapshotSpec
+	attachments map[string]*model.VolumeAttachmentSpec
+
+	defaultProfileID string
+}
+
+// NewFakeOpenSDS creates a fake server holding only the default profile.
+func NewFakeOpenSDS() *FakeOpenSDS {
+	f := &FakeOpenSDS{
+		profiles:    make(map[string]*model.ProfileSpec),
+		volumes:     make(map[string]*model.VolumeSpec),
+		snapshots:   make(map[string]*model.VolumeSnapshotSpec),
+		attachments: make(map[string]*model.VolumeAttachmentSpec),
+	}
+
+	profile := &model.ProfileSpec{
+		BaseModel:        newBaseModel(),
+		Name:             DefaultProfileName,
+		Description:      "default policy",
+		StorageType:      "block",
+		CustomProperties: model.CustomPropertiesSpec{},
+	}
+	f.profiles[profile.Id] = profile
+	f.defaultProfileID = profile.Id
+
+	return f
+}
+
+// DefaultProfileID returns the id of the default profile.
+func (f *FakeOpenSDS) DefaultProfileID() string {
+	return f.defaultProfileID
+}
+
+// ServeHTTP implements http.Handler.
+func (f *FakeOpenSDS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	// The versions are listed at the root, the other urls look like
+	// /{apiVersion}/{tenantId}/{resource}[/{id}[/...]].
+	path := strings.Trim(r.URL.Path, "/")
+	if path == "" {
+		f.listVersions(w, r)
+		return
+	}
+
+	words := strings.Split(path, "/")
+	if len(words) < 3 || words[0] != constants.APIVersion {
+		writeError(w, model.ErrorNotFound, fmt.Sprintf("url %s is not supported", r.URL.Path))
+		return
+	}
+
+	resource, args := words[2], words[3:]
+	if resource == "block" && len(args) > 0 {
+		resource, args = "block/"+args[0], args[1:]
+	}
+
+	switch resource {
+	case "profiles":
+		f.serveProfiles(w, r, args)
+	case "block/volumes":
+		f.serveVolumes(w, r, args)
+	case "block/snapshots":
+		f.serveSnapshots(w, r, args)
+	case "block/attachments":
+		f.serveAttachments(w, r, args)
+	default:
+		writeError(w, model.ErrorNotFound, fmt.Sprintf("resource %s is not supported", resource))
+	}
+}
+
+func (f *FakeOpenSDS) listVersions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, r)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, []*model.VersionSpec{{
+		Name:      constants.APIVersion,
+		Status:    "CURRENT",
+		UpdatedAt: "2017-07-10T14:36:58.014Z",
+	}})
+}
+
+func (f *FakeOpenSDS) serveProfiles(w http.ResponseWriter, r *http.Request, args []string) {
+	switch {
+	case len(args) == 0 && r.Method == http.MethodPost:
+		profile := &model.ProfileSpec{}
+		if !readJSON(w, r, profile) {
+			return
+		}
+		profile.BaseModel = newBaseModel()
+		if profile.CustomProperties == nil {
+			profile.CustomProperties = model.CustomPropertiesSpec{}
+		}
+		f.profiles[profile.Id] = profile
+		writeJSON(w, http.StatusOK, profile)
+
+	case len(args) == 0 && r.Method == http.MethodGet:
+		var profiles []*model.ProfileSpec
+		for _, profile := range f.profiles {
+			profiles = append(profiles, profile)
+		}
+		writeJSON(w, http.StatusOK, profiles)
+
+	case len(args) >= 1:
+		profile, ok := f.profiles[args[0]]
+		if !ok {
+			writeError(w, model.ErrorNotFound, fmt.Sprintf("profile %s not found", args[0]))
+			return
+		}
+		if len(args) > 1 && args[1] == "customProperties" {
+			f.serveCustomProperties(w, r, profile, args[2:])
+			return
+		}
+		if len(args) > 1 {
+			writeError(w, model.ErrorNotFound, fmt.Sprintf("url %s is not supported", r.URL.Path))
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, profile)
+		case http.MethodPut:
+			update := &model.ProfileSpec{}
+			if !readJSON(w, r, update) {
+				return
+			}
+			if update.Name != "" {
+				profile.Name = update.Name
+			}
+			if update.Description != "" {
+				profile.Description = update.Description
+			}
+			profile.UpdatedAt = now()
+			writeJSON(w, http.StatusOK, profile)
+		case http.MethodDelete:
+			for _, volume := range f.volumes {
+				if volume.ProfileId == profile.Id {
+					writeError(w, model.ErrorBadRequest, fmt.Sprintf("profile %s is used by volume %s", profile.Id, volume.Id))
+					return
+				}
+			}
+			delete(f.profiles, profile.Id)
+			w.WriteHeader(http.StatusOK)
+		default:
+			writeMethodNotAllowed(w, r)
+		}
+
+	default:
+		writeMethodNotAllowed(w, r)
+	}
+}
+
+func (f *FakeOpenSDS) serveCustomProperties(w http.ResponseWriter, r *http.Request,
+	profile *model.ProfileSpec, args []string) {
+	switch {
+	case len(args) == 0 && r.Method == http.MethodPost:
+		props := model.CustomPropertiesSpec{}
+		if !readJSON(w, r, &props) {
+			return
+		}
+		for k, v := range props {
+			profile.CustomProperties[k] = v
+		}
+		profile.UpdatedAt = now()
+		writeJSON(w, http.StatusOK, profile.CustomProperties)
+
+	case len(args) == 0 && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, profile.CustomProperties)
+
+	case len(args) == 1 && r.Method == http.MethodDelete:
+		if _, ok := profile.CustomProperties[args[0]]; !ok {
+			writeError(w, model.ErrorNotFound, fmt.Sprintf("custom property %s not found", args[0]))
+			return
+		}
+		delete(profile.CustomProperties, args[0])
+		profile.UpdatedAt = now()
+		w.WriteHeader(http.StatusOK)
+
+	default:
+		writeMethodNotAllowed(w, r)
+	}
+}
+
+func (f *FakeOpenSDS) serveVolumes(w http.ResponseWriter, r *http.Request, args []string) {
+	switch {
+	case len(args) == 0 && r.Method == http.MethodPost:
+		volume := &model.VolumeSpec{}
+		if !readJSON(w, r, volume) {
+			return
+		}
+		if volume.Size <= 0 {
+			writeError(w, model.ErrorBadRequest, "volume size must be positive")
+			return
+		}
+		if volume.ProfileId == "" {
+			volume.ProfileId = f.defaultProfileID
+		}
+		if _, ok := f.profiles[volume.ProfileId]; !ok {
+			writeError(w, model.ErrorBadRequest, fmt.Sprintf("profile %s not found", volume.ProfileId))
+			return
+		}
+		if volume.AvailabilityZone == "" {
+			volume.AvailabilityZone = "default"
+		}
+		if volume.SnapshotId != "" && !f.checkRestore(w, volume.SnapshotId, volume.Size) {
+			return
+		}
+		volume.BaseModel = newBaseModel()
+		volume.Status = statusCreating
+		f.volumes[volume.Id] = volume
+		writeJSON(w, http.StatusAccepted, volume)
+
+	case len(args) == 0 && r.Method == http.MethodGet:
+		var volumes []*model.VolumeSpec
+		for _, volume := range f.volumes {
+			settle(&volume.Status)
+			volumes = append(volumes, volume)
+		}
+		writeJSON(w, http.StatusOK, volumes)
+
+	case len(args) == 1:
+		volume, ok := f.volumes[args[0]]
+		if !ok {
+			writeError(w, model.ErrorNotFound, fmt.Sprintf("volume %s not found", args[0]))
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			settle(&volume.Status)
+			writeJSON(w, http.StatusOK, volume)
+		case http.MethodPut:
+			update := &model.VolumeSpec{}
+			if !readJSON(w, r, update) {
+				return
+			}
+			if update.Name != "" {
+				volume.Name = update.Name
+			}
+			if update.Description != "" {
+				volume.Description = update.Description
+			}
+			volume.UpdatedAt = now()
+			writeJSON(w, http.StatusOK, volume)
+		case http.MethodDelete:
+			for _, snapshot := range f.snapshots {
+				if snapshot.VolumeId == volume.Id {
+					writeError(w, model.ErrorBadRequest, fmt.Sprintf("volume %s has snapshot %s", volume.Id, snapshot.Id))
+					return
+				}
+			}
+			delete(f.volumes, volume.Id)
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			writeMethodNotAllowed(w, r)
+		}
+
+	default:
+		writeMethodNotAllowed(w, r)
+	}
+}
+
+func (f *FakeOpenSDS) serveSnapshots(w http.ResponseWriter, r *http.Request, args []string) {
+	switch {
+	case len(args) == 0 && r.Method == http.MethodPost:
+		snapshot := &model.VolumeSnapshotSpec{}
+		if !readJSON(w, r, snapshot) {
+			return
+		}
+		volume, ok := f.volumes[snapshot.VolumeId]
+		if !ok {
+			writeError(w, model.ErrorBadRequest, fmt.Sprintf("volume %s not found", snapshot.VolumeId))
+			return
+		}
+		snapshot.BaseModel = newBaseModel()
+		snapshot.Size = volume.Size
+		snapshot.ProfileId = volume.ProfileId
+		snapshot.Status = statusCreating
+		f.snapshots[snapshot.Id] = snapshot
+		writeJSON(w, http.StatusAccepted, snapshot)
+
+	case len(args) == 0 && r.Method == http.MethodGet:
+		var snapshots []*model.VolumeSnapshotSpec
+		for _, snapshot := range f.snapshots {
+			settle(&snapshot.Status)
+			snapshots = append(snapshots, snapshot)
+		}
+		writeJSON(w, http.StatusOK, snapshots)
+
+	case len(args) == 1:
+		snapshot, ok := f.snapshots[args[0]]
+		if !ok {
+			writeError(w, model.ErrorNotFound, fmt.Sprintf("snapshot %s not found", args[0]))
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			settle(&snapshot.Status)
+			writeJSON(w, http.StatusOK, snapshot)
+		case http.MethodPut:
+			update := &model.VolumeSnapshotSpec{}
+			if !readJSON(w, r, update) {
+				return
+			}
+			if update.Name != "" {
+				snapshot.Name = update.Name
+			}
+			if update.Description != "" {
+				snapshot.Description = update.Description
+			}
+			snapshot.UpdatedAt = now()
+			writeJSON(w, http.StatusOK, snapshot)
+		case http.MethodDelete:
+			delete(f.snapshots, snapshot.Id)
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			writeMethodNotAllowed(w, r)
+		}
+
+	default:
+		writeMethodNotAllowed(w, r)
+	}
+}
+
+func (f *FakeOpenSDS) serveAttachments(w http.ResponseWriter, r *http.Request, args []string) {
+	switch {
+	case len(args) == 0 && r.Method == http.MethodPost:
+		attachment := &model.VolumeAttachmentSpec{}
+		if !readJSON(w, r, attachment) {
+			return
+		}
+		if _, ok := f.volumes[attachment.VolumeId]; !ok {
+			writeError(w, model.ErrorBadRequest, fmt.Sprintf("volume %s not found", attachment.VolumeId))
+			return
+		}
+		attachment.BaseModel = newBaseModel()
+		attachment.Status = statusCreating
+		attachment.AccessProtocol = "iscsi"
+		f.attachments[attachment.Id] = attachment
+		writeJSON(w, http.StatusAccepted, attachment)
+
+	case len(args) == 0 && r.Method == http.MethodGet:
+		var attachments []*model.VolumeAttachmentSpec
+		for _, attachment := range f.attachments {
+			settleAttachment(attachment)
+			attachments = append(attachments, attachment)
+		}
+		writeJSON(w, http.StatusOK, attachments)
+
+	case len(args) == 1:
+		attachment, ok := f.attachments[args[0]]
+		if !ok {
+			writeError(w, model.ErrorNotFound, fmt.Sprintf("attachment %s not found", args[0]))
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			settleAttachment(attachment)
+			writeJSON(w, http.StatusOK, attachment)
+		case http.MethodPut:
+			update := &model.VolumeAttachmentSpec{}
+			if !readJSON(w, r, update) {
+				return
+			}
+			if update.HostInfo != (model.HostInfo{}) {
+				attachment.HostInfo = update.HostInfo
+			}
+			if update.Mountpoint != "" {
+				attachment.Mountpoint = update.Mountpoint
+			}
+			attachment.UpdatedAt = now()
+			writeJSON(w, http.StatusOK, attachment)
+		case http.MethodDelete:
+			delete(f.attachments, attachment.Id)
+			w.WriteHeader(http.StatusOK)
+		default:
+			writeMethodNotAllowed(w, r)
+		}
+
+	default:
+		writeMethodNotAllowed(w, r)
+	}
+}
+
+// checkRestore checks that an available snapshot can be restored into a
+// volume of the given size.
+func (f *FakeOpenSDS) checkRestore(w http.ResponseWriter, snapshotID string, size int64) bool {
+	snapshot, ok := f.snapshots[snapshotID]
+	if !ok {
+		writeError(w, model.ErrorBadRequest, fmt.Sprintf("snapshot %s not found", snapshotID))
+		return false
+	}
+	settle(&snapshot.Status)
+	if snapshot.Status != statusAvailable {
+		writeError(w, model.ErrorBadRequest, fmt.Sprintf("snapshot %s is %s", snapshotID, snapshot.Status))
+		return false
+	}
+	if size < snapshot.Size {
+		writeError(w, model.ErrorBadRequest, fmt.Sprintf("size %d is smaller than snapshot %s", size, snapshotID))
+		return false
+	}
+	return true
+}
+
+// settle finishes the creation of a resource.
+func settle(status *string) {
+	if *status == statusCreating {
+		*status = statusAvailable
+	}
+}
+
+// settleAttachment finishes the creation of an attachment, which then
+// carries the iscsi connection information of the volume.
+func settleAttachment(attachment *model.VolumeAttachmentSpec) {
+	if attachment.Status != statusCreating {
+		return
+	}
+
+	attachment.Status = statusAvailable
+	attachment.ConnectionInfo = model.ConnectionInfo{
+		DriverVolumeType: "iscsi",
+		ConnectionData: map[string]interface{}{
+			"targetDiscovered": true,
+			"targetIQN":        "iqn.2017-10.io.opensds:" + attachment.VolumeId,
+			"targetPortal":     "127.0.0.1:3260",
+			"targetLun":        1,
+			"volumeId":         attachment.VolumeId,
+			"accessMode":       "rw",
+			"encrypted":        false,
+			"authMethod":       "",
+			"authUserName":     "",
+			"authPassword":     "",
+		},
+	}
+}
+
+// FakeConnector attaches the iscsi LUNs of the fake server as files of a
+// directory, one per target IQN, so that the data of a volume can be copied
+// on the host running the tests.
+type FakeConnector struct {
+	Dir string
+}
+
+// Attach implements connector.Connector.
+func (fc *FakeConnector) Attach(connData map[string]interface{}) (string, error) {
+	iqn, _ := connData["targetIQN"].(string)
+	if iqn == "" {
+		return "", fmt.Errorf("targetIQN is missing in the connection data")
+	}
+
+	device := filepath.Join(fc.Dir, strings.Replace(iqn, ":", "_", -1))
+	f, err := os.OpenFile(device, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", err
+	}
+	return device, f.Close()
+}
+
+// Detach implements connector.Connector, the files are kept.
+func (fc *FakeConnector) Detach(map[string]interface{}) error {
+	return nil
+}
+
+// GetInitiatorInfo implements connector.Connector.
+func (fc *FakeConnector) GetInitiatorInfo() (connector.InitiatorInfo, error) {
+	return connector.InitiatorInfo{
+		InitiatorData: map[string]interface{}{connector.Iqn: "iqn.1993-08.org.debian:01:conformance"},
+	}, nil
+}
+
+func newBaseModel() *model.BaseModel {
+	return &model.BaseModel{
+		Id:        uuid.NewV4().String(),
+		CreatedAt: now(),
+	}
+}
+
+func now() string {
+	return time.Now().Format(constants.TimeFormat)
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeError(w, model.ErrorBadRequest, fmt.Sprintf("parse request body failed: %v", err))
+		return false
+	}
+
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		writeError(w, model.ErrorInternalServer, fmt.Sprintf("marshal result failed: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(body)
+}
+
+func writeError(w http.ResponseWriter, code int, reason string) {
+	var body []byte
+	switch code {
+	case model.ErrorBadRequest:
+		body = model.ErrorBadRequestStatus(reason)
+	case model.ErrorNotFound:
+		body = model.ErrorNotFoundStatus(reason)
+	default:
+		body = model.ErrorInternalServerStatus(reason)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(body)
+}
+
+func writeMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusMethodNotAllowed)
+	fmt.Fprintf(w, "method %s is not allowed on %s", r.Method, r.URL.Path)
+}
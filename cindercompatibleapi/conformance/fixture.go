@@ -0,0 +1,565 @@
+// Copyright (c) 2018 Huawei Technologies Co., Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+This module implements the replay of the cinder fixtures, which are
+request and response pairs recorded against an upstream cinder, and the
+report of the field level differences with the responses of the cinder
+compatible api.
+
+*/
+
+package conformance
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kinds of gaps
+const (
+	// GapStatus means the status codes differ.
+	GapStatus = "status"
+	// GapMissing means a field returned by cinder is not returned.
+	GapMissing = "missing"
+	// GapExtra means a field not returned by cinder is returned.
+	GapExtra = "extra"
+	// GapType means a field has another json type than in cinder.
+	GapType = "type"
+	// GapValue means a checked field has an unexpected value.
+	GapValue = "value"
+	// GapEmpty means a list is empty while cinder returned elements.
+	GapEmpty = "empty"
+)
+
+// Fixture is a scenario recorded against an upstream cinder, the steps
+// are replayed in order.
+type Fixture struct {
+	Name  string  `json:"name"`
+	Steps []*Step `json:"steps"`
+}
+
+// Step is one request of a scenario and the response of cinder.
+type Step struct {
+	Name     string   `json:"name"`
+	Request  Request  `json:"request"`
+	Response Response `json:"response"`
+
+	// Check maps the fields, for example volume.size or volumes[0].id,
+	// to the values expected from the cinder compatible api. Most values
+	// of the recorded response, such as the ids and the times, can not be
+	// the same, so only the checked values are compared.
+	Check map[string]string `json:"check,omitempty"`
+
+	// Save maps the variables used by the following steps to the fields
+	// of the response holding their values.
+	Save map[string]string `json:"save,omitempty"`
+
+	// WaitFor repeats the request, as a client waiting for a status does,
+	// until the fields have the given values. The last response is the
+	// one compared.
+	WaitFor map[string]string `json:"waitFor,omitempty"`
+
+	// KnownGaps lists the gaps, in the form "field: kind", which are
+	// accepted for the time being.
+	KnownGaps []string `json:"knownGaps,omitempty"`
+}
+
+// Request is sent as it was by python-cinderclient. The variables, written
+// {name}, are replaced in the path and the body.
+type Request struct {
+	Method string          `json:"method"`
+	Path   string          `json:"path"`
+	Body   json.RawMessage `json:"body,omitempty"`
+}
+
+// Response is the response recorded from cinder.
+type Response struct {
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body,omitempty"`
+}
+
+// Gap is a difference with the response of cinder.
+type Gap struct {
+	Field  string `json:"field"`
+	Kind   string `json:"kind"`
+	Detail string `json:"detail"`
+}
+
+// Key identifies the gap in the known gaps of a step.
+func (g Gap) Key() string {
+	return g.Field + ": " + g.Kind
+}
+
+// StepResult is the outcome of a step.
+type StepResult struct {
+	Fixture string `json:"fixture"`
+	Step    string `json:"step"`
+	Gaps    []Gap  `json:"gaps,omitempty"`
+
+	// Unexpected lists the gaps which are not known.
+	Unexpected []Gap `json:"unexpected,omitempty"`
+	// Fixed lists the known gaps which are not found any more.
+	Fixed []string `json:"fixed,omitempty"`
+}
+
+// LoadFixtures reads the fixtures of a directory, one per json file,
+// sorted by file name.
+func LoadFixtures(dir string) ([]*Fixture, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	var fixtures []*Fixture
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("read fixture %s failed: %v", file, err)
+		}
+
+		fixture := &Fixture{}
+		if err := json.Unmarshal(data, fixture); err != nil {
+			return nil, fmt.Errorf("parse fixture %s failed: %v", file, err)
+		}
+		fixtures = append(fixtures, fixture)
+	}
+
+	return fixtures, nil
+}
+
+// Runner replays the fixtures against a cinder compatible api.
+type Runner struct {
+	// BaseURL is the root url of the service, without the api version.
+	BaseURL string
+	Client  *http.Client
+	// Vars holds the initial variables, such as project_id.
+	Vars map[string]string
+	// WaitTimeout bounds the repetitions of a step with WaitFor, it
+	// defaults to DefaultWaitTimeout.
+	WaitTimeout time.Duration
+}
+
+// DefaultWaitTimeout ...
+const DefaultWaitTimeout = 5 * time.Second
+
+// Run replays the steps of a fixture in order. An error is only returned
+// when the steps can not go on, the differences are reported in the
+// results.
+func (r *Runner) Run(fixture *Fixture) ([]*StepResult, error) {
+	vars := make(map[string]string)
+	for k, v := range r.Vars {
+		vars[k] = v
+	}
+
+	var results []*StepResult
+	for _, step := range fixture.Steps {
+		result, err := r.runStep(fixture.Name, step, vars)
+		if err != nil {
+			return results, fmt.Errorf("%s/%s: %v", fixture.Name, step.Name, err)
+		}
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+func (r *Runner) runStep(fixture string, step *Step, vars map[string]string) (*StepResult, error) {
+	status, rbody, err := r.send(step, vars)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := r.WaitTimeout
+	if timeout == 0 {
+		timeout = DefaultWaitTimeout
+	}
+	for start := time.Now(); !reached(rbody, step.WaitFor, vars); {
+		if time.Since(start) >= timeout {
+			return nil, fmt.Errorf("wait for %v timed out, the last response is %s", step.WaitFor, rbody)
+		}
+		time.Sleep(10 * time.Millisecond)
+		if status, rbody, err = r.send(step, vars); err != nil {
+			return nil, err
+		}
+	}
+
+	result := &StepResult{Fixture: fixture, Step: step.Name}
+	if status != step.Response.Status {
+		result.Gaps = append(result.Gaps, Gap{
+			Field:  "(status)",
+			Kind:   GapStatus,
+			Detail: fmt.Sprintf("cinder returns %d, got %d: %s", step.Response.Status, status, rbody),
+		})
+	}
+
+	// An error response is only compared by status, its body is free text.
+	var actual interface{}
+	if status < http.StatusBadRequest && len(bytes.TrimSpace(rbody)) > 0 {
+		if err := json.Unmarshal(rbody, &actual); err != nil {
+			return nil, fmt.Errorf("parse response body %q failed: %v", rbody, err)
+		}
+	}
+
+	if len(step.Response.Body) > 0 && step.Response.Status < http.StatusBadRequest &&
+		status < http.StatusBadRequest {
+		var recorded interface{}
+		if err := json.Unmarshal(step.Response.Body, &recorded); err != nil {
+			return nil, fmt.Errorf("parse recorded response body failed: %v", err)
+		}
+		result.Gaps = append(result.Gaps, Compare(recorded, actual)...)
+	}
+
+	for _, field := range sortedKeys(step.Check) {
+		want := expand(step.Check[field], vars)
+		got, ok := lookup(actual, field)
+		if !ok {
+			// Reported as missing unless the recorded body misses it too.
+			if _, recorded := lookupRaw(step.Response.Body, field); !recorded {
+				result.Gaps = append(result.Gaps, Gap{Field: field, Kind: GapMissing,
+					Detail: "checked field is not returned"})
+			}
+			continue
+		}
+		if got != want {
+			result.Gaps = append(result.Gaps, Gap{Field: field, Kind: GapValue,
+				Detail: fmt.Sprintf("expected %q, got %q", want, got)})
+		}
+	}
+
+	for _, name := range sortedKeys(step.Save) {
+		value, ok := lookup(actual, step.Save[name])
+		if !ok {
+			return nil, fmt.Errorf("field %s to save as %s is not in the response %s",
+				step.Save[name], name, rbody)
+		}
+		vars[name] = value
+	}
+
+	result.classify(step.KnownGaps)
+	return result, nil
+}
+
+// send sends the request of a step and returns the status and the body
+// of the response.
+func (r *Runner) send(step *Step, vars map[string]string) (int, []byte, error) {
+	var body io.Reader
+	if len(step.Request.Body) > 0 {
+		b, err := pythonJSON([]byte(expand(string(step.Request.Body), vars)))
+		if err != nil {
+			return 0, nil, fmt.Errorf("encode request body failed: %v", err)
+		}
+		body = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(step.Request.Method, r.BaseURL+expand(step.Request.Path, vars), body)
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", "python-cinderclient")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	rbody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return resp.StatusCode, rbody, nil
+}
+
+// reached tells whether the fields of a response have the waited values.
+func reached(rbody []byte, waitFor map[string]string, vars map[string]string) bool {
+	if len(waitFor) == 0 {
+		return true
+	}
+
+	var actual interface{}
+	if err := json.Unmarshal(rbody, &actual); err != nil {
+		return false
+	}
+	for field, want := range waitFor {
+		if got, ok := lookup(actual, field); !ok || got != expand(want, vars) {
+			return false
+		}
+	}
+	return true
+}
+
+// classify splits the gaps into the known and the unexpected ones, and
+// finds the known gaps which are fixed.
+func (result *StepResult) classify(knownGaps []string) {
+	known := make(map[string]bool)
+	for _, key := range knownGaps {
+		known[key] = true
+	}
+
+	found := make(map[string]bool)
+	for _, gap := range result.Gaps {
+		found[gap.Key()] = true
+		if !known[gap.Key()] {
+			result.Unexpected = append(result.Unexpected, gap)
+		}
+	}
+
+	for _, key := range knownGaps {
+		if !found[key] {
+			result.Fixed = append(result.Fixed, key)
+		}
+	}
+}
+
+// Compare walks the recorded cinder response and reports, field by field,
+// the differences of the actual response. The values themselves are not
+// compared, a null in the recorded response matches any json type. Lists
+// are compared by their first element.
+func Compare(recorded, actual interface{}) []Gap {
+	var gaps []Gap
+	compare("", recorded, actual, &gaps)
+	return gaps
+}
+
+func compare(field string, recorded, actual interface{}, gaps *[]Gap) {
+	if recorded == nil || actual == nil {
+		return
+	}
+
+	if jsonType(recorded) != jsonType(actual) {
+		*gaps = append(*gaps, Gap{
+			Field:  fieldName(field),
+			Kind:   GapType,
+			Detail: fmt.Sprintf("cinder returns %s, got %s", jsonType(recorded), jsonType(actual)),
+		})
+		return
+	}
+
+	switch rv := recorded.(type) {
+	case map[string]interface{}:
+		av := actual.(map[string]interface{})
+		for _, k := range sortedKeys(rv) {
+			child := join(field, k)
+			if _, ok := av[k]; !ok {
+				*gaps = append(*gaps, Gap{Field: child, Kind: GapMissing, Detail: "not returned"})
+				continue
+			}
+			compare(child, rv[k], av[k], gaps)
+		}
+		for _, k := range sortedKeys(av) {
+			if _, ok := rv[k]; !ok {
+				*gaps = append(*gaps, Gap{Field: join(field, k), Kind: GapExtra, Detail: "not returned by cinder"})
+			}
+		}
+
+	case []interface{}:
+		av := actual.([]interface{})
+		if len(rv) == 0 {
+			return
+		}
+		if len(av) == 0 {
+			*gaps = append(*gaps, Gap{Field: fieldName(field), Kind: GapEmpty,
+				Detail: fmt.Sprintf("cinder returns %d elements", len(rv))})
+			return
+		}
+		compare(field+"[]", rv[0], av[0], gaps)
+	}
+}
+
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func join(field, key string) string {
+	if field == "" {
+		return key
+	}
+	return field + "." + key
+}
+
+func fieldName(field string) string {
+	if field == "" {
+		return "(body)"
+	}
+	return field
+}
+
+var indexPattern = regexp.MustCompile(`^(.*)\[(\d+)\]$`)
+
+// lookup finds a field such as volumes[0].id and returns its value as a
+// string, strings are returned as they are and other values as json.
+func lookup(v interface{}, field string) (string, bool) {
+	for _, word := range strings.Split(field, ".") {
+		index := -1
+		if m := indexPattern.FindStringSubmatch(word); m != nil {
+			word = m[1]
+			index, _ = strconv.Atoi(m[2])
+		}
+
+		if word != "" {
+			obj, ok := v.(map[string]interface{})
+			if !ok {
+				return "", false
+			}
+			if v, ok = obj[word]; !ok {
+				return "", false
+			}
+		}
+
+		if index >= 0 {
+			list, ok := v.([]interface{})
+			if !ok || index >= len(list) {
+				return "", false
+			}
+			v = list[index]
+		}
+	}
+
+	if s, ok := v.(string); ok {
+		return s, true
+	}
+	b, _ := json.Marshal(v)
+	return string(b), true
+}
+
+func lookupRaw(raw json.RawMessage, field string) (string, bool) {
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return "", false
+	}
+	return lookup(v, field)
+}
+
+var varPattern = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+// expand replaces the known variables, the other braces are kept.
+func expand(s string, vars map[string]string) string {
+	return varPattern.ReplaceAllStringFunc(s, func(m string) string {
+		if v, ok := vars[m[1:len(m)-1]]; ok {
+			return v
+		}
+		return m
+	})
+}
+
+// pythonJSON encodes a json document the way json.dumps of python does by
+// default, the keys keep their order and the separators are ", " and ": ".
+// Some handlers compare the raw request body, so the requests must be sent
+// byte for byte as python-cinderclient sends them.
+func pythonJSON(data []byte) ([]byte, error) {
+	type frame struct {
+		object bool
+		n      int
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var buf bytes.Buffer
+	var stack []*frame
+	separate := func() {
+		if len(stack) == 0 {
+			return
+		}
+		top := stack[len(stack)-1]
+		switch {
+		case top.object && top.n%2 == 1:
+			buf.WriteString(": ")
+		case top.n > 0:
+			buf.WriteString(", ")
+		}
+		top.n++
+	}
+
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := tok.(type) {
+		case json.Delim:
+			if t == '{' || t == '[' {
+				separate()
+				stack = append(stack, &frame{object: t == '{'})
+			} else {
+				stack = stack[:len(stack)-1]
+			}
+			buf.WriteString(t.String())
+		default:
+			separate()
+			b, err := json.Marshal(t)
+			if err != nil {
+				return nil, err
+			}
+			buf.Write(b)
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch v := m.(type) {
+	case map[string]string:
+		for k := range v {
+			keys = append(keys, k)
+		}
+	case map[string]interface{}:
+		for k := range v {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2018 Huawei Technologies Co., Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conformance
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestCompare(t *testing.T) {
+	var recorded, actual interface{}
+	json.Unmarshal([]byte(`{"volume": {"id": "a", "bootable": "false",
+		"name": null, "links": [{"href": "h", "rel": "self"}], "attachments": []}}`), &recorded)
+	json.Unmarshal([]byte(`{"volume": {"id": "b", "bootable": false,
+		"name": "vol", "links": [], "host": "h"}}`), &actual)
+
+	expected := []Gap{
+		{Field: "volume.attachments", Kind: GapMissing, Detail: "not returned"},
+		{Field: "volume.bootable", Kind: GapType, Detail: "cinder returns string, got boolean"},
+		{Field: "volume.links", Kind: GapEmpty, Detail: "cinder returns 1 elements"},
+		{Field: "volume.host", Kind: GapExtra, Detail: "not returned by cinder"},
+	}
+	if gaps := Compare(recorded, actual); !reflect.DeepEqual(gaps, expected) {
+		t.Errorf("Expected %v, actual %v", expected, gaps)
+	}
+}
+
+func TestClassify(t *testing.T) {
+	result := &StepResult{Gaps: []Gap{
+		{Field: "volume.links", Kind: GapMissing},
+		{Field: "volume.bootable", Kind: GapType},
+	}}
+	result.classify([]string{"volume.links: missing", "volume.host: extra"})
+
+	expected := []Gap{{Field: "volume.bootable", Kind: GapType}}
+	if !reflect.DeepEqual(result.Unexpected, expected) {
+		t.Errorf("Expected %v, actual %v", expected, result.Unexpected)
+	}
+	if !reflect.DeepEqual(result.Fixed, []string{"volume.host: extra"}) {
+		t.Errorf("Expected %v, actual %v", []string{"volume.host: extra"}, result.Fixed)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	var v interface{}
+	json.Unmarshal([]byte(`{"volumes": [{"id": "a", "size": 1}], "ok": true}`), &v)
+
+	for field, expected := range map[string]string{
+		"volumes[0].id":   "a",
+		"volumes[0].size": "1",
+		"ok":              "true",
+	} {
+		if got, ok := lookup(v, field); !ok || got != expected {
+			t.Errorf("%s: expected %v, actual %v", field, expected, got)
+		}
+	}
+
+	if _, ok := lookup(v, "volumes[1].id"); ok {
+		t.Errorf("Expected volumes[1].id not to be found")
+	}
+}
+
+func TestPythonJSON(t *testing.T) {
+	body, err := pythonJSON([]byte(`{
+		"os-reserve": null
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != `{"os-reserve": null}` {
+		t.Errorf("Expected %v, actual %v", `{"os-reserve": null}`, string(body))
+	}
+
+	body, _ = pythonJSON([]byte(`{"volume": {"size": 1, "name": "v", "metadata": {}, "ids": [1, 2]}}`))
+	expected := `{"volume": {"size": 1, "name": "v", "metadata": {}, "ids": [1, 2]}}`
+	if string(body) != expected {
+		t.Errorf("Expected %v, actual %v", expected, string(body))
+	}
+}
+
+func TestExpand(t *testing.T) {
+	vars := map[string]string{"project_id": "p", "volume_id": "v"}
+	if s := expand("/v3/{project_id}/volumes/{volume_id}/{other}", vars); s != "/v3/p/volumes/v/{other}" {
+		t.Errorf("Expected %v, actual %v", "/v3/p/volumes/v/{other}", s)
+	}
+}
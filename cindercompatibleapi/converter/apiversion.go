@@ -43,7 +43,7 @@ type ListAllAPIVersions struct {
 // VersionLink ...
 type VersionLink struct {
 	Href string `json:"href"`
-	Type string `json:"type"`
+	Type string `json:"type,omitempty"`
 	Rel  string `json:"rel"`
 }
 
@@ -61,6 +61,7 @@ func ListAllAPIVersionsResp(versions []*model.VersionSpec) *ListAllAPIVersionsRe
 			cinderVersion.Updated = version.UpdatedAt
 			cinderVersion.MinVersion = "3.0"
 			cinderVersion.ID = "v3.0"
+			cinderVersion.Links = []VersionLink{{Href: Endpoint + "/", Rel: "self"}}
 
 			resp.Versions = append(resp.Versions, cinderVersion)
 
@@ -0,0 +1,250 @@
+// Copyright (c) 2018 Huawei Technologies Co., Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+This module implements the conversion between the cinder backups and the
+backups kept by the compatible api.
+
+*/
+
+package converter
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/opensds/nbp/cindercompatibleapi/backup"
+	"github.com/opensds/nbp/cindercompatibleapi/message"
+)
+
+// *******************Create a backup*******************
+
+// CreateBackupReqSpec ...
+type CreateBackupReqSpec struct {
+	Backup CreateReqBackup `json:"backup"`
+}
+
+// CreateReqBackup ...
+type CreateReqBackup struct {
+	VolumeID    string            `json:"volume_id"`
+	Container   string            `json:"container,omitempty"`
+	Name        string            `json:"name,omitempty"`
+	Description string            `json:"description,omitempty"`
+	Incremental bool              `json:"incremental,omitempty"`
+	Force       bool              `json:"force,omitempty"`
+	SnapshotID  string            `json:"snapshot_id,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+}
+
+// CreateBackupRespSpec ...
+type CreateBackupRespSpec struct {
+	Backup ListRespBackup `json:"backup"`
+}
+
+// CreateBackupReq converts the request, the container defaults to the
+// given one. Force is accepted because the backup is made from a snapshot,
+// which does not need the volume to be detached.
+func CreateBackupReq(cinderReq *CreateBackupReqSpec, projectID, defaultContainer string) (*backup.Backup, error) {
+	if "" == cinderReq.Backup.VolumeID {
+		return nil, errors.New("volume_id is required")
+	}
+
+	if ("" != cinderReq.Backup.SnapshotID) || (0 != len(cinderReq.Backup.Metadata)) {
+		return nil, errors.New("OpenSDS does not support the parameter: snapshot_id/metadata")
+	}
+
+	b := backup.Backup{}
+	b.ProjectID = projectID
+	b.VolumeID = cinderReq.Backup.VolumeID
+	b.Name = cinderReq.Backup.Name
+	b.Description = cinderReq.Backup.Description
+	b.Container = cinderReq.Backup.Container
+	if "" == b.Container {
+		b.Container = defaultContainer
+	}
+
+	return &b, nil
+}
+
+// CreateBackupResp ...
+func CreateBackupResp(b *backup.Backup) *CreateBackupRespSpec {
+	return &CreateBackupRespSpec{Backup: *listBackupResp(b)}
+}
+
+// *******************List backups*******************
+
+// ListBackupsRespSpec ...
+type ListBackupsRespSpec struct {
+	Backups []ListRespBackup `json:"backups"`
+}
+
+// ListRespBackup ...
+type ListRespBackup struct {
+	ID    string `json:"id"`
+	Links []Link `json:"links"`
+	Name  string `json:"name"`
+}
+
+// ListBackupsResp ...
+func ListBackupsResp(backups []*backup.Backup) *ListBackupsRespSpec {
+	var resp ListBackupsRespSpec
+
+	if 0 == len(backups) {
+		resp.Backups = make([]ListRespBackup, 0, 0)
+	} else {
+		for _, b := range backups {
+			resp.Backups = append(resp.Backups, *listBackupResp(b))
+		}
+	}
+
+	return &resp
+}
+
+func listBackupResp(b *backup.Backup) *ListRespBackup {
+	return &ListRespBackup{
+		ID:    b.ID,
+		Links: backupLinks(b),
+		Name:  b.Name,
+	}
+}
+
+// *******************List backups with details*******************
+
+// ListBackupsDetailsRespSpec ...
+type ListBackupsDetailsRespSpec struct {
+	Backups []RespBackupDetails `json:"backups"`
+}
+
+// RespBackupDetails ...
+type RespBackupDetails struct {
+	AvailabilityZone    string `json:"availability_zone"`
+	Container           string `json:"container"`
+	CreatedAt           string `json:"created_at"`
+	DataTimestamp       string `json:"data_timestamp"`
+	Description         string `json:"description"`
+	FailReason          string `json:"fail_reason"`
+	HasDependentBackups bool   `json:"has_dependent_backups"`
+	ID                  string `json:"id"`
+	IsIncremental       bool   `json:"is_incremental"`
+	Links               []Link `json:"links"`
+	Name                string `json:"name"`
+	ObjectCount         int64  `json:"object_count"`
+	Size                int64  `json:"size"`
+	SnapshotID          string `json:"snapshot_id"`
+	Status              string `json:"status"`
+	UpdatedAt           string `json:"updated_at"`
+	VolumeID            string `json:"volume_id"`
+}
+
+// ListBackupsDetailsResp ...
+func ListBackupsDetailsResp(backups []*backup.Backup) *ListBackupsDetailsRespSpec {
+	var resp ListBackupsDetailsRespSpec
+
+	if 0 == len(backups) {
+		resp.Backups = make([]RespBackupDetails, 0, 0)
+	} else {
+		for _, b := range backups {
+			resp.Backups = append(resp.Backups, *backupDetailsResp(b))
+		}
+	}
+
+	return &resp
+}
+
+// *******************Show backup details*******************
+
+// ShowBackupRespSpec ...
+type ShowBackupRespSpec struct {
+	Backup RespBackupDetails `json:"backup"`
+}
+
+// ShowBackupResp ...
+func ShowBackupResp(b *backup.Backup) *ShowBackupRespSpec {
+	return &ShowBackupRespSpec{Backup: *backupDetailsResp(b)}
+}
+
+// The snapshot_id of a cinder backup is the snapshot the backup was made
+// from at the request of the user, the snapshot used internally is not
+// reported.
+func backupDetailsResp(b *backup.Backup) *RespBackupDetails {
+	return &RespBackupDetails{
+		AvailabilityZone:    b.AvailabilityZone,
+		Container:           b.Container,
+		CreatedAt:           formatBackupTime(b.CreatedAt),
+		DataTimestamp:       formatBackupTime(b.DataTimestamp),
+		Description:         b.Description,
+		FailReason:          b.FailReason,
+		HasDependentBackups: b.HasDependentBackups,
+		ID:                  b.ID,
+		IsIncremental:       b.IsIncremental(),
+		Links:               backupLinks(b),
+		Name:                b.Name,
+		ObjectCount:         b.ObjectCount,
+		Size:                b.Size,
+		Status:              b.Status,
+		UpdatedAt:           formatBackupTime(b.UpdatedAt),
+		VolumeID:            b.VolumeID,
+	}
+}
+
+// *******************Restore a backup*******************
+
+// RestoreBackupReqSpec ...
+type RestoreBackupReqSpec struct {
+	Restore RestoreReqBackup `json:"restore"`
+}
+
+// RestoreReqBackup ...
+type RestoreReqBackup struct {
+	VolumeID string `json:"volume_id,omitempty"`
+	Name     string `json:"name,omitempty"`
+}
+
+// RestoreBackupRespSpec ...
+type RestoreBackupRespSpec struct {
+	Restore RestoreRespBackup `json:"restore"`
+}
+
+// RestoreRespBackup ...
+type RestoreRespBackup struct {
+	BackupID   string `json:"backup_id"`
+	VolumeID   string `json:"volume_id"`
+	VolumeName string `json:"volume_name"`
+}
+
+// RestoreBackupResp ...
+func RestoreBackupResp(backupID, volumeID, volumeName string) *RestoreBackupRespSpec {
+	resp := RestoreBackupRespSpec{}
+	resp.Restore.BackupID = backupID
+	resp.Restore.VolumeID = volumeID
+	resp.Restore.VolumeName = volumeName
+
+	return &resp
+}
+
+func backupLinks(b *backup.Backup) []Link {
+	path := "/" + b.ProjectID + "/backups/" + b.ID
+	return []Link{
+		{Href: Endpoint + path, Rel: "self"},
+		{Href: strings.TrimSuffix(Endpoint, "/"+APIVersion) + path, Rel: "bookmark"},
+	}
+}
+
+func formatBackupTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(message.TimeFormat)
+}
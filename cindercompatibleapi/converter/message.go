@@ -0,0 +1,85 @@
+// Copyright (c) 2018 Huawei Technologies Co., Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+This module implements a entry into the OpenSDS northbound service.
+*/
+
+package converter
+
+import (
+	"github.com/opensds/nbp/cindercompatibleapi/message"
+)
+
+// RespMessage ...
+type RespMessage struct {
+	RequestID       string `json:"request_id"`
+	Links           []Link `json:"links,omitempty"`
+	MessageLevel    string `json:"message_level"`
+	EventID         string `json:"event_id"`
+	CreatedAt       string `json:"created_at"`
+	GuaranteedUntil string `json:"guaranteed_until"`
+	ResourceUUID    string `json:"resource_uuid"`
+	ID              string `json:"id"`
+	ResourceType    string `json:"resource_type"`
+	UserMessage     string `json:"user_message"`
+}
+
+// *******************List messages*******************
+
+// ListMessagesRespSpec ...
+type ListMessagesRespSpec struct {
+	Messages []RespMessage `json:"messages"`
+}
+
+// ListMessagesResp ...
+func ListMessagesResp(msgs []*message.Message) *ListMessagesRespSpec {
+	var resp ListMessagesRespSpec
+
+	if 0 == len(msgs) {
+		resp.Messages = make([]RespMessage, 0, 0)
+	} else {
+		for _, msg := range msgs {
+			resp.Messages = append(resp.Messages, *messageResp(msg))
+		}
+	}
+
+	return &resp
+}
+
+// *******************Show message details*******************
+
+// ShowMessageRespSpec ...
+type ShowMessageRespSpec struct {
+	Message RespMessage `json:"message"`
+}
+
+// ShowMessageResp ...
+func ShowMessageResp(msg *message.Message) *ShowMessageRespSpec {
+	return &ShowMessageRespSpec{Message: *messageResp(msg)}
+}
+
+func messageResp(msg *message.Message) *RespMessage {
+	return &RespMessage{
+		RequestID:       msg.RequestID,
+		MessageLevel:    msg.MessageLevel,
+		EventID:         msg.EventID,
+		CreatedAt:       msg.CreatedAt.UTC().Format(message.TimeFormat),
+		GuaranteedUntil: msg.GuaranteedUntil.UTC().Format(message.TimeFormat),
+		ResourceUUID:    msg.ResourceUUID,
+		ID:              msg.ID,
+		ResourceType:    msg.ResourceType,
+		UserMessage:     msg.UserMessage,
+	}
+}
@@ -20,6 +20,7 @@ package converter
 
 import (
 	"errors"
+	"sort"
 
 	"github.com/opensds/opensds/pkg/model"
 )
@@ -384,6 +385,49 @@ func UpdateVolumeResp(volume *model.VolumeSpec) *UpdateVolumeRespSpec {
 	return &resp
 }
 
+// *******************Volume summary*******************
+
+// VolumeSummaryRespSpec ...
+type VolumeSummaryRespSpec struct {
+	VolumeSummary VolumeSummary `json:"volume-summary"`
+}
+
+// VolumeSummary ...
+type VolumeSummary struct {
+	TotalSize  int64               `json:"total_size"`
+	TotalCount int64               `json:"total_count"`
+	Metadata   map[string][]string `json:"metadata"`
+}
+
+// VolumeSummaryResp ...
+func VolumeSummaryResp(volumes []*model.VolumeSpec) *VolumeSummaryRespSpec {
+	resp := VolumeSummaryRespSpec{}
+	resp.VolumeSummary.Metadata = make(map[string][]string)
+	values := make(map[string]map[string]bool)
+
+	for _, volume := range volumes {
+		resp.VolumeSummary.TotalCount++
+		resp.VolumeSummary.TotalSize += volume.Size
+
+		for k, v := range volume.Metadata {
+			if nil == values[k] {
+				values[k] = make(map[string]bool)
+			}
+			values[k][v] = true
+		}
+	}
+
+	// Every key lists its distinct values once, in a stable order.
+	for k, vs := range values {
+		for v := range vs {
+			resp.VolumeSummary.Metadata[k] = append(resp.VolumeSummary.Metadata[k], v)
+		}
+		sort.Strings(resp.VolumeSummary.Metadata[k])
+	}
+
+	return &resp
+}
+
 // *******************Volume actions*******************
 
 // InitializeConnectionReqSpec ...
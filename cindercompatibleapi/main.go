@@ -23,23 +23,41 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strconv"
 	"time"
 
+	log "github.com/golang/glog"
 	"github.com/opensds/nbp/cindercompatibleapi/api"
+	"github.com/opensds/nbp/cindercompatibleapi/config"
+	_ "github.com/opensds/opensds/contrib/connector/fc"
+	_ "github.com/opensds/opensds/contrib/connector/iscsi"
+	_ "github.com/opensds/opensds/contrib/connector/rbd"
 	"github.com/opensds/opensds/pkg/utils/logs"
 )
 
 func main() {
-	flag.Parse()
+	cfg, err := config.Parse(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: invalid configuration: %v\n", err)
+		os.Exit(2)
+	}
+
+	// An explicit -v wins over the configured log level.
+	verbositySet := false
+	flag.Visit(func(f *flag.Flag) {
+		if "v" == f.Name {
+			verbositySet = true
+		}
+	})
+	if !verbositySet {
+		flag.Set("v", strconv.Itoa(cfg.LogLevel))
+	}
 	logs.InitLogs(5 * time.Second)
 	defer logs.FlushLogs()
 
-	cinderEndpoint, ok := os.LookupEnv("CINDER_ENDPOINT")
-	if !ok {
-		fmt.Println("ERROR: You must provide the cinder endpoint by setting " +
-			"the environment variable CINDER_ENDPOINT")
-		return
+	if err := api.Run(cfg); err != nil {
+		log.Error(err)
+		logs.FlushLogs()
+		os.Exit(1)
 	}
-
-	api.Run(cinderEndpoint)
 }
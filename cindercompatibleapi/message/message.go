@@ -0,0 +1,220 @@
+// Copyright (c) 2018 Huawei Technologies Co., Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+This module implements the user messages which explain asynchronous
+failures to cinder clients.
+
+*/
+
+package message
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+const (
+	// DefaultTTL is the time a message is guaranteed to be kept,
+	// the same as the default message_ttl of cinder.
+	DefaultTTL = 30 * 24 * time.Hour
+
+	// LevelError is the only message level cinder reports.
+	LevelError = "ERROR"
+
+	// TimeFormat is the time format used in cinder responses.
+	TimeFormat = "2006-01-02T15:04:05.000000"
+)
+
+// Resource types
+const (
+	ResourceVolume         = "VOLUME"
+	ResourceVolumeSnapshot = "VOLUME_SNAPSHOT"
+	ResourceVolumeBackup   = "VOLUME_BACKUP"
+)
+
+// Field is an id and its description, as defined in cinder message_field.
+type Field struct {
+	ID          string
+	Description string
+}
+
+// Actions
+var (
+	ActionScheduleAllocateVolume = Field{"001", "schedule allocate volume"}
+	ActionAttachVolume           = Field{"002", "attach volume"}
+	ActionExtendVolume           = Field{"007", "extend volume"}
+	ActionSnapshotCreate         = Field{"009", "create snapshot"}
+	ActionSnapshotDelete         = Field{"010", "delete snapshot"}
+	ActionBackupCreate           = Field{"013", "create backup"}
+	ActionBackupDelete           = Field{"014", "delete backup"}
+	ActionBackupRestore          = Field{"015", "restore backup"}
+	ActionVolumeDelete           = Field{"018", "delete volume"}
+)
+
+// Details
+var (
+	DetailUnknownError         = Field{"001", "An unknown error occurred."}
+	DetailDriverNotInitialized = Field{"002", "Driver is not initialized at present."}
+	DetailNoBackendAvailable   = Field{"003", "Could not find any available weighted backend."}
+	// Cinder has no detail for an attachment timeout, it is reported as an
+	// unknown error with its own text.
+	DetailAttachTimeout = Field{"001", "The attachment did not become available in time."}
+)
+
+// Message describes a user message.
+type Message struct {
+	ID              string
+	ProjectID       string
+	RequestID       string
+	ResourceType    string
+	ResourceUUID    string
+	EventID         string
+	MessageLevel    string
+	UserMessage     string
+	CreatedAt       time.Time
+	GuaranteedUntil time.Time
+}
+
+// EventID builds the event id of a message in the format used by cinder,
+// for example VOLUME_VOLUME_002_001.
+func EventID(resourceType string, action, detail Field) string {
+	return fmt.Sprintf("VOLUME_%s_%s_%s", resourceType, action.ID, detail.ID)
+}
+
+// UserMessage builds the human readable message of an event.
+func UserMessage(action, detail Field) string {
+	return fmt.Sprintf("%s: %s", action.Description, detail.Description)
+}
+
+// Store keeps the user messages in memory until they expire.
+type Store struct {
+	sync.Mutex
+	ttl      time.Duration
+	messages map[string]*Message
+	now      func() time.Time
+}
+
+// NewStore creates a store which keeps messages for ttl.
+func NewStore(ttl time.Duration) *Store {
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+
+	return &Store{
+		ttl:      ttl,
+		messages: make(map[string]*Message),
+		now:      time.Now,
+	}
+}
+
+// Create records a message for a failed action on a resource.
+func (s *Store) Create(projectID, requestID, resourceType, resourceUUID string,
+	action, detail Field) *Message {
+	s.Lock()
+	defer s.Unlock()
+
+	now := s.now()
+	msg := &Message{
+		ID:              uuid.NewV4().String(),
+		ProjectID:       projectID,
+		RequestID:       requestID,
+		ResourceType:    resourceType,
+		ResourceUUID:    resourceUUID,
+		EventID:         EventID(resourceType, action, detail),
+		MessageLevel:    LevelError,
+		UserMessage:     UserMessage(action, detail),
+		CreatedAt:       now,
+		GuaranteedUntil: now.Add(s.ttl),
+	}
+	s.messages[msg.ID] = msg
+
+	return msg
+}
+
+// Get returns the message with the given id. Expired messages are
+// not returned.
+func (s *Store) Get(projectID, id string) (*Message, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.cleanupLocked()
+	msg, ok := s.messages[id]
+	if !ok || !matchProject(msg, projectID) {
+		return nil, fmt.Errorf("message %s could not be found", id)
+	}
+
+	return msg, nil
+}
+
+// List returns all messages of a project, oldest first.
+func (s *Store) List(projectID string) []*Message {
+	s.Lock()
+	defer s.Unlock()
+
+	s.cleanupLocked()
+	var msgs []*Message
+	for _, msg := range s.messages {
+		if matchProject(msg, projectID) {
+			msgs = append(msgs, msg)
+		}
+	}
+
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].CreatedAt.Before(msgs[j].CreatedAt)
+	})
+
+	return msgs
+}
+
+// Delete removes the message with the given id.
+func (s *Store) Delete(projectID, id string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	msg, ok := s.messages[id]
+	if !ok || !matchProject(msg, projectID) {
+		return fmt.Errorf("message %s could not be found", id)
+	}
+	delete(s.messages, id)
+
+	return nil
+}
+
+// Cleanup removes the expired messages.
+func (s *Store) Cleanup() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.cleanupLocked()
+}
+
+func (s *Store) cleanupLocked() {
+	now := s.now()
+	for id, msg := range s.messages {
+		if now.After(msg.GuaranteedUntil) {
+			delete(s.messages, id)
+		}
+	}
+}
+
+// An empty project id matches every message, that is the case when the
+// request url does not carry a project id.
+func matchProject(msg *Message, projectID string) bool {
+	return "" == projectID || "" == msg.ProjectID || msg.ProjectID == projectID
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2018 Huawei Technologies Co., Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package message
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	store := NewStore(DefaultTTL)
+	msg := store.Create("project-a", "req-1", ResourceVolume,
+		"bd5b12a8-a101-11e7-941e-d77981b584d8", ActionAttachVolume,
+		DetailAttachTimeout)
+
+	if msg.EventID != "VOLUME_VOLUME_002_001" {
+		t.Errorf("Expected %v, actual %v", "VOLUME_VOLUME_002_001", msg.EventID)
+	}
+
+	if _, err := store.Get("project-b", msg.ID); err == nil {
+		t.Errorf("Expected message %v to be hidden from another project", msg.ID)
+	}
+
+	if msgs := store.List("project-a"); len(msgs) != 1 || msgs[0] != msg {
+		t.Errorf("Expected [%v], actual %v", msg, msgs)
+	}
+
+	if err := store.Delete("project-a", msg.ID); err != nil {
+		t.Errorf("Expected no error, actual %v", err)
+	}
+
+	if err := store.Delete("project-a", msg.ID); err == nil {
+		t.Errorf("Expected an error when deleting message %v twice", msg.ID)
+	}
+}
+
+func TestStoreExpiry(t *testing.T) {
+	store := NewStore(time.Hour)
+	now := time.Now()
+	store.now = func() time.Time { return now }
+
+	msg := store.Create("", "", ResourceVolume,
+		"bd5b12a8-a101-11e7-941e-d77981b584d8", ActionAttachVolume,
+		DetailAttachTimeout)
+
+	now = now.Add(2 * time.Hour)
+	if _, err := store.Get("", msg.ID); err == nil {
+		t.Errorf("Expected expired message %v to be removed", msg.ID)
+	}
+
+	if msgs := store.List(""); len(msgs) != 0 {
+		t.Errorf("Expected no messages, actual %v", msgs)
+	}
+}
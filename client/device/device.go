@@ -0,0 +1,357 @@
+// Copyright (c) 2018 Huawei Technologies Co., Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package device resolves the block device of an attached volume through the
+// stable links of /dev/disk. The /dev/sdX name a volume is attached as may be
+// another disk after a reboot, the links by id and by path are not.
+package device
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/opensds/opensds/contrib/connector"
+)
+
+var (
+	// DiskByIdDir the links of the disks by WWN and serial
+	DiskByIdDir = "/dev/disk/by-id"
+	// DiskByPathDir the links of the disks by the path they are attached by
+	DiskByPathDir = "/dev/disk/by-path"
+
+	// ReadIdentity reads the identity of a device
+	ReadIdentity = readIdentity
+
+	// ErrNotFound the device of a volume is not attached
+	ErrNotFound = errors.New("the device is not found")
+)
+
+// Connection data keys of the identity of a LUN
+var (
+	wwnKeys    = []string{"wwn", "lunWwn"}
+	serialKeys = []string{"serial", "serialNumber"}
+)
+
+// Identity the identity of a LUN, a field is empty if it is not known
+type Identity struct {
+	WWN    string
+	Serial string
+}
+
+// IdentityOf returns the identity of the LUN of the connection data
+func IdentityOf(connData map[string]interface{}) Identity {
+	return Identity{
+		WWN:    normalizeWWN(lookupString(connData, wwnKeys)),
+		Serial: strings.TrimSpace(lookupString(connData, serialKeys)),
+	}
+}
+
+// IsEmpty checks if nothing of the identity is known
+func (id Identity) IsEmpty() bool {
+	return "" == id.WWN && "" == id.Serial
+}
+
+// Matches checks if the identity of a device is id, every field known by
+// both of them must be the same and one of them at least
+func (id Identity) Matches(actual Identity) bool {
+	compared := false
+
+	if "" != id.WWN && "" != actual.WWN {
+		if normalizeWWN(id.WWN) != normalizeWWN(actual.WWN) {
+			return false
+		}
+		compared = true
+	}
+
+	if "" != id.Serial && "" != actual.Serial {
+		if id.Serial != actual.Serial {
+			return false
+		}
+		compared = true
+	}
+
+	return compared
+}
+
+func (id Identity) String() string {
+	return fmt.Sprintf("wwn %q, serial %q", id.WWN, id.Serial)
+}
+
+// Resolve returns a stable link to the device of a volume attached with the
+// connection data. A LUN of a known identity is found by id, a LUN of an
+// iSCSI or FC target by path, the device the connector attached is used as
+// it is otherwise.
+func Resolve(driverVolumeType string, connData map[string]interface{}, device string) (string, error) {
+	if id := IdentityOf(connData); !id.IsEmpty() {
+		return findById(id)
+	}
+
+	var patterns []string
+	for _, pathData := range PathConnectionData(driverVolumeType, connData) {
+		patterns = append(patterns, byPathPatterns(driverVolumeType, pathData)...)
+	}
+
+	if len(patterns) > 0 {
+		return findByPath(patterns)
+	}
+
+	if "" == device || "-" == device {
+		return "", ErrNotFound
+	}
+
+	return device, nil
+}
+
+// Verify checks if a device is the LUN of the identity, a device of an
+// unknown identity can not be checked
+func Verify(device string, id Identity) error {
+	if id.IsEmpty() {
+		return nil
+	}
+
+	actual, err := ReadIdentity(Canonical(device))
+	if err != nil {
+		return fmt.Errorf("failed to read the identity of %s: %v", device, err)
+	}
+
+	if !id.Matches(actual) {
+		return fmt.Errorf("%s is %v instead of %v", device, actual, id)
+	}
+
+	return nil
+}
+
+// Canonical returns the device node a link points to, a path which can not
+// be resolved is only cleaned
+func Canonical(path string) string {
+	if realPath, err := filepath.EvalSymlinks(path); err == nil {
+		return realPath
+	}
+
+	return filepath.Clean(path)
+}
+
+// IsSameDevice checks if two paths are the same device node
+func IsSameDevice(a string, b string) bool {
+	if "" == a || "" == b {
+		return false
+	}
+
+	return a == b || Canonical(a) == Canonical(b)
+}
+
+// findById finds the link of the device of a LUN by id, a link is only taken
+// once the device it points to is verified
+func findById(id Identity) (string, error) {
+	entries, err := ioutil.ReadDir(DiskByIdDir)
+	if os.IsNotExist(err) {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.Contains(name, "-part") || !isIdLinkOf(name, id) {
+			continue
+		}
+
+		link := filepath.Join(DiskByIdDir, name)
+		if err := Verify(link, id); err != nil {
+			continue
+		}
+
+		return link, nil
+	}
+
+	return "", ErrNotFound
+}
+
+// isIdLinkOf checks if a link of /dev/disk/by-id is named after the identity
+func isIdLinkOf(name string, id Identity) bool {
+	if "" != id.WWN {
+		if name == "wwn-0x"+id.WWN || name == "scsi-3"+id.WWN {
+			return true
+		}
+	}
+
+	if "" != id.Serial {
+		if strings.HasSuffix(name, "_"+id.Serial) || strings.HasSuffix(name, "-"+id.Serial) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// byPathPatterns the patterns of the links of /dev/disk/by-path to the LUN of
+// an iSCSI or FC target
+func byPathPatterns(driverVolumeType string, connData map[string]interface{}) []string {
+	switch driverVolumeType {
+	case connector.IscsiDriver:
+		portal := lookupString(connData, []string{"targetPortal"})
+		iqn := lookupString(connData, []string{"targetIqn"})
+		lun, ok := lookupInt(connData, "targetLun")
+		if "" == portal || "" == iqn || !ok {
+			return nil
+		}
+
+		return []string{fmt.Sprintf("ip-%s-iscsi-%s-lun-%d", portal, iqn, lun)}
+	case connector.FcDriver:
+		lun, ok := lookupInt(connData, "target_lun")
+		if !ok {
+			return nil
+		}
+
+		var patterns []string
+		for _, wwn := range lookupStrings(connData, "target_wwn") {
+			patterns = append(patterns, fmt.Sprintf("*-fc-0x%s-lun-%d", normalizeWWN(wwn), lun))
+		}
+		return patterns
+	default:
+		return nil
+	}
+}
+
+// findByPath finds the first link of /dev/disk/by-path matching a pattern
+func findByPath(patterns []string) (string, error) {
+	links, err := globLinks(DiskByPathDir, patterns)
+	if err != nil {
+		return "", err
+	}
+
+	if 0 == len(links) {
+		return "", ErrNotFound
+	}
+
+	return links[0], nil
+}
+
+// globLinks returns the links of a directory matching the patterns which
+// point to an existing device
+func globLinks(dir string, patterns []string) ([]string, error) {
+	var links []string
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, link := range matches {
+			if _, err := os.Stat(link); err == nil {
+				links = append(links, link)
+			}
+		}
+	}
+
+	return links, nil
+}
+
+// readIdentity reads the identity of a device with lsblk
+func readIdentity(device string) (Identity, error) {
+	out, err := exec.Command("lsblk", "-d", "-n", "-P", "-o", "WWN,SERIAL", device).CombinedOutput()
+	if err != nil {
+		return Identity{}, fmt.Errorf("lsblk %s failed: %v, %s", device, err, strings.TrimSpace(string(out)))
+	}
+
+	return parseLsblkPairs(string(out)), nil
+}
+
+// parseLsblkPairs parses the KEY="value" pairs lsblk prints for a device
+func parseLsblkPairs(out string) Identity {
+	var id Identity
+	for _, field := range strings.Fields(out) {
+		kv := strings.SplitN(field, "=", 2)
+		if 2 != len(kv) {
+			continue
+		}
+
+		value := strings.Trim(kv[1], `"`)
+		switch kv[0] {
+		case "WWN":
+			id.WWN = normalizeWWN(value)
+		case "SERIAL":
+			id.Serial = value
+		}
+	}
+
+	return id
+}
+
+// normalizeWWN the hex digits of a WWN in lower case, e.g. 6005076... for
+// 0x6005076..., naa.6005076... or 60:05:07:6...
+func normalizeWWN(wwn string) string {
+	wwn = strings.ToLower(strings.TrimSpace(wwn))
+	wwn = strings.TrimPrefix(wwn, "0x")
+	wwn = strings.TrimPrefix(wwn, "naa.")
+	return strings.NewReplacer(":", "", "-", "").Replace(wwn)
+}
+
+// lookupString returns the first of the keys which is a string of the
+// connection data
+func lookupString(connData map[string]interface{}, keys []string) string {
+	for _, key := range keys {
+		if s, ok := connData[key].(string); ok && "" != s {
+			return s
+		}
+	}
+
+	return ""
+}
+
+// lookupStrings returns a string or the strings of a list of the connection
+// data
+func lookupStrings(connData map[string]interface{}, key string) []string {
+	switch v := connData[key].(type) {
+	case string:
+		return []string{v}
+	case []string:
+		return v
+	case []interface{}:
+		var list []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	default:
+		return nil
+	}
+}
+
+// lookupInt returns a number of the connection data, which JSON decodes as
+// a float64
+func lookupInt(connData map[string]interface{}, key string) (int, bool) {
+	switch v := connData[key].(type) {
+	case int:
+		return v, true
+	case int64:
+		return int(v), true
+	case float64:
+		return int(v), true
+	case string:
+		i, err := strconv.Atoi(v)
+		return i, err == nil
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,220 @@
+// Copyright (c) 2018 Huawei Technologies Co., Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// fakeDisks makes a /dev of fake devices and the links to them by id and by
+// path, and reads the identities of the devices from memory
+func fakeDisks(t *testing.T, identities map[string]Identity, links map[string]string) (string, func()) {
+	dir, err := ioutil.TempDir("", "device")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sub := range []string{"by-id", "by-path"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name := range identities {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for link, name := range links {
+		if err := os.Symlink(filepath.Join(dir, name), filepath.Join(dir, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	byId, byPath, read := DiskByIdDir, DiskByPathDir, ReadIdentity
+	DiskByIdDir, DiskByPathDir = filepath.Join(dir, "by-id"), filepath.Join(dir, "by-path")
+	ReadIdentity = func(device string) (Identity, error) {
+		return identities[filepath.Base(device)], nil
+	}
+
+	return dir, func() {
+		DiskByIdDir, DiskByPathDir, ReadIdentity = byId, byPath, read
+		os.RemoveAll(dir)
+	}
+}
+
+func TestIdentityOf(t *testing.T) {
+	var sampleConnData = map[string]interface{}{
+		"targetIqn": "iqn.2017-10.io.opensds:volume-1",
+		"lunWwn":    "0x6005076810810261F800000000000A2B",
+		"serial":    " 0A2B ",
+	}
+
+	expected := Identity{WWN: "6005076810810261f800000000000a2b", Serial: "0A2B"}
+	if actual := IdentityOf(sampleConnData); !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected: %v, actual: %v\n", expected, actual)
+	}
+
+	if !IdentityOf(map[string]interface{}{"targetLun": 1}).IsEmpty() {
+		t.Errorf("expected: an empty identity\n")
+	}
+}
+
+func TestMatches(t *testing.T) {
+	id := Identity{WWN: "6005076810810261f800000000000a2b", Serial: "0A2B"}
+
+	var sampleCases = []struct {
+		actual   Identity
+		expected bool
+	}{
+		{Identity{WWN: "naa.6005076810810261F800000000000A2B"}, true},
+		{Identity{Serial: "0A2B"}, true},
+		{Identity{WWN: "6005076810810261f800000000000a2b", Serial: "0A2C"}, false},
+		{Identity{WWN: "6005076810810261f800000000000a2c"}, false},
+		// Nothing can be compared
+		{Identity{}, false},
+	}
+
+	for _, c := range sampleCases {
+		if actual := id.Matches(c.actual); c.expected != actual {
+			t.Errorf("%v, expected: %v, actual: %v\n", c.actual, c.expected, actual)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	dir, tearDown := fakeDisks(t,
+		map[string]Identity{
+			"sdb": {WWN: "6005076810810261f800000000000a2b", Serial: "0A2B"},
+			"sdc": {WWN: "6005076810810261f800000000000a2c", Serial: "0A2C"},
+		},
+		map[string]string{
+			"by-id/wwn-0x6005076810810261f800000000000a2b":         "sdb",
+			"by-id/wwn-0x6005076810810261f800000000000a2b-part1":   "sdc",
+			"by-id/scsi-36005076810810261f800000000000a2c":         "sdc",
+			"by-id/scsi-SIBM_2145_0A2C":                            "sdc",
+			"by-path/ip-1.2.3.4:3260-iscsi-iqn.2017-10.io-lun-1":   "sdb",
+			"by-path/pci-0000:05:00.0-fc-0x5005076801402f35-lun-2": "sdc",
+		})
+	defer tearDown()
+
+	var sampleCases = []struct {
+		driverVolumeType string
+		connData         map[string]interface{}
+		device           string
+		expected         string
+		err              error
+	}{
+		{
+			driverVolumeType: "iscsi",
+			connData:         map[string]interface{}{"wwn": "6005076810810261F800000000000A2B"},
+			expected:         filepath.Join(dir, "by-id/wwn-0x6005076810810261f800000000000a2b"),
+		},
+		{
+			driverVolumeType: "fibre_channel",
+			connData:         map[string]interface{}{"serialNumber": "0A2C"},
+			expected:         filepath.Join(dir, "by-id/scsi-SIBM_2145_0A2C"),
+		},
+		{
+			// The link named after the WWN is another LUN
+			driverVolumeType: "iscsi",
+			connData:         map[string]interface{}{"wwn": "6005076810810261f800000000000a2c", "serial": "0A2B"},
+			err:              ErrNotFound,
+		},
+		{
+			driverVolumeType: "iscsi",
+			connData: map[string]interface{}{
+				"targetPortal": "1.2.3.4:3260",
+				"targetIqn":    "iqn.2017-10.io",
+				"targetLun":    float64(1),
+			},
+			device:   "/dev/sdx",
+			expected: filepath.Join(dir, "by-path/ip-1.2.3.4:3260-iscsi-iqn.2017-10.io-lun-1"),
+		},
+		{
+			driverVolumeType: "fibre_channel",
+			connData: map[string]interface{}{
+				"target_wwn": []interface{}{"5005076801402f34", "5005076801402F35"},
+				"target_lun": float64(2),
+			},
+			expected: filepath.Join(dir, "by-path/pci-0000:05:00.0-fc-0x5005076801402f35-lun-2"),
+		},
+		{
+			driverVolumeType: "iscsi",
+			connData: map[string]interface{}{
+				"targetPortal": "1.2.3.4:3260",
+				"targetIqn":    "iqn.2017-10.io",
+				"targetLun":    float64(3),
+			},
+			err: ErrNotFound,
+		},
+		{
+			driverVolumeType: "rbd",
+			connData:         map[string]interface{}{"name": "rbd/volume-1"},
+			device:           "/dev/rbd0",
+			expected:         "/dev/rbd0",
+		},
+		{
+			driverVolumeType: "rbd",
+			connData:         map[string]interface{}{"name": "rbd/volume-1"},
+			device:           "-",
+			err:              ErrNotFound,
+		},
+	}
+
+	for _, c := range sampleCases {
+		actual, err := Resolve(c.driverVolumeType, c.connData, c.device)
+		if c.err != err || c.expected != actual {
+			t.Errorf("%v, expected: %v, %v, actual: %v, %v\n", c.connData, c.expected, c.err, actual, err)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	dir, tearDown := fakeDisks(t,
+		map[string]Identity{"sdb": {WWN: "6005076810810261f800000000000a2b"}},
+		map[string]string{"by-id/wwn-0x6005076810810261f800000000000a2b": "sdb"})
+	defer tearDown()
+
+	link := filepath.Join(dir, "by-id/wwn-0x6005076810810261f800000000000a2b")
+	if err := Verify(link, Identity{WWN: "0x6005076810810261F800000000000A2B"}); nil != err {
+		t.Errorf("expected: nil, actual: %v\n", err)
+	}
+
+	if err := Verify(link, Identity{WWN: "6005076810810261f800000000000a2c"}); nil == err {
+		t.Errorf("expected: an error for another LUN\n")
+	}
+
+	if err := Verify(filepath.Join(dir, "sdc"), Identity{}); nil != err {
+		t.Errorf("expected: nil for an unknown identity, actual: %v\n", err)
+	}
+
+	if !IsSameDevice(link, filepath.Join(dir, "sdb")) || IsSameDevice(link, filepath.Join(dir, "sdc")) {
+		t.Errorf("expected: the link is the same device as %s only\n", filepath.Join(dir, "sdb"))
+	}
+}
+
+func TestParseLsblkPairs(t *testing.T) {
+	expected := Identity{WWN: "6005076810810261f800000000000a2b", Serial: "0A2B"}
+	actual := parseLsblkPairs(`WWN="0x6005076810810261f800000000000a2b" SERIAL="0A2B"` + "\n")
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected: %v, actual: %v\n", expected, actual)
+	}
+}
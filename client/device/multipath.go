@@ -0,0 +1,198 @@
+// Copyright (c) 2018 Huawei Technologies Co., Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/opensds/opensds/contrib/connector"
+)
+
+// The iSCSI targets of a LUN reachable by several paths are given by the
+// connection data keys targetPortals, targetIqns and targetLuns, each path is
+// attached by the connector as a single target. A FC LUN is attached by all of
+// the target WWNs at once, its paths are the links by path to it.
+const (
+	KTargetPortals = "targetPortals"
+	KTargetIqns    = "targetIqns"
+	KTargetLuns    = "targetLuns"
+)
+
+var (
+	// DevDir the device nodes
+	DevDir = "/dev"
+	// SysBlockDir the block devices known by the kernel
+	SysBlockDir = "/sys/block"
+
+	// MultipathAvailable checks if dm-multipath can be used on the node
+	MultipathAvailable = multipathAvailable
+	// RunMultipath runs the multipath command
+	RunMultipath = runMultipath
+
+	// MultipathWait how long the multipath device of a LUN is waited for
+	MultipathWait = 10 * time.Second
+)
+
+// PathConnectionData splits the connection data of a LUN into that of each
+// of its paths, a single IQN or LUN is used for every portal
+func PathConnectionData(driverVolumeType string, connData map[string]interface{}) []map[string]interface{} {
+	portals := lookupStrings(connData, KTargetPortals)
+	if connector.IscsiDriver != driverVolumeType || 0 == len(portals) {
+		return []map[string]interface{}{connData}
+	}
+
+	iqns := lookupStrings(connData, KTargetIqns)
+	luns, _ := connData[KTargetLuns].([]interface{})
+
+	var paths []map[string]interface{}
+	for i, portal := range portals {
+		pathData := make(map[string]interface{}, len(connData))
+		for k, v := range connData {
+			pathData[k] = v
+		}
+
+		pathData["targetPortal"] = portal
+		if i < len(iqns) {
+			pathData["targetIqn"] = iqns[i]
+		}
+		if i < len(luns) {
+			pathData["targetLun"] = luns[i]
+		}
+
+		paths = append(paths, pathData)
+	}
+
+	return paths
+}
+
+// FindPaths returns the links by path to a LUN attached with the connection
+// data of one of its paths
+func FindPaths(driverVolumeType string, connData map[string]interface{}) []string {
+	links, _ := globLinks(DiskByPathDir, byPathPatterns(driverVolumeType, connData))
+	return links
+}
+
+// Multipath returns the dm-multipath device over the paths of a LUN, which is
+// created unless multipathd did already
+func Multipath(paths []string) (string, error) {
+	if device := holderOf(paths); "" != device {
+		return device, nil
+	}
+
+	for _, path := range paths {
+		if err := RunMultipath(Canonical(path)); err != nil {
+			return "", err
+		}
+	}
+
+	for deadline := time.Now().Add(MultipathWait); time.Now().Before(deadline); time.Sleep(time.Second) {
+		if device := holderOf(paths); "" != device {
+			return device, nil
+		}
+	}
+
+	return "", fmt.Errorf("no multipath device is created over %v", paths)
+}
+
+// IsMultipath checks if a device is a dm-multipath device
+func IsMultipath(device string) bool {
+	return "" != multipathUUID(filepath.Base(Canonical(device)))
+}
+
+// MultipathPaths returns the paths of a dm-multipath device
+func MultipathPaths(device string) []string {
+	entries, err := ioutil.ReadDir(filepath.Join(SysBlockDir, filepath.Base(Canonical(device)), "slaves"))
+	if err != nil {
+		return nil
+	}
+
+	var paths []string
+	for _, entry := range entries {
+		paths = append(paths, filepath.Join(DevDir, entry.Name()))
+	}
+
+	return paths
+}
+
+// FlushMultipath removes a dm-multipath device, the paths it is over are
+// left attached
+func FlushMultipath(device string) error {
+	return RunMultipath("-f", Canonical(device))
+}
+
+// multipathAvailable checks if the multipath tools are installed, multipathd
+// is expected to be running with them
+func multipathAvailable() bool {
+	_, err := exec.LookPath("multipath")
+	return err == nil
+}
+
+// runMultipath runs the multipath command with the arguments
+func runMultipath(args ...string) error {
+	out, err := exec.Command("multipath", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("multipath %s failed: %v, %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+// holderOf returns a stable link to the dm-multipath device holding one of
+// the paths, or an empty string
+func holderOf(paths []string) string {
+	for _, path := range paths {
+		holders, err := ioutil.ReadDir(filepath.Join(SysBlockDir, filepath.Base(Canonical(path)), "holders"))
+		if err != nil {
+			continue
+		}
+
+		for _, holder := range holders {
+			uuid := multipathUUID(holder.Name())
+			if "" == uuid {
+				continue
+			}
+
+			link := filepath.Join(DiskByIdDir, "dm-uuid-"+uuid)
+			if _, err := os.Stat(link); err == nil {
+				return link
+			}
+
+			return filepath.Join(DevDir, holder.Name())
+		}
+	}
+
+	return ""
+}
+
+// multipathUUID returns the uuid of a dm-multipath device, e.g. mpath-36005...,
+// or an empty string if the device is not one
+func multipathUUID(name string) string {
+	if !strings.HasPrefix(name, "dm-") {
+		return ""
+	}
+
+	uuid, err := ioutil.ReadFile(filepath.Join(SysBlockDir, name, "dm", "uuid"))
+	if err != nil || !strings.HasPrefix(string(uuid), "mpath-") {
+		return ""
+	}
+
+	return strings.TrimSpace(string(uuid))
+}
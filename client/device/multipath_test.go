@@ -0,0 +1,122 @@
+// Copyright (c) 2018 Huawei Technologies Co., Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPathConnectionData(t *testing.T) {
+	var sampleConnData = map[string]interface{}{
+		"targetPortals": []interface{}{"1.2.3.4:3260", "1.2.3.5:3260"},
+		"targetIqns":    []interface{}{"iqn.2017-10.io:a", "iqn.2017-10.io:b"},
+		"targetLun":     float64(1),
+		"authMethod":    "chap",
+	}
+
+	expected := []map[string]interface{}{
+		{
+			"targetPortals": sampleConnData["targetPortals"],
+			"targetIqns":    sampleConnData["targetIqns"],
+			"targetPortal":  "1.2.3.4:3260",
+			"targetIqn":     "iqn.2017-10.io:a",
+			"targetLun":     float64(1),
+			"authMethod":    "chap",
+		},
+		{
+			"targetPortals": sampleConnData["targetPortals"],
+			"targetIqns":    sampleConnData["targetIqns"],
+			"targetPortal":  "1.2.3.5:3260",
+			"targetIqn":     "iqn.2017-10.io:b",
+			"targetLun":     float64(1),
+			"authMethod":    "chap",
+		},
+	}
+
+	if actual := PathConnectionData("iscsi", sampleConnData); !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected: %v, actual: %v\n", expected, actual)
+	}
+
+	// A single target and a FC LUN are attached at once
+	single := map[string]interface{}{"targetPortal": "1.2.3.4:3260", "targetIqn": "iqn.2017-10.io:a"}
+	if actual := PathConnectionData("iscsi", single); !reflect.DeepEqual([]map[string]interface{}{single}, actual) {
+		t.Errorf("expected: %v, actual: %v\n", single, actual)
+	}
+
+	if actual := PathConnectionData("fibre_channel", sampleConnData); 1 != len(actual) {
+		t.Errorf("expected: 1 path, actual: %v\n", actual)
+	}
+}
+
+func TestMultipath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "multipath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// dm-0 is the multipath device over sdb and sdc, sdd is a single path
+	for _, p := range []string{"sys/sdb/holders/dm-0", "sys/sdc/holders/dm-0", "sys/sdd/holders",
+		"sys/dm-0/dm", "sys/dm-0/slaves/sdb", "sys/dm-0/slaves/sdc", "by-id"} {
+		if err := os.MkdirAll(filepath.Join(dir, p), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"sdb", "sdc", "sdd", "dm-0"} {
+		ioutil.WriteFile(filepath.Join(dir, name), nil, 0644)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "sys/dm-0/dm/uuid"), []byte("mpath-36005076810810261f800000000000a2b\n"), 0644)
+	link := filepath.Join(dir, "by-id/dm-uuid-mpath-36005076810810261f800000000000a2b")
+	os.Symlink(filepath.Join(dir, "dm-0"), link)
+
+	devDir, sysBlockDir, byId, runMultipath, wait := DevDir, SysBlockDir, DiskByIdDir, RunMultipath, MultipathWait
+	defer func() {
+		DevDir, SysBlockDir, DiskByIdDir, RunMultipath, MultipathWait = devDir, sysBlockDir, byId, runMultipath, wait
+	}()
+	var runs [][]string
+	DevDir, SysBlockDir, DiskByIdDir = dir, filepath.Join(dir, "sys"), filepath.Join(dir, "by-id")
+	RunMultipath = func(args ...string) error {
+		runs = append(runs, args)
+		return nil
+	}
+	MultipathWait = 0
+
+	device, err := Multipath([]string{filepath.Join(dir, "sdc")})
+	if nil != err || link != device || 0 != len(runs) {
+		t.Errorf("expected: %v found, actual: %v, %v, %v\n", link, device, err, runs)
+	}
+
+	if !IsMultipath(link) || IsMultipath(filepath.Join(dir, "sdb")) {
+		t.Errorf("expected: only %v is multipath\n", link)
+	}
+
+	expected := []string{filepath.Join(dir, "sdb"), filepath.Join(dir, "sdc")}
+	if actual := MultipathPaths(link); !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected: %v, actual: %v\n", expected, actual)
+	}
+
+	// multipath is asked for a device over a path no multipathd took
+	if _, err := Multipath([]string{filepath.Join(dir, "sdd")}); nil == err || 1 != len(runs) {
+		t.Errorf("expected: an error once multipath ran, actual: %v, %v\n", err, runs)
+	}
+
+	if err := FlushMultipath(link); nil != err || !reflect.DeepEqual([]string{"-f", filepath.Join(dir, "dm-0")}, runs[1]) {
+		t.Errorf("expected: dm-0 flushed, actual: %v, %v\n", err, runs)
+	}
+}
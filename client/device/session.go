@@ -0,0 +1,176 @@
+// Copyright (c) 2018 Huawei Technologies Co., Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/opensds/opensds/contrib/connector"
+)
+
+// A session is what the node keeps of a target once a LUN is attached by it:
+// an iSCSI session to a target portal, or the SCSI device of a LUN of a FC
+// target, which stays after the volume is gone unless it is detached.
+
+var (
+	// ListSessions lists the iSCSI sessions and the FC paths of the node
+	ListSessions = listSessions
+	// RunIscsiadm runs the iscsiadm command and returns its output
+	RunIscsiadm = runIscsiadm
+)
+
+// Session an iSCSI session or a FC path of the node
+type Session struct {
+	DriverVolumeType string
+	// Target the portal of an iSCSI session, the WWN of the target of a FC path
+	Target string
+	// Name the IQN of an iSCSI session, the LUN of a FC path
+	Name string
+}
+
+func (s Session) String() string {
+	return fmt.Sprintf("%s %s %s", s.DriverVolumeType, s.Target, s.Name)
+}
+
+// ConnectionData the connection data the connector detaches the session by
+func (s Session) ConnectionData() map[string]interface{} {
+	if connector.FcDriver == s.DriverVolumeType {
+		lun, _ := strconv.Atoi(s.Name)
+		return map[string]interface{}{"target_wwn": []string{s.Target}, "target_lun": lun}
+	}
+
+	return map[string]interface{}{"targetPortal": s.Target, "targetIqn": s.Name}
+}
+
+// Devices returns the links by path to the LUNs of a session, and the
+// dm-multipath device over them if any
+func (s Session) Devices() []string {
+	var pattern string
+	if connector.FcDriver == s.DriverVolumeType {
+		pattern = fmt.Sprintf("*-fc-0x%s-lun-%s", s.Target, s.Name)
+	} else {
+		pattern = fmt.Sprintf("ip-%s-iscsi-%s-lun-*", s.Target, s.Name)
+	}
+
+	links, _ := globLinks(DiskByPathDir, []string{pattern})
+	if holder := holderOf(links); "" != holder {
+		links = append(links, holder)
+	}
+
+	return links
+}
+
+// SessionsOf returns the sessions the node attaches a LUN by with the
+// connection data of its attachment
+func SessionsOf(driverVolumeType string, connData map[string]interface{}) []Session {
+	var sessions []Session
+	switch driverVolumeType {
+	case connector.IscsiDriver:
+		for _, pathData := range PathConnectionData(driverVolumeType, connData) {
+			portal := lookupString(pathData, []string{"targetPortal"})
+			iqn := lookupString(pathData, []string{"targetIqn"})
+			if "" != portal && "" != iqn {
+				sessions = append(sessions, Session{DriverVolumeType: driverVolumeType, Target: portal, Name: iqn})
+			}
+		}
+	case connector.FcDriver:
+		lun, ok := lookupInt(connData, "target_lun")
+		if !ok {
+			return nil
+		}
+
+		for _, wwn := range lookupStrings(connData, "target_wwn") {
+			sessions = append(sessions, Session{DriverVolumeType: driverVolumeType, Target: normalizeWWN(wwn), Name: strconv.Itoa(lun)})
+		}
+	}
+
+	return sessions
+}
+
+// listSessions lists the iSCSI sessions with iscsiadm and the FC paths by
+// their links by path
+func listSessions() ([]Session, error) {
+	out, err := RunIscsiadm("-m", "session")
+	if err != nil && !strings.Contains(out, "No active sessions") {
+		return nil, fmt.Errorf("iscsiadm -m session failed: %v, %s", err, strings.TrimSpace(out))
+	}
+	sessions := parseIscsiSessions(out)
+
+	links, err := filepath.Glob(filepath.Join(DiskByPathDir, "*-fc-0x*-lun-*"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, link := range links {
+		m := fcPathPattern.FindStringSubmatch(filepath.Base(link))
+		if nil == m {
+			continue
+		}
+
+		// A LUN has a path by each HBA of the node
+		session := Session{DriverVolumeType: connector.FcDriver, Target: normalizeWWN(m[1]), Name: m[2]}
+		if !ContainsSession(sessions, session) {
+			sessions = append(sessions, session)
+		}
+	}
+
+	return sessions, nil
+}
+
+var (
+	// e.g. tcp: [1] 192.168.0.10:3260,1 iqn.2017-10.io.opensds:volume (non-flash)
+	iscsiSessionPattern = regexp.MustCompile(`^\S+: \[\d+\] (\S+),\d+ (\S+)`)
+	// e.g. pci-0000:05:00.0-fc-0x500507680b21ac5c-lun-1
+	fcPathPattern = regexp.MustCompile(`-fc-0x([0-9a-fA-F]+)-lun-(\d+)$`)
+)
+
+// ContainsSession checks if a session is one of the sessions
+func ContainsSession(sessions []Session, session Session) bool {
+	for _, s := range sessions {
+		if s == session {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseIscsiSessions parses the output of iscsiadm -m session
+func parseIscsiSessions(out string) []Session {
+	var sessions []Session
+	for _, line := range strings.Split(out, "\n") {
+		if m := iscsiSessionPattern.FindStringSubmatch(strings.TrimSpace(line)); nil != m {
+			sessions = append(sessions, Session{DriverVolumeType: connector.IscsiDriver, Target: m[1], Name: m[2]})
+		}
+	}
+
+	return sessions
+}
+
+// runIscsiadm runs the iscsiadm command with the arguments, a node without
+// iscsiadm has no iSCSI session
+func runIscsiadm(args ...string) (string, error) {
+	if _, err := exec.LookPath("iscsiadm"); err != nil {
+		return "", nil
+	}
+
+	out, err := exec.Command("iscsiadm", args...).CombinedOutput()
+	return string(out), err
+}
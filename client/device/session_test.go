@@ -0,0 +1,113 @@
+// Copyright (c) 2018 Huawei Technologies Co., Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestListSessions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{
+		"pci-0000:05:00.0-fc-0x500507680B21AC5C-lun-1",
+		"pci-0000:05:00.1-fc-0x500507680b21ac5c-lun-1",
+		"pci-0000:05:00.0-fc-0x500507680b21ac5c-lun-2",
+		"ip-1.2.3.4:3260-iscsi-iqn.2017-10.io:a-lun-1",
+	} {
+		ioutil.WriteFile(filepath.Join(dir, name), nil, 0600)
+	}
+
+	byPath, runIscsiadm := DiskByPathDir, RunIscsiadm
+	defer func() {
+		DiskByPathDir, RunIscsiadm = byPath, runIscsiadm
+	}()
+	DiskByPathDir = dir
+	RunIscsiadm = func(args ...string) (string, error) {
+		return "tcp: [1] 1.2.3.4:3260,1 iqn.2017-10.io:a (non-flash)\n" +
+			"tcp: [2] [fe80::1]:3260,1 iqn.2017-10.io:b (non-flash)\n", nil
+	}
+
+	sessions, err := ListSessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Session{
+		{DriverVolumeType: "iscsi", Target: "1.2.3.4:3260", Name: "iqn.2017-10.io:a"},
+		{DriverVolumeType: "iscsi", Target: "[fe80::1]:3260", Name: "iqn.2017-10.io:b"},
+		{DriverVolumeType: "fibre_channel", Target: "500507680b21ac5c", Name: "1"},
+		{DriverVolumeType: "fibre_channel", Target: "500507680b21ac5c", Name: "2"},
+	}
+	if !reflect.DeepEqual(expected, sessions) {
+		t.Errorf("expected: %v, actual: %v\n", expected, sessions)
+	}
+
+	// iscsiadm fails when the node has no session
+	RunIscsiadm = func(args ...string) (string, error) {
+		return "iscsiadm: No active sessions.\n", errors.New("exit status 21")
+	}
+	if sessions, err := ListSessions(); err != nil || 2 != len(sessions) {
+		t.Errorf("expected: the fc paths, actual: %v, %v\n", sessions, err)
+	}
+
+	if devices := expected[0].Devices(); 1 != len(devices) ||
+		filepath.Join(dir, "ip-1.2.3.4:3260-iscsi-iqn.2017-10.io:a-lun-1") != devices[0] {
+		t.Errorf("expected: the link of the lun, actual: %v\n", devices)
+	}
+}
+
+func TestSessionsOf(t *testing.T) {
+	iscsi := SessionsOf("iscsi", map[string]interface{}{
+		"targetPortals": []interface{}{"1.2.3.4:3260", "1.2.3.5:3260"},
+		"targetIqn":     "iqn.2017-10.io:a",
+		"targetLun":     float64(1),
+	})
+	expected := []Session{
+		{DriverVolumeType: "iscsi", Target: "1.2.3.4:3260", Name: "iqn.2017-10.io:a"},
+		{DriverVolumeType: "iscsi", Target: "1.2.3.5:3260", Name: "iqn.2017-10.io:a"},
+	}
+	if !reflect.DeepEqual(expected, iscsi) {
+		t.Errorf("expected: %v, actual: %v\n", expected, iscsi)
+	}
+
+	fc := SessionsOf("fibre_channel", map[string]interface{}{
+		"target_wwn": []interface{}{"0x500507680B21AC5C"},
+		"target_lun": float64(2),
+	})
+	expected = []Session{{DriverVolumeType: "fibre_channel", Target: "500507680b21ac5c", Name: "2"}}
+	if !reflect.DeepEqual(expected, fc) {
+		t.Errorf("expected: %v, actual: %v\n", expected, fc)
+	}
+
+	// The session is detached by the connection data it is attached by
+	expectedData := map[string]interface{}{"target_wwn": []string{"500507680b21ac5c"}, "target_lun": 2}
+	if !reflect.DeepEqual(expectedData, fc[0].ConnectionData()) {
+		t.Errorf("expected: %v, actual: %v\n", expectedData, fc[0].ConnectionData())
+	}
+
+	if sessions := SessionsOf("rbd", map[string]interface{}{"name": "pool/image"}); 0 != len(sessions) {
+		t.Errorf("expected: no session, actual: %v\n", sessions)
+	}
+}
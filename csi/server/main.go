@@ -18,6 +18,7 @@ import (
 	"flag"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
@@ -26,6 +27,7 @@ import (
 	"github.com/opensds/nbp/csi/server/plugin/opensds"
 	"github.com/opensds/nbp/csi/util"
 	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/reflection"
 
@@ -38,6 +40,11 @@ var (
 	csiEndpoint         string
 	opensdsEndpoint     string
 	opensdsAuthStrategy string
+	availabilityZone    string
+	nodeLabelFile       string
+	nodeStateFile       string
+	defaultProfile      string
+	metadataKeys        []string
 )
 
 func init() {
@@ -73,6 +80,24 @@ func main() {
 	cmd.PersistentFlags().StringVar(&csiEndpoint, "csiEndpoint", csiEp, "CSI Endpoint")
 	cmd.PersistentFlags().StringVar(&opensdsEndpoint, "opensdsEndpoint", opensdsEp, "OpenSDS Endpoint")
 	cmd.PersistentFlags().StringVar(&opensdsAuthStrategy, "opensdsAuthStrategy", "", "OpenSDS Auth Strategy")
+	cmd.PersistentFlags().StringVar(&availabilityZone, "availabilityZone", os.Getenv(util.NodeAvailabilityZone),
+		"Availability zone of the node")
+	cmd.PersistentFlags().StringVar(&nodeLabelFile, "nodeLabelFile", os.Getenv(util.NodeLabelFile),
+		"File of key=value node labels the availability zone of the node is read from")
+	cmd.PersistentFlags().StringVar(&nodeStateFile, "nodeStateFile", os.Getenv(util.NodeStateFile),
+		"File the node service records the staged and published volumes of the node in")
+	defProfile := util.OpensdsDefaultProfile
+	if prf, ok := os.LookupEnv(util.CSIDefaultProfile); ok {
+		defProfile = prf
+	}
+	cmd.PersistentFlags().StringVar(&defaultProfile, "defaultProfile", defProfile,
+		"Name or id of the profile of volumes and snapshots created without a profile parameter")
+	var defMetadataKeys []string
+	if keys, ok := os.LookupEnv(util.CSIMetadataKeys); ok && "" != keys {
+		defMetadataKeys = strings.Split(keys, ",")
+	}
+	cmd.PersistentFlags().StringSliceVar(&metadataKeys, "metadataKeys", defMetadataKeys,
+		"Parameters recorded as labels in the metadata of volumes and snapshots")
 
 	cmd.ParseFlags(os.Args[1:])
 	if err := cmd.Execute(); err != nil {
@@ -99,7 +124,21 @@ func handle() {
 	s := grpc.NewServer()
 
 	// Register CSI Service
-	var defaultplugin plugin.Service = &opensds.Plugin{}
+	opensdsPlugin := &opensds.Plugin{
+		AvailabilityZone: availabilityZone,
+		NodeLabelFile:    nodeLabelFile,
+		DefaultProfile:   defaultProfile,
+		MetadataKeys:     metadataKeys,
+		NodeStateFile:    nodeStateFile,
+	}
+
+	// Reconcile the volumes of the node before a crash or a restart
+	if err := opensdsPlugin.StartNode(context.Background()); err != nil {
+		glog.Errorf("failed to start the node service: %v", err)
+		os.Exit(1)
+	}
+
+	var defaultplugin plugin.Service = opensdsPlugin
 	conServer := &server{plugin: defaultplugin}
 	csi.RegisterIdentityServer(s, conServer)
 	csi.RegisterControllerServer(s, conServer)
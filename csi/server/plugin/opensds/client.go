@@ -0,0 +1,331 @@
+// Copyright (c) 2018 Huawei Technologies Co., Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opensds
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	c "github.com/opensds/opensds/client"
+	"github.com/opensds/opensds/pkg/utils/constants"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+//                            OpenSDS Calls                                   //
+////////////////////////////////////////////////////////////////////////////////
+
+// The OpenSDS client neither takes a context nor retries, so its calls are
+// made through call and retry, which make no call once the request context is
+// done and stop calling OpenSDS for a while when it is unreachable. A call is
+// made with a copy of the client whose HTTP requests are canceled once the
+// request context is done, so a hung OpenSDS does not hold a request past
+// the deadline of its sidecar.
+
+var (
+	// retryAttempts times an idempotent call is made at most
+	retryAttempts = 4
+	// retryInitialBackoff time to wait before the first retry, it doubles
+	// after each retry up to retryMaxBackoff
+	retryInitialBackoff = 500 * time.Millisecond
+	retryMaxBackoff     = 5 * time.Second
+
+	// breakerThreshold consecutive calls failing to reach OpenSDS which open
+	// the breaker
+	breakerThreshold = 5
+	// breakerCooldown time the calls fail without reaching OpenSDS once the
+	// breaker is open
+	breakerCooldown = 30 * time.Second
+
+	breaker = &circuitBreaker{}
+
+	// opensdsRequestTimeout is the same as the one of the OpenSDS client, it is
+	// long enough to upload a snapshot to the cloud
+	opensdsRequestTimeout = 6 * time.Minute
+	opensdsHTTPClient     = newOpenSDSHTTPClient()
+	noauthReceiverType    = reflect.TypeOf(c.NewReceiver())
+)
+
+// circuitBreaker counts the consecutive calls which failed to reach OpenSDS
+type circuitBreaker struct {
+	sync.Mutex
+	failures int
+	openedAt time.Time
+}
+
+// allow tells whether a call can be made, the calls are made again once the
+// cooldown is over to find out whether OpenSDS is back
+func (cb *circuitBreaker) allow() bool {
+	cb.Lock()
+	defer cb.Unlock()
+
+	return cb.failures < breakerThreshold || time.Since(cb.openedAt) >= breakerCooldown
+}
+
+// tripped tells whether OpenSDS was unreachable the last times it was called
+func (cb *circuitBreaker) tripped() bool {
+	cb.Lock()
+	defer cb.Unlock()
+
+	return cb.failures >= breakerThreshold
+}
+
+// record records the result of a call, an error other than Unavailable means
+// OpenSDS was reached
+func (cb *circuitBreaker) record(err error) {
+	cb.Lock()
+	defer cb.Unlock()
+
+	if codes.Unavailable != errorCode(err) {
+		cb.failures = 0
+		return
+	}
+
+	cb.failures++
+	if cb.failures >= breakerThreshold {
+		glog.Warningf("OpenSDS is unreachable, calls fail for %v", breakerCooldown)
+		cb.openedAt = time.Now()
+	}
+}
+
+// reset closes the breaker
+func (cb *circuitBreaker) reset() {
+	cb.Lock()
+	defer cb.Unlock()
+
+	cb.failures = 0
+	cb.openedAt = time.Time{}
+}
+
+// call makes an OpenSDS call unless ctx is done. The HTTP requests of the call
+// are canceled once ctx is done, the call then fails with the error of ctx.
+func call(ctx context.Context, op string, fn func(client *c.Client) error) error {
+	if nil != ctx.Err() {
+		return contextError(ctx, op)
+	}
+
+	if !breaker.allow() {
+		msg := fmt.Sprintf("%s failed: OpenSDS is unreachable", op)
+		return status.Error(codes.Unavailable, msg)
+	}
+
+	err := fn(clientWithContext(ctx, Client))
+	if nil != err && nil != ctx.Err() {
+		// OpenSDS was not found unreachable, the request was stopped
+		glog.Warningf("%s is stopped: %v", op, err)
+		return contextError(ctx, op)
+	}
+
+	breaker.record(err)
+	return err
+}
+
+// retry makes an idempotent OpenSDS call, the call is made again with
+// exponential backoff while OpenSDS is unavailable
+func retry(ctx context.Context, op string, fn func(client *c.Client) error) error {
+	backoff := retryInitialBackoff
+
+	for attempt := 1; ; attempt++ {
+		err := call(ctx, op, fn)
+		if nil == err || codes.Unavailable != errorCode(err) ||
+			attempt >= retryAttempts || !breaker.allow() {
+			return err
+		}
+
+		glog.Warningf("%s failed, retry in %v: %v", op, backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return contextError(ctx, op)
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > retryMaxBackoff {
+			backoff = retryMaxBackoff
+		}
+	}
+}
+
+// contextError the error of an operation stopped because ctx is done
+func contextError(ctx context.Context, op string) error {
+	msg := fmt.Sprintf("%s stopped: %v", op, ctx.Err())
+
+	if context.Canceled == ctx.Err() {
+		return status.Error(codes.Canceled, msg)
+	}
+
+	return status.Error(codes.DeadlineExceeded, msg)
+}
+
+// clientWithContext returns a copy of client whose HTTP requests are canceled
+// once ctx is done. A receiver other than those of the OpenSDS client, e.g. a
+// fake one, is used as it is.
+func clientWithContext(ctx context.Context, client *c.Client) *c.Client {
+	cc := *client
+	if nil != client.ProfileMgr {
+		mgr := *client.ProfileMgr
+		mgr.Receiver = receiverWithContext(ctx, mgr.Receiver)
+		cc.ProfileMgr = &mgr
+	}
+	if nil != client.DockMgr {
+		mgr := *client.DockMgr
+		mgr.Receiver = receiverWithContext(ctx, mgr.Receiver)
+		cc.DockMgr = &mgr
+	}
+	if nil != client.PoolMgr {
+		mgr := *client.PoolMgr
+		mgr.Receiver = receiverWithContext(ctx, mgr.Receiver)
+		cc.PoolMgr = &mgr
+	}
+	if nil != client.VolumeMgr {
+		mgr := *client.VolumeMgr
+		mgr.Receiver = receiverWithContext(ctx, mgr.Receiver)
+		cc.VolumeMgr = &mgr
+	}
+	if nil != client.VersionMgr {
+		mgr := *client.VersionMgr
+		mgr.Receiver = receiverWithContext(ctx, mgr.Receiver)
+		cc.VersionMgr = &mgr
+	}
+	if nil != client.ReplicationMgr {
+		mgr := *client.ReplicationMgr
+		mgr.Receiver = receiverWithContext(ctx, mgr.Receiver)
+		cc.ReplicationMgr = &mgr
+	}
+
+	return &cc
+}
+
+// receiverWithContext replaces the noauth and keystone receivers of the
+// OpenSDS client with one which sends their requests with ctx
+func receiverWithContext(ctx context.Context, r c.Receiver) c.Receiver {
+	if keystone, ok := r.(*c.KeystoneReciver); ok {
+		return &contextReceiver{ctx: ctx, keystone: keystone}
+	}
+
+	if reflect.TypeOf(r) == noauthReceiverType {
+		return &contextReceiver{ctx: ctx}
+	}
+
+	return r
+}
+
+// contextReceiver sends the requests of the OpenSDS client like its own
+// receivers do, they are canceled once ctx is done
+type contextReceiver struct {
+	ctx context.Context
+	// keystone keeps the token of the requests, it is nil with noauth
+	keystone *c.KeystoneReciver
+}
+
+// Recv implementation, a request rejected with an expired keystone token is
+// sent again with a new one
+func (r *contextReceiver) Recv(urlStr string, method string, input interface{}, output interface{}) error {
+	if nil == r.keystone {
+		return r.request(urlStr, method, "", input, output)
+	}
+
+	err := r.request(urlStr, method, r.keystone.Auth.TokenID, input, output)
+	if httpErr, ok := err.(*c.HttpError); ok && http.StatusUnauthorized == httpErr.Code {
+		if err := r.keystone.GetToken(); err != nil {
+			return err
+		}
+		err = r.request(urlStr, method, r.keystone.Auth.TokenID, input, output)
+	}
+
+	return err
+}
+
+func (r *contextReceiver) request(urlStr string, method string, token string, input interface{}, output interface{}) error {
+	var body io.Reader
+	if nil != input {
+		b, err := json.Marshal(input)
+		if err != nil {
+			return err
+		}
+		glog.V(5).Infof("%s %s request body: %s", strings.ToUpper(method), urlStr, b)
+		body = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(strings.ToUpper(method), urlStr, body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(r.ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if "" != token {
+		req.Header.Set(constants.AuthTokenHeader, token)
+	}
+
+	resp, err := opensdsHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	rbody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	glog.V(5).Infof("%s %s response %s: %s", strings.ToUpper(method), urlStr, resp.Status, rbody)
+	if 400 <= resp.StatusCode && resp.StatusCode <= 599 {
+		return c.NewHttpError(resp.StatusCode, string(rbody))
+	}
+
+	// If the format of output is nil, skip unmarshaling the result.
+	if nil == output {
+		return nil
+	}
+	if err := json.Unmarshal(rbody, output); err != nil {
+		return fmt.Errorf("failed to unmarshal result message: %v", err)
+	}
+
+	return nil
+}
+
+// newOpenSDSHTTPClient the HTTP client of the OpenSDS requests, an https
+// endpoint is verified with the CA certificate of OpenSDS
+func newOpenSDSHTTPClient() *http.Client {
+	client := &http.Client{Timeout: opensdsRequestTimeout}
+
+	caCert, err := ioutil.ReadFile(constants.OpensdsCaCertFile)
+	if err != nil {
+		return client
+	}
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caCert)
+	client.Transport = &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	}
+
+	return client
+}
@@ -0,0 +1,213 @@
+// Copyright (c) 2018 Huawei Technologies Co., Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opensds
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	c "github.com/opensds/opensds/client"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var errUnreachable = errors.New("dial tcp 127.0.0.1:50040: connect: connection refused")
+
+// fastRetry makes the retries of a test quick, the returned func restores them
+func fastRetry() func() {
+	attempts, initial, max := retryAttempts, retryInitialBackoff, retryMaxBackoff
+	retryAttempts, retryInitialBackoff, retryMaxBackoff = 3, time.Millisecond, 2*time.Millisecond
+	breaker.reset()
+
+	return func() {
+		retryAttempts, retryInitialBackoff, retryMaxBackoff = attempts, initial, max
+		breaker.reset()
+	}
+}
+
+func TestCallContext(t *testing.T) {
+	defer fastRetry()()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	called := false
+	err := call(ctx, "list volumes", func(*c.Client) error {
+		called = true
+		return nil
+	})
+	if called || codes.Canceled != status.Code(err) {
+		t.Errorf("expected: %v, actual: %v, called: %v\n", codes.Canceled, err, called)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	// A call failing once ctx is done fails with the error of ctx
+	err = call(ctx, "create volume", func(*c.Client) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if codes.DeadlineExceeded != status.Code(err) || breaker.tripped() {
+		t.Errorf("expected: %v, actual: %v\n", codes.DeadlineExceeded, err)
+	}
+}
+
+func TestCallHungOpenSDS(t *testing.T) {
+	defer fastRetry()()
+
+	// OpenSDS never answers
+	hung := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-hung:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(hung)
+
+	client := Client
+	Client = c.NewClient(&c.Config{Endpoint: server.URL, AuthOptions: c.NewNoauthOptions("tenant")})
+	lookups = newLookupCache()
+	defer func() {
+		Client = client
+		lookups = newLookupCache()
+	}()
+
+	var fakePlugin = &Plugin{}
+	timeout := 100 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	start := time.Now()
+	_, err := fakePlugin.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: "volume-1"})
+	if codes.DeadlineExceeded != status.Code(err) {
+		t.Errorf("expected: %v, actual: %v\n", codes.DeadlineExceeded, err)
+	}
+
+	if elapsed := time.Since(start); elapsed > timeout+time.Second {
+		t.Errorf("expected: the call stops at the deadline, actual: %v\n", elapsed)
+	}
+}
+
+func TestCallHoldsLock(t *testing.T) {
+	defer fastRetry()()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	unlock, err := lockOperation(lockVolumeName + "volume-1")
+	if nil != err {
+		t.Fatalf("failed to lockOperation: %v\n", err)
+	}
+
+	over := make(chan struct{})
+	go func() {
+		defer close(over)
+		defer unlock()
+		call(ctx, "create volume", func(*c.Client) error {
+			time.Sleep(50 * time.Millisecond)
+			return nil
+		})
+	}()
+
+	// The request is retried once ctx is done, the operation is still pending
+	<-ctx.Done()
+	if _, err := lockOperation(lockVolumeName + "volume-1"); !isPendingError(err) {
+		t.Errorf("expected: %v, actual: %v\n", codes.Aborted, err)
+	}
+
+	<-over
+	unlock, err = lockOperation(lockVolumeName + "volume-1")
+	if nil != err {
+		t.Fatalf("failed to lockOperation: %v\n", err)
+	}
+	unlock()
+}
+
+func TestRetry(t *testing.T) {
+	defer fastRetry()()
+
+	testCases := []struct {
+		errs          []error
+		expectedCalls int
+		expectedCode  codes.Code
+	}{
+		{[]error{nil}, 1, codes.OK},
+		{[]error{errUnreachable, nil}, 2, codes.OK},
+		{[]error{errUnreachable, errUnreachable, errUnreachable}, 3, codes.Unavailable},
+		{[]error{httpError(http.StatusNotFound, "volume not found")}, 1, codes.NotFound},
+		{[]error{httpError(http.StatusBadRequest, "size must be positive")}, 1, codes.InvalidArgument},
+	}
+
+	for _, tc := range testCases {
+		calls := 0
+		err := retry(context.Background(), "get volume", func(*c.Client) error {
+			err := tc.errs[calls]
+			calls++
+			return err
+		})
+
+		if tc.expectedCalls != calls || tc.expectedCode != errorCode(err) {
+			t.Errorf("expected: %d calls %v, actual: %d calls %v\n",
+				tc.expectedCalls, tc.expectedCode, calls, err)
+		}
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	defer fastRetry()()
+
+	var fakePlugin = &Plugin{}
+	var fakeCtx = context.Background()
+
+	for i := 0; i < breakerThreshold; i++ {
+		call(fakeCtx, "list volumes", func(*c.Client) error { return errUnreachable })
+	}
+
+	called := false
+	err := call(fakeCtx, "list volumes", func(*c.Client) error {
+		called = true
+		return nil
+	})
+	if called || codes.Unavailable != status.Code(err) {
+		t.Errorf("expected: %v, actual: %v, called: %v\n", codes.Unavailable, err, called)
+	}
+
+	rs, err := fakePlugin.Probe(fakeCtx, &csi.ProbeRequest{})
+	if err != nil || rs.GetReady().GetValue() {
+		t.Errorf("expected not ready, actual: %v, %v\n", rs, err)
+	}
+
+	// The breaker lets calls through once the cooldown is over
+	cooldown := breakerCooldown
+	breakerCooldown = 0
+	defer func() { breakerCooldown = cooldown }()
+
+	rs, err = fakePlugin.Probe(fakeCtx, &csi.ProbeRequest{})
+	if err != nil || !rs.GetReady().GetValue() {
+		t.Errorf("expected ready, actual: %v, %v\n", rs, err)
+	}
+
+	if breaker.tripped() {
+		t.Errorf("expected the breaker to be closed\n")
+	}
+}
@@ -21,6 +21,30 @@ const (
 	KParamAZ                = "availabilityzone"
 	KParamEnableReplication = "enablereplication"
 	KParamSecondaryAZ       = "secondaryavailabilityzone"
+	KParamMkfsOptions       = "mkfsoptions"
+	KParamMultipath         = "multipath"
+
+	// KParamProvisionerPrefix prefix of the parameters added by the external
+	// provisioner and snapshotter
+	KParamProvisionerPrefix = "csi.storage.k8s.io/"
+
+	// Parameters of the kubernetes objects a volume or snapshot is created for
+	KParamPVCName                   = KParamProvisionerPrefix + "pvc/name"
+	KParamPVCNamespace              = KParamProvisionerPrefix + "pvc/namespace"
+	KParamPVName                    = KParamProvisionerPrefix + "pv/name"
+	KParamVolumeSnapshotName        = KParamProvisionerPrefix + "volumesnapshot/name"
+	KParamVolumeSnapshotNamespace   = KParamProvisionerPrefix + "volumesnapshot/namespace"
+	KParamVolumeSnapshotContentName = KParamProvisionerPrefix + "volumesnapshotcontent/name"
+)
+
+const (
+	// Metadata keys of the kubernetes objects a volume or snapshot is created for
+	KMetaPVCName                   = "pvcName"
+	KMetaPVCNamespace              = "pvcNamespace"
+	KMetaPVName                    = "pvName"
+	KMetaVolumeSnapshotName        = "volumeSnapshotName"
+	KMetaVolumeSnapshotNamespace   = "volumeSnapshotNamespace"
+	KMetaVolumeSnapshotContentName = "volumeSnapshotContentName"
 )
 
 // CSI volume attribute keywords
@@ -32,6 +56,8 @@ const (
 	KVolumeProfileId     = "profileId"
 	KVolumeLvPath        = "lvPath"
 	KVolumeReplicationId = "replicationId"
+	KVolumeMkfsOptions   = "mkfsOptions"
+	KVolumeMultipath     = "multipath"
 )
 
 // CSI publish attribute keywords
@@ -47,6 +73,8 @@ const (
 const (
 	KTargetPath        = "targetPath"
 	KStagingTargetPath = "stagingTargetPath"
+	// KNodeId the CSI node id the volume is published to
+	KNodeId = "nodeId"
 )
 
 // Opensds replication metadata keywords
@@ -58,7 +86,29 @@ const (
 // volume prefix
 const SecondaryPrefix = "secondary-"
 
+const (
+	// TopologyZoneKey topology segment key of the availability zone
+	TopologyZoneKey = "topology." + PluginName + "/zone"
+	// KubernetesZoneLabel zone label of a kubernetes node
+	KubernetesZoneLabel = "failure-domain.beta.kubernetes.io/zone"
+)
+
+const (
+	// KSourceVolumeId volume metadata key of the volume a clone is created from
+	KSourceVolumeId = "sourceVolumeId"
+	// CloneSnapshotPrefix name prefix of the temporary snapshot of a clone
+	CloneSnapshotPrefix = "clone-"
+)
+
 const (
 	// DefFSType default filesystem type
 	DefFSType = "ext4"
 )
+
+var (
+	// SupportedFSTypes filesystem types the node service can format
+	SupportedFSTypes = []string{"ext2", "ext3", "ext4", "xfs", "btrfs"}
+	// MultiNodeWriterProtocols protocols with which a volume can be written
+	// from more than one node
+	MultiNodeWriterProtocols = []string{"rbd"}
+)
@@ -46,38 +46,27 @@ import (
 var (
 	// Client opensds client
 	Client *c.Client
+
+	// volumePollInterval interval of polling the status of a volume
+	volumePollInterval = 2 * time.Second
+	// expandTimeout timeout of waiting for a volume to be expanded
+	expandTimeout = 5 * time.Minute
+	// createTimeout timeout of waiting for a volume or snapshot to be created
+	createTimeout = 5 * time.Minute
 )
 
 func init() {
 	Client = sdscontroller.GetClient("", "")
 }
 
-// GetDefaultProfile implementation
-func GetDefaultProfile() (*model.ProfileSpec, error) {
-	profiles, err := Client.ListProfiles()
-	if err != nil {
-		glog.Error("Get default profile failed: ", err)
-		return nil, err
-	}
-
-	for _, profile := range profiles {
-		if profile.Name == "default" {
-			return profile, nil
-		}
-	}
-
-	return nil, status.Error(codes.FailedPrecondition, "No default profile")
-}
-
 // FindVolume implementation
-func FindVolume(req *model.VolumeSpec) (bool, bool, *model.VolumeSpec, error) {
+func FindVolume(ctx context.Context, req *model.VolumeSpec) (bool, bool, *model.VolumeSpec, error) {
 	isExist := false
-	volumes, err := Client.ListVolumes()
-
+	volumes, err := listVolumesByName(ctx, req.Name)
 	if err != nil {
 		glog.Error("List volumes failed: ", err)
 
-		return false, false, nil, err
+		return false, false, nil, statusError(err, "list volumes failed")
 	}
 
 	for _, volume := range volumes {
@@ -86,7 +75,7 @@ func FindVolume(req *model.VolumeSpec) (bool, bool, *model.VolumeSpec, error) {
 
 			if (volume.Size == req.Size) && (volume.ProfileId == req.ProfileId) &&
 				(volume.AvailabilityZone == req.AvailabilityZone) &&
-				(volume.SnapshotId == req.SnapshotId) {
+				isSameContentSource(volume, req) {
 				glog.V(5).Infof("Volume already exists and is compatible")
 
 				return true, true, volume, nil
@@ -97,6 +86,21 @@ func FindVolume(req *model.VolumeSpec) (bool, bool, *model.VolumeSpec, error) {
 	return isExist, false, nil, nil
 }
 
+// isSameContentSource Check if a volume was created from the source of a request
+func isSameContentSource(volume *model.VolumeSpec, req *model.VolumeSpec) bool {
+	sourceVolumeId := req.Metadata[KSourceVolumeId]
+	if volume.Metadata[KSourceVolumeId] != sourceVolumeId {
+		return false
+	}
+
+	// The snapshot a clone is created from is a temporary one
+	if "" != sourceVolumeId {
+		return true
+	}
+
+	return volume.SnapshotId == req.SnapshotId
+}
+
 // CreateVolume implementation
 func (p *Plugin) CreateVolume(
 	ctx context.Context,
@@ -106,6 +110,12 @@ func (p *Plugin) CreateVolume(
 	glog.V(5).Info("start to CreateVolume")
 	defer glog.V(5).Info("end to CreateVolume")
 
+	unlock, err := lockOperation(lockVolumeName + req.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
 	// build volume body
 	volumebody := &model.VolumeSpec{}
 	volumebody.Name = req.Name
@@ -121,33 +131,40 @@ func (p *Plugin) CreateVolume(
 		//Using default volume size
 		volumebody.Size = 1
 	}
-	var secondaryAZ = util.OpensdsDefaultSecondaryAZ
-	var enableReplication = false
-	for k, v := range req.GetParameters() {
-		switch strings.ToLower(k) {
-		case KParamProfile:
-			volumebody.ProfileId = v
-		case KParamAZ:
-			volumebody.AvailabilityZone = v
-		case KParamEnableReplication:
-			if strings.ToLower(v) == "true" {
-				enableReplication = true
-			}
-		case KParamSecondaryAZ:
-			secondaryAZ = v
-		}
+	params, err := p.parseVolumeParameters(ctx, req.GetParameters())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateMkfsOptions(params.mkfsOptions, req.GetVolumeCapabilities()); err != nil {
+		return nil, err
 	}
 
+	if nil != params.profile {
+		volumebody.ProfileId = params.profile.Id
+	}
+	volumebody.AvailabilityZone = params.az
+	volumebody.Metadata = params.metadata
+	volumebody.Description = describeOwner("PVC", params.metadata[KMetaPVCNamespace], params.metadata[KMetaPVCName])
+	var secondaryAZ = params.secondaryAZ
+	var enableReplication = params.enableReplication
+
 	contentSource := req.GetVolumeContentSource()
 	if nil != contentSource {
 		snapshot := contentSource.GetSnapshot()
 		if snapshot != nil {
 			volumebody.SnapshotId = snapshot.GetSnapshotId()
 		}
+
+		if source := contentSource.GetVolume(); source != nil {
+			if err := setCloneSource(ctx, volumebody, source.GetVolumeId(), req.CapacityRange); err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	if "" == volumebody.ProfileId {
-		defaultRrf, err := GetDefaultProfile()
+		defaultRrf, err := p.getDefaultProfile(ctx)
 		if err != nil {
 			return nil, err
 		}
@@ -155,13 +172,15 @@ func (p *Plugin) CreateVolume(
 		volumebody.ProfileId = defaultRrf.Id
 	}
 
-	if "" == volumebody.AvailabilityZone {
-		volumebody.AvailabilityZone = "default"
+	az, err := selectAvailabilityZone(volumebody.AvailabilityZone, req.AccessibilityRequirements)
+	if err != nil {
+		return nil, err
 	}
+	volumebody.AvailabilityZone = az
 
 	glog.V(5).Infof("CreateVolume volumebody: %v", volumebody)
 
-	isExist, isCompatible, findVolume, err := FindVolume(volumebody)
+	isExist, isCompatible, findVolume, err := FindVolume(ctx, volumebody)
 	if err != nil {
 		return nil, err
 	}
@@ -176,16 +195,31 @@ func (p *Plugin) CreateVolume(
 				"Volume already exists but is incompatible")
 		}
 	} else {
-		createVolume, err := Client.CreateVolume(volumebody)
+		var createVolume *model.VolumeSpec
+		var err error
+
+		if sourceVolumeId := volumebody.Metadata[KSourceVolumeId]; "" != sourceVolumeId {
+			createVolume, err = cloneVolume(ctx, volumebody, sourceVolumeId)
+		} else {
+			err = call(ctx, "create volume", func(client *c.Client) (err error) {
+				createVolume, err = client.CreateVolume(volumebody)
+				return err
+			})
+		}
+		lookups.forget(lookupVolumeName + volumebody.Name)
+
 		if err != nil {
-			isExist, isCompatible, findV, findErr := FindVolume(volumebody)
+			isExist, isCompatible, findV, findErr := FindVolume(ctx, volumebody)
 			if findErr != nil {
 				return nil, findErr
 			}
 
 			if !(isExist && isCompatible) {
 				glog.Error("failed to CreateVolume", err)
-				return nil, err
+				if "" != volumebody.Metadata[KSourceVolumeId] {
+					deleteCloneSnapshot(volumebody.Name, err)
+				}
+				return nil, statusError(err, "create volume %s failed", volumebody.Name)
 			}
 
 			v = findV
@@ -195,6 +229,15 @@ func (p *Plugin) CreateVolume(
 		}
 	}
 
+	// The volume can only be used once the backend has created it
+	v, err = waitForVolumeCreated(ctx, v.Id)
+	if "" != volumebody.Metadata[KSourceVolumeId] {
+		deleteCloneSnapshot(volumebody.Name, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
 	glog.V(5).Infof("opensds volume = %v", v)
 	// return volume info
 	volumeinfo := &csi.Volume{
@@ -208,15 +251,42 @@ func (p *Plugin) CreateVolume(
 			KVolumeProfileId: v.ProfileId,
 			KVolumeLvPath:    v.Metadata["lvPath"],
 		},
+		ContentSource: contentSource,
+		AccessibleTopology: []*csi.Topology{
+			&csi.Topology{
+				Segments: map[string]string{TopologyZoneKey: v.AvailabilityZone},
+			},
+		},
+	}
+
+	// The node service formats the volume with the mkfs options
+	if "" != params.mkfsOptions {
+		volumeinfo.VolumeContext[KVolumeMkfsOptions] = params.mkfsOptions
+	}
+
+	// The node service stages the volume only through dm-multipath
+	if params.multipath {
+		volumeinfo.VolumeContext[KVolumeMultipath] = "true"
 	}
 
 	glog.V(5).Infof("resp volumeinfo = %v", volumeinfo)
 	if enableReplication && !isExist {
 		volumebody.AvailabilityZone = secondaryAZ
 		volumebody.Name = SecondaryPrefix + req.Name
-		sVol, err := Client.CreateVolume(volumebody)
+		volumebody.SnapshotId = ""
+		var sVol *model.VolumeSpec
+		err := call(ctx, "create secondary volume", func(client *c.Client) (err error) {
+			sVol, err = client.CreateVolume(volumebody)
+			return err
+		})
+		lookups.forget(lookupVolumeName + volumebody.Name)
 		if err != nil {
 			glog.Errorf("failed to create secondar volume: %v", err)
+			return nil, statusError(err, "create secondary volume %s failed", volumebody.Name)
+		}
+
+		sVol, err = waitForVolumeCreated(ctx, sVol.Id)
+		if err != nil {
 			return nil, err
 		}
 		replicaBody := &model.ReplicationSpec{
@@ -226,10 +296,15 @@ func (p *Plugin) CreateVolume(
 			ReplicationMode:   model.ReplicationModeSync,
 			ReplicationPeriod: 0,
 		}
-		replicaResp, err := Client.CreateReplication(replicaBody)
+		var replicaResp *model.ReplicationSpec
+		err = call(ctx, "create replication", func(client *c.Client) (err error) {
+			replicaResp, err = client.CreateReplication(replicaBody)
+			return err
+		})
+		lookups.forget(v.Id, sVol.Id)
 		if err != nil {
 			glog.Errorf("Create replication failed: %v", err)
-			return nil, err
+			return nil, statusError(err, "create replication %s failed", req.Name)
 		}
 		volumeinfo.VolumeContext[KVolumeReplicationId] = replicaResp.Id
 	}
@@ -239,16 +314,260 @@ func (p *Plugin) CreateVolume(
 	}, nil
 }
 
-func getReplicationByVolume(volId string) *model.ReplicationSpec {
-	replications, _ := Client.ListReplications()
-	for _, r := range replications {
-		if volId == r.PrimaryVolumeId || volId == r.SecondaryVolumeId {
-			return r
+// selectAvailabilityZone Select the AZ of a volume, the AZ of the StorageClass
+// must be one of the requisite ones, otherwise the first preferred one which is
+// requisite is selected
+func selectAvailabilityZone(az string, requirement *csi.TopologyRequirement) (string, error) {
+	var requisite []string
+	for _, topology := range requirement.GetRequisite() {
+		if zone, ok := topology.GetSegments()[TopologyZoneKey]; ok {
+			requisite = append(requisite, zone)
+		}
+	}
+
+	if "" != az {
+		if len(requisite) > 0 && !utils.Contained(az, requisite) {
+			msg := fmt.Sprintf("the availability zone %s is not in the requisite topology %v", az, requisite)
+			return "", status.Error(codes.InvalidArgument, msg)
+		}
+
+		return az, nil
+	}
+
+	for _, topology := range requirement.GetPreferred() {
+		zone, ok := topology.GetSegments()[TopologyZoneKey]
+		if ok && (0 == len(requisite) || utils.Contained(zone, requisite)) {
+			return zone, nil
+		}
+	}
+
+	if len(requisite) > 0 {
+		return requisite[0], nil
+	}
+
+	return util.OpensdsDefaultAZ, nil
+}
+
+// setCloneSource Set the source volume of a clone and check that the clone is
+// not smaller than it
+func setCloneSource(ctx context.Context, volumebody *model.VolumeSpec, sourceVolumeId string,
+	capacityRange *csi.CapacityRange) error {
+	source, err := getVolume(ctx, sourceVolumeId)
+	if err != nil {
+		if codes.NotFound == status.Code(err) {
+			msg := fmt.Sprintf("the source volume %s is not exist", sourceVolumeId)
+			return status.Error(codes.NotFound, msg)
+		}
+		return err
+	}
+
+	if nil == capacityRange || 0 == capacityRange.RequiredBytes {
+		if volumebody.Size < source.Size {
+			volumebody.Size = source.Size
 		}
+	} else if volumebody.Size < source.Size {
+		msg := fmt.Sprintf("the size %d GiB is smaller than the size %d GiB of the source volume %s",
+			volumebody.Size, source.Size, sourceVolumeId)
+		return status.Error(codes.OutOfRange, msg)
+	}
+
+	if nil != capacityRange && capacityRange.LimitBytes > 0 &&
+		volumebody.Size*util.GiB > capacityRange.LimitBytes {
+		msg := fmt.Sprintf("the size %d GiB of the clone exceeds the limit %d bytes",
+			volumebody.Size, capacityRange.LimitBytes)
+		return status.Error(codes.OutOfRange, msg)
 	}
+
+	if nil == volumebody.Metadata {
+		volumebody.Metadata = make(map[string]string)
+	}
+	volumebody.Metadata[KSourceVolumeId] = sourceVolumeId
+
 	return nil
 }
 
+// cloneVolume Create a volume from a temporary snapshot of the source volume.
+// The snapshot of an earlier request for the clone is used again, it is only
+// deleted by deleteCloneSnapshot once the clone is created or failed.
+func cloneVolume(ctx context.Context, volumebody *model.VolumeSpec, sourceVolumeId string) (*model.VolumeSpec, error) {
+	snapReq := &model.VolumeSnapshotSpec{
+		Name:        CloneSnapshotPrefix + volumebody.Name,
+		Description: "temporary snapshot to clone volume " + sourceVolumeId,
+		VolumeId:    sourceVolumeId,
+	}
+
+	snapshots, err := listSnapshotsByName(ctx, snapReq.Name)
+	if err != nil {
+		return nil, statusError(err, "list snapshots failed")
+	}
+
+	var snapshot *model.VolumeSnapshotSpec
+	for _, s := range snapshots {
+		if s.VolumeId == sourceVolumeId {
+			glog.V(5).Infof("the temporary snapshot %s of an earlier clone is used", s.Id)
+			snapshot = s
+			break
+		}
+	}
+
+	if nil == snapshot {
+		err := call(ctx, "create snapshot", func(client *c.Client) (err error) {
+			snapshot, err = client.CreateVolumeSnapshot(snapReq)
+			return err
+		})
+		lookups.forget(lookupSnapshotName + snapReq.Name)
+		if err != nil {
+			glog.Errorf("failed to create snapshot of the source volume %s: %v", sourceVolumeId, err)
+			return nil, statusError(err, "create snapshot of the source volume %s failed", sourceVolumeId)
+		}
+	}
+
+	_, err = waitForSnapshot(ctx, snapshot.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	cloneReq := *volumebody
+	cloneReq.SnapshotId = snapshot.Id
+	var vol *model.VolumeSpec
+	err = call(ctx, "create volume", func(client *c.Client) (err error) {
+		vol, err = client.CreateVolume(&cloneReq)
+		return err
+	})
+	if err != nil {
+		return nil, statusError(err, "create volume %s failed", cloneReq.Name)
+	}
+
+	return vol, nil
+}
+
+// deleteCloneSnapshot deletes the temporary snapshot of a clone once the
+// backend is done with the clone, err is the result of waiting for it. The
+// data may still be copied from the snapshot of a clone which is not created
+// when the request is done, the snapshot is left to the retried request.
+func deleteCloneSnapshot(cloneName string, err error) {
+	if code := status.Code(err); codes.Canceled == code || codes.DeadlineExceeded == code {
+		glog.V(5).Infof("the clone %s is not created yet, its temporary snapshot is kept", cloneName)
+		return
+	}
+
+	// The snapshot is deleted even if the request is done
+	ctx := context.Background()
+	snapshots, err := listSnapshotsByName(ctx, CloneSnapshotPrefix+cloneName)
+	if err != nil {
+		glog.Errorf("failed to list the temporary snapshots of the clone %s: %v", cloneName, err)
+		return
+	}
+
+	for _, snapshot := range snapshots {
+		err := retry(ctx, "delete snapshot", func(client *c.Client) error {
+			return client.DeleteVolumeSnapshot(snapshot.Id, nil)
+		})
+		lookups.forget(snapshot.Id)
+		if err != nil && !isNotFoundError(err) {
+			glog.Errorf("failed to delete the temporary snapshot %s: %v", snapshot.Id, err)
+		}
+	}
+}
+
+// waitForVolumeCreated waits until the backend has created a volume, a volume
+// the backend failed to create is deleted
+func waitForVolumeCreated(ctx context.Context, volId string) (*model.VolumeSpec, error) {
+	return waitForVolume(ctx, volId, "created", createTimeout, func(v *model.VolumeSpec) (bool, error) {
+		// A volume found in use by a retried request was created before
+		if model.VolumeAvailable == v.Status || model.VolumeInUse == v.Status {
+			return true, nil
+		}
+
+		if !isVolumeErrorStatus(v.Status) {
+			return false, nil
+		}
+
+		// The volume is deleted even if the request is done
+		if err := deleteVolume(context.Background(), volId); err != nil {
+			glog.Errorf("failed to delete the volume %s in %s: %v", volId, v.Status, err)
+		}
+
+		// e.g. error_insufficient_capacity
+		code := codes.Internal
+		if c, ok := messageCode(strings.Replace(v.Status, "_", " ", -1)); ok && codes.ResourceExhausted == c {
+			code = c
+		}
+
+		return false, status.Error(code,
+			fmt.Sprintf("the backend failed to create the volume %s, it is deleted", volId))
+	})
+}
+
+// isVolumeErrorStatus checks if a status is error or one of the error_* or
+// errorDeleting like statuses
+func isVolumeErrorStatus(s string) bool {
+	return strings.HasPrefix(strings.ToLower(s), model.VolumeError)
+}
+
+// waitForSnapshot waits until a snapshot is available, a snapshot the backend
+// failed to create is deleted
+func waitForSnapshot(ctx context.Context, snapshotId string) (*model.VolumeSnapshotSpec, error) {
+	timeout := time.After(createTimeout)
+
+	for {
+		var snapshot *model.VolumeSnapshotSpec
+		err := retry(ctx, "get snapshot", func(client *c.Client) (err error) {
+			snapshot, err = client.GetVolumeSnapshot(snapshotId)
+			return err
+		})
+		if err != nil && !isNotFoundError(err) {
+			return nil, statusError(err, "get snapshot %s failed", snapshotId)
+		}
+
+		if err != nil || snapshot == nil {
+			msg := fmt.Sprintf("the snapshot %s is not exist", snapshotId)
+			return nil, status.Error(codes.NotFound, msg)
+		}
+
+		switch snapshot.Status {
+		case model.VolumeSnapAvailable:
+			return snapshot, nil
+		case model.VolumeSnapError:
+			// The snapshot is deleted even if the request is done
+			err := retry(context.Background(), "delete snapshot", func(client *c.Client) error {
+				return client.DeleteVolumeSnapshot(snapshotId, nil)
+			})
+			lookups.forget(snapshotId)
+			if err != nil && !isNotFoundError(err) {
+				glog.Errorf("failed to delete the snapshot %s in error: %v", snapshotId, err)
+			}
+
+			msg := fmt.Sprintf("the backend failed to create the snapshot %s, it is deleted", snapshotId)
+			glog.Error(msg)
+			return nil, status.Error(codes.Internal, msg)
+		case model.VolumeSnapCreating:
+			break
+		default:
+			msg := fmt.Sprintf("the snapshot %s is %s", snapshotId, snapshot.Status)
+			return nil, status.Error(codes.FailedPrecondition, msg)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, contextError(ctx, "wait for snapshot "+snapshotId)
+		case <-timeout:
+			msg := fmt.Sprintf("timed out waiting for the snapshot %s to be available", snapshotId)
+			return nil, status.Error(codes.DeadlineExceeded, msg)
+		case <-time.After(volumePollInterval):
+		}
+	}
+}
+
+func getReplicationByVolume(ctx context.Context, volId string) *model.ReplicationSpec {
+	r, err := findReplicationByVolume(ctx, volId)
+	if err != nil {
+		glog.Errorf("failed to find the replication of the volume %s: %v", volId, err)
+		return nil
+	}
+	return r
+}
+
 // DeleteVolume implementation
 func (p *Plugin) DeleteVolume(
 	ctx context.Context,
@@ -258,19 +577,34 @@ func (p *Plugin) DeleteVolume(
 	defer glog.V(5).Info("end to DeleteVolume")
 	volId := req.VolumeId
 
-	r := getReplicationByVolume(volId)
+	if "" == volId {
+		return nil, status.Error(codes.InvalidArgument, "Volume_id must be specified")
+	}
+
+	unlock, err := lockOperation(lockVolumeId + volId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// A volume which does not exist has been deleted
+	r := getReplicationByVolume(ctx, volId)
 	if r != nil {
-		if err := Client.DeleteReplication(r.Id, nil); err != nil {
-			return nil, err
+		err := retry(ctx, "delete replication", func(client *c.Client) error {
+			return client.DeleteReplication(r.Id, nil)
+		})
+		lookups.forget(r.Id)
+		if err != nil && !isNotFoundError(err) {
+			return nil, statusError(err, "delete replication %s failed", r.Id)
 		}
-		if err := Client.DeleteVolume(r.PrimaryVolumeId, &model.VolumeSpec{}); err != nil {
+		if err := deleteVolume(ctx, r.PrimaryVolumeId); err != nil {
 			return nil, err
 		}
-		if err := Client.DeleteVolume(r.SecondaryVolumeId, &model.VolumeSpec{}); err != nil {
+		if err := deleteVolume(ctx, r.SecondaryVolumeId); err != nil {
 			return nil, err
 		}
 	} else {
-		if err := Client.DeleteVolume(volId, &model.VolumeSpec{}); err != nil {
+		if err := deleteVolume(ctx, volId); err != nil {
 			return nil, err
 		}
 	}
@@ -278,6 +612,33 @@ func (p *Plugin) DeleteVolume(
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
+// deleteVolume deletes a volume, it succeeds if the volume does not exist
+func deleteVolume(ctx context.Context, volId string) error {
+	err := retry(ctx, "delete volume", func(client *c.Client) error {
+		return client.DeleteVolume(volId, &model.VolumeSpec{})
+	})
+	lookups.forget(volId)
+	if err != nil && !isNotFoundError(err) {
+		glog.Errorf("failed to delete volume %s: %v", volId, err)
+		return statusError(err, "delete volume %s failed", volId)
+	}
+
+	return nil
+}
+
+// withoutNodeId returns the metadata of an attachment without the node id,
+// which the attachments published before it was recorded do not have
+func withoutNodeId(metadata map[string]string) map[string]string {
+	m := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		if KNodeId != k {
+			m[k] = v
+		}
+	}
+
+	return m
+}
+
 // isStringMapEqual implementation
 func isStringMapEqual(metadataA, metadataB map[string]string) bool {
 	glog.V(5).Infof("start to isStringMapEqual, metadataA = %v, metadataB = %v!",
@@ -301,15 +662,15 @@ func isStringMapEqual(metadataA, metadataB map[string]string) bool {
 }
 
 // isVolumePublished Check if the volume is published and compatible
-func isVolumePublished(canAtMultiNode bool, attachReq *model.VolumeAttachmentSpec,
+func isVolumePublished(ctx context.Context, canAtMultiNode bool, attachReq *model.VolumeAttachmentSpec,
 	metadata map[string]string) (*model.VolumeAttachmentSpec, error) {
 	glog.V(5).Infof("start to isVolumePublished, canAtMultiNode = %v, attachReq = %v",
 		canAtMultiNode, attachReq)
 
-	attachments, err := Client.ListVolumeAttachments()
+	attachments, err := listAttachmentsByVolume(ctx, attachReq.VolumeId)
 	if err != nil {
 		glog.V(5).Info("ListVolumeAttachments failed: " + err.Error())
-		return nil, status.Error(codes.FailedPrecondition, err.Error())
+		return nil, statusError(err, "list volume attachments failed")
 	}
 
 	for _, attachSpec := range attachments {
@@ -326,7 +687,7 @@ func isVolumePublished(canAtMultiNode bool, attachReq *model.VolumeAttachmentSpe
 				if attachSpec.Platform == attachReq.Platform &&
 					attachSpec.OsType == attachReq.OsType &&
 					attachSpec.Initiator == attachReq.Initiator &&
-					isStringMapEqual(attachSpec.Metadata, metadata) &&
+					isStringMapEqual(withoutNodeId(attachSpec.Metadata), withoutNodeId(metadata)) &&
 					attachSpec.AccessProtocol == attachReq.AccessProtocol {
 					glog.V(5).Info("Volume published and is compatible")
 
@@ -343,6 +704,32 @@ func isVolumePublished(canAtMultiNode bool, attachReq *model.VolumeAttachmentSpe
 	return nil, nil
 }
 
+// getPoolProtocol gets the access protocol of the pool a volume is in
+func getPoolProtocol(ctx context.Context, poolId string) (string, error) {
+	var pool *model.StoragePoolSpec
+	err := retry(ctx, "get pool", func(client *c.Client) (err error) {
+		pool, err = client.GetPool(poolId)
+		return err
+	})
+	if err != nil && !isNotFoundError(err) {
+		return "", statusError(err, "get pool %s failed", poolId)
+	}
+
+	if err != nil || pool == nil {
+		msg := fmt.Sprintf("the pool %s is not exist", poolId)
+		glog.Error(msg)
+		return "", status.Error(codes.NotFound, msg)
+	}
+
+	var protocol = strings.ToLower(pool.Extras.IOConnectivity.AccessProtocol)
+	if protocol == "" {
+		// Default protocol is iscsi
+		protocol = "iscsi"
+	}
+
+	return protocol, nil
+}
+
 // ControllerPublishVolume implementation
 func (p *Plugin) ControllerPublishVolume(
 	ctx context.Context,
@@ -352,24 +739,21 @@ func (p *Plugin) ControllerPublishVolume(
 	glog.V(5).Info("start to ControllerPublishVolume")
 	defer glog.V(5).Info("end to ControllerPublishVolume")
 
-	//check volume is exist
-	volSpec, errVol := Client.GetVolume(req.VolumeId)
-	if errVol != nil || volSpec == nil {
-		msg := fmt.Sprintf("the volume %s is not exist", req.VolumeId)
-		return nil, status.Error(codes.NotFound, msg)
+	unlock, err := lockOperation(lockVolumeId + req.VolumeId)
+	if err != nil {
+		return nil, err
 	}
+	defer unlock()
 
-	pool, err := Client.GetPool(volSpec.PoolId)
-	if err != nil || pool == nil {
-		msg := fmt.Sprintf("the pool %s is not sxist", volSpec.PoolId)
-		glog.Error(msg)
-		return nil, status.Error(codes.NotFound, msg)
+	//check volume is exist
+	volSpec, err := getVolume(ctx, req.VolumeId)
+	if err != nil {
+		return nil, err
 	}
 
-	var protocol = strings.ToLower(pool.Extras.IOConnectivity.AccessProtocol)
-	if protocol == "" {
-		// Default protocol is iscsi
-		protocol = "iscsi"
+	protocol, err := getPoolProtocol(ctx, volSpec.PoolId)
+	if err != nil {
+		return nil, err
 	}
 
 	var initator string
@@ -410,7 +794,7 @@ func (p *Plugin) ControllerPublishVolume(
 			OsType:    runtime.GOOS,
 			Initiator: initator,
 		},
-		Metadata:       req.VolumeContext,
+		Metadata:       utils.MergeStringMaps(req.VolumeContext, map[string]string{KNodeId: req.NodeId}),
 		AccessProtocol: protocol,
 	}
 
@@ -424,7 +808,7 @@ func (p *Plugin) ControllerPublishVolume(
 	}
 
 	expectedMetadata := utils.MergeStringMaps(attachReq.Metadata, volSpec.Metadata)
-	existAttachment, err := isVolumePublished(canAtMultiNode, attachReq, expectedMetadata)
+	existAttachment, err := isVolumePublished(ctx, canAtMultiNode, attachReq, expectedMetadata)
 	if err != nil {
 		return nil, err
 	}
@@ -432,11 +816,15 @@ func (p *Plugin) ControllerPublishVolume(
 	var attachSpec *model.VolumeAttachmentSpec
 
 	if nil == existAttachment {
-		newAttachment, errAttach := Client.CreateVolumeAttachment(attachReq)
+		var newAttachment *model.VolumeAttachmentSpec
+		errAttach := call(ctx, "create volume attachment", func(client *c.Client) (err error) {
+			newAttachment, err = client.CreateVolumeAttachment(attachReq)
+			return err
+		})
+		lookups.forget(attachReq.VolumeId)
 		if errAttach != nil {
-			msg := fmt.Sprintf("the volume %s failed to publish to node %s.", req.VolumeId, req.NodeId)
-			glog.Errorf("failed to ControllerPublishVolume: %v", attachReq)
-			return nil, status.Error(codes.FailedPrecondition, msg)
+			glog.Errorf("failed to ControllerPublishVolume: %v, %v", attachReq, errAttach)
+			return nil, statusError(errAttach, "the volume %s failed to publish to node %s", req.VolumeId, req.NodeId)
 		}
 
 		attachSpec = newAttachment
@@ -454,23 +842,31 @@ func (p *Plugin) ControllerPublishVolume(
 	}
 
 	if replicationId, ok := req.VolumeContext[KVolumeReplicationId]; ok {
-		r, err := Client.GetReplication(replicationId)
+		var r *model.ReplicationSpec
+		err := retry(ctx, "get replication", func(client *c.Client) (err error) {
+			r, err = client.GetReplication(replicationId)
+			return err
+		})
 		if err != nil {
-			return nil, status.Error(codes.FailedPrecondition, "Get replication failed")
+			return nil, statusError(err, "get replication %s failed", replicationId)
 		}
 
 		attachReq.VolumeId = r.SecondaryVolumeId
-		existAttachment, err := isVolumePublished(canAtMultiNode, attachReq, expectedMetadata)
+		existAttachment, err := isVolumePublished(ctx, canAtMultiNode, attachReq, expectedMetadata)
 		if err != nil {
 			return nil, err
 		}
 
 		if nil == existAttachment {
-			newAttachment, errAttach := Client.CreateVolumeAttachment(attachReq)
+			var newAttachment *model.VolumeAttachmentSpec
+			errAttach := call(ctx, "create volume attachment", func(client *c.Client) (err error) {
+				newAttachment, err = client.CreateVolumeAttachment(attachReq)
+				return err
+			})
+			lookups.forget(attachReq.VolumeId)
 			if errAttach != nil {
-				msg := fmt.Sprintf("the volume %s failed to publish to node %s.", req.VolumeId, req.NodeId)
-				glog.Errorf("failed to ControllerPublishVolume: %v", attachReq)
-				return nil, status.Error(codes.FailedPrecondition, msg)
+				glog.Errorf("failed to ControllerPublishVolume: %v, %v", attachReq, errAttach)
+				return nil, statusError(errAttach, "the volume %s failed to publish to node %s", req.VolumeId, req.NodeId)
 			}
 
 			attachSpec = newAttachment
@@ -549,16 +945,20 @@ func (p *Plugin) ControllerUnpublishVolume(
 		req.VolumeId, req.NodeId, req.Secrets)
 	defer glog.V(5).Info("end to ControllerUnpublishVolume")
 
+	unlock, err := lockOperation(lockVolumeId + req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
 	//check volume is exist
-	volSpec, errVol := Client.GetVolume(req.VolumeId)
-	if errVol != nil || volSpec == nil {
-		msg := fmt.Sprintf("the volume %s is not exist", req.VolumeId)
-		return nil, status.Error(codes.NotFound, msg)
+	if _, err := getVolume(ctx, req.VolumeId); err != nil {
+		return nil, err
 	}
 
-	attachments, err := Client.ListVolumeAttachments()
+	attachments, err := listAttachmentsByVolume(ctx, req.VolumeId)
 	if err != nil {
-		return nil, status.Error(codes.FailedPrecondition, "Failed to unpublish volume.")
+		return nil, statusError(err, "list volume attachments failed")
 	}
 
 	hostName, _, _, _ := extractInfoFromNodeId(req.NodeId)
@@ -570,7 +970,12 @@ func (p *Plugin) ControllerUnpublishVolume(
 		}
 	}
 
-	if r := getReplicationByVolume(req.VolumeId); r != nil {
+	if r := getReplicationByVolume(ctx, req.VolumeId); r != nil {
+		attachments, err := listAttachmentsByVolume(ctx, r.SecondaryVolumeId)
+		if err != nil {
+			return nil, statusError(err, "list volume attachments failed")
+		}
+
 		for _, attachSpec := range attachments {
 			if attachSpec.VolumeId == r.SecondaryVolumeId && (req.NodeId == "" || attachSpec.Host == hostName) {
 				acts = append(acts, attachSpec)
@@ -579,11 +984,14 @@ func (p *Plugin) ControllerUnpublishVolume(
 	}
 
 	for _, act := range acts {
-		err = Client.DeleteVolumeAttachment(act.Id, act)
-		if err != nil {
-			msg := fmt.Sprintf("the volume %s failed to unpublish from node %s.", req.VolumeId, req.NodeId)
+		act := act
+		err = retry(ctx, "delete volume attachment", func(client *c.Client) error {
+			return client.DeleteVolumeAttachment(act.Id, act)
+		})
+		lookups.forget(act.VolumeId)
+		if err != nil && !isNotFoundError(err) {
 			glog.Errorf("failed to ControllerUnpublishVolume: %v", err)
-			return nil, status.Error(codes.FailedPrecondition, msg)
+			return nil, statusError(err, "the volume %s failed to unpublish from node %s", req.VolumeId, req.NodeId)
 		}
 
 		glog.V(5).Infof("attachment %v has been successfully deleted", act.Id)
@@ -597,7 +1005,210 @@ func (p *Plugin) ValidateVolumeCapabilities(
 	ctx context.Context,
 	req *csi.ValidateVolumeCapabilitiesRequest) (
 	*csi.ValidateVolumeCapabilitiesResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+
+	glog.V(5).Infof("start to ValidateVolumeCapabilities, VolumeId: %v, VolumeCapabilities: %v",
+		req.VolumeId, req.VolumeCapabilities)
+	defer glog.V(5).Info("end to ValidateVolumeCapabilities")
+
+	if "" == req.VolumeId || 0 == len(req.VolumeCapabilities) {
+		return nil, status.Error(codes.InvalidArgument, "Volume_id/volume_capabilities must be specified")
+	}
+
+	volSpec, err := getVolume(ctx, req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+
+	protocol, err := getPoolProtocol(ctx, volSpec.PoolId)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, capability := range req.VolumeCapabilities {
+		if msg := validateVolumeCapability(capability, protocol); msg != "" {
+			glog.V(5).Infof("volume %s does not support the capability: %s", req.VolumeId, msg)
+			return &csi.ValidateVolumeCapabilitiesResponse{Message: msg}, nil
+		}
+	}
+
+	return &csi.ValidateVolumeCapabilitiesResponse{
+		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeContext:      req.VolumeContext,
+			VolumeCapabilities: req.VolumeCapabilities,
+			Parameters:         req.Parameters,
+		},
+	}, nil
+}
+
+// validateVolumeCapability checks if a capability can be honored for a volume
+// accessed with the protocol, the reason is returned if it can not
+func validateVolumeCapability(capability *csi.VolumeCapability, protocol string) string {
+	if capability == nil || capability.AccessMode == nil {
+		return "access mode must be specified"
+	}
+
+	mode := capability.AccessMode.Mode
+	switch mode {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
+		break
+	case csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:
+		if !utils.Contained(protocol, MultiNodeWriterProtocols) {
+			return fmt.Sprintf("access mode %v is not supported by protocol %s", mode, protocol)
+		}
+	default:
+		return fmt.Sprintf("access mode %v is not supported", mode)
+	}
+
+	if capability.GetBlock() != nil {
+		return ""
+	}
+
+	mnt := capability.GetMount()
+	if mnt == nil {
+		return "access type must be block or mount"
+	}
+
+	if "" != mnt.FsType && !utils.Contained(mnt.FsType, SupportedFSTypes) {
+		return fmt.Sprintf("fs type %s is not supported", mnt.FsType)
+	}
+
+	readOnly := csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY == mode ||
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY == mode
+	flags := make(map[string]bool)
+
+	for _, flag := range mnt.MountFlags {
+		switch {
+		case "" == strings.TrimSpace(flag):
+			return "mount flag cannot be empty"
+		case "bind" == flag || "remount" == flag:
+			return fmt.Sprintf("mount flag %s is managed by the driver", flag)
+		case !isMountOptionAllowed(mnt.FsType, flag):
+			return fmt.Sprintf("mount flag %s is not allowed", flag)
+		case "rw" == flag && readOnly:
+			return fmt.Sprintf("mount flag rw conflicts with access mode %v", mode)
+		case ("rw" == flag && flags["ro"]) || ("ro" == flag && flags["rw"]):
+			return "mount flags ro and rw conflict"
+		}
+
+		flags[flag] = true
+	}
+
+	return ""
+}
+
+// ControllerExpandVolume implementation
+func (p *Plugin) ControllerExpandVolume(
+	ctx context.Context,
+	req *csi.ControllerExpandVolumeRequest) (
+	*csi.ControllerExpandVolumeResponse, error) {
+
+	glog.V(5).Infof("start to ControllerExpandVolume, VolumeId: %v, CapacityRange: %v",
+		req.VolumeId, req.CapacityRange)
+	defer glog.V(5).Info("end to ControllerExpandVolume")
+
+	if "" == req.VolumeId || nil == req.CapacityRange {
+		return nil, status.Error(codes.InvalidArgument, "Volume_id/capacity_range must be specified")
+	}
+
+	unlock, err := lockOperation(lockVolumeId + req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	allocationUnitBytes := util.GiB
+	newSize := (req.CapacityRange.RequiredBytes + allocationUnitBytes - 1) / allocationUnitBytes
+	if newSize < 1 {
+		newSize = 1
+	}
+
+	if limit := req.CapacityRange.LimitBytes; limit > 0 && newSize*allocationUnitBytes > limit {
+		msg := fmt.Sprintf("the size %d GiB exceeds the limit %d bytes", newSize, limit)
+		return nil, status.Error(codes.OutOfRange, msg)
+	}
+
+	vol, err := getVolume(ctx, req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+
+	if vol.Size < newSize {
+		if model.VolumeAvailable != vol.Status && model.VolumeInUse != vol.Status {
+			msg := fmt.Sprintf("the volume %s cannot be expanded in status %s", req.VolumeId, vol.Status)
+			return nil, status.Error(codes.FailedPrecondition, msg)
+		}
+
+		err = call(ctx, "extend volume", func(client *c.Client) error {
+			_, err := client.ExtendVolume(req.VolumeId, &model.ExtendVolumeSpec{NewSize: newSize})
+			return err
+		})
+		lookups.forget(req.VolumeId)
+		if err != nil {
+			glog.Errorf("failed to expand the volume %s: %v", req.VolumeId, err)
+			return nil, statusError(err, "failed to expand the volume %s", req.VolumeId)
+		}
+
+		vol, err = waitForVolume(ctx, req.VolumeId, "expanded", expandTimeout, func(v *model.VolumeSpec) (bool, error) {
+			if model.VolumeErrorExtending == v.Status {
+				return false, status.Error(codes.Internal,
+					fmt.Sprintf("the backend failed to expand the volume %s", req.VolumeId))
+			}
+
+			return v.Size >= newSize && model.VolumeExtending != v.Status, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// A block volume has no filesystem for the node to grow
+	return &csi.ControllerExpandVolumeResponse{
+		CapacityBytes:         vol.Size * allocationUnitBytes,
+		NodeExpansionRequired: nil == req.GetVolumeCapability().GetBlock(),
+	}, nil
+}
+
+// ControllerGetVolume implementation, GET_VOLUME is not advertised
+func (p *Plugin) ControllerGetVolume(
+	ctx context.Context,
+	req *csi.ControllerGetVolumeRequest) (
+	*csi.ControllerGetVolumeResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "ControllerGetVolume is not supported")
+}
+
+// waitForVolume waits until the volume is done, an error of done stops waiting
+func waitForVolume(ctx context.Context, volId string, action string, timeout time.Duration,
+	done func(*model.VolumeSpec) (bool, error)) (*model.VolumeSpec, error) {
+	expired := time.After(timeout)
+
+	for {
+		vol, err := getVolume(ctx, volId)
+		if err != nil {
+			return nil, err
+		}
+
+		ok, err := done(vol)
+		if err != nil {
+			glog.Error(err.Error())
+			return nil, err
+		}
+
+		if ok {
+			return vol, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, contextError(ctx, "wait for volume "+volId)
+		case <-expired:
+			msg := fmt.Sprintf("timed out waiting for the volume %s to be %s", volId, action)
+			return nil, status.Error(codes.DeadlineExceeded, msg)
+		case <-time.After(volumePollInterval):
+		}
+	}
 }
 
 // ListVolumes implementation
@@ -606,62 +1217,204 @@ func (p *Plugin) ListVolumes(
 	req *csi.ListVolumesRequest) (
 	*csi.ListVolumesResponse, error) {
 
-	glog.V(5).Info("start to ListVolumes")
+	glog.V(5).Infof("start to ListVolumes, MaxEntries: %v, StartingToken: %v",
+		req.MaxEntries, req.StartingToken)
 	defer glog.V(5).Info("end to ListVolumes")
 
-	// only support list all the volumes at present
-	volumes, err := Client.ListVolumes()
+	var volumes []*model.VolumeSpec
+	err := retry(ctx, "list volumes", func(client *c.Client) (err error) {
+		volumes, err = client.ListVolumes()
+		return err
+	})
 	if err != nil {
-		return nil, err
+		return nil, statusError(err, "list volumes failed")
 	}
 
-	ens := []*csi.ListVolumesResponse_Entry{}
+	var sortedKeys []string
+	volumesMap := make(map[string]*model.VolumeSpec)
+
 	for _, v := range volumes {
 		if v != nil {
+			sortedKeys = append(sortedKeys, v.Id)
+			volumesMap[v.Id] = v
+		}
+	}
+	sort.Strings(sortedKeys)
 
-			volumeinfo := &csi.Volume{
-				CapacityBytes: v.Size,
-				VolumeId:      v.Id,
-				VolumeContext: map[string]string{
-					"Name":             v.Name,
-					"Status":           v.Status,
-					"AvailabilityZone": v.AvailabilityZone,
-					"PoolId":           v.PoolId,
-					"ProfileId":        v.ProfileId,
-				},
-			}
+	if len(sortedKeys) <= 0 && "" == req.StartingToken {
+		return &csi.ListVolumesResponse{}, nil
+	}
 
-			ens = append(ens, &csi.ListVolumesResponse_Entry{
-				Volume: volumeinfo,
-			})
+	var (
+		ulenVolumes   = int32(len(sortedKeys))
+		maxEntries    = req.MaxEntries
+		startingToken int32
+	)
+
+	if v := req.StartingToken; v != "" {
+		i, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return nil, status.Error(codes.Aborted, "parsing the startingToken failed")
+		}
+		startingToken = int32(i)
+	}
+
+	if startingToken >= ulenVolumes {
+		return nil, status.Errorf(
+			codes.Aborted,
+			"startingToken=%d >= len(volumes)=%d",
+			startingToken, ulenVolumes)
+	}
+
+	// If maxEntries is 0 or greater than the number of remaining entries then
+	// set maxEntries to the number of remaining entries.
+	var sliceKeys []string
+	var nextToken string
+	nextTokenIndex := startingToken + maxEntries
+
+	if maxEntries == 0 || nextTokenIndex >= ulenVolumes {
+		sliceKeys = sortedKeys[startingToken:]
+	} else {
+		sliceKeys = sortedKeys[startingToken:nextTokenIndex]
+		nextToken = fmt.Sprintf("%d", nextTokenIndex)
+	}
+
+	var attachments []*model.VolumeAttachmentSpec
+	err = retry(ctx, "list volume attachments", func(client *c.Client) (err error) {
+		attachments, err = client.ListVolumeAttachments()
+		return err
+	})
+	if err != nil {
+		return nil, statusError(err, "list volume attachments failed")
+	}
+
+	ens := []*csi.ListVolumesResponse_Entry{}
+	for _, key := range sliceKeys {
+		v := volumesMap[key]
+		publishedNodeIds, condition := getVolumePublishState(v, attachments)
+
+		volumeinfo := &csi.Volume{
+			CapacityBytes: v.Size * util.GiB,
+			VolumeId:      v.Id,
+			VolumeContext: map[string]string{
+				KVolumeName:      v.Name,
+				KVolumeStatus:    v.Status,
+				KVolumeAZ:        v.AvailabilityZone,
+				KVolumePoolId:    v.PoolId,
+				KVolumeProfileId: v.ProfileId,
+				KVolumeLvPath:    v.Metadata["lvPath"],
+			},
 		}
+
+		ens = append(ens, &csi.ListVolumesResponse_Entry{
+			Volume: volumeinfo,
+			Status: &csi.ListVolumesResponse_VolumeStatus{
+				PublishedNodeIds: publishedNodeIds,
+				VolumeCondition:  condition,
+			},
+		})
 	}
 
 	return &csi.ListVolumesResponse{
-		Entries: ens,
+		Entries:   ens,
+		NextToken: nextToken,
 	}, nil
 }
 
+// getVolumePublishState Get the ids of the nodes a volume is published to and
+// the condition of the volume from its attachments. An attachment published
+// before the node id was recorded on it is reported by its host name.
+func getVolumePublishState(vol *model.VolumeSpec, attachments []*model.VolumeAttachmentSpec) ([]string, *csi.VolumeCondition) {
+	var publishedNodeIds []string
+	var abnormal []string
+
+	switch vol.Status {
+	case model.VolumeError, model.VolumeErrorDeleting, model.VolumeErrorExtending:
+		abnormal = append(abnormal, "volume is "+vol.Status)
+	}
+
+	for _, attachment := range attachments {
+		if attachment == nil || attachment.VolumeId != vol.Id {
+			continue
+		}
+
+		nodeId := attachment.Metadata[KNodeId]
+		if "" == nodeId {
+			nodeId = attachment.Host
+		}
+
+		if !utils.Contained(nodeId, publishedNodeIds) {
+			publishedNodeIds = append(publishedNodeIds, nodeId)
+		}
+
+		switch attachment.Status {
+		case model.VolumeAttachError, model.VolumeAttachErrorDeleting:
+			abnormal = append(abnormal, fmt.Sprintf("attachment %s on node %s is %s",
+				attachment.Id, attachment.Host, attachment.Status))
+		}
+	}
+
+	sort.Strings(publishedNodeIds)
+	if len(abnormal) > 0 {
+		return publishedNodeIds, &csi.VolumeCondition{Abnormal: true, Message: strings.Join(abnormal, ", ")}
+	}
+
+	return publishedNodeIds, &csi.VolumeCondition{Message: "the volume is healthy"}
+}
+
 // GetCapacity implementation
 func (p *Plugin) GetCapacity(
 	ctx context.Context,
 	req *csi.GetCapacityRequest) (
 	*csi.GetCapacityResponse, error) {
 
-	glog.V(5).Info("start to GetCapacity")
+	glog.V(5).Infof("start to GetCapacity, Parameters: %v, AccessibleTopology: %v",
+		req.Parameters, req.AccessibleTopology)
 	defer glog.V(5).Info("end to GetCapacity")
 
-	pools, err := Client.ListPools()
+	params, err := p.parseVolumeParameters(ctx, req.GetParameters())
 	if err != nil {
 		return nil, err
 	}
 
-	// calculate all the free capacity of pools
+	// The volumes created without a profile parameter are of the default one
+	profile := params.profile
+	if nil == profile {
+		if profile, err = p.getDefaultProfile(ctx); err != nil {
+			return nil, err
+		}
+	}
+	az := params.az
+
+	if zone, ok := req.GetAccessibleTopology().GetSegments()[TopologyZoneKey]; ok {
+		if "" != az && az != zone {
+			// The volumes of the StorageClass can not be in the zone
+			return &csi.GetCapacityResponse{}, nil
+		}
+		az = zone
+	}
+
+	var pools []*model.StoragePoolSpec
+	err = retry(ctx, "list pools", func(client *c.Client) (err error) {
+		pools, err = client.ListPools()
+		return err
+	})
+	if err != nil {
+		return nil, statusError(err, "list pools failed")
+	}
+
+	// calculate the free capacity of the pools volumes can be created in
 	freecapacity := int64(0)
 	for _, p := range pools {
-		if p != nil {
-			freecapacity += int64(p.FreeCapacity)
+		if p == nil || "unavailable" == p.Status {
+			continue
 		}
+
+		if ("" != az && p.AvailabilityZone != az) || !isPoolMatchProfile(p, profile) {
+			continue
+		}
+
+		freecapacity += p.FreeCapacity * util.GiB
 	}
 
 	return &csi.GetCapacityResponse{
@@ -669,6 +1422,51 @@ func (p *Plugin) GetCapacity(
 	}, nil
 }
 
+// isPoolMatchProfile Check if a pool meets the constraints of a profile
+func isPoolMatchProfile(pool *model.StoragePoolSpec, profile *model.ProfileSpec) bool {
+	if nil == profile {
+		return true
+	}
+
+	if "" != profile.StorageType && !strings.EqualFold(profile.StorageType, pool.StorageType) {
+		return false
+	}
+
+	wantStorage := profile.ProvisioningProperties.DataStorage
+	poolStorage := pool.Extras.DataStorage
+	if "" != wantStorage.ProvisioningPolicy &&
+		!strings.EqualFold(wantStorage.ProvisioningPolicy, poolStorage.ProvisioningPolicy) {
+		return false
+	}
+
+	if wantStorage.IsSpaceEfficient && !poolStorage.IsSpaceEfficient {
+		return false
+	}
+
+	if wantStorage.RecoveryTimeObjective > 0 && poolStorage.RecoveryTimeObjective > wantStorage.RecoveryTimeObjective {
+		return false
+	}
+
+	wantIO := profile.ProvisioningProperties.IOConnectivity
+	poolIO := pool.Extras.IOConnectivity
+	if "" != wantIO.AccessProtocol && !strings.EqualFold(wantIO.AccessProtocol, poolIO.AccessProtocol) {
+		return false
+	}
+
+	if wantIO.MaxIOPS > poolIO.MaxIOPS || wantIO.MaxBWS > poolIO.MaxBWS {
+		return false
+	}
+
+	for key, want := range profile.CustomProperties {
+		have, ok := pool.Extras.Advanced[key]
+		if !ok || fmt.Sprint(want) != fmt.Sprint(have) {
+			return false
+		}
+	}
+
+	return true
+}
+
 // ControllerGetCapabilities implementation
 func (p *Plugin) ControllerGetCapabilities(
 	ctx context.Context,
@@ -722,19 +1520,46 @@ func (p *Plugin) ControllerGetCapabilities(
 					},
 				},
 			},
+			&csi.ControllerServiceCapability{
+				Type: &csi.ControllerServiceCapability_Rpc{
+					Rpc: &csi.ControllerServiceCapability_RPC{
+						Type: csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+					},
+				},
+			},
+			&csi.ControllerServiceCapability{
+				Type: &csi.ControllerServiceCapability_Rpc{
+					Rpc: &csi.ControllerServiceCapability_RPC{
+						Type: csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+					},
+				},
+			},
+			&csi.ControllerServiceCapability{
+				Type: &csi.ControllerServiceCapability_Rpc{
+					Rpc: &csi.ControllerServiceCapability_RPC{
+						Type: csi.ControllerServiceCapability_RPC_LIST_VOLUMES_PUBLISHED_NODES,
+					},
+				},
+			},
+			&csi.ControllerServiceCapability{
+				Type: &csi.ControllerServiceCapability_Rpc{
+					Rpc: &csi.ControllerServiceCapability_RPC{
+						Type: csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
+					},
+				},
+			},
 		},
 	}, nil
 }
 
 // FindSnapshot implementation
-func FindSnapshot(req *model.VolumeSnapshotSpec) (bool, bool, *model.VolumeSnapshotSpec, error) {
+func FindSnapshot(ctx context.Context, req *model.VolumeSnapshotSpec) (bool, bool, *model.VolumeSnapshotSpec, error) {
 	isExist := false
-	snapshots, err := Client.ListVolumeSnapshots()
-
+	snapshots, err := listSnapshotsByName(ctx, req.Name)
 	if err != nil {
 		glog.Error("List volume snapshots failed: ", err)
 
-		return false, false, nil, err
+		return false, false, nil, statusError(err, "list volume snapshots failed")
 	}
 
 	for _, snapshot := range snapshots {
@@ -770,22 +1595,32 @@ func (p *Plugin) CreateSnapshot(
 		return nil, status.Error(codes.InvalidArgument, "Source Volume ID cannot be empty")
 	}
 
+	unlock, err := lockOperation(lockSnapshotName + req.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
 	snapReq := &model.VolumeSnapshotSpec{
 		Name:     req.Name,
 		VolumeId: req.SourceVolumeId,
 	}
 
-	for k, v := range req.GetParameters() {
-		switch strings.ToLower(k) {
-		// TODO: support profile name
-		case KParamProfile:
-			snapReq.ProfileId = v
-		}
+	params, err := p.parseSnapshotParameters(ctx, req.GetParameters())
+	if err != nil {
+		return nil, err
+	}
+
+	if nil != params.profile {
+		snapReq.ProfileId = params.profile.Id
 	}
+	snapReq.Metadata = params.metadata
+	snapReq.Description = describeOwner("VolumeSnapshot",
+		params.metadata[KMetaVolumeSnapshotNamespace], params.metadata[KMetaVolumeSnapshotName])
 
 	glog.Infof("opensds CreateVolumeSnapshot request body: %v", snapReq)
 	var snapshot *model.VolumeSnapshotSpec
-	isExist, isCompatible, findSnapshot, err := FindSnapshot(snapReq)
+	isExist, isCompatible, findSnapshot, err := FindSnapshot(ctx, snapReq)
 
 	if err != nil {
 		return nil, err
@@ -799,15 +1634,26 @@ func (p *Plugin) CreateSnapshot(
 				"Snapshot already exists but is incompatible")
 		}
 	} else {
-		createSnapshot, err := Client.CreateVolumeSnapshot(snapReq)
+		var createSnapshot *model.VolumeSnapshotSpec
+		err := call(ctx, "create snapshot", func(client *c.Client) (err error) {
+			createSnapshot, err = client.CreateVolumeSnapshot(snapReq)
+			return err
+		})
+		lookups.forget(lookupSnapshotName + snapReq.Name)
 		if err != nil {
 			glog.Error("failed to CreateVolumeSnapshot", err)
-			return nil, err
+			return nil, statusError(err, "create snapshot %s failed", req.Name)
 		}
 
 		snapshot = createSnapshot
 	}
 
+	// A snapshot the backend failed to create is deleted while waiting
+	snapshot, err = waitForSnapshot(ctx, snapshot.Id)
+	if err != nil {
+		return nil, err
+	}
+
 	glog.V(5).Infof("opensds snapshot = %v", snapshot)
 	creationTime, err := p.convertStringToPtypesTimestamp(snapshot.CreatedAt)
 	if nil != err {
@@ -820,7 +1666,7 @@ func (p *Plugin) CreateSnapshot(
 			SnapshotId:     snapshot.Id,
 			SourceVolumeId: snapshot.VolumeId,
 			CreationTime:   creationTime,
-			ReadyToUse:     true,
+			ReadyToUse:     model.VolumeSnapAvailable == snapshot.Status,
 		},
 	}, nil
 }
@@ -851,11 +1697,22 @@ func (p *Plugin) DeleteSnapshot(
 		return nil, status.Error(codes.InvalidArgument, "Snapshot ID cannot be empty")
 	}
 
-	err := Client.DeleteVolumeSnapshot(req.SnapshotId, nil)
-
-	if nil != err {
+	unlock, err := lockOperation(lockSnapshotId + req.SnapshotId)
+	if err != nil {
 		return nil, err
 	}
+	defer unlock()
+
+	// A snapshot which does not exist has been deleted
+	err = retry(ctx, "delete snapshot", func(client *c.Client) error {
+		return client.DeleteVolumeSnapshot(req.SnapshotId, nil)
+	})
+	lookups.forget(req.SnapshotId)
+
+	if nil != err && !isNotFoundError(err) {
+		glog.Errorf("failed to delete snapshot %s: %v", req.SnapshotId, err)
+		return nil, statusError(err, "delete snapshot %s failed", req.SnapshotId)
+	}
 
 	return &csi.DeleteSnapshotResponse{}, nil
 }
@@ -871,9 +1728,13 @@ func (p *Plugin) ListSnapshots(
 		req.MaxEntries, req.StartingToken, req.SourceVolumeId, req.SnapshotId)
 
 	var opts map[string]string
-	allSnapshots, err := Client.ListVolumeSnapshots(opts)
+	var allSnapshots []*model.VolumeSnapshotSpec
+	err := retry(ctx, "list volume snapshots", func(client *c.Client) (err error) {
+		allSnapshots, err = client.ListVolumeSnapshots(opts)
+		return err
+	})
 	if nil != err {
-		return nil, err
+		return nil, statusError(err, "list volume snapshots failed")
 	}
 
 	snapshotId := req.GetSnapshotId()
@@ -998,7 +1859,7 @@ func (p *Plugin) ListSnapshots(
 				SnapshotId:     snapshot.Id,
 				SourceVolumeId: snapshot.VolumeId,
 				CreationTime:   creationTime,
-				ReadyToUse:     true,
+				ReadyToUse:     model.VolumeSnapAvailable == snapshot.Status,
 			},
 		})
 	}
@@ -17,8 +17,10 @@ package opensds
 import (
 	"encoding/json"
 	"errors"
+	"net/http"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -35,11 +37,26 @@ import (
 
 func init() {
 	Client.VolumeMgr = fv
+	Client.PoolMgr = fp
+	Client.ProfileMgr = fpr
+	Client.ReplicationMgr = frp
 }
 
 var fv = &c.VolumeMgr{
 	Receiver: NewFakeVolumeReceiver(),
 }
+
+var fp = &c.PoolMgr{
+	Receiver: NewFakeVolumeReceiver(),
+}
+
+var fpr = &c.ProfileMgr{
+	Receiver: NewFakeVolumeReceiver(),
+}
+
+var frp = &c.ReplicationMgr{
+	Receiver: NewFakeVolumeReceiver(),
+}
 var (
 	ByteVolume = `{
 		"id": "bd5b12a8-a101-11e7-941e-d77981b584d8",
@@ -61,9 +78,126 @@ var (
 			"status": "available",
 			"poolId": "084bf71e-a102-11e7-88a8-e31fe6d52248",
 			"profileId": "1106b972-66ef-11e7-b172-db03f3689c9c"
+		},
+		{
+			"id": "9d8b6f3e-a101-11e7-941e-d77981b584d8",
+			"name": "sample-volume-2",
+			"size": 2,
+			"availabilityZone": "default",
+			"status": "error",
+			"poolId": "084bf71e-a102-11e7-88a8-e31fe6d52248",
+			"profileId": "1106b972-66ef-11e7-b172-db03f3689c9c"
+		}
+	]`
+
+	BytePool = `{
+		"id": "084bf71e-a102-11e7-88a8-e31fe6d52248",
+		"name": "sample-pool-01",
+		"totalCapacity": 100,
+		"freeCapacity": 90,
+		"availabilityZone": "default",
+		"extras": {
+			"ioConnectivity": {
+				"accessProtocol": "iscsi"
+			}
+		}
+	}`
+
+	BytePools = `[
+		{
+			"id": "084bf71e-a102-11e7-88a8-e31fe6d52248",
+			"name": "sample-pool-01",
+			"freeCapacity": 90,
+			"availabilityZone": "default",
+			"extras": {
+				"dataStorage": {"provisioningPolicy": "Thin", "isSpaceEfficient": true},
+				"ioConnectivity": {"accessProtocol": "iscsi", "maxIOPS": 1000},
+				"advanced": {"diskType": "SSD"}
+			}
+		},
+		{
+			"id": "a594b8ac-a103-11e7-985f-d723bcf01b5f",
+			"name": "sample-pool-02",
+			"freeCapacity": 170,
+			"availabilityZone": "az2",
+			"extras": {
+				"dataStorage": {"provisioningPolicy": "Thick"},
+				"ioConnectivity": {"accessProtocol": "rbd"},
+				"advanced": {"diskType": "SAS"}
+			}
+		},
+		{
+			"id": "b6e5f2c6-a103-11e7-985f-d723bcf01b5f",
+			"name": "sample-pool-03",
+			"status": "unavailable",
+			"freeCapacity": 300,
+			"availabilityZone": "default"
+		}
+	]`
+
+	ByteProfile = `{
+		"id": "1106b972-66ef-11e7-b172-db03f3689c9c",
+		"name": "ssd",
+		"provisioningProperties": {
+			"dataStorage": {"provisioningPolicy": "Thin"}
+		},
+		"customProperties": {"diskType": "SSD"}
+	}`
+
+	ByteProfiles = `[
+		{
+			"id": "1106b972-66ef-11e7-b172-db03f3689c9c",
+			"name": "ssd",
+			"provisioningProperties": {
+				"dataStorage": {"provisioningPolicy": "Thin"}
+			},
+			"customProperties": {"diskType": "SSD"}
+		},
+		{
+			"id": "2f9c0a04-66ef-11e7-ade2-43158893e017",
+			"name": "default"
+		},
+		{
+			"id": "3f9c0a04-66ef-11e7-ade2-43158893e017",
+			"name": "gold"
+		},
+		{
+			"id": "4f9c0a04-66ef-11e7-ade2-43158893e017",
+			"name": "gold"
 		}
 	]`
 
+	ByteAttachments = `[
+		{
+			"id": "f2dda3d2-bf79-11e7-8665-f750b088f63e",
+			"volumeId": "bd5b12a8-a101-11e7-941e-d77981b584d8",
+			"status": "available",
+			"hostInfo": {"host": "node1"},
+			"metadata": {"nodeId": "node1,iqn:iqn.2017-10.io.opensds:node1"}
+		},
+		{
+			"id": "0f3cd5b2-bf7a-11e7-8665-f750b088f63e",
+			"volumeId": "bd5b12a8-a101-11e7-941e-d77981b584d8",
+			"status": "error",
+			"hostInfo": {"host": "node2"}
+		}
+	]`
+
+	ByteErrorVolume = `{
+		"id": "9d8b6f3e-a101-11e7-941e-d77981b584d8",
+		"name": "error-volume",
+		"size": 1,
+		"availabilityZone": "default",
+		"status": "error"
+	}`
+	ByteErrorSnapshot = `{
+		"id": "9d8b6f3e-a101-11e7-941e-d77981b584d8",
+		"createdAt":"2018-09-05T17:07:28",
+		"name": "error-snapshot",
+		"size": 1,
+		"status": "error",
+		"volumeId": "bd5b12a8-a101-11e7-941e-d77981b584d8"
+	}`
 	ByteSnapshot = `{
 		"id": "3769855c-a102-11e7-b772-17b880d2f537",
 		"createdAt":"2018-09-05T17:07:28",
@@ -96,6 +230,31 @@ var (
 	]`
 )
 
+// fakeMissingId the id of the resources the fake OpenSDS does not have
+const fakeMissingId = "bd5b12a8-a101-11e7-941e-d77981b584d9"
+
+// fakeErrorId the id of the volume and snapshot the fake OpenSDS failed to create
+const fakeErrorId = "9d8b6f3e-a101-11e7-941e-d77981b584d8"
+
+// fakeDeleted the urls the fake OpenSDS is asked to delete
+var fakeDeleted struct {
+	sync.Mutex
+	urls []string
+}
+
+func isFakeDeleted(id string) bool {
+	fakeDeleted.Lock()
+	defer fakeDeleted.Unlock()
+
+	for _, url := range fakeDeleted.urls {
+		if strings.HasSuffix(url, "/"+id) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func NewFakeVolumeReceiver() c.Receiver {
 	return &fakeVolumeReceiver{}
 }
@@ -103,7 +262,7 @@ func NewFakeVolumeReceiver() c.Receiver {
 type fakeVolumeReceiver struct{}
 
 func (*fakeVolumeReceiver) Recv(
-	string,
+	url string,
 	method string,
 	in interface{},
 	out interface{},
@@ -127,21 +286,77 @@ func (*fakeVolumeReceiver) Recv(
 		break
 	case "GET":
 		switch out.(type) {
+		case *model.VolumeSpec:
+			if strings.HasSuffix(url, "/"+fakeErrorId) {
+				return json.Unmarshal([]byte(ByteErrorVolume), out)
+			}
+			if !strings.HasSuffix(url, "/bd5b12a8-a101-11e7-941e-d77981b584d8") {
+				return c.NewHttpError(http.StatusNotFound, string(model.ErrorNotFoundStatus("volume not found")))
+			}
+			if err := json.Unmarshal([]byte(ByteVolume), out); err != nil {
+				return err
+			}
+			break
+		case *model.VolumeSnapshotSpec:
+			if strings.HasSuffix(url, "/"+fakeErrorId) {
+				return json.Unmarshal([]byte(ByteErrorSnapshot), out)
+			}
+			if err := json.Unmarshal([]byte(ByteSnapshot), out); err != nil {
+				return err
+			}
+			break
+		case *model.ProfileSpec:
+			if !strings.HasSuffix(url, "/1106b972-66ef-11e7-b172-db03f3689c9c") {
+				return c.NewHttpError(http.StatusNotFound, string(model.ErrorNotFoundStatus("profile not found")))
+			}
+			if err := json.Unmarshal([]byte(ByteProfile), out); err != nil {
+				return err
+			}
+			break
+		case *[]*model.ProfileSpec:
+			if err := json.Unmarshal([]byte(ByteProfiles), out); err != nil {
+				return err
+			}
+			break
+		case *[]*model.StoragePoolSpec:
+			if err := json.Unmarshal([]byte(BytePools), out); err != nil {
+				return err
+			}
+			break
+		case *model.StoragePoolSpec:
+			if err := json.Unmarshal([]byte(BytePool), out); err != nil {
+				return err
+			}
+			break
 		case *[]*model.VolumeSnapshotSpec:
 			if err := json.Unmarshal([]byte(ByteSnapshots), out); err != nil {
 				return err
 			}
 			break
+		case *[]*model.VolumeAttachmentSpec:
+			if err := json.Unmarshal([]byte(ByteAttachments), out); err != nil {
+				return err
+			}
+			break
 		case *[]*model.VolumeSpec:
 			if err := json.Unmarshal([]byte(ByteVolumes), out); err != nil {
 				return err
 			}
 			break
+		case *[]*model.ReplicationSpec:
+			break
 		default:
 			return errors.New("output format not supported")
 		}
 		break
 	case "DELETE":
+		fakeDeleted.Lock()
+		fakeDeleted.urls = append(fakeDeleted.urls, url)
+		fakeDeleted.Unlock()
+
+		if strings.HasSuffix(url, "/"+fakeMissingId) {
+			return c.NewHttpError(http.StatusNotFound, string(model.ErrorNotFoundStatus("resource not found")))
+		}
 		break
 	default:
 		return errors.New("inputed method format not supported")
@@ -197,6 +412,34 @@ func TestControllerGetCapabilities(t *testing.T) {
 				},
 			},
 		},
+		&csi.ControllerServiceCapability{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{
+					Type: csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+				},
+			},
+		},
+		&csi.ControllerServiceCapability{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{
+					Type: csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+				},
+			},
+		},
+		&csi.ControllerServiceCapability{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{
+					Type: csi.ControllerServiceCapability_RPC_LIST_VOLUMES_PUBLISHED_NODES,
+				},
+			},
+		},
+		&csi.ControllerServiceCapability{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{
+					Type: csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
+				},
+			},
+		},
 	}
 
 	rs, err := fakePlugin.ControllerGetCapabilities(fakeCtx, fakeReq)
@@ -280,6 +523,47 @@ func TestDeleteSnapshot(t *testing.T) {
 	if !reflect.DeepEqual(expectedResponse, rs) {
 		t.Errorf("expected: %v, actual: %v\n", expectedResponse, rs)
 	}
+
+	// Deleting a snapshot which does not exist succeeds
+	fakeReq.SnapshotId = fakeMissingId
+	rs, err = fakePlugin.DeleteSnapshot(fakeCtx, &fakeReq)
+
+	if nil != err {
+		t.Errorf("failed to DeleteSnapshot: %v\n", err)
+	}
+
+	if !reflect.DeepEqual(expectedResponse, rs) {
+		t.Errorf("expected: %v, actual: %v\n", expectedResponse, rs)
+	}
+}
+
+func TestDeleteVolume(t *testing.T) {
+	var fakePlugin = &Plugin{}
+	var fakeCtx = context.Background()
+	fakeReq := csi.DeleteVolumeRequest{}
+
+	_, err := fakePlugin.DeleteVolume(fakeCtx, &fakeReq)
+	expectedErr := status.Error(codes.InvalidArgument, "Volume_id must be specified")
+
+	if !reflect.DeepEqual(expectedErr, err) {
+		t.Errorf("expected: %v, actual: %v\n", expectedErr, err)
+	}
+
+	expectedResponse := &csi.DeleteVolumeResponse{}
+
+	// Deleting a volume which does not exist succeeds
+	for _, volId := range []string{"bd5b12a8-a101-11e7-941e-d77981b584d8", fakeMissingId} {
+		fakeReq.VolumeId = volId
+		rs, err := fakePlugin.DeleteVolume(fakeCtx, &fakeReq)
+
+		if nil != err {
+			t.Errorf("failed to DeleteVolume: %v\n", err)
+		}
+
+		if !reflect.DeepEqual(expectedResponse, rs) {
+			t.Errorf("expected: %v, actual: %v\n", expectedResponse, rs)
+		}
+	}
 }
 
 func TestListSnapshots(t *testing.T) {
@@ -464,6 +748,12 @@ func TestCreateVolume(t *testing.T) {
 			KVolumeProfileId: "1106b972-66ef-11e7-b172-db03f3689c9c",
 			KVolumeLvPath:    "",
 		},
+		ContentSource: fakeReq.VolumeContentSource,
+		AccessibleTopology: []*csi.Topology{
+			&csi.Topology{
+				Segments: map[string]string{TopologyZoneKey: "default"},
+			},
+		},
 	}
 
 	expectedRs := &csi.CreateVolumeResponse{
@@ -485,3 +775,733 @@ func TestIsStringMapEqual(t *testing.T) {
 	}
 	
 	}
+
+func TestValidateVolumeCapabilities(t *testing.T) {
+	var fakePlugin = &Plugin{}
+	var fakeCtx = context.Background()
+	fakeReq := csi.ValidateVolumeCapabilitiesRequest{}
+
+	_, err := fakePlugin.ValidateVolumeCapabilities(fakeCtx, &fakeReq)
+	expectedErr := status.Error(codes.InvalidArgument, "Volume_id/volume_capabilities must be specified")
+
+	if !reflect.DeepEqual(expectedErr, err) {
+		t.Errorf("expected: %v, actual: %v\n", expectedErr, err)
+	}
+
+	newCapability := func(mode csi.VolumeCapability_AccessMode_Mode, fsType string, flags ...string) *csi.VolumeCapability {
+		return &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{
+					FsType:     fsType,
+					MountFlags: flags,
+				},
+			},
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: mode,
+			},
+		}
+	}
+
+	fakeReq.VolumeId = "bd5b12a8-a101-11e7-941e-d77981b584d9"
+	fakeReq.VolumeCapabilities = []*csi.VolumeCapability{
+		newCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, ""),
+	}
+
+	_, err = fakePlugin.ValidateVolumeCapabilities(fakeCtx, &fakeReq)
+	expectedErr = status.Error(codes.NotFound, "the volume bd5b12a8-a101-11e7-941e-d77981b584d9 is not exist")
+
+	if !reflect.DeepEqual(expectedErr, err) {
+		t.Errorf("expected: %v, actual: %v\n", expectedErr, err)
+	}
+
+	fakeReq.VolumeId = "bd5b12a8-a101-11e7-941e-d77981b584d8"
+	fakeReq.VolumeCapabilities = []*csi.VolumeCapability{
+		newCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, "ext4", "noatime"),
+		newCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY, "", "ro"),
+		&csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Block{
+				Block: &csi.VolumeCapability_BlockVolume{},
+			},
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		},
+	}
+	fakeReq.Parameters = map[string]string{KParamAZ: "default"}
+
+	rs, err := fakePlugin.ValidateVolumeCapabilities(fakeCtx, &fakeReq)
+	if nil != err {
+		t.Errorf("failed to ValidateVolumeCapabilities: %v\n", err)
+	}
+
+	expectedRs := &csi.ValidateVolumeCapabilitiesResponse{
+		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeCapabilities: fakeReq.VolumeCapabilities,
+			Parameters:         fakeReq.Parameters,
+		},
+	}
+
+	if !reflect.DeepEqual(expectedRs, rs) {
+		t.Errorf("expected: %v, actual: %v\n", expectedRs, rs)
+	}
+
+	testCases := []struct {
+		capability *csi.VolumeCapability
+		message    string
+	}{
+		{
+			newCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER, ""),
+			"access mode MULTI_NODE_MULTI_WRITER is not supported by protocol iscsi",
+		},
+		{
+			newCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, "zfs"),
+			"fs type zfs is not supported",
+		},
+		{
+			newCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY, "", "rw"),
+			"mount flag rw conflicts with access mode SINGLE_NODE_READER_ONLY",
+		},
+		{
+			newCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, "", "ro", "rw"),
+			"mount flags ro and rw conflict",
+		},
+		{
+			newCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, "", "bind"),
+			"mount flag bind is managed by the driver",
+		},
+		{
+			newCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, "ext4", "inode64"),
+			"mount flag inode64 is not allowed",
+		},
+	}
+
+	for _, tc := range testCases {
+		fakeReq.VolumeCapabilities = []*csi.VolumeCapability{tc.capability}
+		rs, err = fakePlugin.ValidateVolumeCapabilities(fakeCtx, &fakeReq)
+		if nil != err {
+			t.Errorf("failed to ValidateVolumeCapabilities: %v\n", err)
+		}
+
+		expectedRs = &csi.ValidateVolumeCapabilitiesResponse{Message: tc.message}
+		if !reflect.DeepEqual(expectedRs, rs) {
+			t.Errorf("expected: %v, actual: %v\n", expectedRs, rs)
+		}
+	}
+}
+
+func TestControllerExpandVolume(t *testing.T) {
+	var fakePlugin = &Plugin{}
+	var fakeCtx = context.Background()
+	fakeReq := csi.ControllerExpandVolumeRequest{}
+
+	_, err := fakePlugin.ControllerExpandVolume(fakeCtx, &fakeReq)
+	expectedErr := status.Error(codes.InvalidArgument, "Volume_id/capacity_range must be specified")
+
+	if !reflect.DeepEqual(expectedErr, err) {
+		t.Errorf("expected: %v, actual: %v\n", expectedErr, err)
+	}
+
+	fakeReq.VolumeId = "bd5b12a8-a101-11e7-941e-d77981b584d8"
+	fakeReq.CapacityRange = &csi.CapacityRange{RequiredBytes: util.GiB + 1, LimitBytes: util.GiB + 1}
+	_, err = fakePlugin.ControllerExpandVolume(fakeCtx, &fakeReq)
+	expectedErr = status.Error(codes.OutOfRange, "the size 2 GiB exceeds the limit 1073741825 bytes")
+
+	if !reflect.DeepEqual(expectedErr, err) {
+		t.Errorf("expected: %v, actual: %v\n", expectedErr, err)
+	}
+
+	fakeReq.VolumeId = "bd5b12a8-a101-11e7-941e-d77981b584d9"
+	fakeReq.CapacityRange = &csi.CapacityRange{RequiredBytes: util.GiB}
+	_, err = fakePlugin.ControllerExpandVolume(fakeCtx, &fakeReq)
+	expectedErr = status.Error(codes.NotFound, "the volume bd5b12a8-a101-11e7-941e-d77981b584d9 is not exist")
+
+	if !reflect.DeepEqual(expectedErr, err) {
+		t.Errorf("expected: %v, actual: %v\n", expectedErr, err)
+	}
+
+	// The volume is already of the required size
+	fakeReq.VolumeId = "bd5b12a8-a101-11e7-941e-d77981b584d8"
+	rs, err := fakePlugin.ControllerExpandVolume(fakeCtx, &fakeReq)
+	if nil != err {
+		t.Errorf("failed to ControllerExpandVolume: %v\n", err)
+	}
+
+	expectedRs := &csi.ControllerExpandVolumeResponse{CapacityBytes: util.GiB, NodeExpansionRequired: true}
+	if !reflect.DeepEqual(expectedRs, rs) {
+		t.Errorf("expected: %v, actual: %v\n", expectedRs, rs)
+	}
+
+	// The fake backend never grows the volume
+	defer func(interval, timeout time.Duration) {
+		volumePollInterval, expandTimeout = interval, timeout
+	}(volumePollInterval, expandTimeout)
+	volumePollInterval, expandTimeout = time.Millisecond, 10*time.Millisecond
+
+	fakeReq.CapacityRange = &csi.CapacityRange{RequiredBytes: 2 * util.GiB}
+	_, err = fakePlugin.ControllerExpandVolume(fakeCtx, &fakeReq)
+	expectedErr = status.Error(codes.DeadlineExceeded,
+		"timed out waiting for the volume bd5b12a8-a101-11e7-941e-d77981b584d8 to be expanded")
+
+	if !reflect.DeepEqual(expectedErr, err) {
+		t.Errorf("expected: %v, actual: %v\n", expectedErr, err)
+	}
+}
+
+func TestCreateVolumeFromVolume(t *testing.T) {
+	var fakePlugin = &Plugin{}
+	var fakeCtx = context.Background()
+	fakeReq := csi.CreateVolumeRequest{
+		Name: "clone-volume",
+		Parameters: map[string]string{
+			"profile": "1106b972-66ef-11e7-b172-db03f3689c9c",
+		},
+		VolumeContentSource: &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Volume{
+				Volume: &csi.VolumeContentSource_VolumeSource{
+					VolumeId: "bd5b12a8-a101-11e7-941e-d77981b584d9",
+				},
+			},
+		},
+	}
+
+	_, err := fakePlugin.CreateVolume(fakeCtx, &fakeReq)
+	expectedErr := status.Error(codes.NotFound, "the source volume bd5b12a8-a101-11e7-941e-d77981b584d9 is not exist")
+
+	if !reflect.DeepEqual(expectedErr, err) {
+		t.Errorf("expected: %v, actual: %v\n", expectedErr, err)
+	}
+
+	fakeReq.VolumeContentSource.GetVolume().VolumeId = "bd5b12a8-a101-11e7-941e-d77981b584d8"
+	fakeReq.CapacityRange = &csi.CapacityRange{LimitBytes: util.GiB / 2}
+	_, err = fakePlugin.CreateVolume(fakeCtx, &fakeReq)
+	expectedErr = status.Error(codes.OutOfRange, "the size 1 GiB of the clone exceeds the limit 536870912 bytes")
+
+	if !reflect.DeepEqual(expectedErr, err) {
+		t.Errorf("expected: %v, actual: %v\n", expectedErr, err)
+	}
+
+	fakeReq.CapacityRange = nil
+	rs, err := fakePlugin.CreateVolume(fakeCtx, &fakeReq)
+	if nil != err {
+		t.Fatalf("failed to CreateVolume: %v\n", err)
+	}
+
+	if util.GiB != rs.Volume.CapacityBytes || !reflect.DeepEqual(fakeReq.VolumeContentSource, rs.Volume.ContentSource) {
+		t.Errorf("expected a clone of 1 GiB, actual: %v\n", rs.Volume)
+	}
+}
+
+func TestCreateVolumeFromVolumeTimeout(t *testing.T) {
+	fb := newFakeBackend()
+	fb.delay = 0
+	defer useFakeBackend(fb)()
+
+	defer func(interval time.Duration) {
+		volumePollInterval = interval
+	}(volumePollInterval)
+	volumePollInterval = time.Millisecond
+
+	fb.volumes["volume-1"] = &model.VolumeSpec{
+		BaseModel: &model.BaseModel{Id: "volume-1"},
+		Name:      "volume-1",
+		Size:      1,
+		Status:    model.VolumeAvailable,
+	}
+	fb.volumeStatus = model.VolumeCreating
+
+	var fakePlugin = &Plugin{}
+	fakeReq := csi.CreateVolumeRequest{
+		Name:       "clone-volume",
+		Parameters: map[string]string{"profile": "1106b972-66ef-11e7-b172-db03f3689c9c"},
+		VolumeContentSource: &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Volume{
+				Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: "volume-1"},
+			},
+		},
+	}
+
+	// The clone is not created when the request times out, the data may still
+	// be copied from the temporary snapshot
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := fakePlugin.CreateVolume(ctx, &fakeReq)
+	if codes.DeadlineExceeded != status.Code(err) || 1 != len(fb.snapshots) {
+		t.Fatalf("expected: %v and the snapshot kept, actual: %v, %v\n", codes.DeadlineExceeded, err, fb.snapshots)
+	}
+
+	// The retried request finds the clone created and deletes the snapshot
+	for _, vol := range fb.volumes {
+		vol.Status = model.VolumeAvailable
+	}
+	if _, err := fakePlugin.CreateVolume(context.Background(), &fakeReq); nil != err {
+		t.Fatalf("failed to CreateVolume: %v\n", err)
+	}
+
+	if 0 != len(fb.snapshots) || 2 != fb.creates {
+		t.Errorf("expected: the snapshot deleted and 2 creates, actual: %v, %v creates\n", fb.snapshots, fb.creates)
+	}
+}
+
+func TestIsSameContentSource(t *testing.T) {
+	clone := &model.VolumeSpec{
+		SnapshotId: "3769855c-a102-11e7-b772-17b880d2f537",
+		Metadata:   map[string]string{KSourceVolumeId: "bd5b12a8-a101-11e7-941e-d77981b584d8"},
+	}
+
+	testCases := []struct {
+		req      *model.VolumeSpec
+		expected bool
+	}{
+		{&model.VolumeSpec{Metadata: map[string]string{KSourceVolumeId: "bd5b12a8-a101-11e7-941e-d77981b584d8"}}, true},
+		{&model.VolumeSpec{Metadata: map[string]string{KSourceVolumeId: "bd5b12a8-a101-11e7-941e-d77981b584d9"}}, false},
+		{&model.VolumeSpec{SnapshotId: "3769855c-a102-11e7-b772-17b880d2f537"}, false},
+		{&model.VolumeSpec{}, false},
+	}
+
+	for _, tc := range testCases {
+		if actual := isSameContentSource(clone, tc.req); tc.expected != actual {
+			t.Errorf("expected: %v, actual: %v\n", tc.expected, actual)
+		}
+	}
+
+	if !isSameContentSource(&model.VolumeSpec{SnapshotId: "s"}, &model.VolumeSpec{SnapshotId: "s"}) {
+		t.Errorf("expected: true, actual: false\n")
+	}
+}
+
+func TestSelectAvailabilityZone(t *testing.T) {
+	newTopologies := func(zones ...string) []*csi.Topology {
+		var topologies []*csi.Topology
+		for _, zone := range zones {
+			topologies = append(topologies, &csi.Topology{
+				Segments: map[string]string{TopologyZoneKey: zone},
+			})
+		}
+		return topologies
+	}
+
+	testCases := []struct {
+		az          string
+		requirement *csi.TopologyRequirement
+		expected    string
+		expectedErr error
+	}{
+		{"", nil, "default", nil},
+		{"az1", nil, "az1", nil},
+		{"az1", &csi.TopologyRequirement{Requisite: newTopologies("az1", "az2")}, "az1", nil},
+		{"az3", &csi.TopologyRequirement{Requisite: newTopologies("az1", "az2")}, "",
+			status.Error(codes.InvalidArgument, "the availability zone az3 is not in the requisite topology [az1 az2]")},
+		{"", &csi.TopologyRequirement{Requisite: newTopologies("az1", "az2")}, "az1", nil},
+		{"", &csi.TopologyRequirement{
+			Requisite: newTopologies("az1", "az2"),
+			Preferred: newTopologies("az3", "az2"),
+		}, "az2", nil},
+		{"", &csi.TopologyRequirement{Preferred: newTopologies("az3")}, "az3", nil},
+	}
+
+	for _, tc := range testCases {
+		az, err := selectAvailabilityZone(tc.az, tc.requirement)
+		if tc.expected != az || !reflect.DeepEqual(tc.expectedErr, err) {
+			t.Errorf("expected: %v %v, actual: %v %v\n", tc.expected, tc.expectedErr, az, err)
+		}
+	}
+}
+
+func TestGetCapacity(t *testing.T) {
+	var fakePlugin = &Plugin{}
+	var fakeCtx = context.Background()
+
+	testCases := []struct {
+		req      *csi.GetCapacityRequest
+		expected int64
+	}{
+		{&csi.GetCapacityRequest{}, 260 * util.GiB},
+		{&csi.GetCapacityRequest{
+			Parameters: map[string]string{KParamProfile: "1106b972-66ef-11e7-b172-db03f3689c9c"},
+		}, 90 * util.GiB},
+		{&csi.GetCapacityRequest{
+			AccessibleTopology: &csi.Topology{Segments: map[string]string{TopologyZoneKey: "az2"}},
+		}, 170 * util.GiB},
+		{&csi.GetCapacityRequest{
+			Parameters:         map[string]string{KParamProfile: "1106b972-66ef-11e7-b172-db03f3689c9c"},
+			AccessibleTopology: &csi.Topology{Segments: map[string]string{TopologyZoneKey: "az2"}},
+		}, 0},
+		{&csi.GetCapacityRequest{
+			Parameters:         map[string]string{KParamAZ: "default"},
+			AccessibleTopology: &csi.Topology{Segments: map[string]string{TopologyZoneKey: "az2"}},
+		}, 0},
+	}
+
+	for _, tc := range testCases {
+		rs, err := fakePlugin.GetCapacity(fakeCtx, tc.req)
+		if nil != err {
+			t.Errorf("failed to GetCapacity: %v\n", err)
+			continue
+		}
+
+		if tc.expected != rs.AvailableCapacity {
+			t.Errorf("expected: %v, actual: %v\n", tc.expected, rs.AvailableCapacity)
+		}
+	}
+
+	// Without a profile parameter only the pools of the default profile count
+	rs, err := (&Plugin{DefaultProfile: "1106b972-66ef-11e7-b172-db03f3689c9c"}).GetCapacity(fakeCtx, &csi.GetCapacityRequest{})
+	if nil != err || 90*util.GiB != rs.GetAvailableCapacity() {
+		t.Errorf("expected: %v, actual: %v, %v\n", 90*util.GiB, rs.GetAvailableCapacity(), err)
+	}
+
+	_, err = fakePlugin.GetCapacity(fakeCtx, &csi.GetCapacityRequest{
+		Parameters: map[string]string{KParamProfile: "unknown"},
+	})
+	expectedErr := status.Error(codes.InvalidArgument, "the profile unknown is not exist")
+
+	if !reflect.DeepEqual(expectedErr, err) {
+		t.Errorf("expected: %v, actual: %v\n", expectedErr, err)
+	}
+}
+
+func TestIsVolumePublishedWithoutNodeId(t *testing.T) {
+	fb := newFakeBackend()
+	fb.delay = 0
+	defer useFakeBackend(fb)()
+
+	// An attachment published before the node id was recorded on it
+	fb.attachments["attachment-1"] = &model.VolumeAttachmentSpec{
+		BaseModel: &model.BaseModel{Id: "attachment-1"},
+		VolumeId:  "volume-1",
+		HostInfo:  model.HostInfo{Host: "node1", Initiator: "iqn.2017-10.io.opensds:node1"},
+		Metadata:  map[string]string{},
+	}
+
+	attachReq := &model.VolumeAttachmentSpec{
+		VolumeId: "volume-1",
+		HostInfo: model.HostInfo{Host: "node1", Initiator: "iqn.2017-10.io.opensds:node1"},
+		Metadata: map[string]string{KNodeId: "node1,iqn:iqn.2017-10.io.opensds:node1"},
+	}
+
+	attachment, err := isVolumePublished(context.Background(), false, attachReq, attachReq.Metadata)
+	if nil != err || nil == attachment || "attachment-1" != attachment.Id {
+		t.Errorf("expected: attachment-1, actual: %v, %v\n", attachment, err)
+	}
+}
+
+func TestListVolumes(t *testing.T) {
+	var fakePlugin = &Plugin{}
+	var fakeCtx = context.Background()
+	expectedEntries := []*csi.ListVolumesResponse_Entry{
+		&csi.ListVolumesResponse_Entry{
+			Volume: &csi.Volume{
+				CapacityBytes: 2 * util.GiB,
+				VolumeId:      "9d8b6f3e-a101-11e7-941e-d77981b584d8",
+				VolumeContext: map[string]string{
+					KVolumeName:      "sample-volume-2",
+					KVolumeStatus:    "error",
+					KVolumeAZ:        "default",
+					KVolumePoolId:    "084bf71e-a102-11e7-88a8-e31fe6d52248",
+					KVolumeProfileId: "1106b972-66ef-11e7-b172-db03f3689c9c",
+					KVolumeLvPath:    "",
+				},
+			},
+			Status: &csi.ListVolumesResponse_VolumeStatus{
+				VolumeCondition: &csi.VolumeCondition{Abnormal: true, Message: "volume is error"},
+			},
+		},
+		&csi.ListVolumesResponse_Entry{
+			Volume: &csi.Volume{
+				CapacityBytes: util.GiB,
+				VolumeId:      "bd5b12a8-a101-11e7-941e-d77981b584d8",
+				VolumeContext: map[string]string{
+					KVolumeName:      "sample-volume-1",
+					KVolumeStatus:    "available",
+					KVolumeAZ:        "",
+					KVolumePoolId:    "084bf71e-a102-11e7-88a8-e31fe6d52248",
+					KVolumeProfileId: "1106b972-66ef-11e7-b172-db03f3689c9c",
+					KVolumeLvPath:    "",
+				},
+			},
+			Status: &csi.ListVolumesResponse_VolumeStatus{
+				PublishedNodeIds: []string{"node1,iqn:iqn.2017-10.io.opensds:node1", "node2"},
+				VolumeCondition: &csi.VolumeCondition{Abnormal: true,
+					Message: "attachment 0f3cd5b2-bf7a-11e7-8665-f750b088f63e on node node2 is error"},
+			},
+		},
+	}
+
+	fakeReq := csi.ListVolumesRequest{}
+	rs, err := fakePlugin.ListVolumes(fakeCtx, &fakeReq)
+	if nil != err {
+		t.Errorf("failed to ListVolumes: %v\n", err)
+	}
+
+	expectedRs := &csi.ListVolumesResponse{Entries: expectedEntries}
+	if !reflect.DeepEqual(expectedRs, rs) {
+		t.Errorf("expected: %v, actual: %v\n", expectedRs, rs)
+	}
+
+	fakeReq.MaxEntries = 1
+	rs, err = fakePlugin.ListVolumes(fakeCtx, &fakeReq)
+	if nil != err {
+		t.Errorf("failed to ListVolumes: %v\n", err)
+	}
+
+	expectedRs = &csi.ListVolumesResponse{Entries: expectedEntries[:1], NextToken: "1"}
+	if !reflect.DeepEqual(expectedRs, rs) {
+		t.Errorf("expected: %v, actual: %v\n", expectedRs, rs)
+	}
+
+	fakeReq.StartingToken = rs.NextToken
+	rs, err = fakePlugin.ListVolumes(fakeCtx, &fakeReq)
+	if nil != err {
+		t.Errorf("failed to ListVolumes: %v\n", err)
+	}
+
+	expectedRs = &csi.ListVolumesResponse{Entries: expectedEntries[1:]}
+	if !reflect.DeepEqual(expectedRs, rs) {
+		t.Errorf("expected: %v, actual: %v\n", expectedRs, rs)
+	}
+
+	// Test error
+	fakeReq.StartingToken = "2"
+	_, err = fakePlugin.ListVolumes(fakeCtx, &fakeReq)
+	expectedErr := status.Error(codes.Aborted, "startingToken=2 >= len(volumes)=2")
+
+	if !reflect.DeepEqual(expectedErr, err) {
+		t.Errorf("expected: %v, actual: %v\n", expectedErr, err)
+	}
+
+	fakeReq.StartingToken = "k"
+	_, err = fakePlugin.ListVolumes(fakeCtx, &fakeReq)
+	expectedErr = status.Error(codes.Aborted, "parsing the startingToken failed")
+
+	if !reflect.DeepEqual(expectedErr, err) {
+		t.Errorf("expected: %v, actual: %v\n", expectedErr, err)
+	}
+}
+
+func TestParseVolumeParameters(t *testing.T) {
+	vp, err := (&Plugin{}).parseVolumeParameters(context.Background(), map[string]string{
+		"Profile":                     "ssd",
+		KParamAZ:                      "az1",
+		KParamEnableReplication:       "True",
+		KParamMkfsOptions:             "-i 8192",
+		KParamMultipath:               "true",
+		"csi.storage.k8s.io/pvc/name": "pvc",
+	})
+	if nil != err {
+		t.Fatalf("failed to parseVolumeParameters: %v\n", err)
+	}
+
+	if "1106b972-66ef-11e7-b172-db03f3689c9c" != vp.profile.Id || "az1" != vp.az ||
+		!vp.enableReplication || util.OpensdsDefaultSecondaryAZ != vp.secondaryAZ || "-i 8192" != vp.mkfsOptions || !vp.multipath {
+		t.Errorf("unexpected parameters: %v\n", vp)
+	}
+
+	testCases := []struct {
+		params      map[string]string
+		expectedErr error
+	}{
+		{map[string]string{"pool": "pool1"}, status.Error(codes.InvalidArgument, "unknown parameter pool")},
+		{map[string]string{KParamAZ: ""}, status.Error(codes.InvalidArgument, "the parameter availabilityzone cannot be empty")},
+		{map[string]string{KParamEnableReplication: "yes"},
+			status.Error(codes.InvalidArgument, "the parameter enablereplication must be true or false, not \"yes\"")},
+		{map[string]string{KParamMultipath: "always"},
+			status.Error(codes.InvalidArgument, "the parameter multipath must be true or false, not \"always\"")},
+		{map[string]string{KParamProfile: "gold"},
+			status.Error(codes.InvalidArgument, "more than one profile is named gold, use the profile id")},
+		{map[string]string{KParamProfile: "silver"}, status.Error(codes.InvalidArgument, "the profile silver is not exist")},
+	}
+
+	for _, tc := range testCases {
+		_, err := (&Plugin{}).parseVolumeParameters(context.Background(), tc.params)
+		if !reflect.DeepEqual(tc.expectedErr, err) {
+			t.Errorf("expected: %v, actual: %v\n", tc.expectedErr, err)
+		}
+	}
+
+	_, err = (&Plugin{}).parseSnapshotParameters(context.Background(), map[string]string{KParamAZ: "az1"})
+	expectedErr := status.Error(codes.InvalidArgument, "unknown parameter availabilityzone")
+	if !reflect.DeepEqual(expectedErr, err) {
+		t.Errorf("expected: %v, actual: %v\n", expectedErr, err)
+	}
+}
+
+func TestParseMetadataParameters(t *testing.T) {
+	plugin := &Plugin{MetadataKeys: []string{"team"}}
+
+	vp, err := plugin.parseVolumeParameters(context.Background(), map[string]string{
+		KParamPVCName:               "data",
+		KParamPVCNamespace:          "default",
+		KParamPVName:                "pvc-1234",
+		"team":                      "storage",
+		"csi.storage.k8s.io/fstype": "ext4",
+	})
+	if err != nil {
+		t.Errorf("expected: %v, actual: %v\n", nil, err)
+	}
+
+	expectedMetadata := map[string]string{
+		KMetaPVCName:      "data",
+		KMetaPVCNamespace: "default",
+		KMetaPVName:       "pvc-1234",
+		"team":            "storage",
+	}
+	if !reflect.DeepEqual(expectedMetadata, vp.metadata) {
+		t.Errorf("expected: %v, actual: %v\n", expectedMetadata, vp.metadata)
+	}
+
+	sp, err := plugin.parseSnapshotParameters(context.Background(), map[string]string{
+		KParamVolumeSnapshotName:        "snap",
+		KParamVolumeSnapshotNamespace:   "default",
+		KParamVolumeSnapshotContentName: "snapcontent-1234",
+	})
+	if err != nil {
+		t.Errorf("expected: %v, actual: %v\n", nil, err)
+	}
+
+	expectedMetadata = map[string]string{
+		KMetaVolumeSnapshotName:        "snap",
+		KMetaVolumeSnapshotNamespace:   "default",
+		KMetaVolumeSnapshotContentName: "snapcontent-1234",
+	}
+	if !reflect.DeepEqual(expectedMetadata, sp.metadata) {
+		t.Errorf("expected: %v, actual: %v\n", expectedMetadata, sp.metadata)
+	}
+
+	_, err = (&Plugin{}).parseVolumeParameters(context.Background(), map[string]string{"team": "storage"})
+	expectedErr := status.Error(codes.InvalidArgument, "unknown parameter team")
+	if !reflect.DeepEqual(expectedErr, err) {
+		t.Errorf("expected: %v, actual: %v\n", expectedErr, err)
+	}
+
+	expectedDesc := "Created by " + PluginName + " for PVC default/data"
+	if desc := describeOwner("PVC", "default", "data"); expectedDesc != desc {
+		t.Errorf("expected: %v, actual: %v\n", expectedDesc, desc)
+	}
+
+	if desc := describeOwner("PVC", "default", ""); "" != desc {
+		t.Errorf("expected: %v, actual: %v\n", "", desc)
+	}
+}
+
+func TestGetDefaultProfile(t *testing.T) {
+	testCases := []struct {
+		plugin      *Plugin
+		expectedId  string
+		expectedErr error
+	}{
+		{&Plugin{}, "2f9c0a04-66ef-11e7-ade2-43158893e017", nil},
+		{&Plugin{DefaultProfile: "ssd"}, "1106b972-66ef-11e7-b172-db03f3689c9c", nil},
+		{&Plugin{DefaultProfile: "3f9c0a04-66ef-11e7-ade2-43158893e017"}, "3f9c0a04-66ef-11e7-ade2-43158893e017", nil},
+		{&Plugin{DefaultProfile: "silver"}, "", status.Error(codes.FailedPrecondition, "No default profile")},
+	}
+
+	for _, tc := range testCases {
+		prf, err := tc.plugin.getDefaultProfile(context.Background())
+		if !reflect.DeepEqual(tc.expectedErr, err) {
+			t.Errorf("expected: %v, actual: %v\n", tc.expectedErr, err)
+			continue
+		}
+
+		if nil == err && tc.expectedId != prf.Id {
+			t.Errorf("expected: %v, actual: %v\n", tc.expectedId, prf.Id)
+		}
+	}
+}
+
+func TestWaitForVolumeCreated(t *testing.T) {
+	var fakeCtx = context.Background()
+
+	vol, err := waitForVolumeCreated(fakeCtx, "bd5b12a8-a101-11e7-941e-d77981b584d8")
+	if nil != err || model.VolumeAvailable != vol.Status {
+		t.Errorf("failed to waitForVolumeCreated: %v, %v\n", vol, err)
+	}
+
+	_, err = waitForVolumeCreated(fakeCtx, fakeErrorId)
+	expectedErr := status.Error(codes.Internal,
+		"the backend failed to create the volume "+fakeErrorId+", it is deleted")
+
+	if !reflect.DeepEqual(expectedErr, err) {
+		t.Errorf("expected: %v, actual: %v\n", expectedErr, err)
+	}
+
+	if !isFakeDeleted(fakeErrorId) {
+		t.Errorf("the volume %s in error is not deleted\n", fakeErrorId)
+	}
+}
+
+func TestWaitForVolumeCreatedInErrorStatus(t *testing.T) {
+	fb := newFakeBackend()
+	fb.delay = 0
+	defer useFakeBackend(fb)()
+
+	defer func(interval time.Duration) {
+		volumePollInterval = interval
+	}(volumePollInterval)
+	volumePollInterval = time.Millisecond
+
+	testCases := []struct {
+		status   string
+		expected codes.Code
+	}{
+		{model.VolumeError, codes.Internal},
+		{model.VolumeErrorExtending, codes.Internal},
+		{"error_insufficient_capacity", codes.ResourceExhausted},
+	}
+
+	for _, tc := range testCases {
+		fb.volumes["volume-1"] = &model.VolumeSpec{
+			BaseModel: &model.BaseModel{Id: "volume-1"},
+			Status:    tc.status,
+		}
+
+		_, err := waitForVolumeCreated(context.Background(), "volume-1")
+		expectedErr := status.Error(tc.expected, "the backend failed to create the volume volume-1, it is deleted")
+		if !reflect.DeepEqual(expectedErr, err) {
+			t.Errorf("expected: %v, actual: %v\n", expectedErr, err)
+		}
+
+		if _, ok := fb.volumes["volume-1"]; ok {
+			t.Errorf("the volume in %s is not deleted\n", tc.status)
+		}
+	}
+
+	// A volume is only created once it is available
+	fb.volumes["volume-1"] = &model.VolumeSpec{
+		BaseModel: &model.BaseModel{Id: "volume-1"},
+		Status:    model.VolumeExtending,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := waitForVolumeCreated(ctx, "volume-1"); codes.DeadlineExceeded != status.Code(err) {
+		t.Errorf("expected: %v, actual: %v\n", codes.DeadlineExceeded, err)
+	}
+}
+
+func TestWaitForSnapshot(t *testing.T) {
+	var fakeCtx = context.Background()
+
+	snapshot, err := waitForSnapshot(fakeCtx, "3769855c-a102-11e7-b772-17b880d2f537")
+	if nil != err || model.VolumeSnapAvailable != snapshot.Status {
+		t.Errorf("failed to waitForSnapshot: %v, %v\n", snapshot, err)
+	}
+
+	_, err = waitForSnapshot(fakeCtx, fakeErrorId)
+	expectedErr := status.Error(codes.Internal,
+		"the backend failed to create the snapshot "+fakeErrorId+", it is deleted")
+
+	if !reflect.DeepEqual(expectedErr, err) {
+		t.Errorf("expected: %v, actual: %v\n", expectedErr, err)
+	}
+
+	if !isFakeDeleted(fakeErrorId) {
+		t.Errorf("the snapshot %s in error is not deleted\n", fakeErrorId)
+	}
+
+	ctx, cancel := context.WithCancel(fakeCtx)
+	cancel()
+
+	_, err = waitForSnapshot(ctx, "3769855c-a102-11e7-b772-17b880d2f537")
+	if codes.Canceled != status.Code(err) {
+		t.Errorf("expected: %v, actual: %v\n", codes.Canceled, err)
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2018 Huawei Technologies Co., Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opensds
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	c "github.com/opensds/opensds/client"
+	"github.com/opensds/opensds/pkg/model"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+//                            Error Classification                            //
+////////////////////////////////////////////////////////////////////////////////
+
+// The external provisioner, attacher and snapshotter decide whether to retry
+// by the code of an error, so the errors of OpenSDS are converted to the code
+// telling what went wrong instead of being returned as they are.
+
+// errorMessageCodes the codes of the errors OpenSDS only tells in the message,
+// the OpenSDS controller returns most of them as 400 or 500
+var errorMessageCodes = []struct {
+	code     codes.Code
+	keywords []string
+}{
+	{codes.NotFound, []string{"not found", "not exist", "can't find", "cannot find", "could not be found", "no such"}},
+	{codes.AlreadyExists, []string{"already exist", "duplicate"}},
+	{codes.ResourceExhausted, []string{"insufficient", "no available pool", "no valid pool", "not enough", "quota"}},
+	{codes.Aborted, []string{"in progress", "is busy", "conflict"}},
+	{codes.Unavailable, []string{"connection refused", "connection reset", "no route to host", "timeout"}},
+}
+
+// errorCode gets the gRPC code of an error of OpenSDS
+func errorCode(err error) codes.Code {
+	if nil == err {
+		return codes.OK
+	}
+
+	if st, ok := status.FromError(err); ok {
+		return st.Code()
+	}
+
+	if httpErr, ok := err.(*c.HttpError); ok {
+		return httpErrorCode(httpErr)
+	}
+
+	if _, ok := err.(*model.NotFoundError); ok {
+		return codes.NotFound
+	}
+
+	if _, ok := err.(net.Error); ok {
+		return codes.Unavailable
+	}
+
+	if code, ok := messageCode(err.Error()); ok {
+		return code
+	}
+
+	return codes.Internal
+}
+
+// httpErrorCode gets the gRPC code of an HTTP error returned by OpenSDS
+func httpErrorCode(err *c.HttpError) codes.Code {
+	// The message of the error is its body until it is decoded
+	err.Decode()
+
+	switch err.Code {
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusConflict:
+		if code, ok := messageCode(err.Msg); ok && codes.AlreadyExists == code {
+			return code
+		}
+		return codes.Aborted
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusRequestEntityTooLarge, http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusNotImplemented:
+		return codes.Unimplemented
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return codes.Unavailable
+	}
+
+	if code, ok := messageCode(err.Msg); ok {
+		return code
+	}
+
+	switch {
+	case http.StatusBadRequest == err.Code:
+		return codes.InvalidArgument
+	case err.Code < http.StatusInternalServerError:
+		return codes.FailedPrecondition
+	default:
+		return codes.Internal
+	}
+}
+
+// messageCode gets the code of an error by its message
+func messageCode(msg string) (codes.Code, bool) {
+	msg = strings.ToLower(msg)
+
+	for _, mc := range errorMessageCodes {
+		for _, keyword := range mc.keywords {
+			if strings.Contains(msg, keyword) {
+				return mc.code, true
+			}
+		}
+	}
+
+	return codes.Unknown, false
+}
+
+// statusError converts an error of OpenSDS to a gRPC status error, the
+// message tells the operation that failed
+func statusError(err error, format string, a ...interface{}) error {
+	if nil == err {
+		return nil
+	}
+
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	msg := fmt.Sprintf(format, a...)
+	return status.Error(errorCode(err), fmt.Sprintf("%s: %v", msg, err))
+}
+
+// isNotFoundError checks if an error of OpenSDS means the resource does not exist
+func isNotFoundError(err error) bool {
+	return nil != err && codes.NotFound == errorCode(err)
+}
+
+// getVolume gets a volume, the error is NotFound if the volume does not exist
+func getVolume(ctx context.Context, volId string) (*model.VolumeSpec, error) {
+	var vol *model.VolumeSpec
+	err := retry(ctx, "get volume", func(client *c.Client) (err error) {
+		vol, err = client.GetVolume(volId)
+		return err
+	})
+	if nil != err && !isNotFoundError(err) {
+		return nil, statusError(err, "get volume %s failed", volId)
+	}
+
+	if nil != err || nil == vol {
+		msg := fmt.Sprintf("the volume %s is not exist", volId)
+		return nil, status.Error(codes.NotFound, msg)
+	}
+
+	return vol, nil
+}
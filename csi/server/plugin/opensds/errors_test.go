@@ -0,0 +1,96 @@
+// Copyright (c) 2018 Huawei Technologies Co., Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opensds
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+
+	c "github.com/opensds/opensds/client"
+	"github.com/opensds/opensds/pkg/model"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func httpError(code int, msg string) error {
+	return c.NewHttpError(code, string(model.ErrorBadRequestStatus(msg)))
+}
+
+func TestErrorCode(t *testing.T) {
+	testCases := []struct {
+		err      error
+		expected codes.Code
+	}{
+		{nil, codes.OK},
+		{status.Error(codes.OutOfRange, "out of range"), codes.OutOfRange},
+		{httpError(http.StatusNotFound, "volume not found"), codes.NotFound},
+		{httpError(http.StatusBadRequest, "Can't find the volume"), codes.NotFound},
+		{httpError(http.StatusConflict, "the volume already exists"), codes.AlreadyExists},
+		{httpError(http.StatusConflict, "the volume is being deleted"), codes.Aborted},
+		{httpError(http.StatusBadRequest, "no available pool to meet user's requirement"), codes.ResourceExhausted},
+		{httpError(http.StatusInternalServerError, "insufficient capacity"), codes.ResourceExhausted},
+		{httpError(http.StatusBadRequest, "size must be positive"), codes.InvalidArgument},
+		{httpError(http.StatusUnauthorized, "token expired"), codes.Unauthenticated},
+		{httpError(http.StatusForbidden, "forbidden"), codes.PermissionDenied},
+		{httpError(http.StatusServiceUnavailable, "down"), codes.Unavailable},
+		{httpError(http.StatusInternalServerError, "driver failed"), codes.Internal},
+		{c.NewHttpError(http.StatusNotFound, "404 page not found"), codes.NotFound},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, codes.Unavailable},
+		{model.NewNotFoundError("volume not found"), codes.NotFound},
+		{errors.New("dial tcp 127.0.0.1:50040: connection refused"), codes.Unavailable},
+		{errors.New("failed to unmarshal result message"), codes.Internal},
+	}
+
+	for _, tc := range testCases {
+		if code := errorCode(tc.err); tc.expected != code {
+			t.Errorf("%v, expected: %v, actual: %v\n", tc.err, tc.expected, code)
+		}
+	}
+}
+
+func TestStatusError(t *testing.T) {
+	if err := statusError(nil, "get volume %s failed", "v1"); nil != err {
+		t.Errorf("expected: %v, actual: %v\n", nil, err)
+	}
+
+	expectedErr := status.Error(codes.OutOfRange, "out of range")
+	if err := statusError(expectedErr, "get volume %s failed", "v1"); !reflect.DeepEqual(expectedErr, err) {
+		t.Errorf("expected: %v, actual: %v\n", expectedErr, err)
+	}
+
+	err := statusError(httpError(http.StatusNotFound, "volume not found"), "get volume %s failed", "v1")
+	expectedErr = status.Error(codes.NotFound, "get volume v1 failed: Code: 404, Desc: Not Found, Msg: volume not found")
+	if !reflect.DeepEqual(expectedErr, err) {
+		t.Errorf("expected: %v, actual: %v\n", expectedErr, err)
+	}
+}
+
+func TestGetVolume(t *testing.T) {
+	_, err := getVolume(context.Background(), fakeMissingId)
+	expectedErr := status.Error(codes.NotFound, "the volume "+fakeMissingId+" is not exist")
+
+	if !reflect.DeepEqual(expectedErr, err) {
+		t.Errorf("expected: %v, actual: %v\n", expectedErr, err)
+	}
+
+	vol, err := getVolume(context.Background(), "bd5b12a8-a101-11e7-941e-d77981b584d8")
+	if nil != err || "bd5b12a8-a101-11e7-941e-d77981b584d8" != vol.Id {
+		t.Errorf("failed to getVolume: %v, %v\n", vol, err)
+	}
+}
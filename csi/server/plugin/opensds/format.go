@@ -0,0 +1,263 @@
+// Copyright (c) 2018 Huawei Technologies Co., Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opensds
+
+import (
+	"fmt"
+	"strings"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/opensds/opensds/pkg/utils"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+//                            Filesystem options                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// The mkfs options of a volume are given by the mkfsoptions parameter of its
+// StorageClass, e.g. "-i 8192 -L data", and reach the node service through the
+// volume context. They and the mount flags of a capability are checked against
+// what each filesystem allows, the other options could change which device is
+// formatted or how it is mounted.
+
+// mkfsForceFlags the flag which makes mkfs format a device it would refuse to,
+// the node service only formats the devices without anything on them
+var mkfsForceFlags = map[string]string{
+	"ext2":  "-F",
+	"ext3":  "-F",
+	"ext4":  "-F",
+	"xfs":   "-f",
+	"btrfs": "-f",
+}
+
+// extMkfsFlags the mkfs.ext* flags which can be given, along with whether they
+// take a value
+var extMkfsFlags = map[string]bool{
+	"-b": true,  // block size
+	"-E": true,  // extended options, e.g. nodiscard
+	"-i": true,  // bytes per inode
+	"-I": true,  // inode size
+	"-j": false, // journal
+	"-L": true,  // label
+	"-m": true,  // reserved blocks percentage
+	"-N": true,  // number of inodes
+	"-O": true,  // features
+	"-T": true,  // usage type
+}
+
+// mkfsFlags the mkfs flags which can be given for each filesystem
+var mkfsFlags = map[string]map[string]bool{
+	"ext2": extMkfsFlags,
+	"ext3": extMkfsFlags,
+	"ext4": extMkfsFlags,
+	"xfs": {
+		"-b": true,  // block size
+		"-d": true,  // data section
+		"-i": true,  // inodes
+		"-K": false, // no discard
+		"-l": true,  // log section
+		"-L": true,  // label
+		"-m": true,  // metadata
+		"-n": true,  // naming
+		"-s": true,  // sector size
+	},
+	"btrfs": {
+		"-d": true,  // data profile
+		"-K": false, // no discard
+		"-L": true,  // label
+		"-m": true,  // metadata profile
+		"-n": true,  // node size
+		"-O": true,  // features
+		"-s": true,  // sector size
+	},
+}
+
+// extMkfsSubOptions the sub-options which can be given to the mkfs.ext* flags
+// taking a comma separated list of them, e.g. -E stride=16,nodiscard. The ones
+// which write elsewhere than at the start of the device are left out.
+var extMkfsSubOptions = map[string][]string{
+	"-E": {
+		"stride", "stripe_width", "stripe-width", "resize", "lazy_itable_init",
+		"lazy_journal_init", "packed_meta_blocks", "root_owner", "discard",
+		"nodiscard", "num_backup_sb", "quotatype", "encoding", "encoding_flags",
+	},
+}
+
+// mkfsSubOptions the sub-options which can be given to the flags of each
+// filesystem taking a comma separated list of them, a sub-option with a value
+// is allowed by its name. The xfs sub-options naming a file or another device
+// for a section, e.g. -d name= or -l logdev=, are not allowed.
+var mkfsSubOptions = map[string]map[string][]string{
+	"ext2": extMkfsSubOptions,
+	"ext3": extMkfsSubOptions,
+	"ext4": extMkfsSubOptions,
+	"xfs": {
+		"-b": {"size", "log"},
+		"-d": {"agcount", "agsize", "su", "sunit", "sw", "swidth", "noalign",
+			"extszinherit", "projinherit", "cowextsize"},
+		"-i": {"size", "log", "perblock", "maxpct", "align", "attr",
+			"projid32bit", "sparse"},
+		"-l": {"size", "version", "su", "sunit", "lazy-count"},
+		"-m": {"crc", "finobt", "uuid", "rmapbt", "reflink"},
+		"-n": {"size", "log", "version", "ftype"},
+		"-s": {"size", "log"},
+	},
+}
+
+// commonMountOptions the mount options allowed for every filesystem
+var commonMountOptions = []string{
+	"ro", "rw", "sync", "async", "dirsync", "_netdev",
+	"nosuid", "suid", "nodev", "dev", "noexec", "exec",
+	"noatime", "atime", "nodiratime", "diratime", "relatime", "norelatime",
+	"strictatime", "nostrictatime", "lazytime", "nolazytime",
+	"discard", "nodiscard",
+}
+
+// extMountOptions the mount options allowed for the ext* filesystems
+var extMountOptions = []string{
+	"acl", "noacl", "user_xattr", "nouser_xattr", "errors", "data", "commit",
+	"barrier", "nobarrier", "delalloc", "nodelalloc", "journal_checksum",
+	"stripe", "quota", "noquota", "usrquota", "grpquota", "prjquota", "dax",
+}
+
+// fsMountOptions the mount options allowed for each filesystem besides the
+// common ones, an option with a value is allowed by its name
+var fsMountOptions = map[string][]string{
+	"ext2": extMountOptions,
+	"ext3": extMountOptions,
+	"ext4": extMountOptions,
+	"xfs": {
+		"inode32", "inode64", "noquota", "quota", "usrquota", "grpquota",
+		"prjquota", "uquota", "gquota", "pquota", "logbufs", "logbsize",
+		"largeio", "nolargeio", "allocsize", "sunit", "swidth", "wsync",
+		"nouuid", "attr2", "noattr2", "filestreams", "dax",
+	},
+	"btrfs": {
+		"compress", "compress-force", "ssd", "nossd", "ssd_spread",
+		"space_cache", "nospace_cache", "autodefrag", "noautodefrag",
+		"commit", "subvol", "subvolid", "datacow", "nodatacow", "datasum",
+		"nodatasum", "barrier", "nobarrier", "flushoncommit",
+		"noflushoncommit", "thread_pool",
+	},
+}
+
+// parseMkfsOptions parses the mkfs options of a volume into the arguments of
+// mkfs for a filesystem, an option it does not allow is an error
+func parseMkfsOptions(fsType string, options string) ([]string, error) {
+	fields := strings.Fields(options)
+	if 0 == len(fields) {
+		return nil, nil
+	}
+
+	if "" == fsType {
+		fsType = DefFSType
+	}
+
+	flags, ok := mkfsFlags[fsType]
+	if !ok {
+		return nil, fmt.Errorf("mkfs options are not supported for fs type %s", fsType)
+	}
+
+	for i := 0; i < len(fields); i++ {
+		hasValue, ok := flags[fields[i]]
+		if !ok {
+			return nil, fmt.Errorf("mkfs option %s is not allowed for fs type %s", fields[i], fsType)
+		}
+
+		if hasValue {
+			if i+1 == len(fields) || strings.HasPrefix(fields[i+1], "-") {
+				return nil, fmt.Errorf("mkfs option %s needs a value", fields[i])
+			}
+
+			if subOptions, ok := mkfsSubOptions[fsType][fields[i]]; ok {
+				for _, subOption := range strings.Split(fields[i+1], ",") {
+					name := strings.SplitN(subOption, "=", 2)[0]
+					if !utils.Contained(name, subOptions) {
+						return nil, fmt.Errorf("mkfs option %s %s is not allowed for fs type %s",
+							fields[i], subOption, fsType)
+					}
+				}
+			}
+			i++
+		}
+	}
+
+	return fields, nil
+}
+
+// validateMkfsOptions checks the mkfs options of a volume against the
+// filesystems of the capabilities it is created with
+func validateMkfsOptions(options string, capabilities []*csi.VolumeCapability) error {
+	if "" == strings.TrimSpace(options) {
+		return nil
+	}
+
+	for _, capability := range capabilities {
+		mnt := capability.GetMount()
+		if nil == mnt {
+			continue
+		}
+
+		if _, err := parseMkfsOptions(mnt.FsType, options); err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// isMountOptionAllowed checks if a mount option is allowed for a filesystem,
+// an option of any of the filesystems is allowed if it is not known. The
+// options are joined with commas, so a comma would smuggle in another option.
+func isMountOptionAllowed(fsType string, option string) bool {
+	if strings.Contains(option, ",") {
+		return false
+	}
+
+	name := strings.SplitN(option, "=", 2)[0]
+	if utils.Contained(name, commonMountOptions) {
+		return true
+	}
+
+	if "" != fsType {
+		return utils.Contained(name, fsMountOptions[fsType])
+	}
+
+	for _, options := range fsMountOptions {
+		if utils.Contained(name, options) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validateMountFlags checks the mount flags of a capability against the
+// allowed mount options of its filesystem
+func validateMountFlags(mnt *csi.VolumeCapability_MountVolume) error {
+	for _, flag := range mnt.MountFlags {
+		if "" == flag {
+			continue
+		}
+
+		if !isMountOptionAllowed(mnt.FsType, flag) {
+			return status.Error(codes.InvalidArgument, fmt.Sprintf("mount flag %s is not allowed", flag))
+		}
+	}
+
+	return nil
+}
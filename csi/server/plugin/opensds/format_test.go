@@ -0,0 +1,119 @@
+// Copyright (c) 2018 Huawei Technologies Co., Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opensds
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseMkfsOptions(t *testing.T) {
+	testCases := []struct {
+		fsType      string
+		options     string
+		expected    []string
+		expectedErr error
+	}{
+		{"ext4", "", nil, nil},
+		{"ext4", " -i 8192  -L data -E nodiscard ", []string{"-i", "8192", "-L", "data", "-E", "nodiscard"}, nil},
+		{"", "-m 0", []string{"-m", "0"}, nil},
+		{"xfs", "-K -L data -i size=512", []string{"-K", "-L", "data", "-i", "size=512"}, nil},
+		{"btrfs", "-K -m single", []string{"-K", "-m", "single"}, nil},
+		{"xfs", "-i size=512 -E nodiscard", nil, fmt.Errorf("mkfs option -E is not allowed for fs type xfs")},
+		{"ext4", "-i", nil, fmt.Errorf("mkfs option -i needs a value")},
+		{"ext4", "-L -F", nil, fmt.Errorf("mkfs option -L needs a value")},
+		// A device or a block count would be taken as the device
+		{"ext4", "/dev/sda", nil, fmt.Errorf("mkfs option /dev/sda is not allowed for fs type ext4")},
+		{"zfs", "-L data", nil, fmt.Errorf("mkfs options are not supported for fs type zfs")},
+		{"xfs", "-d su=64k,sw=4 -l size=64m", []string{"-d", "su=64k,sw=4", "-l", "size=64m"}, nil},
+		{"ext4", "-E stride=16,stripe_width=64", []string{"-E", "stride=16,stripe_width=64"}, nil},
+		// A sub-option could make mkfs write to a file or another device
+		{"xfs", "-d su=64k,name=/etc/passwd", nil, fmt.Errorf("mkfs option -d name=/etc/passwd is not allowed for fs type xfs")},
+		{"xfs", "-l logdev=/dev/sdb", nil, fmt.Errorf("mkfs option -l logdev=/dev/sdb is not allowed for fs type xfs")},
+		{"xfs", "-d rtdev=/dev/sdb", nil, fmt.Errorf("mkfs option -d rtdev=/dev/sdb is not allowed for fs type xfs")},
+		{"ext4", "-E offset=4096", nil, fmt.Errorf("mkfs option -E offset=4096 is not allowed for fs type ext4")},
+	}
+
+	for _, tc := range testCases {
+		args, err := parseMkfsOptions(tc.fsType, tc.options)
+		if !reflect.DeepEqual(tc.expected, args) || !reflect.DeepEqual(tc.expectedErr, err) {
+			t.Errorf("%s %q, expected: %v, %v, actual: %v, %v\n", tc.fsType, tc.options,
+				tc.expected, tc.expectedErr, args, err)
+		}
+	}
+}
+
+func TestValidateMkfsOptions(t *testing.T) {
+	capabilities := []*csi.VolumeCapability{
+		mountCapability("ext4"),
+		mountCapability("xfs"),
+		&csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Block{
+				Block: &csi.VolumeCapability_BlockVolume{},
+			},
+		},
+	}
+
+	if err := validateMkfsOptions("-L data", capabilities); nil != err {
+		t.Errorf("failed to validateMkfsOptions: %v\n", err)
+	}
+
+	err := validateMkfsOptions("-E nodiscard", capabilities)
+	expectedErr := status.Error(codes.InvalidArgument, "mkfs option -E is not allowed for fs type xfs")
+	if !reflect.DeepEqual(expectedErr, err) {
+		t.Errorf("expected: %v, actual: %v\n", expectedErr, err)
+	}
+}
+
+func TestIsMountOptionAllowed(t *testing.T) {
+	testCases := []struct {
+		fsType   string
+		option   string
+		expected bool
+	}{
+		{"ext4", "noatime", true},
+		{"ext4", "discard", true},
+		{"ext4", "errors=remount-ro", true},
+		{"xfs", "inode64", true},
+		{"xfs", "logbsize=256k", true},
+		{"btrfs", "compress=zstd", true},
+		{"ext4", "inode64", false},
+		{"xfs", "data=journal", false},
+		// The filesystem of a volume is not known without a fs type
+		{"", "inode64", true},
+		{"", "loop", false},
+		{"ext4", "context=system_u:object_r:container_file_t:s0", false},
+		// The flags are joined with commas into the mount options
+		{"ext4", "commit=5,loop", false},
+		{"xfs", "noatime,loop", false},
+	}
+
+	for _, tc := range testCases {
+		if actual := isMountOptionAllowed(tc.fsType, tc.option); tc.expected != actual {
+			t.Errorf("%s %s, expected: %v, actual: %v\n", tc.fsType, tc.option, tc.expected, actual)
+		}
+	}
+
+	err := validateMountFlags(mountCapability("ext4", "noatime", "loop").GetMount())
+	expectedErr := status.Error(codes.InvalidArgument, "mount flag loop is not allowed")
+	if !reflect.DeepEqual(expectedErr, err) {
+		t.Errorf("expected: %v, actual: %v\n", expectedErr, err)
+	}
+}
@@ -5,6 +5,8 @@ import (
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/golang/glog"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	c "github.com/opensds/opensds/client"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -25,7 +27,9 @@ func (p *Plugin) Probe(
 
 	switch runtime.GOOS {
 	case "linux":
-		return &csi.ProbeResponse{}, nil
+		return &csi.ProbeResponse{
+			Ready: &wrappers.BoolValue{Value: isOpenSDSReachable(ctx)},
+		}, nil
 	default:
 		msg := "unsupported operating system:" + runtime.GOOS
 		glog.Error(msg)
@@ -64,6 +68,40 @@ func (p *Plugin) GetPluginCapabilities(
 					},
 				},
 			},
+			&csi.PluginCapability{
+				Type: &csi.PluginCapability_Service_{
+					Service: &csi.PluginCapability_Service{
+						Type: csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
+					},
+				},
+			},
+			&csi.PluginCapability{
+				Type: &csi.PluginCapability_VolumeExpansion_{
+					VolumeExpansion: &csi.PluginCapability_VolumeExpansion{
+						Type: csi.PluginCapability_VolumeExpansion_ONLINE,
+					},
+				},
+			},
 		},
 	}, nil
 }
+
+// isOpenSDSReachable The plugin is not ready while the calls to OpenSDS fail
+// to reach it, OpenSDS is called again once the breaker lets calls through
+func isOpenSDSReachable(ctx context.Context) bool {
+	if !breaker.tripped() {
+		return true
+	}
+
+	if breaker.allow() {
+		err := call(ctx, "probe OpenSDS", func(client *c.Client) error {
+			_, err := client.ListProfiles()
+			return err
+		})
+		if err != nil {
+			glog.Warningf("OpenSDS is unreachable: %v", err)
+		}
+	}
+
+	return !breaker.tripped()
+}
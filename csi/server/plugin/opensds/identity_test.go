@@ -42,3 +42,42 @@ func TestGetPluginInfo(t *testing.T) {
 		t.Errorf("expected: %v, actual: %v\n", rs, expectedPluginInfo)
 	}
 }
+
+func TestGetPluginCapabilities(t *testing.T) {
+	var fakePlugin = &Plugin{}
+	var fakeCtx = context.Background()
+	fakeReq := &csi.GetPluginCapabilitiesRequest{}
+
+	expectedCapabilities := []*csi.PluginCapability{
+		&csi.PluginCapability{
+			Type: &csi.PluginCapability_Service_{
+				Service: &csi.PluginCapability_Service{
+					Type: csi.PluginCapability_Service_CONTROLLER_SERVICE,
+				},
+			},
+		},
+		&csi.PluginCapability{
+			Type: &csi.PluginCapability_Service_{
+				Service: &csi.PluginCapability_Service{
+					Type: csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
+				},
+			},
+		},
+		&csi.PluginCapability{
+			Type: &csi.PluginCapability_VolumeExpansion_{
+				VolumeExpansion: &csi.PluginCapability_VolumeExpansion{
+					Type: csi.PluginCapability_VolumeExpansion_ONLINE,
+				},
+			},
+		},
+	}
+
+	rs, err := fakePlugin.GetPluginCapabilities(fakeCtx, fakeReq)
+	if err != nil {
+		t.Errorf("failed to GetPluginCapabilities: %v\n", err)
+	}
+
+	if !reflect.DeepEqual(rs.Capabilities, expectedCapabilities) {
+		t.Errorf("expected: %v, actual: %v\n", expectedCapabilities, rs.Capabilities)
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2018 Huawei Technologies Co., Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opensds
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/golang/glog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+//                            Operation Locks                                 //
+////////////////////////////////////////////////////////////////////////////////
+
+// The sidecars retry a request before the previous one is done, two requests
+// on the same volume would both find it is not created or published yet. A
+// request is aborted while another one on the same volume, snapshot or path
+// is pending, the sidecar retries it later.
+
+// Prefixes of the keys of the operation locks
+const (
+	lockVolumeName   = "volume-name/"
+	lockVolumeId     = "volume/"
+	lockSnapshotName = "snapshot-name/"
+	lockSnapshotId   = "snapshot/"
+	lockPath         = "path/"
+)
+
+var operations = &operationLocks{keys: make(map[string]bool)}
+
+// operationLocks keeps the keys of the pending operations
+type operationLocks struct {
+	sync.Mutex
+	keys map[string]bool
+}
+
+// tryLock locks all the keys or none of them, the key which is locked by
+// another operation is returned
+func (ol *operationLocks) tryLock(keys []string) (string, bool) {
+	ol.Lock()
+	defer ol.Unlock()
+
+	for _, key := range keys {
+		if ol.keys[key] {
+			return key, false
+		}
+	}
+
+	for _, key := range keys {
+		ol.keys[key] = true
+	}
+
+	return "", true
+}
+
+// unlock unlocks the keys
+func (ol *operationLocks) unlock(keys []string) {
+	ol.Lock()
+	defer ol.Unlock()
+
+	for _, key := range keys {
+		delete(ol.keys, key)
+	}
+}
+
+// lockOperation locks the keys of an operation, the error is Aborted if an
+// operation on one of them is pending. The returned func unlocks the keys.
+func lockOperation(keys ...string) (func(), error) {
+	if key, ok := operations.tryLock(keys); !ok {
+		glog.V(5).Infof("operation pending on %s", key)
+		return nil, status.Error(codes.Aborted, fmt.Sprintf("operation pending on %s", key))
+	}
+
+	return func() {
+		operations.unlock(keys)
+	}, nil
+}
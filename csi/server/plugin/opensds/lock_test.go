@@ -0,0 +1,402 @@
+// Copyright (c) 2018 Huawei Technologies Co., Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opensds
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	c "github.com/opensds/opensds/client"
+	"github.com/opensds/opensds/pkg/model"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeBackend an OpenSDS keeping the volumes it creates, its calls take
+// delay so that the requests of a test overlap. The lists are filtered and
+// encoded like those of OpenSDS.
+type fakeBackend struct {
+	sync.Mutex
+	delay       time.Duration
+	volumes     map[string]*model.VolumeSpec
+	attachments map[string]*model.VolumeAttachmentSpec
+	snapshots   map[string]*model.VolumeSnapshotSpec
+	// volumeStatus the status of the volumes the backend creates
+	volumeStatus string
+	creates      int
+	deletes      int
+	lists        int
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{
+		delay:       5 * time.Millisecond,
+		volumes:     make(map[string]*model.VolumeSpec),
+		attachments: make(map[string]*model.VolumeAttachmentSpec),
+		snapshots:   make(map[string]*model.VolumeSnapshotSpec),
+		// The volumes are created at once
+		volumeStatus: model.VolumeAvailable,
+	}
+}
+
+// useFakeBackend makes the volume calls go to fb, the returned func restores
+// them. The lookups of other backends are dropped.
+func useFakeBackend(fb *fakeBackend) func() {
+	volumeMgr := Client.VolumeMgr
+	Client.VolumeMgr = &c.VolumeMgr{Receiver: fb}
+	lookups = newLookupCache()
+
+	return func() {
+		Client.VolumeMgr = volumeMgr
+		lookups = newLookupCache()
+	}
+}
+
+// matchFilter checks the value of a field like the filters of OpenSDS do
+func matchFilter(filter url.Values, key, value string) bool {
+	return "" == filter.Get(key) || strings.EqualFold(filter.Get(key), value)
+}
+
+// encode copies in to out through JSON like a response of OpenSDS
+func encode(in interface{}, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(body, out)
+}
+
+func (fb *fakeBackend) Recv(rawurl string, method string, in interface{}, out interface{}) error {
+	time.Sleep(fb.delay)
+
+	fb.Lock()
+	defer fb.Unlock()
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return err
+	}
+	id := path.Base(u.Path)
+	filter := u.Query()
+
+	switch strings.ToUpper(method) {
+	case "POST":
+		fb.creates++
+		switch req := in.(type) {
+		case c.VolumeBuilder:
+			vol := model.VolumeSpec(*req)
+			vol.BaseModel = &model.BaseModel{Id: fmt.Sprintf("fake-volume-%d", fb.creates)}
+			vol.Status = fb.volumeStatus
+			fb.volumes[vol.Id] = &vol
+			*out.(*model.VolumeSpec) = vol
+		case c.VolumeSnapshotBuilder:
+			snapshot := model.VolumeSnapshotSpec(*req)
+			snapshot.BaseModel = &model.BaseModel{Id: fmt.Sprintf("fake-snapshot-%d", fb.creates)}
+			snapshot.Status = model.VolumeSnapAvailable
+			fb.snapshots[snapshot.Id] = &snapshot
+			*out.(*model.VolumeSnapshotSpec) = snapshot
+		default:
+			return fmt.Errorf("input %T not supported", in)
+		}
+	case "PUT":
+		switch req := in.(type) {
+		case c.VolumeBuilder:
+			if _, ok := fb.volumes[id]; !ok {
+				return c.NewHttpError(http.StatusNotFound, "volume not found")
+			}
+			vol := &model.VolumeSpec{}
+			if err := encode(req, vol); err != nil {
+				return err
+			}
+			fb.volumes[id] = vol
+		case c.VolumeAttachmentBuilder:
+			if _, ok := fb.attachments[id]; !ok {
+				return c.NewHttpError(http.StatusNotFound, "attachment not found")
+			}
+			attachment := &model.VolumeAttachmentSpec{}
+			if err := encode(req, attachment); err != nil {
+				return err
+			}
+			fb.attachments[id] = attachment
+		default:
+			return fmt.Errorf("input %T not supported", in)
+		}
+	case "GET":
+		switch res := out.(type) {
+		case *[]*model.VolumeSpec:
+			fb.lists++
+			var list []*model.VolumeSpec
+			for _, vol := range fb.volumes {
+				if matchFilter(filter, "Name", vol.Name) {
+					list = append(list, vol)
+				}
+			}
+			return encode(list, res)
+		case *[]*model.VolumeAttachmentSpec:
+			fb.lists++
+			var list []*model.VolumeAttachmentSpec
+			for _, attachment := range fb.attachments {
+				if matchFilter(filter, "VolumeId", attachment.VolumeId) {
+					list = append(list, attachment)
+				}
+			}
+			return encode(list, res)
+		case *[]*model.VolumeSnapshotSpec:
+			fb.lists++
+			var list []*model.VolumeSnapshotSpec
+			for _, snapshot := range fb.snapshots {
+				if matchFilter(filter, "Name", snapshot.Name) {
+					list = append(list, snapshot)
+				}
+			}
+			return encode(list, res)
+		case *model.VolumeSnapshotSpec:
+			snapshot, ok := fb.snapshots[id]
+			if !ok {
+				return c.NewHttpError(http.StatusNotFound, "snapshot not found")
+			}
+			return encode(snapshot, res)
+		case *model.VolumeSpec:
+			vol, ok := fb.volumes[id]
+			if !ok {
+				return c.NewHttpError(http.StatusNotFound, "volume not found")
+			}
+			return encode(vol, res)
+		case *model.VolumeAttachmentSpec:
+			attachment, ok := fb.attachments[id]
+			if !ok {
+				return c.NewHttpError(http.StatusNotFound, "attachment not found")
+			}
+			return encode(attachment, res)
+		default:
+			return fmt.Errorf("output %T not supported", out)
+		}
+	case "DELETE":
+		if _, ok := fb.snapshots[id]; ok {
+			fb.deletes++
+			delete(fb.snapshots, id)
+			return nil
+		}
+
+		if _, ok := fb.volumes[id]; !ok {
+			return c.NewHttpError(http.StatusNotFound, "volume not found")
+		}
+
+		fb.deletes++
+		delete(fb.volumes, id)
+	default:
+		return fmt.Errorf("method %s not supported", method)
+	}
+
+	return nil
+}
+
+// isPendingError checks if an operation was aborted by another pending one
+func isPendingError(err error) bool {
+	st, ok := status.FromError(err)
+	return ok && codes.Aborted == st.Code()
+}
+
+func TestLockOperation(t *testing.T) {
+	unlock, err := lockOperation(lockVolumeId+"volume-1", lockPath+"/mnt/target-1")
+	if nil != err {
+		t.Fatalf("failed to lockOperation: %v\n", err)
+	}
+
+	for _, keys := range [][]string{
+		{lockVolumeId + "volume-1"},
+		{lockPath + "/mnt/target-1"},
+		{lockVolumeId + "volume-2", lockPath + "/mnt/target-1"},
+	} {
+		if _, err := lockOperation(keys...); !isPendingError(err) {
+			t.Errorf("expected: %v, actual: %v\n", codes.Aborted, err)
+		}
+	}
+
+	// A failed lock leaves none of its keys locked
+	unlockOther, err := lockOperation(lockVolumeId+"volume-2", lockPath+"/mnt/target-2")
+	if nil != err {
+		t.Errorf("failed to lockOperation: %v\n", err)
+	} else {
+		unlockOther()
+	}
+
+	// A volume name and a volume id are different keys
+	unlockName, err := lockOperation(lockVolumeName + "volume-1")
+	if nil != err {
+		t.Errorf("failed to lockOperation: %v\n", err)
+	} else {
+		unlockName()
+	}
+
+	unlock()
+
+	unlock, err = lockOperation(lockVolumeId + "volume-1")
+	if nil != err {
+		t.Errorf("failed to lockOperation after unlock: %v\n", err)
+	} else {
+		unlock()
+	}
+}
+
+func TestConcurrentCreateVolume(t *testing.T) {
+	fb := newFakeBackend()
+	defer useFakeBackend(fb)()
+
+	var fakePlugin = &Plugin{}
+	fakeReq := &csi.CreateVolumeRequest{
+		Name: "concurrent-volume",
+		Parameters: map[string]string{
+			"profile":          "1106b972-66ef-11e7-b172-db03f3689c9c",
+			"availabilityzone": "default",
+		},
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	volIds := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			rs, err := fakePlugin.CreateVolume(context.Background(), fakeReq)
+			if nil != err {
+				if !isPendingError(err) {
+					t.Errorf("expected: %v, actual: %v\n", codes.Aborted, err)
+				}
+				return
+			}
+
+			mu.Lock()
+			volIds[rs.Volume.VolumeId] = true
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	// The retry of an aborted request finds the volume created by the first one
+	rs, err := fakePlugin.CreateVolume(context.Background(), fakeReq)
+	if nil != err {
+		t.Fatalf("failed to CreateVolume: %v\n", err)
+	}
+	volIds[rs.Volume.VolumeId] = true
+
+	if 1 != fb.creates || 1 != len(volIds) {
+		t.Errorf("expected: 1 volume created, actual: %v created, ids %v\n", fb.creates, volIds)
+	}
+}
+
+func TestConcurrentCreateVolumes(t *testing.T) {
+	fb := newFakeBackend()
+	defer useFakeBackend(fb)()
+
+	var fakePlugin = &Plugin{}
+
+	// Requests for different volumes do not wait for each other
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			_, err := fakePlugin.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+				Name: fmt.Sprintf("concurrent-volume-%d", i),
+				Parameters: map[string]string{
+					"profile":          "1106b972-66ef-11e7-b172-db03f3689c9c",
+					"availabilityzone": "default",
+				},
+			})
+			if nil != err {
+				t.Errorf("failed to CreateVolume: %v\n", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if 10 != fb.creates {
+		t.Errorf("expected: %v, actual: %v\n", 10, fb.creates)
+	}
+}
+
+func TestConcurrentDeleteVolume(t *testing.T) {
+	fb := newFakeBackend()
+	defer useFakeBackend(fb)()
+
+	vol, err := Client.CreateVolume(&model.VolumeSpec{Name: "concurrent-volume", Size: 1})
+	if nil != err {
+		t.Fatalf("failed to create volume: %v\n", err)
+	}
+
+	var fakePlugin = &Plugin{}
+	fakeReq := &csi.DeleteVolumeRequest{VolumeId: vol.Id}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			_, err := fakePlugin.DeleteVolume(context.Background(), fakeReq)
+			if nil != err && !isPendingError(err) {
+				t.Errorf("expected: %v, actual: %v\n", codes.Aborted, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if _, err := fakePlugin.DeleteVolume(context.Background(), fakeReq); nil != err {
+		t.Errorf("failed to DeleteVolume: %v\n", err)
+	}
+
+	if 1 != fb.deletes || 0 != len(fb.volumes) {
+		t.Errorf("expected: 1 volume deleted, actual: %v deleted, %v left\n", fb.deletes, len(fb.volumes))
+	}
+}
+
+func TestNodeOperationPending(t *testing.T) {
+	unlock, err := lockOperation(lockPath + "/mnt/pending-target")
+	if nil != err {
+		t.Fatalf("failed to lockOperation: %v\n", err)
+	}
+	defer unlock()
+
+	var fakePlugin = &Plugin{}
+	_, err = fakePlugin.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+		VolumeId:   "bd5b12a8-a101-11e7-941e-d77981b584d8",
+		TargetPath: "/mnt/pending-target",
+	})
+	if !isPendingError(err) {
+		t.Errorf("expected: %v, actual: %v\n", codes.Aborted, err)
+	}
+
+	_, err = fakePlugin.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{
+		VolumeId:          "bd5b12a8-a101-11e7-941e-d77981b584d8",
+		StagingTargetPath: "/mnt/pending-target",
+	})
+	if !isPendingError(err) {
+		t.Errorf("expected: %v, actual: %v\n", codes.Aborted, err)
+	}
+}
@@ -0,0 +1,305 @@
+// Copyright (c) 2018 Huawei Technologies Co., Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opensds
+
+import (
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	c "github.com/opensds/opensds/client"
+	"github.com/opensds/opensds/pkg/model"
+	"golang.org/x/net/context"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+//                            Lookups                                         //
+////////////////////////////////////////////////////////////////////////////////
+
+// Every request looks up the volume, snapshot, attachments or replication it
+// is about. They are listed by the filters of OpenSDS instead of listing all
+// of them, and the results are kept for a short time for the retries of the
+// sidecars. A result is dropped once the plugin changes one of the resources
+// it tells about.
+
+var (
+	// lookupCacheTTL time a lookup result is used for
+	lookupCacheTTL = 5 * time.Second
+	// lookupCacheSize number of results above which the expired ones are
+	// dropped
+	lookupCacheSize = 1024
+
+	lookups = newLookupCache()
+)
+
+// Prefixes of the keys of the lookup results
+const (
+	lookupVolumeName   = "volume-name/"
+	lookupSnapshotName = "snapshot-name/"
+	lookupAttachments  = "attachments/"
+	lookupReplication  = "replication/"
+)
+
+// lookupEntry a lookup result and the ids it is indexed by
+type lookupEntry struct {
+	value     interface{}
+	ids       []string
+	expiresAt time.Time
+}
+
+// lookupCache keeps the lookup results by their keys, and indexes them by the
+// ids of the resources they tell about
+type lookupCache struct {
+	sync.Mutex
+	entries map[string]*lookupEntry
+	index   map[string]map[string]bool
+}
+
+func newLookupCache() *lookupCache {
+	return &lookupCache{
+		entries: make(map[string]*lookupEntry),
+		index:   make(map[string]map[string]bool),
+	}
+}
+
+// get returns the result of a lookup which is not expired
+func (lc *lookupCache) get(key string) (interface{}, bool) {
+	lc.Lock()
+	defer lc.Unlock()
+
+	entry, ok := lc.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	if time.Now().After(entry.expiresAt) {
+		lc.remove(key)
+		return nil, false
+	}
+
+	return entry.value, true
+}
+
+// set keeps the result of a lookup, it is indexed by its key and the ids
+func (lc *lookupCache) set(key string, value interface{}, ids ...string) {
+	if lookupCacheTTL <= 0 {
+		return
+	}
+
+	lc.Lock()
+	defer lc.Unlock()
+
+	lc.remove(key)
+
+	if len(lc.entries) >= lookupCacheSize {
+		now := time.Now()
+		for k, entry := range lc.entries {
+			if now.After(entry.expiresAt) {
+				lc.remove(k)
+			}
+		}
+	}
+
+	entry := &lookupEntry{
+		value:     value,
+		ids:       append([]string{key}, ids...),
+		expiresAt: time.Now().Add(lookupCacheTTL),
+	}
+	lc.entries[key] = entry
+
+	for _, id := range entry.ids {
+		if nil == lc.index[id] {
+			lc.index[id] = make(map[string]bool)
+		}
+		lc.index[id][key] = true
+	}
+}
+
+// forget drops the results indexed by any of the keys or ids
+func (lc *lookupCache) forget(ids ...string) {
+	lc.Lock()
+	defer lc.Unlock()
+
+	for _, id := range ids {
+		for key := range lc.index[id] {
+			lc.remove(key)
+		}
+	}
+}
+
+// remove drops a result, the caller must hold the lock
+func (lc *lookupCache) remove(key string) {
+	entry, ok := lc.entries[key]
+	if !ok {
+		return
+	}
+
+	delete(lc.entries, key)
+
+	for _, id := range entry.ids {
+		delete(lc.index[id], key)
+		if 0 == len(lc.index[id]) {
+			delete(lc.index, id)
+		}
+	}
+}
+
+// listFilter the filter of a list call of OpenSDS, whose client does not
+// escape the values
+func listFilter(key, value string) map[string]string {
+	return map[string]string{key: url.QueryEscape(value)}
+}
+
+// listVolumesByName lists the volumes with a name, an empty result is not
+// kept since the volume may be being created
+func listVolumesByName(ctx context.Context, name string) ([]*model.VolumeSpec, error) {
+	key := lookupVolumeName + name
+	if value, ok := lookups.get(key); ok {
+		return value.([]*model.VolumeSpec), nil
+	}
+
+	var volumes []*model.VolumeSpec
+	err := retry(ctx, "list volumes", func(client *c.Client) (err error) {
+		volumes, err = client.ListVolumes(listFilter("Name", name))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The filter of OpenSDS ignores the case
+	var found []*model.VolumeSpec
+	var ids []string
+	for _, volume := range volumes {
+		if volume != nil && volume.Name == name {
+			found = append(found, volume)
+			ids = append(ids, volume.Id)
+		}
+	}
+
+	if len(found) > 0 {
+		lookups.set(key, found, ids...)
+	}
+
+	return found, nil
+}
+
+// listSnapshotsByName lists the snapshots with a name
+func listSnapshotsByName(ctx context.Context, name string) ([]*model.VolumeSnapshotSpec, error) {
+	key := lookupSnapshotName + name
+	if value, ok := lookups.get(key); ok {
+		return value.([]*model.VolumeSnapshotSpec), nil
+	}
+
+	var snapshots []*model.VolumeSnapshotSpec
+	err := retry(ctx, "list volume snapshots", func(client *c.Client) (err error) {
+		snapshots, err = client.ListVolumeSnapshots(listFilter("Name", name))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var found []*model.VolumeSnapshotSpec
+	var ids []string
+	for _, snapshot := range snapshots {
+		if snapshot != nil && snapshot.Name == name {
+			found = append(found, snapshot)
+			ids = append(ids, snapshot.Id)
+		}
+	}
+
+	if len(found) > 0 {
+		lookups.set(key, found, ids...)
+	}
+
+	return found, nil
+}
+
+// listAttachmentsByVolume lists the attachments of a volume, an empty result
+// is not kept since the other plugin may be creating an attachment
+func listAttachmentsByVolume(ctx context.Context, volId string) ([]*model.VolumeAttachmentSpec, error) {
+	key := lookupAttachments + volId
+	if value, ok := lookups.get(key); ok {
+		return value.([]*model.VolumeAttachmentSpec), nil
+	}
+
+	var attachments []*model.VolumeAttachmentSpec
+	err := retry(ctx, "list volume attachments", func(client *c.Client) (err error) {
+		attachments, err = client.ListVolumeAttachments(listFilter("VolumeId", volId))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var found []*model.VolumeAttachmentSpec
+	ids := []string{volId}
+	for _, attachment := range attachments {
+		if attachment != nil && attachment.VolumeId == volId {
+			found = append(found, attachment)
+			ids = append(ids, attachment.Id)
+		}
+	}
+
+	if len(found) > 0 {
+		lookups.set(key, found, ids...)
+	}
+
+	return found, nil
+}
+
+// findReplicationByVolume finds the replication a volume is the primary or
+// the secondary volume of. An empty result is kept as well, a replication is
+// created along with its volumes.
+func findReplicationByVolume(ctx context.Context, volId string) (*model.ReplicationSpec, error) {
+	key := lookupReplication + volId
+	if value, ok := lookups.get(key); ok {
+		return value.(*model.ReplicationSpec), nil
+	}
+
+	var found *model.ReplicationSpec
+	for _, filterKey := range []string{"PrimaryVolumeId", "SecondaryVolumeId"} {
+		var replications []*model.ReplicationSpec
+		err := retry(ctx, "list replications", func(client *c.Client) (err error) {
+			replications, err = client.ListReplications(listFilter(filterKey, volId))
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, r := range replications {
+			if r != nil && (volId == r.PrimaryVolumeId || volId == r.SecondaryVolumeId) {
+				found = r
+				break
+			}
+		}
+
+		if found != nil {
+			break
+		}
+	}
+
+	if found != nil {
+		lookups.set(key, found, volId, found.Id, found.PrimaryVolumeId, found.SecondaryVolumeId)
+	} else {
+		lookups.set(key, found, volId)
+	}
+
+	glog.V(5).Infof("replication of the volume %s: %v", volId, found)
+	return found, nil
+}
@@ -0,0 +1,245 @@
+// Copyright (c) 2018 Huawei Technologies Co., Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opensds
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/opensds/opensds/pkg/model"
+	"golang.org/x/net/context"
+)
+
+func TestLookupCache(t *testing.T) {
+	lc := newLookupCache()
+
+	lc.set("volume-name/a", "a", "volume-1", "volume-2")
+	lc.set("volume-name/b", "b", "volume-2")
+	lc.set("volume-name/c", "c")
+
+	if value, ok := lc.get("volume-name/a"); !ok || "a" != value {
+		t.Errorf("expected: %v, actual: %v\n", "a", value)
+	}
+
+	// A result is dropped by any of its ids or its key
+	lc.forget("volume-1")
+	if _, ok := lc.get("volume-name/a"); ok {
+		t.Errorf("expected: volume-name/a is dropped\n")
+	}
+	if _, ok := lc.get("volume-name/b"); !ok {
+		t.Errorf("expected: volume-name/b is kept\n")
+	}
+
+	lc.forget("volume-name/c")
+	if _, ok := lc.get("volume-name/c"); ok {
+		t.Errorf("expected: volume-name/c is dropped\n")
+	}
+
+	lc.forget("volume-2")
+	if 0 != len(lc.entries) || 0 != len(lc.index) {
+		t.Errorf("expected: empty cache, actual: %v, %v\n", lc.entries, lc.index)
+	}
+
+	// An expired result is not used
+	lc.set("volume-name/d", "d")
+	lc.entries["volume-name/d"].expiresAt = time.Now().Add(-time.Second)
+	if _, ok := lc.get("volume-name/d"); ok {
+		t.Errorf("expected: volume-name/d is expired\n")
+	}
+}
+
+func TestListVolumesByName(t *testing.T) {
+	fb := newFakeBackend()
+	fb.delay = 0
+	fb.volumes["volume-1"] = &model.VolumeSpec{BaseModel: &model.BaseModel{Id: "volume-1"}, Name: "sample-volume"}
+	fb.volumes["volume-2"] = &model.VolumeSpec{BaseModel: &model.BaseModel{Id: "volume-2"}, Name: "SAMPLE-VOLUME"}
+	fb.volumes["volume-3"] = &model.VolumeSpec{BaseModel: &model.BaseModel{Id: "volume-3"}, Name: "other-volume"}
+	defer useFakeBackend(fb)()
+
+	volumes, err := listVolumesByName(context.Background(), "sample-volume")
+	if nil != err {
+		t.Fatalf("failed to listVolumesByName: %v\n", err)
+	}
+
+	if 1 != len(volumes) || "volume-1" != volumes[0].Id {
+		t.Errorf("expected: [volume-1], actual: %v\n", volumes)
+	}
+
+	// The retries use the result
+	listVolumesByName(context.Background(), "sample-volume")
+	if 1 != fb.lists {
+		t.Errorf("expected: %v, actual: %v\n", 1, fb.lists)
+	}
+
+	// Deleting the volume drops the result
+	if err := deleteVolume(context.Background(), "volume-1"); nil != err {
+		t.Fatalf("failed to deleteVolume: %v\n", err)
+	}
+
+	volumes, err = listVolumesByName(context.Background(), "sample-volume")
+	if nil != err || 0 != len(volumes) || 2 != fb.lists {
+		t.Errorf("expected: no volume after 2 lists, actual: %v after %v lists, %v\n", volumes, fb.lists, err)
+	}
+
+	// No volume is not kept
+	listVolumesByName(context.Background(), "sample-volume")
+	if 3 != fb.lists {
+		t.Errorf("expected: %v, actual: %v\n", 3, fb.lists)
+	}
+}
+
+func TestListAttachmentsByVolume(t *testing.T) {
+	fb := newFakeBackend()
+	fb.delay = 0
+	fb.attachments["attachment-1"] = &model.VolumeAttachmentSpec{BaseModel: &model.BaseModel{Id: "attachment-1"}, VolumeId: "volume-1"}
+	fb.attachments["attachment-2"] = &model.VolumeAttachmentSpec{BaseModel: &model.BaseModel{Id: "attachment-2"}, VolumeId: "volume-2"}
+	defer useFakeBackend(fb)()
+
+	attachments, err := listAttachmentsByVolume(context.Background(), "volume-2")
+	if nil != err {
+		t.Fatalf("failed to listAttachmentsByVolume: %v\n", err)
+	}
+
+	expected := []*model.VolumeAttachmentSpec{fb.attachments["attachment-2"]}
+	if !reflect.DeepEqual(expected, attachments) {
+		t.Errorf("expected: %v, actual: %v\n", expected, attachments)
+	}
+
+	lookups.forget("attachment-2")
+	listAttachmentsByVolume(context.Background(), "volume-2")
+	if 2 != fb.lists {
+		t.Errorf("expected: %v, actual: %v\n", 2, fb.lists)
+	}
+}
+
+// benchmarkVolumes number of volumes OpenSDS has in the benchmarks
+const benchmarkVolumes = 10000
+
+// newBenchmarkBackend a backend with benchmarkVolumes volumes, each of them
+// is attached to a node
+func newBenchmarkBackend() *fakeBackend {
+	fb := newFakeBackend()
+	fb.delay = 0
+
+	for i := 0; i < benchmarkVolumes; i++ {
+		volId := fmt.Sprintf("volume-%d", i)
+		fb.volumes[volId] = &model.VolumeSpec{
+			BaseModel:        &model.BaseModel{Id: volId},
+			Name:             fmt.Sprintf("pvc-%d", i),
+			Size:             1,
+			AvailabilityZone: "default",
+			Status:           model.VolumeAvailable,
+		}
+
+		attachmentId := fmt.Sprintf("attachment-%d", i)
+		fb.attachments[attachmentId] = &model.VolumeAttachmentSpec{
+			BaseModel: &model.BaseModel{Id: attachmentId},
+			VolumeId:  volId,
+			HostInfo:  model.HostInfo{Host: "node-1"},
+		}
+	}
+
+	return fb
+}
+
+// withoutLookupCache runs a benchmark with the lookup results not kept
+func withoutLookupCache(b *testing.B, fn func(b *testing.B)) {
+	ttl := lookupCacheTTL
+	lookupCacheTTL = 0
+	lookups = newLookupCache()
+	defer func() {
+		lookupCacheTTL = ttl
+	}()
+
+	fn(b)
+}
+
+// BenchmarkFindVolume compares listing all the volumes, which FindVolume did
+// before, with listing them by name
+func BenchmarkFindVolume(b *testing.B) {
+	defer useFakeBackend(newBenchmarkBackend())()
+
+	req := &model.VolumeSpec{Name: "pvc-5000", Size: 1, AvailabilityZone: "default"}
+	ctx := context.Background()
+
+	b.Run("ListAll", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			volumes, _ := Client.ListVolumes()
+			for _, vol := range volumes {
+				if vol.Name == req.Name {
+					break
+				}
+			}
+		}
+	})
+
+	b.Run("Filtered", func(b *testing.B) {
+		withoutLookupCache(b, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, ok, _, err := FindVolume(ctx, req); !ok || nil != err {
+					b.Fatalf("failed to FindVolume: %v\n", err)
+				}
+			}
+		})
+	})
+
+	b.Run("Cached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, ok, _, err := FindVolume(ctx, req); !ok || nil != err {
+				b.Fatalf("failed to FindVolume: %v\n", err)
+			}
+		}
+	})
+}
+
+// BenchmarkIsVolumePublished compares listing all the attachments, which
+// isVolumePublished did before, with listing them by volume
+func BenchmarkIsVolumePublished(b *testing.B) {
+	defer useFakeBackend(newBenchmarkBackend())()
+
+	attachReq := &model.VolumeAttachmentSpec{VolumeId: "volume-5000", HostInfo: model.HostInfo{Host: "node-1"}}
+	ctx := context.Background()
+
+	b.Run("ListAll", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			attachments, _ := Client.ListVolumeAttachments()
+			for _, attachment := range attachments {
+				if attachment.VolumeId == attachReq.VolumeId {
+					break
+				}
+			}
+		}
+	})
+
+	b.Run("Filtered", func(b *testing.B) {
+		withoutLookupCache(b, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if attachment, err := isVolumePublished(ctx, false, attachReq, nil); nil == attachment || nil != err {
+					b.Fatalf("failed to isVolumePublished: %v\n", err)
+				}
+			}
+		})
+	})
+
+	b.Run("Cached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if attachment, err := isVolumePublished(ctx, false, attachReq, nil); nil == attachment || nil != err {
+				b.Fatalf("failed to isVolumePublished: %v\n", err)
+			}
+		}
+	})
+}
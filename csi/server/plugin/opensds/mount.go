@@ -0,0 +1,523 @@
+// Copyright (c) 2018 Huawei Technologies Co., Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opensds
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/golang/glog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+//                            Mounter                                         //
+////////////////////////////////////////////////////////////////////////////////
+
+// The node service finds out what is mounted from /proc/self/mountinfo, and
+// mounts and formats through the Mounter, which the tests replace with a fake.
+
+// procMountInfo the mount points seen by the plugin
+const procMountInfo = "/proc/self/mountinfo"
+
+var mounter Mounter = &systemMounter{}
+
+// MountPoint a mount point of /proc/self/mountinfo
+type MountPoint struct {
+	Id       int
+	ParentId int
+	// Device the major:minor of the device the filesystem is on
+	Device string
+	// Root the path in the filesystem which is mounted
+	Root string
+	Path string
+	// Opts the options of the mount point, SuperOpts those of the filesystem
+	Opts      []string
+	FsType    string
+	Source    string
+	SuperOpts []string
+}
+
+// Formatter makes filesystems on devices
+type Formatter interface {
+	// GetFSType returns the filesystem on a device, it is empty if there is
+	// none. A device which has something else on it is an error.
+	GetFSType(device string) (string, error)
+	// Format makes a filesystem on a device
+	Format(device string, fsType string, args []string) error
+	// Check checks the filesystem on a device which is not mounted, and
+	// repairs what can be repaired safely
+	Check(device string, fsType string) error
+}
+
+// Mounter mounts the filesystems and devices of the node
+type Mounter interface {
+	Formatter
+	// List lists the mount points, a mount point is after the ones it
+	// is mounted over
+	List() ([]*MountPoint, error)
+	// Mount mounts source at target, fsType is detected if it is empty
+	Mount(source string, target string, fsType string, options []string) error
+	// Unmount unmounts the top mount point at target
+	Unmount(target string) error
+}
+
+// systemMounter the Mounter of the node the plugin runs on
+type systemMounter struct{}
+
+// List implementation
+func (*systemMounter) List() ([]*MountPoint, error) {
+	f, err := os.Open(procMountInfo)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return parseMountInfo(f)
+}
+
+// Mount implementation
+func (*systemMounter) Mount(source string, target string, fsType string, options []string) error {
+	var args []string
+	if "" != fsType {
+		args = append(args, "-t", fsType)
+	}
+	if options = mountOptions(options); len(options) > 0 {
+		args = append(args, "-o", strings.Join(options, ","))
+	}
+
+	return runCommand("mount", append(args, source, target)...)
+}
+
+// Unmount implementation
+func (*systemMounter) Unmount(target string) error {
+	return runCommand("umount", target)
+}
+
+// GetFSType implementation
+func (*systemMounter) GetFSType(device string) (string, error) {
+	out, err := exec.Command("blkid", "-p", "-o", "export", device).CombinedOutput()
+	if err != nil {
+		// blkid exits with 2 when it finds nothing on the device
+		if code, ok := exitStatus(err); ok && 2 == code {
+			return "", nil
+		}
+
+		return "", fmt.Errorf("blkid %s failed: %v, %s", device, err, strings.TrimSpace(string(out)))
+	}
+
+	var fsType, ptType string
+	for _, line := range strings.Split(string(out), "\n") {
+		kv := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if 2 != len(kv) {
+			continue
+		}
+
+		switch kv[0] {
+		case "TYPE":
+			fsType = kv[1]
+		case "PTTYPE":
+			ptType = kv[1]
+		}
+	}
+
+	if "" == fsType && "" != ptType {
+		return "", fmt.Errorf("the device %s has a %s partition table", device, ptType)
+	}
+
+	return fsType, nil
+}
+
+// Format implementation
+func (*systemMounter) Format(device string, fsType string, args []string) error {
+	mkfsArgs := []string{"-t", fsType}
+	if flag, ok := mkfsForceFlags[fsType]; ok {
+		mkfsArgs = append(mkfsArgs, flag)
+	}
+	mkfsArgs = append(mkfsArgs, args...)
+
+	return runCommand("mkfs", append(mkfsArgs, device)...)
+}
+
+// Check implementation, only the ext* filesystems are checked. xfs and btrfs
+// check themselves when mounted, their check tools fail on a dirty log and
+// take long on a large filesystem.
+func (*systemMounter) Check(device string, fsType string) error {
+	if !strings.HasPrefix(fsType, "ext") {
+		return nil
+	}
+
+	out, err := exec.Command("fsck", "-a", device).CombinedOutput()
+	if err == nil {
+		return nil
+	}
+
+	code, ok := exitStatus(err)
+	switch {
+	case !ok:
+		// The node may have no fsck, the filesystem is mounted unchecked
+		glog.Warningf("failed to run fsck on %s: %v", device, err)
+		return nil
+	case code < 4:
+		// 1 and 2 tell the errors were corrected
+		glog.Infof("fsck corrected the errors on %s: %s", device, strings.TrimSpace(string(out)))
+		return nil
+	default:
+		return fmt.Errorf("fsck -a %s failed with status %d: %s", device, code, strings.TrimSpace(string(out)))
+	}
+}
+
+// exitStatus returns the exit status of a command which failed, it is false
+// if the command did not run
+func exitStatus(err error) (int, bool) {
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			return ws.ExitStatus(), true
+		}
+	}
+
+	return 0, false
+}
+
+// runCommand runs a command, the error tells its output
+func runCommand(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s failed: %v, %s", name, strings.Join(args, " "), err,
+			strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+// parseMountInfo parses the lines of a mountinfo file, which are
+// "id parent major:minor root path options [optional...] - fstype source superoptions"
+func parseMountInfo(r io.Reader) ([]*MountPoint, error) {
+	var mounts []*MountPoint
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if "" == line {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		sep := -1
+		for i := 6; i < len(fields); i++ {
+			if "-" == fields[i] {
+				sep = i
+				break
+			}
+		}
+
+		if sep < 0 || len(fields) < sep+3 {
+			return nil, fmt.Errorf("invalid mountinfo line: %q", line)
+		}
+
+		id, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid mountinfo line: %q", line)
+		}
+
+		parentId, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid mountinfo line: %q", line)
+		}
+
+		mp := &MountPoint{
+			Id:       id,
+			ParentId: parentId,
+			Device:   fields[2],
+			Root:     unescapeMountPath(fields[3]),
+			Path:     unescapeMountPath(fields[4]),
+			Opts:     strings.Split(fields[5], ","),
+			FsType:   fields[sep+1],
+			Source:   unescapeMountPath(fields[sep+2]),
+		}
+		if len(fields) > sep+3 {
+			mp.SuperOpts = strings.Split(fields[sep+3], ",")
+		}
+
+		mounts = append(mounts, mp)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return mounts, nil
+}
+
+// unescapeMountPath decodes the octal escapes of the space, tab, newline and
+// backslash in a path of mountinfo
+func unescapeMountPath(path string) string {
+	if !strings.Contains(path, `\`) {
+		return path
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if '\\' == path[i] && i+3 < len(path) {
+			if c, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+
+	return b.String()
+}
+
+// canonicalPath the path the kernel shows for a path, a path which does not
+// exist is only cleaned
+func canonicalPath(path string) string {
+	if realPath, err := filepath.EvalSymlinks(path); err == nil {
+		return realPath
+	}
+
+	return filepath.Clean(path)
+}
+
+// isPathWithin checks if path is base or is under base
+func isPathWithin(path string, base string) bool {
+	rel, err := filepath.Rel(base, path)
+	return err == nil && ".." != rel && !strings.HasPrefix(rel, "../")
+}
+
+// mountSource returns the device of the filesystem a path is in and the path
+// in the filesystem, which a bind mount of the path shows
+func mountSource(mounts []*MountPoint, path string) (string, string, bool) {
+	var found *MountPoint
+	for _, mp := range mounts {
+		if isPathWithin(path, mp.Path) && (nil == found || len(mp.Path) >= len(found.Path)) {
+			found = mp
+		}
+	}
+
+	if nil == found {
+		return "", "", false
+	}
+
+	rel, _ := filepath.Rel(found.Path, path)
+	return found.Device, filepath.Join(found.Root, rel), true
+}
+
+// getMountPoint returns the top mount point at a path, it is nil if nothing
+// is mounted at the path
+func getMountPoint(path string) (*MountPoint, error) {
+	mounts, err := mounter.List()
+	if err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("failed to list mount points: %v", err))
+	}
+
+	return findMountPoint(mounts, path), nil
+}
+
+// findMountPoint returns the top mount point at a path among mounts
+func findMountPoint(mounts []*MountPoint, path string) *MountPoint {
+	path = canonicalPath(path)
+
+	var found *MountPoint
+	for _, mp := range mounts {
+		if mp.Path == path {
+			found = mp
+		}
+	}
+
+	return found
+}
+
+// isMountPoint Check if something is mounted at the path
+func isMountPoint(path string) (bool, error) {
+	mp, err := getMountPoint(path)
+	return nil != mp, err
+}
+
+// isMountedFrom checks if a mount point is the filesystem on a device
+func isMountedFrom(mp *MountPoint, device string) bool {
+	return canonicalPath(mp.Source) == canonicalPath(device)
+}
+
+// isBindMountOf checks if a mount point is a bind mount of a path, the path
+// is a file or a directory in a filesystem, or a device node
+func isBindMountOf(mp *MountPoint, path string) (bool, error) {
+	mounts, err := mounter.List()
+	if err != nil {
+		return false, status.Error(codes.Internal, fmt.Sprintf("failed to list mount points: %v", err))
+	}
+
+	device, root, ok := mountSource(mounts, canonicalPath(path))
+	return ok && mp.Device == device && mp.Root == root, nil
+}
+
+// vfsOptions the options the kernel shows as the options of a mount point,
+// along with the options they cancel
+var vfsOptions = map[string]string{
+	"nosuid":      "suid",
+	"nodev":       "dev",
+	"noexec":      "exec",
+	"noatime":     "atime",
+	"nodiratime":  "diratime",
+	"relatime":    "norelatime",
+	"strictatime": "nostrictatime",
+}
+
+// isVFSOption checks if the kernel shows an option as an option of a mount
+// point rather than of the filesystem
+func isVFSOption(option string) bool {
+	if "ro" == option || "rw" == option {
+		return true
+	}
+
+	for set, unset := range vfsOptions {
+		if option == set || option == unset {
+			return true
+		}
+	}
+
+	return false
+}
+
+// mountOptions drops the empty options
+func mountOptions(options []string) []string {
+	var opts []string
+	for _, option := range options {
+		if option = strings.TrimSpace(option); "" != option {
+			opts = append(opts, option)
+		}
+	}
+
+	return opts
+}
+
+// hasOption checks if an option is among the options of a mount point
+func hasOption(opts []string, option string) bool {
+	for _, opt := range opts {
+		if opt == option {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isReadOnlyFilesystem checks if the filesystem of a read-write mount point
+// is read-only, e.g. remounted read-only by the kernel on errors. A volume
+// published read-only is a read-only mount of a read-write filesystem.
+func isReadOnlyFilesystem(mp *MountPoint) bool {
+	return hasOption(mp.SuperOpts, "ro") && !hasOption(mp.Opts, "ro")
+}
+
+// mountOptionsMatch checks if a mount point has the options it would have
+// been mounted with. The options the kernel does not show are not compared.
+func mountOptionsMatch(mp *MountPoint, options []string) bool {
+	mode := "rw"
+	for _, option := range mountOptions(options) {
+		switch {
+		case "ro" == option || "rw" == option:
+			mode = option
+		case "" != vfsOptions[option]:
+			if !hasOption(mp.Opts, option) {
+				glog.V(5).Infof("%s is not mounted with %s", mp.Path, option)
+				return false
+			}
+		default:
+			for set, unset := range vfsOptions {
+				if option == unset && hasOption(mp.Opts, set) {
+					glog.V(5).Infof("%s is mounted with %s", mp.Path, set)
+					return false
+				}
+			}
+		}
+	}
+
+	if !hasOption(mp.Opts, mode) {
+		glog.V(5).Infof("%s is not mounted %s", mp.Path, mode)
+		return false
+	}
+
+	return true
+}
+
+// formatAndMount mounts the filesystem on a device, a device without any
+// filesystem is formatted first with the mkfs arguments and an existing
+// filesystem is checked. The filesystem must be fsType unless it is empty, a
+// device is formatted as DefFSType then.
+func formatAndMount(device string, target string, fsType string, mkfsArgs []string, options []string) error {
+	curFSType, err := mounter.GetFSType(device)
+	if err != nil {
+		msg := fmt.Sprintf("failed to detect the filesystem on %s: %v", device, err)
+		glog.Error(msg)
+		return status.Error(codes.Internal, msg)
+	}
+
+	if "" == curFSType {
+		curFSType = DefFSType
+		if "" != fsType {
+			curFSType = fsType
+		}
+
+		glog.Infof("formatting %s as %s with %v", device, curFSType, mkfsArgs)
+		if err := mounter.Format(device, curFSType, mkfsArgs); err != nil {
+			return status.Error(codes.Aborted, fmt.Sprintf("failed to mkfs: %v", err.Error()))
+		}
+	} else if "" != fsType && fsType != curFSType {
+		glog.Errorf("Volume formatted but is incompatible, %v != %v!", fsType, curFSType)
+		return status.Error(codes.Aborted, "Volume formatted but is incompatible")
+	} else if err := checkFilesystem(device, curFSType); err != nil {
+		return err
+	}
+
+	if err := mounter.Mount(device, target, curFSType, options); err != nil {
+		return status.Error(codes.Aborted, fmt.Sprintf("failed to mount: %v", err.Error()))
+	}
+
+	return nil
+}
+
+// checkFilesystem checks an existing filesystem before it is mounted, unless
+// it is mounted somewhere else already
+func checkFilesystem(device string, fsType string) error {
+	mounts, err := mounter.List()
+	if err != nil {
+		return status.Error(codes.Internal, fmt.Sprintf("failed to list mount points: %v", err))
+	}
+
+	for _, mp := range mounts {
+		if isMountedFrom(mp, device) {
+			glog.V(5).Infof("%s is mounted at %s, it is not checked", device, mp.Path)
+			return nil
+		}
+	}
+
+	if err := mounter.Check(device, fsType); err != nil {
+		msg := fmt.Sprintf("the filesystem on %s is corrupted: %v", device, err)
+		glog.Error(msg)
+		return status.Error(codes.FailedPrecondition, msg)
+	}
+
+	return nil
+}
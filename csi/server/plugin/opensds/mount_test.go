@@ -0,0 +1,340 @@
+// Copyright (c) 2018 Huawei Technologies Co., Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opensds
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeMounter a Mounter keeping the mount points and the filesystems of the
+// devices in memory, the devices are in the devtmpfs mounted at /dev
+type fakeMounter struct {
+	sync.Mutex
+	mounts      []*MountPoint
+	filesystems map[string]string
+	devices     map[string]string
+	corrupted   map[string]bool
+	formatArgs  []string
+	formats     int
+	checks      int
+	mountCalls  int
+	nextId      int
+}
+
+func newFakeMounter() *fakeMounter {
+	return &fakeMounter{
+		mounts: []*MountPoint{
+			{Id: 1, Device: "0:1", Root: "/", Path: "/", Opts: []string{"rw"}, FsType: "rootfs", Source: "rootfs"},
+			{Id: 2, ParentId: 1, Device: "0:5", Root: "/", Path: "/dev", Opts: []string{"rw", "nosuid"}, FsType: "devtmpfs", Source: "udev"},
+		},
+		filesystems: make(map[string]string),
+		devices:     make(map[string]string),
+		corrupted:   make(map[string]bool),
+		nextId:      3,
+	}
+}
+
+// useFakeMounter makes the node service use fm, the returned func restores it
+func useFakeMounter(fm *fakeMounter) func() {
+	m := mounter
+	mounter = fm
+
+	return func() {
+		mounter = m
+	}
+}
+
+// addDevice adds a device with a filesystem, which is empty if it has none
+func (fm *fakeMounter) addDevice(device string, fsType string) {
+	fm.Lock()
+	defer fm.Unlock()
+
+	fm.devices[device] = fmt.Sprintf("8:%d", 16*len(fm.devices))
+	fm.filesystems[device] = fsType
+}
+
+// List implementation
+func (fm *fakeMounter) List() ([]*MountPoint, error) {
+	fm.Lock()
+	defer fm.Unlock()
+
+	mounts := make([]*MountPoint, len(fm.mounts))
+	copy(mounts, fm.mounts)
+	return mounts, nil
+}
+
+// Mount implementation, the options are split like the kernel does
+func (fm *fakeMounter) Mount(source string, target string, fsType string, options []string) error {
+	fm.Lock()
+	defer fm.Unlock()
+
+	fm.mountCalls++
+
+	mp := &MountPoint{Id: fm.nextId, Path: canonicalPath(target), Opts: []string{"rw"}}
+	isBind := false
+	for _, option := range mountOptions(options) {
+		switch {
+		case "bind" == option:
+			isBind = true
+		case "ro" == option || "rw" == option:
+			mp.Opts[0] = option
+		case isVFSOption(option):
+			mp.Opts = append(mp.Opts, option)
+		default:
+			mp.SuperOpts = append(mp.SuperOpts, option)
+		}
+	}
+
+	if parent := findMountPoint(fm.mounts, mp.Path); nil != parent {
+		mp.ParentId = parent.Id
+	}
+
+	if isBind {
+		device, root, ok := mountSource(fm.mounts, canonicalPath(source))
+		if !ok {
+			return fmt.Errorf("%s is not found", source)
+		}
+
+		mp.Device, mp.Root = device, root
+		for _, m := range fm.mounts {
+			if m.Device == device {
+				mp.FsType, mp.Source = m.FsType, m.Source
+			}
+		}
+	} else {
+		curFSType, ok := fm.filesystems[source]
+		if !ok {
+			return fmt.Errorf("special device %s does not exist", source)
+		}
+
+		if "" == curFSType || ("" != fsType && fsType != curFSType) {
+			return fmt.Errorf("wrong fs type on %s", source)
+		}
+
+		mp.Device, mp.Root, mp.FsType, mp.Source = fm.devices[source], "/", curFSType, source
+	}
+
+	fm.nextId++
+	fm.mounts = append(fm.mounts, mp)
+	return nil
+}
+
+// Unmount implementation
+func (fm *fakeMounter) Unmount(target string) error {
+	fm.Lock()
+	defer fm.Unlock()
+
+	target = canonicalPath(target)
+	for i := len(fm.mounts) - 1; i >= 0; i-- {
+		if fm.mounts[i].Path == target {
+			fm.mounts = append(fm.mounts[:i], fm.mounts[i+1:]...)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%s: not mounted", target)
+}
+
+// GetFSType implementation
+func (fm *fakeMounter) GetFSType(device string) (string, error) {
+	fm.Lock()
+	defer fm.Unlock()
+
+	fsType, ok := fm.filesystems[device]
+	if !ok {
+		return "", fmt.Errorf("%s does not exist", device)
+	}
+
+	return fsType, nil
+}
+
+// Format implementation
+func (fm *fakeMounter) Format(device string, fsType string, args []string) error {
+	fm.Lock()
+	defer fm.Unlock()
+
+	if _, ok := fm.filesystems[device]; !ok {
+		return fmt.Errorf("%s does not exist", device)
+	}
+
+	fm.formats++
+	fm.formatArgs = args
+	fm.filesystems[device] = fsType
+	delete(fm.corrupted, device)
+	return nil
+}
+
+// Check implementation
+func (fm *fakeMounter) Check(device string, fsType string) error {
+	fm.Lock()
+	defer fm.Unlock()
+
+	fm.checks++
+	if fm.corrupted[device] {
+		return fmt.Errorf("%s is corrupted", device)
+	}
+
+	return nil
+}
+
+func TestParseMountInfo(t *testing.T) {
+	mountInfo := `22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw,errors=remount-ro
+23 22 0:5 / /dev rw,nosuid,relatime shared:2 - devtmpfs udev rw,size=4010956k,mode=755
+300 22 8:16 / /var/lib/kubelet/plugins/staging\040dir rw,noexec,relatime shared:150 - xfs /dev/sdb rw,attr2,inode64,noquota
+301 22 0:5 /sdb /var/lib/kubelet/pods/pod/block ro,nosuid,relatime - devtmpfs udev rw,size=4010956k,mode=755
+`
+
+	mounts, err := parseMountInfo(strings.NewReader(mountInfo))
+	if err != nil {
+		t.Fatalf("failed to parseMountInfo: %v\n", err)
+	}
+
+	expected := &MountPoint{
+		Id:        300,
+		ParentId:  22,
+		Device:    "8:16",
+		Root:      "/",
+		Path:      "/var/lib/kubelet/plugins/staging dir",
+		Opts:      []string{"rw", "noexec", "relatime"},
+		FsType:    "xfs",
+		Source:    "/dev/sdb",
+		SuperOpts: []string{"rw", "attr2", "inode64", "noquota"},
+	}
+
+	if 4 != len(mounts) || !reflect.DeepEqual(expected, mounts[2]) {
+		t.Errorf("expected: %v, actual: %v\n", expected, mounts)
+	}
+
+	// The bind mount of a device node is the path of the device in devtmpfs
+	if isBound, _ := isBindMountOfIn(mounts, mounts[3], "/dev/sdb"); !isBound {
+		t.Errorf("expected %v to be a bind mount of /dev/sdb\n", mounts[3])
+	}
+
+	if _, err := parseMountInfo(strings.NewReader("22 1 8:1 / / rw\n")); nil == err {
+		t.Errorf("expected an error for a line without the separator\n")
+	}
+}
+
+// isBindMountOfIn checks isBindMountOf against mounts
+func isBindMountOfIn(mounts []*MountPoint, mp *MountPoint, path string) (bool, error) {
+	fm := newFakeMounter()
+	fm.mounts = mounts
+	defer useFakeMounter(fm)()
+
+	return isBindMountOf(mp, path)
+}
+
+func TestMountOptionsMatch(t *testing.T) {
+	mp := &MountPoint{
+		Opts:      []string{"rw", "noexec", "relatime"},
+		SuperOpts: []string{"rw", "attr2", "inode64", "noquota"},
+	}
+
+	testCases := []struct {
+		options  []string
+		expected bool
+	}{
+		{nil, true},
+		{[]string{""}, true},
+		{[]string{"rw", "noexec"}, true},
+		// The options the kernel does not show are not compared
+		{[]string{"bind", "discard", "_netdev"}, true},
+		{[]string{"ro"}, false},
+		{[]string{"nodev"}, false},
+		{[]string{"exec"}, false},
+	}
+
+	for _, tc := range testCases {
+		if actual := mountOptionsMatch(mp, tc.options); tc.expected != actual {
+			t.Errorf("options %v, expected: %v, actual: %v\n", tc.options, tc.expected, actual)
+		}
+	}
+}
+
+func TestUnescapeMountPath(t *testing.T) {
+	testCases := map[string]string{
+		`/mnt/a\040b`:    "/mnt/a b",
+		`/mnt/a\011b\\`:  "/mnt/a\tb\\\\",
+		`/mnt/a\134b`:    `/mnt/a\b`,
+		`/mnt/plain`:     "/mnt/plain",
+		`/mnt/short\04`:  `/mnt/short\04`,
+		`/mnt/invalid\9`: `/mnt/invalid\9`,
+	}
+
+	for path, expected := range testCases {
+		if actual := unescapeMountPath(path); expected != actual {
+			t.Errorf("expected: %q, actual: %q\n", expected, actual)
+		}
+	}
+}
+
+func TestFormatAndMount(t *testing.T) {
+	fm := newFakeMounter()
+	fm.addDevice("/dev/sdb", "")
+	fm.addDevice("/dev/sdc", "xfs")
+	fm.addDevice("/dev/sdd", "ext4")
+	fm.corrupted["/dev/sdd"] = true
+	defer useFakeMounter(fm)()
+
+	// A device without any filesystem is formatted with the mkfs arguments
+	if err := formatAndMount("/dev/sdb", "/mnt/sdb", "", []string{"-i", "8192"}, nil); err != nil {
+		t.Errorf("failed to formatAndMount: %v\n", err)
+	}
+
+	if fsType, _ := fm.GetFSType("/dev/sdb"); DefFSType != fsType || 1 != fm.formats || 0 != fm.checks {
+		t.Errorf("expected: %v formatted once, actual: %v formatted %v times\n", DefFSType, fsType, fm.formats)
+	}
+
+	if expected := []string{"-i", "8192"}; !reflect.DeepEqual(expected, fm.formatArgs) {
+		t.Errorf("expected: %v, actual: %v\n", expected, fm.formatArgs)
+	}
+
+	// The filesystem on a device is checked and kept
+	if err := formatAndMount("/dev/sdc", "/mnt/sdc", "", nil, nil); err != nil {
+		t.Errorf("failed to formatAndMount: %v\n", err)
+	}
+
+	if mp, _ := getMountPoint("/mnt/sdc"); nil == mp || "xfs" != mp.FsType || 1 != fm.formats || 1 != fm.checks {
+		t.Errorf("expected: xfs checked and mounted without formatting, actual: %v, %v checks\n", mp, fm.checks)
+	}
+
+	// A filesystem mounted somewhere else is not checked
+	if err := formatAndMount("/dev/sdc", "/mnt/sdc-again", "xfs", nil, nil); err != nil || 1 != fm.checks {
+		t.Errorf("expected: mounted without a check, actual: %v checks, %v\n", fm.checks, err)
+	}
+
+	err := formatAndMount("/dev/sdc", "/mnt/sdc-ext4", "ext4", nil, nil)
+	expectedErr := status.Error(codes.Aborted, "Volume formatted but is incompatible")
+	if !reflect.DeepEqual(expectedErr, err) {
+		t.Errorf("expected: %v, actual: %v\n", expectedErr, err)
+	}
+
+	// A corrupted filesystem is not mounted
+	err = formatAndMount("/dev/sdd", "/mnt/sdd", "ext4", nil, nil)
+	if codes.FailedPrecondition != status.Code(err) {
+		t.Errorf("expected: %v, actual: %v\n", codes.FailedPrecondition, err)
+	}
+
+	if mounted, _ := isMountPoint("/mnt/sdd"); mounted {
+		t.Errorf("expected /mnt/sdd not to be mounted\n")
+	}
+}
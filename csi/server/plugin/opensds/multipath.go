@@ -0,0 +1,149 @@
+// Copyright (c) 2018 Huawei Technologies Co., Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opensds
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+	sdsdevice "github.com/opensds/nbp/client/device"
+	"github.com/opensds/opensds/contrib/connector"
+	"github.com/opensds/opensds/pkg/model"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+//                               Multipath                                    //
+////////////////////////////////////////////////////////////////////////////////
+
+// A LUN is attached by every iSCSI portal or FC target the connection data of
+// its attachment gives, and used through the dm-multipath device over its
+// paths when the node has dm-multipath, so losing a path does not lose the
+// volume. The multipath parameter of a StorageClass makes it required.
+
+// attachPaths attaches a LUN by each of its paths and returns the links to
+// them, a path which fails is skipped as long as another one is attached
+func attachPaths(attachment *model.VolumeAttachmentSpec) ([]string, error) {
+	volConnector := connector.NewConnector(attachment.DriverVolumeType)
+	if nil == volConnector {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("unsupport driverVolumeType: %s", attachment.DriverVolumeType))
+	}
+
+	var paths, failures []string
+	for _, pathData := range sdsdevice.PathConnectionData(attachment.DriverVolumeType, attachment.ConnectionData) {
+		devicePath, err := volConnector.Attach(pathData)
+		if nil != err || 0 == len(devicePath) || "-" == devicePath {
+			glog.Warningf("failed to attach a path of attachment %s: %v", attachment.Id, err)
+			failures = append(failures, fmt.Sprint(err))
+			continue
+		}
+
+		for _, path := range append([]string{devicePath}, sdsdevice.FindPaths(attachment.DriverVolumeType, pathData)...) {
+			if !containsDevice(paths, path) {
+				paths = append(paths, path)
+			}
+		}
+	}
+
+	if 0 == len(paths) {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("failed to find device: %s", strings.Join(failures, "; ")))
+	}
+
+	if err := verifyPaths(attachment, paths); err != nil {
+		return nil, err
+	}
+
+	return paths, nil
+}
+
+// multipathDevice returns the dm-multipath device over the paths of a LUN, a
+// single path is used if the node has no dm-multipath and it is not required
+func multipathDevice(attachment *model.VolumeAttachmentSpec, paths []string, required bool) (string, error) {
+	var reason string
+	if sdsdevice.MultipathAvailable() {
+		device, err := sdsdevice.Multipath(paths)
+		if nil == err {
+			return device, nil
+		}
+		reason = err.Error()
+	} else {
+		reason = "dm-multipath is not available on the node"
+	}
+
+	if required {
+		// The paths are not left attached for a volume which can not be staged
+		if err := detachPaths(attachment.DriverVolumeType, attachment.ConnectionData, ""); err != nil {
+			glog.Errorf("failed to detach the paths of attachment %s: %v", attachment.Id, err)
+		}
+
+		msg := fmt.Sprintf("multipath is required by attachment %s: %s", attachment.Id, reason)
+		glog.Error(msg)
+		return "", status.Error(codes.FailedPrecondition, msg)
+	}
+
+	glog.Warningf("attachment %s uses the single path %s: %s", attachment.Id, paths[0], reason)
+	return resolveDevice(attachment, paths[0])
+}
+
+// detachPaths removes the dm-multipath device of a LUN, if any, and detaches
+// every path of it
+func detachPaths(driverVolumeType string, connData map[string]interface{}, device string) error {
+	volConnector := connector.NewConnector(driverVolumeType)
+	if nil == volConnector {
+		return fmt.Errorf("unsupport driverVolumeType: %s", driverVolumeType)
+	}
+
+	if "" != device && "-" != device && sdsdevice.IsMultipath(device) {
+		if err := sdsdevice.FlushMultipath(device); err != nil {
+			return err
+		}
+	}
+
+	for _, pathData := range sdsdevice.PathConnectionData(driverVolumeType, connData) {
+		if err := volConnector.Detach(pathData); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// verifyPaths checks that every path is the LUN of an attachment
+func verifyPaths(attachment *model.VolumeAttachmentSpec, paths []string) error {
+	id := sdsdevice.IdentityOf(attachment.ConnectionData)
+	for _, path := range paths {
+		if err := sdsdevice.Verify(path, id); err != nil {
+			msg := fmt.Sprintf("refuse to use the device of attachment %s: %v", attachment.Id, err)
+			glog.Error(msg)
+			return status.Error(codes.FailedPrecondition, msg)
+		}
+	}
+
+	return nil
+}
+
+// containsDevice checks if one of the devices is the same device node as
+// device
+func containsDevice(devices []string, device string) bool {
+	for _, d := range devices {
+		if sdsdevice.IsSameDevice(d, device) {
+			return true
+		}
+	}
+
+	return false
+}
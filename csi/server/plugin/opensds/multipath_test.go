@@ -0,0 +1,155 @@
+// Copyright (c) 2018 Huawei Technologies Co., Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opensds
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	sdsdevice "github.com/opensds/nbp/client/device"
+	"github.com/opensds/opensds/contrib/connector"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeMultipathDisks makes the devices of a LUN attached by two iSCSI portals
+// as sdb and sdc, and the multipath device dm-0 over them
+func fakeMultipathDisks(t *testing.T, dir string) (string, func()) {
+	for _, p := range []string{"sys/sdb/holders/dm-0", "sys/sdc/holders/dm-0", "sys/dm-0/dm",
+		"sys/dm-0/slaves/sdb", "sys/dm-0/slaves/sdc", "by-id", "by-path"} {
+		if err := os.MkdirAll(filepath.Join(dir, p), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{"sdb", "sdc", "dm-0"} {
+		ioutil.WriteFile(filepath.Join(dir, name), nil, 0600)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "sys/dm-0/dm/uuid"), []byte("mpath-36005076810810261f800000000000a2b\n"), 0600)
+
+	links := map[string]string{
+		"by-id/dm-uuid-mpath-36005076810810261f800000000000a2b": "dm-0",
+		"by-path/ip-1.2.3.4:3260-iscsi-iqn.2017-10.io-lun-1":    "sdb",
+		"by-path/ip-1.2.3.5:3260-iscsi-iqn.2017-10.io-lun-1":    "sdc",
+	}
+	for link, name := range links {
+		if err := os.Symlink(filepath.Join(dir, name), filepath.Join(dir, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	devDir, sysBlockDir, byId, byPath := sdsdevice.DevDir, sdsdevice.SysBlockDir, sdsdevice.DiskByIdDir, sdsdevice.DiskByPathDir
+	sdsdevice.DevDir, sdsdevice.SysBlockDir = dir, filepath.Join(dir, "sys")
+	sdsdevice.DiskByIdDir, sdsdevice.DiskByPathDir = filepath.Join(dir, "by-id"), filepath.Join(dir, "by-path")
+
+	return filepath.Join(dir, "by-id/dm-uuid-mpath-36005076810810261f800000000000a2b"), func() {
+		sdsdevice.DevDir, sdsdevice.SysBlockDir = devDir, sysBlockDir
+		sdsdevice.DiskByIdDir, sdsdevice.DiskByPathDir = byId, byPath
+	}
+}
+
+func TestNodeStageMultipathVolume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "multipath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mpath, restoreDisks := fakeMultipathDisks(t, dir)
+	defer restoreDisks()
+
+	available, runMultipath := sdsdevice.MultipathAvailable, sdsdevice.RunMultipath
+	defer func() {
+		sdsdevice.MultipathAvailable, sdsdevice.RunMultipath = available, runMultipath
+	}()
+	hasMultipath := false
+	var runs [][]string
+	sdsdevice.MultipathAvailable = func() bool {
+		return hasMultipath
+	}
+	sdsdevice.RunMultipath = func(args ...string) error {
+		runs = append(runs, args)
+		return nil
+	}
+
+	fb, fm, tearDown := setUpFakeNode(t, "-", "")
+	defer tearDown()
+	fm.addDevice(mpath, "")
+
+	attachment := fb.attachments["attachment-1"]
+	attachment.DriverVolumeType = connector.IscsiDriver
+	attachment.ConnectionData = map[string]interface{}{
+		"targetPortals": []interface{}{"1.2.3.4:3260", "1.2.3.5:3260"},
+		"targetIqn":     "iqn.2017-10.io",
+		"targetLun":     float64(1),
+	}
+
+	fc := &fakeConnector{devices: map[string]string{
+		"1.2.3.4:3260": filepath.Join(dir, "by-path/ip-1.2.3.4:3260-iscsi-iqn.2017-10.io-lun-1"),
+		"1.2.3.5:3260": filepath.Join(dir, "by-path/ip-1.2.3.5:3260-iscsi-iqn.2017-10.io-lun-1"),
+	}}
+	connector.RegisterConnector(connector.IscsiDriver, fc)
+	defer connector.UnregisterConnector(connector.IscsiDriver)
+
+	var fakePlugin = &Plugin{}
+	var fakeCtx = context.Background()
+	fakeReq := &csi.NodeStageVolumeRequest{
+		VolumeId:          "volume-1",
+		StagingTargetPath: filepath.Join(dir, "staging"),
+		VolumeCapability:  mountCapability("ext4"),
+		PublishContext:    map[string]string{KPublishAttachId: "attachment-1"},
+		VolumeContext:     map[string]string{KVolumeMultipath: "true"},
+	}
+
+	// Multipath is required but the node has no dm-multipath, both paths are
+	// attached and detached again
+	_, err = fakePlugin.NodeStageVolume(fakeCtx, fakeReq)
+	if codes.FailedPrecondition != status.Code(err) || 2 != fc.attaches || 2 != fc.detaches {
+		t.Errorf("expected: %v, actual: %v, %v attaches, %v detaches\n", codes.FailedPrecondition, err, fc.attaches, fc.detaches)
+	}
+
+	// The LUN is staged through the multipath device over both paths
+	hasMultipath = true
+	if _, err := fakePlugin.NodeStageVolume(fakeCtx, fakeReq); err != nil {
+		t.Fatalf("failed to NodeStageVolume: %v\n", err)
+	}
+
+	if mpath != fb.attachments["attachment-1"].Mountpoint || 4 != fc.attaches {
+		t.Errorf("expected: %v, actual: %v, %v attaches\n", mpath, fb.attachments["attachment-1"].Mountpoint, fc.attaches)
+	}
+
+	if mp, _ := getMountPoint(fakeReq.StagingTargetPath); nil == mp || !isMountedFrom(mp, mpath) {
+		t.Errorf("expected: %v mounted, actual: %v\n", mpath, mp)
+	}
+
+	// Unstaging removes the multipath device and detaches every path
+	_, err = fakePlugin.NodeUnstageVolume(fakeCtx, &csi.NodeUnstageVolumeRequest{
+		VolumeId:          "volume-1",
+		StagingTargetPath: fakeReq.StagingTargetPath,
+	})
+	if err != nil {
+		t.Fatalf("failed to NodeUnstageVolume: %v\n", err)
+	}
+
+	expected := [][]string{{"-f", filepath.Join(dir, "dm-0")}}
+	if !reflect.DeepEqual(expected, runs) || 4 != fc.detaches || "-" != fb.attachments["attachment-1"].Mountpoint {
+		t.Errorf("expected: %v, actual: %v, %v detaches, %v\n", expected, runs, fc.detaches, fb.attachments["attachment-1"].Mountpoint)
+	}
+}
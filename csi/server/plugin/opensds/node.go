@@ -16,12 +16,20 @@ package opensds
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"syscall"
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/golang/glog"
+	sdsdevice "github.com/opensds/nbp/client/device"
 	sdscontroller "github.com/opensds/nbp/client/opensds"
+	"github.com/opensds/nbp/csi/util"
+	c "github.com/opensds/opensds/client"
 	"github.com/opensds/opensds/contrib/connector"
 	"github.com/opensds/opensds/pkg/model"
 	"golang.org/x/net/context"
@@ -38,13 +46,29 @@ func init() {
 }
 
 // getVolumeAndAttachment Get volume and attachment with volumeId and attachmentId
-func getVolumeAndAttachment(volumeId string, attachmentId string) (*model.VolumeSpec, *model.VolumeAttachmentSpec, error) {
-	vol, err := Client.GetVolume(volumeId)
+func getVolumeAndAttachment(ctx context.Context, volumeId string, attachmentId string) (*model.VolumeSpec, *model.VolumeAttachmentSpec, error) {
+	var vol *model.VolumeSpec
+	err := retry(ctx, "get volume", func(client *c.Client) (err error) {
+		vol, err = client.GetVolume(volumeId)
+		return err
+	})
+	if nil != err && !isNotFoundError(err) {
+		return nil, nil, statusError(err, "get volume %s failed", volumeId)
+	}
+
 	if nil != err || nil == vol {
 		return nil, nil, status.Error(codes.NotFound, "Volume does not exist")
 	}
 
-	attachment, err := Client.GetVolumeAttachment(attachmentId)
+	var attachment *model.VolumeAttachmentSpec
+	err = retry(ctx, "get volume attachment", func(client *c.Client) (err error) {
+		attachment, err = client.GetVolumeAttachment(attachmentId)
+		return err
+	})
+	if nil != err && !isNotFoundError(err) {
+		return nil, nil, statusError(err, "get volume attachment %s failed", attachmentId)
+	}
+
 	if nil != err || nil == attachment {
 		return nil, nil, status.Error(codes.FailedPrecondition,
 			fmt.Sprintf("the volume attachment %s does not exist", attachmentId))
@@ -54,17 +78,18 @@ func getVolumeAndAttachment(volumeId string, attachmentId string) (*model.Volume
 }
 
 // mountDeviceAndUpdateAttachment Mount device and then update attachment
-func mountDeviceAndUpdateAttachment(device string, mountpoint string, key string, mountFlags []string, needUpdateAtc bool, attachment *model.VolumeAttachmentSpec) error {
-	var err error
-
-	if len(mountFlags) > 0 {
-		_, err = exec.Command("mount", "-o", strings.Join(mountFlags, ","), device, mountpoint).CombinedOutput()
-	} else {
-		_, err = exec.Command("mount", device, mountpoint).CombinedOutput()
+func mountDeviceAndUpdateAttachment(ctx context.Context, device string, mountpoint string, key string, mountFlags []string, needUpdateAtc bool, attachment *model.VolumeAttachmentSpec) error {
+	if err := mounter.Mount(device, mountpoint, "", mountFlags); nil != err {
+		return status.Error(codes.Aborted, fmt.Sprintf("failed to mount: %v", err.Error()))
 	}
 
-	if nil != err {
-		return status.Error(codes.Aborted, fmt.Sprintf("failed to mount: %v", err.Error()))
+	return addTargetPathInAttachment(ctx, attachment, key, mountpoint, needUpdateAtc)
+}
+
+// addTargetPathInAttachment Add a targetPath (stagingTargetPath) to the attachment
+func addTargetPathInAttachment(ctx context.Context, attachment *model.VolumeAttachmentSpec, key string, mountpoint string, needUpdateAtc bool) error {
+	if nil == attachment.Metadata {
+		attachment.Metadata = make(map[string]string)
 	}
 
 	// update volume Attachmentment
@@ -84,9 +109,13 @@ func mountDeviceAndUpdateAttachment(device string, mountpoint string, key string
 	}
 
 	if needUpdateAtc {
-		_, err = Client.UpdateVolumeAttachment(attachment.Id, attachment)
+		err := retry(ctx, "update volume attachment", func(client *c.Client) error {
+			_, err := client.UpdateVolumeAttachment(attachment.Id, attachment)
+			return err
+		})
+		lookups.forget(attachment.VolumeId)
 		if err != nil {
-			return status.Error(codes.FailedPrecondition, "update volume attachmentment failed")
+			return statusError(err, "update volume attachment %s failed", attachment.Id)
 		}
 	}
 
@@ -94,19 +123,27 @@ func mountDeviceAndUpdateAttachment(device string, mountpoint string, key string
 }
 
 // getVolumeAndAttachmentByVolumeId Get volume and attachment with volumeId
-func getVolumeAndAttachmentByVolumeId(volId string) (*model.VolumeSpec, *model.VolumeAttachmentSpec, error) {
-	if r := getReplicationByVolume(volId); r != nil {
+func getVolumeAndAttachmentByVolumeId(ctx context.Context, volId string) (*model.VolumeSpec, *model.VolumeAttachmentSpec, error) {
+	if r := getReplicationByVolume(ctx, volId); r != nil {
 		volId = r.Metadata[KAttachedVolumeId]
 	}
 
-	vol, err := Client.GetVolume(volId)
+	var vol *model.VolumeSpec
+	err := retry(ctx, "get volume", func(client *c.Client) (err error) {
+		vol, err = client.GetVolume(volId)
+		return err
+	})
+	if nil != err && !isNotFoundError(err) {
+		return nil, nil, statusError(err, "get volume %s failed", volId)
+	}
+
 	if nil != err || nil == vol {
 		return nil, nil, status.Error(codes.NotFound, "Volume does not exist")
 	}
 
-	attachments, err := Client.ListVolumeAttachments()
+	attachments, err := listAttachmentsByVolume(ctx, volId)
 	if nil != err {
-		return nil, nil, status.Error(codes.FailedPrecondition, "List volume attachments failed")
+		return nil, nil, statusError(err, "list volume attachments failed")
 	}
 
 	var attachment *model.VolumeAttachmentSpec
@@ -129,7 +166,7 @@ func getVolumeAndAttachmentByVolumeId(volId string) (*model.VolumeSpec, *model.V
 }
 
 // delTargetPathInAttachment Delete a targetPath (stagingTargetPath) from the attachment
-func delTargetPathInAttachment(attachment *model.VolumeAttachmentSpec, key string, TargetPath string) error {
+func delTargetPathInAttachment(ctx context.Context, attachment *model.VolumeAttachmentSpec, key string, TargetPath string) error {
 	if nil == attachment {
 		return nil
 	}
@@ -158,13 +195,7 @@ func delTargetPathInAttachment(attachment *model.VolumeAttachmentSpec, key strin
 		delete(attachment.Metadata, key)
 
 		if KStagingTargetPath == key {
-			volConnector := connector.NewConnector(attachment.DriverVolumeType)
-
-			if volConnector == nil {
-				return status.Error(codes.FailedPrecondition, fmt.Sprintf("Unsupport driverVolumeType: %s", attachment.DriverVolumeType))
-			}
-
-			err := volConnector.Detach(attachment.ConnectionData)
+			err := detachPaths(attachment.DriverVolumeType, attachment.ConnectionData, attachment.Mountpoint)
 			if err != nil {
 				return status.Errorf(codes.FailedPrecondition, "%s", err.Error())
 			}
@@ -175,9 +206,13 @@ func delTargetPathInAttachment(attachment *model.VolumeAttachmentSpec, key strin
 		attachment.Metadata[key] = strings.Join(modifyPaths, ";")
 	}
 
-	_, err := Client.UpdateVolumeAttachment(attachment.Id, attachment)
+	err := retry(ctx, "update volume attachment", func(client *c.Client) error {
+		_, err := client.UpdateVolumeAttachment(attachment.Id, attachment)
+		return err
+	})
+	lookups.forget(attachment.VolumeId)
 	if err != nil {
-		return status.Error(codes.FailedPrecondition, "update volume attachment failed")
+		return statusError(err, "update volume attachment %s failed", attachment.Id)
 	}
 
 	return nil
@@ -196,10 +231,16 @@ func (p *Plugin) NodeStageVolume(
 		return nil, status.Error(codes.InvalidArgument, "Volume_id/staging_target_path/volume_capability must be specified")
 	}
 
+	unlock, err := lockOperation(lockVolumeId+req.VolumeId, lockPath+req.StagingTargetPath)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
 	volId := req.VolumeId
 	attachmentId := req.PublishContext[KPublishAttachId]
 
-	if r := getReplicationByVolume(volId); r != nil {
+	if r := getReplicationByVolume(ctx, volId); r != nil {
 		if r.ReplicationStatus == model.ReplicationFailover {
 			volId = r.SecondaryVolumeId
 			attachmentId = req.PublishContext[KPublishSecondaryAttachId]
@@ -208,97 +249,181 @@ func (p *Plugin) NodeStageVolume(
 			r.Metadata = make(map[string]string)
 		}
 		r.Metadata[KAttachedVolumeId] = volId
-		if _, err := Client.UpdateReplication(r.Id, r); err != nil {
-			msg := fmt.Sprintf("update replication(%s) failed, %v", r.Id, err)
-			glog.Error(msg)
-			return nil, status.Error(codes.FailedPrecondition, msg)
+		err := retry(ctx, "update replication", func(client *c.Client) error {
+			_, err := client.UpdateReplication(r.Id, r)
+			return err
+		})
+		lookups.forget(r.Id)
+		if err != nil {
+			glog.Errorf("update replication(%s) failed, %v", r.Id, err)
+			return nil, statusError(err, "update replication %s failed", r.Id)
 		}
 	}
 
-	vol, attachment, err := getVolumeAndAttachment(volId, attachmentId)
+	vol, attachment, err := getVolumeAndAttachment(ctx, volId, attachmentId)
 	if nil != err {
 		return nil, err
 	}
 
-	device := attachment.Mountpoint
 	mountpoint := req.StagingTargetPath
-	needUpdateAtc := false
+	device, needUpdateAtc, err := attachDevice(attachment, "true" == req.VolumeContext[KVolumeMultipath])
+	if err != nil {
+		return nil, err
+	}
 
-	if 0 == len(device) || "-" == device {
-		volConnector := connector.NewConnector(attachment.DriverVolumeType)
-		if nil == volConnector {
-			return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("unsupport driverVolumeType: %s", attachment.DriverVolumeType))
+	// A block volume is staged once the device is attached, it is neither
+	// formatted nor mounted
+	if nil != req.VolumeCapability.GetBlock() {
+		err = addTargetPathInAttachment(ctx, attachment, KStagingTargetPath, mountpoint, needUpdateAtc)
+		if err != nil {
+			return nil, err
 		}
 
-		devicePath, err := volConnector.Attach(attachment.ConnectionData)
-		if nil != err || 0 == len(devicePath) || "-" == devicePath {
-			return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("failed to find device: %s", err.Error()))
+		if err := recordNodeState(req.VolumeId, nodeState.staged(req.VolumeId, attachment, mountpoint, true)); err != nil {
+			return nil, err
 		}
 
-		attachment.Mountpoint = devicePath
-		device = devicePath
-		needUpdateAtc = true
+		if err := updateVolumeStatus(ctx, vol, model.VolumeInUse); err != nil {
+			return nil, err
+		}
+
+		glog.V(5).Info("NodeStageVolume success")
+		return &csi.NodeStageVolumeResponse{}, nil
 	}
 
 	// Check if it is: "Volume published but is incompatible"
 	mnt := req.VolumeCapability.GetMount()
-	mountFlags := mnt.MountFlags
-	_, err = exec.Command("findmnt", device, mountpoint).CombinedOutput()
-	glog.V(5).Infof("findmnt err: %v \n", err)
-
-	if nil == err {
-		if len(mountFlags) > 0 {
-			_, err := exec.Command("findmnt", "-o", strings.Join(mountFlags, ","), device, mountpoint).CombinedOutput()
-			if nil != err {
-				return nil, status.Error(codes.Aborted, "Volume published but is incompatible")
-			}
-		}
+	if nil == mnt {
+		return nil, status.Error(codes.InvalidArgument, "volume_capability must be block or mount")
+	}
 
-		return &csi.NodeStageVolumeResponse{}, nil
+	if err := validateMountFlags(mnt); err != nil {
+		return nil, err
 	}
 
-	// Format
-	curFSType := connector.GetFSType(attachment.Mountpoint)
-	hopeFSType := DefFSType
-	if "" != mnt.FsType {
-		hopeFSType = mnt.FsType
+	mkfsArgs, err := parseMkfsOptions(mnt.FsType, req.VolumeContext[KVolumeMkfsOptions])
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
-	if "" == curFSType {
-		_, err := exec.Command("mkfs", "-t", hopeFSType, "-F", device).CombinedOutput()
-		if err != nil {
-			return nil, status.Error(codes.Aborted, fmt.Sprintf("failed to mkfs: %v", err.Error()))
+	mountFlags := mnt.MountFlags
+	mp, err := getMountPoint(mountpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if nil != mp {
+		// The volume is staged, the attachment is updated in case it was not
+		if !isMountedFrom(mp, device) || !mountOptionsMatch(mp, mountFlags) {
+			return nil, status.Error(codes.Aborted, "Volume published but is incompatible")
 		}
 	} else {
-		if "" != mnt.FsType {
-			if mnt.FsType != curFSType {
-				glog.Errorf("Volume formatted but is incompatible, %v != %v!", mnt.FsType,curFSType )
-				return nil, status.Error(codes.Aborted, "Volume formatted but is incompatible")
-			}
+		// Format and mount
+		if err := os.MkdirAll(mountpoint, 0750); err != nil {
+			return nil, status.Error(codes.Aborted, fmt.Sprintf("failed to mkdir: %v", err.Error()))
+		}
+
+		if err := formatAndMount(device, mountpoint, mnt.FsType, mkfsArgs, mountFlags); err != nil {
+			return nil, err
 		}
 	}
 
-	// Mount
-	_, err = exec.Command("mkdir", "-p", mountpoint).CombinedOutput()
+	err = addTargetPathInAttachment(ctx, attachment, KStagingTargetPath, mountpoint, needUpdateAtc)
 	if err != nil {
-		return nil, status.Error(codes.Aborted, fmt.Sprintf("failed to mkdir: %v", err.Error()))
+		return nil, err
 	}
 
-	err = mountDeviceAndUpdateAttachment(device, mountpoint, KStagingTargetPath, mountFlags, needUpdateAtc, attachment)
-	if err != nil {
+	if err := recordNodeState(req.VolumeId, nodeState.staged(req.VolumeId, attachment, mountpoint, false)); err != nil {
 		return nil, err
 	}
 
-	vol.Status = model.VolumeInUse
-	_, err = Client.UpdateVolume(vol.Id, vol)
-	if err != nil {
-		return nil, status.Error(codes.FailedPrecondition, "update volume failed")
+	if err := updateVolumeStatus(ctx, vol, model.VolumeInUse); err != nil {
+		return nil, err
 	}
 
 	glog.V(5).Info("NodeStageVolume success")
 	return &csi.NodeStageVolumeResponse{}, nil
 }
 
+// attachDevice returns a stable link to the device of an attachment, which is
+// attached first unless it is already, and whether the mountpoint of the
+// attachment is changed to it. The device must be the LUN of the attachment,
+// a /dev/sdX name recorded before may be another disk after a reboot. A LUN
+// reachable by several paths is used through its dm-multipath device.
+func attachDevice(attachment *model.VolumeAttachmentSpec, multipath bool) (string, bool, error) {
+	if 0 != len(attachment.Mountpoint) && "-" != attachment.Mountpoint {
+		device, err := resolveDevice(attachment, attachment.Mountpoint)
+		if nil == err && (!multipath || sdsdevice.IsMultipath(device)) {
+			needUpdateAtc := device != attachment.Mountpoint
+			attachment.Mountpoint = device
+			return device, needUpdateAtc, nil
+		}
+
+		if nil != err && codes.NotFound != status.Code(err) {
+			return "", false, err
+		}
+
+		glog.Warningf("the device %s of attachment %s is gone or not multipath, attaching it again", attachment.Mountpoint, attachment.Id)
+	}
+
+	paths, err := attachPaths(attachment)
+	if err != nil {
+		return "", false, err
+	}
+
+	device, err := multipathDevice(attachment, paths, multipath)
+	if err != nil {
+		if codes.NotFound == status.Code(err) {
+			msg := fmt.Sprintf("the device of attachment %s is not found after it is attached as %s", attachment.Id, paths[0])
+			return "", false, status.Error(codes.FailedPrecondition, msg)
+		}
+		return "", false, err
+	}
+
+	attachment.Mountpoint = device
+	return device, true, nil
+}
+
+// resolveDevice returns a stable link to the device of an attachment, it is
+// NotFound if the device is not attached and FailedPrecondition if the device
+// is not the LUN of the attachment
+func resolveDevice(attachment *model.VolumeAttachmentSpec, device string) (string, error) {
+	if sdsdevice.IsMultipath(device) {
+		return device, verifyPaths(attachment, sdsdevice.MultipathPaths(device))
+	}
+
+	resolved, err := sdsdevice.Resolve(attachment.DriverVolumeType, attachment.ConnectionData, device)
+	if err == sdsdevice.ErrNotFound {
+		return "", status.Error(codes.NotFound, fmt.Sprintf("the device of attachment %s is not found", attachment.Id))
+	}
+	if err != nil {
+		msg := fmt.Sprintf("failed to resolve the device of attachment %s: %v", attachment.Id, err)
+		glog.Error(msg)
+		return "", status.Error(codes.Internal, msg)
+	}
+
+	if err := verifyPaths(attachment, []string{resolved}); err != nil {
+		return "", err
+	}
+
+	return resolved, nil
+}
+
+// updateVolumeStatus Update the status of the volume
+func updateVolumeStatus(ctx context.Context, vol *model.VolumeSpec, volStatus string) error {
+	vol.Status = volStatus
+	err := retry(ctx, "update volume", func(client *c.Client) error {
+		_, err := client.UpdateVolume(vol.Id, vol)
+		return err
+	})
+	lookups.forget(vol.Id)
+	if err != nil {
+		return statusError(err, "update volume %s failed", vol.Id)
+	}
+
+	return nil
+}
+
 // NodeUnstageVolume implementation
 func (p *Plugin) NodeUnstageVolume(
 	ctx context.Context,
@@ -312,26 +437,33 @@ func (p *Plugin) NodeUnstageVolume(
 		return nil, status.Error(codes.InvalidArgument, "Volume_id/staging_target_path must be specified")
 	}
 
-	// Umount
-	err := connector.Umount(req.StagingTargetPath)
+	unlock, err := lockOperation(lockVolumeId+req.VolumeId, lockPath+req.StagingTargetPath)
 	if err != nil {
 		return nil, err
 	}
+	defer unlock()
 
-	vol, attachment, err := getVolumeAndAttachmentByVolumeId(req.VolumeId)
-	if err != nil {
+	// Umount, nothing is mounted at the staging path of a block volume
+	if err := unmountIfMounted(req.StagingTargetPath); err != nil {
 		return nil, err
 	}
 
-	err = delTargetPathInAttachment(attachment, KStagingTargetPath, req.StagingTargetPath)
+	vol, attachment, err := getVolumeAndAttachmentByVolumeId(ctx, req.VolumeId)
 	if err != nil {
 		return nil, err
 	}
 
-	vol.Status = model.VolumeAvailable
-	_, err = Client.UpdateVolume(vol.Id, vol)
+	err = delTargetPathInAttachment(ctx, attachment, KStagingTargetPath, req.StagingTargetPath)
 	if err != nil {
-		return nil, status.Error(codes.FailedPrecondition, "update volume failed")
+		return nil, err
+	}
+
+	if err := recordNodeState(req.VolumeId, nodeState.unstaged(req.VolumeId)); err != nil {
+		return nil, err
+	}
+
+	if err := updateVolumeStatus(ctx, vol, model.VolumeAvailable); err != nil {
+		return nil, err
 	}
 
 	glog.V(5).Info("NodeUnstageVolume success")
@@ -351,54 +483,179 @@ func (p *Plugin) NodePublishVolume(
 		return nil, status.Error(codes.InvalidArgument, "Volume_id/staging_target_path/target_path/volume_capability must be specified")
 	}
 
+	unlock, err := lockOperation(lockVolumeId+req.VolumeId, lockPath+req.TargetPath)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
 	volId := req.VolumeId
 	attachmentId := req.PublishContext[KPublishAttachId]
 
-	if r := getReplicationByVolume(volId); r != nil {
+	if r := getReplicationByVolume(ctx, volId); r != nil {
 		volId = r.Metadata[KAttachedVolumeId]
 		attachmentId = r.Metadata[KAttachedId]
 	}
 
-	_, attachment, err := getVolumeAndAttachment(volId, attachmentId)
+	_, attachment, err := getVolumeAndAttachment(ctx, volId, attachmentId)
 	if nil != err {
 		return nil, err
 	}
 
+	if nil != req.VolumeCapability.GetBlock() {
+		err = publishBlockVolume(ctx, req, attachment)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := recordNodeState(req.VolumeId, nodeState.published(req.VolumeId, attachment, req.StagingTargetPath, req.TargetPath, true)); err != nil {
+			return nil, err
+		}
+
+		glog.V(5).Info("NodePublishVolume success")
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
 	device := req.StagingTargetPath
 	mountpoint := req.TargetPath
 	needUpdateAtc := false
 
 	// Check if it is: "Volume published but is incompatible"
 	mnt := req.VolumeCapability.GetMount()
+	if nil == mnt {
+		return nil, status.Error(codes.InvalidArgument, "volume_capability must be block or mount")
+	}
+
+	if err := validateMountFlags(mnt); err != nil {
+		return nil, err
+	}
+
 	mountFlags := append(mnt.MountFlags, "bind")
 	if req.Readonly {
 		mountFlags = append(mountFlags, "ro")
 	}
 
-	_, err = exec.Command("findmnt", device, mountpoint).CombinedOutput()
-	glog.V(5).Infof("findmnt err: %v \n", err)
+	mp, err := getMountPoint(mountpoint)
+	if err != nil {
+		return nil, err
+	}
 
-	if nil == err {
-		if len(mountFlags) > 0 {
-			_, err := exec.Command("findmnt", "-o", strings.Join(mountFlags, ","), device, mountpoint).CombinedOutput()
-			if nil != err {
-				return nil, status.Error(codes.Aborted, "Volume published but is incompatible")
-			}
+	if nil != mp {
+		isBound, err := isBindMountOf(mp, device)
+		if err != nil {
+			return nil, err
+		}
+
+		if !isBound || !mountOptionsMatch(mp, mountFlags) {
+			return nil, status.Error(codes.Aborted, "Volume published but is incompatible")
+		}
+
+		err = addTargetPathInAttachment(ctx, attachment, KTargetPath, mountpoint, needUpdateAtc)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := recordNodeState(req.VolumeId, nodeState.published(req.VolumeId, attachment, req.StagingTargetPath, mountpoint, false)); err != nil {
+			return nil, err
 		}
 
 		return &csi.NodePublishVolumeResponse{}, nil
 	}
 
+	if err := os.MkdirAll(mountpoint, 0750); err != nil {
+		return nil, status.Error(codes.Aborted, fmt.Sprintf("failed to mkdir: %v", err.Error()))
+	}
+
 	// Mount
-	err = mountDeviceAndUpdateAttachment(device, mountpoint, KTargetPath, mountFlags, needUpdateAtc, attachment)
+	err = mountDeviceAndUpdateAttachment(ctx, device, mountpoint, KTargetPath, mountFlags, needUpdateAtc, attachment)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := recordNodeState(req.VolumeId, nodeState.published(req.VolumeId, attachment, req.StagingTargetPath, mountpoint, false)); err != nil {
+		return nil, err
+	}
+
 	glog.V(5).Info("NodePublishVolume success")
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
+// publishBlockVolume Bind mount the device of a block volume onto a file at the target path
+func publishBlockVolume(ctx context.Context, req *csi.NodePublishVolumeRequest, attachment *model.VolumeAttachmentSpec) error {
+	target := req.TargetPath
+
+	if 0 == len(attachment.Mountpoint) || "-" == attachment.Mountpoint {
+		return status.Error(codes.FailedPrecondition,
+			fmt.Sprintf("the volume %s is not staged", req.VolumeId))
+	}
+
+	device, err := resolveDevice(attachment, attachment.Mountpoint)
+	if err != nil {
+		if codes.NotFound == status.Code(err) {
+			return status.Error(codes.FailedPrecondition,
+				fmt.Sprintf("the device of volume %s is not attached", req.VolumeId))
+		}
+		return err
+	}
+
+	mp, err := getMountPoint(target)
+	if err != nil {
+		return err
+	}
+
+	if nil != mp {
+		isBound, err := isBindMountOf(mp, device)
+		if err != nil {
+			return err
+		}
+
+		if !isBound || !mountOptionsMatch(mp, publishMountFlags(req.Readonly)) {
+			return status.Error(codes.Aborted, "Volume published but is incompatible")
+		}
+
+		return addTargetPathInAttachment(ctx, attachment, KTargetPath, target, false)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0750); err != nil {
+		return status.Error(codes.Aborted, fmt.Sprintf("failed to mkdir: %v", err.Error()))
+	}
+
+	f, err := os.OpenFile(target, os.O_CREATE, 0640)
+	if err != nil {
+		return status.Error(codes.Aborted, fmt.Sprintf("failed to create target file: %v", err.Error()))
+	}
+	f.Close()
+
+	return mountDeviceAndUpdateAttachment(ctx, device, target, KTargetPath, publishMountFlags(req.Readonly), false, attachment)
+}
+
+// publishMountFlags the mount flags of a bind mount at a target path
+func publishMountFlags(readonly bool) []string {
+	if readonly {
+		return []string{"bind", "ro"}
+	}
+
+	return []string{"bind"}
+}
+
+// unmountIfMounted unmounts a path if something is mounted at it
+func unmountIfMounted(path string) error {
+	mounted, err := isMountPoint(path)
+	if err != nil {
+		return err
+	}
+
+	if mounted {
+		if err := mounter.Unmount(path); err != nil {
+			msg := fmt.Sprintf("failed to umount %s: %v", path, err)
+			glog.Error(msg)
+			return status.Error(codes.Internal, msg)
+		}
+	}
+
+	return nil
+}
+
 // NodeUnpublishVolume implementation
 func (p *Plugin) NodeUnpublishVolume(
 	ctx context.Context,
@@ -412,26 +669,188 @@ func (p *Plugin) NodeUnpublishVolume(
 		return nil, status.Error(codes.InvalidArgument, "Volume_id/target_path must be specified")
 	}
 
-	// Umount
-	err := connector.Umount(req.TargetPath)
+	unlock, err := lockOperation(lockVolumeId+req.VolumeId, lockPath+req.TargetPath)
 	if err != nil {
 		return nil, err
 	}
+	defer unlock()
 
-	_, attachment, err := getVolumeAndAttachmentByVolumeId(req.VolumeId)
+	// Umount
+	if err := unmountIfMounted(req.TargetPath); err != nil {
+		return nil, err
+	}
+
+	// The target of a block volume is a file created when it was published
+	if info, err := os.Stat(req.TargetPath); err == nil && info.Mode().IsRegular() {
+		if err := os.Remove(req.TargetPath); err != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("failed to remove target file: %v", err.Error()))
+		}
+	}
+
+	_, attachment, err := getVolumeAndAttachmentByVolumeId(ctx, req.VolumeId)
 	if err != nil {
 		return nil, err
 	}
 
-	err = delTargetPathInAttachment(attachment, KTargetPath, req.TargetPath)
+	err = delTargetPathInAttachment(ctx, attachment, KTargetPath, req.TargetPath)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := recordNodeState(req.VolumeId, nodeState.unpublished(req.VolumeId, req.TargetPath)); err != nil {
+		return nil, err
+	}
+
 	glog.V(5).Info("NodeUnpublishVolume success")
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
+// NodeExpandVolume implementation
+func (p *Plugin) NodeExpandVolume(
+	ctx context.Context,
+	req *csi.NodeExpandVolumeRequest) (
+	*csi.NodeExpandVolumeResponse, error) {
+	defer glog.V(5).Info("end to NodeExpandVolume")
+
+	// Check REQUIRED field
+	glog.V(5).Info("start to NodeExpandVolume, Volume_id: " + req.VolumeId + ", volume_path: " + req.VolumePath)
+	if "" == req.VolumeId || "" == req.VolumePath {
+		return nil, status.Error(codes.InvalidArgument, "Volume_id/volume_path must be specified")
+	}
+
+	unlock, err := lockOperation(lockVolumeId+req.VolumeId, lockPath+req.VolumePath)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	info, err := os.Stat(req.VolumePath)
+	if err != nil {
+		msg := fmt.Sprintf("the volume path %s is not found: %v", req.VolumePath, err)
+		glog.Error(msg)
+		return nil, status.Error(codes.NotFound, msg)
+	}
+
+	_, attachment, err := getVolumeAndAttachmentByVolumeId(ctx, req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+
+	if nil == attachment || 0 == len(attachment.Mountpoint) || "-" == attachment.Mountpoint {
+		msg := fmt.Sprintf("the volume %s is not attached to this node", req.VolumeId)
+		return nil, status.Error(codes.FailedPrecondition, msg)
+	}
+
+	device := attachment.Mountpoint
+	if err := rescanDevice(attachment.DriverVolumeType, device); err != nil {
+		glog.Error(err.Error())
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	// A block volume is used as is, there is no filesystem to grow
+	isBlock := nil != req.GetVolumeCapability().GetBlock() || info.Mode()&os.ModeDevice != 0
+	if !isBlock {
+		if err := resizeFilesystem(device, req.VolumePath); err != nil {
+			return nil, err
+		}
+	}
+
+	usage, err := getBlockUsage(device)
+	if err != nil {
+		msg := fmt.Sprintf("failed to get the size of device %s: %v", device, err)
+		return nil, status.Error(codes.Internal, msg)
+	}
+
+	glog.V(5).Info("NodeExpandVolume success")
+	return &csi.NodeExpandVolumeResponse{
+		CapacityBytes: usage[0].Total,
+	}, nil
+}
+
+// rescanDevice makes the node see the new size of an expanded device
+func rescanDevice(driverVolumeType string, device string) error {
+	switch driverVolumeType {
+	case connector.IscsiDriver:
+		out, err := exec.Command("iscsiadm", "-m", "session", "--rescan").CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("failed to rescan iscsi sessions: %v, %s", err, out)
+		}
+	case connector.FcDriver:
+		break
+	default:
+		// The size of a rbd device is updated by the kernel
+		return nil
+	}
+
+	// A multipath device grows once each of its paths is rescanned
+	if sdsdevice.IsMultipath(device) {
+		for _, path := range sdsdevice.MultipathPaths(device) {
+			if err := rescanPath(path); err != nil {
+				return err
+			}
+		}
+
+		name := filepath.Base(sdsdevice.Canonical(device))
+		out, err := exec.Command("multipathd", "resize", "map", name).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("failed to resize multipath device %s: %v, %s", device, err, out)
+		}
+		return nil
+	}
+
+	return rescanPath(device)
+}
+
+// rescanPath makes the kernel read the size of a SCSI device again
+func rescanPath(device string) error {
+	realDevice, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return fmt.Errorf("failed to resolve device %s: %v", device, err)
+	}
+
+	rescan := filepath.Join("/sys/class/block", filepath.Base(realDevice), "device", "rescan")
+	if _, err := os.Stat(rescan); err != nil {
+		return nil
+	}
+
+	if err := ioutil.WriteFile(rescan, []byte("1"), 0200); err != nil {
+		return fmt.Errorf("failed to rescan device %s: %v", realDevice, err)
+	}
+
+	return nil
+}
+
+// resizeFilesystem grows the mounted filesystem of a device to the device size
+func resizeFilesystem(device string, mountpoint string) error {
+	var out []byte
+
+	fsType, err := mounter.GetFSType(device)
+	if err != nil {
+		msg := fmt.Sprintf("failed to detect the filesystem on %s: %v", device, err)
+		glog.Error(msg)
+		return status.Error(codes.Internal, msg)
+	}
+
+	switch fsType {
+	case "ext2", "ext3", "ext4":
+		out, err = exec.Command("resize2fs", device).CombinedOutput()
+	case "xfs":
+		out, err = exec.Command("xfs_growfs", mountpoint).CombinedOutput()
+	default:
+		msg := fmt.Sprintf("the filesystem %q of device %s cannot be expanded", fsType, device)
+		glog.Error(msg)
+		return status.Error(codes.FailedPrecondition, msg)
+	}
+
+	if err != nil {
+		msg := fmt.Sprintf("failed to expand the filesystem of device %s: %v, %s", device, err, out)
+		glog.Error(msg)
+		return status.Error(codes.Internal, msg)
+	}
+
+	return nil
+}
+
 // getNodeId gets node id based on the protocol, i.e., FC, iSCSI, RBD, etc.
 func getNodeId() (string, error) {
 	hostName, err := connector.GetHostName()
@@ -498,11 +917,54 @@ func (p *Plugin) NodeGetInfo(
 		return nil, err
 	}
 
+	az, err := p.getNodeAvailabilityZone()
+	if err != nil {
+		return nil, err
+	}
+
 	return &csi.NodeGetInfoResponse{
 		NodeId: nodeId,
+		AccessibleTopology: &csi.Topology{
+			Segments: map[string]string{TopologyZoneKey: az},
+		},
 	}, nil
 }
 
+// getNodeAvailabilityZone gets the AZ of the node from the configuration or
+// the node labels, the default AZ is used if none is given
+func (p *Plugin) getNodeAvailabilityZone() (string, error) {
+	if "" != p.AvailabilityZone {
+		return p.AvailabilityZone, nil
+	}
+
+	if "" == p.NodeLabelFile {
+		return util.OpensdsDefaultAZ, nil
+	}
+
+	data, err := ioutil.ReadFile(p.NodeLabelFile)
+	if err != nil {
+		msg := fmt.Sprintf("failed to read node label file %s: %v", p.NodeLabelFile, err)
+		glog.Error(msg)
+		return "", status.Error(codes.FailedPrecondition, msg)
+	}
+
+	labels := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		kv := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if 2 == len(kv) {
+			labels[strings.TrimSpace(kv[0])] = strings.Trim(strings.TrimSpace(kv[1]), "\"")
+		}
+	}
+
+	for _, key := range []string{TopologyZoneKey, KubernetesZoneLabel} {
+		if az := labels[key]; "" != az {
+			return az, nil
+		}
+	}
+
+	return util.OpensdsDefaultAZ, nil
+}
+
 // NodeGetCapabilities implementation
 func (p *Plugin) NodeGetCapabilities(
 	ctx context.Context,
@@ -521,14 +983,148 @@ func (p *Plugin) NodeGetCapabilities(
 					},
 				},
 			},
+			&csi.NodeServiceCapability{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+					},
+				},
+			},
+			&csi.NodeServiceCapability{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
+					},
+				},
+			},
+			&csi.NodeServiceCapability{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+					},
+				},
+			},
 		},
 	}, nil
 }
 
-// NodeGetVolumeStats
+// NodeGetVolumeStats implementation
 func (p *Plugin) NodeGetVolumeStats(
 	ctx context.Context,
 	req *csi.NodeGetVolumeStatsRequest) (
 	*csi.NodeGetVolumeStatsResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	defer glog.V(5).Info("end to NodeGetVolumeStats")
+
+	// Check REQUIRED field
+	glog.V(5).Info("start to NodeGetVolumeStats, Volume_id: " + req.VolumeId + ", volume_path: " + req.VolumePath)
+	if "" == req.VolumeId || "" == req.VolumePath {
+		return nil, status.Error(codes.InvalidArgument, "Volume_id/volume_path must be specified")
+	}
+
+	info, err := os.Stat(req.VolumePath)
+	if os.IsNotExist(err) {
+		msg := fmt.Sprintf("the volume path %s is not found: %v", req.VolumePath, err)
+		glog.Error(msg)
+		return nil, status.Error(codes.NotFound, msg)
+	}
+
+	if err != nil {
+		msg := fmt.Sprintf("failed to stat the volume path %s: %v", req.VolumePath, err)
+		glog.Error(msg)
+		return nil, status.Error(codes.Internal, msg)
+	}
+
+	mp, err := getMountPoint(req.VolumePath)
+	if err != nil {
+		return nil, err
+	}
+
+	// A path which is left without its mount, a device which can not be read
+	// or a filesystem the kernel turned read-only is reported as an abnormal
+	// volume condition
+	condition := &csi.VolumeCondition{Message: "the volume is healthy"}
+
+	if nil == mp {
+		condition.Abnormal = true
+		condition.Message = fmt.Sprintf("the volume is not mounted at %s", req.VolumePath)
+		glog.Warningf("the volume %s is abnormal: %s", req.VolumeId, condition.Message)
+		return &csi.NodeGetVolumeStatsResponse{VolumeCondition: condition}, nil
+	}
+
+	var usage []*csi.VolumeUsage
+	if info.Mode()&os.ModeDevice != 0 {
+		usage, err = getBlockUsage(req.VolumePath)
+		if err != nil {
+			condition.Abnormal = true
+			condition.Message = fmt.Sprintf("failed to read the device of the volume: %v", err)
+			glog.Warningf("the volume %s is abnormal: %s", req.VolumeId, condition.Message)
+			return &csi.NodeGetVolumeStatsResponse{VolumeCondition: condition}, nil
+		}
+	} else {
+		usage, err = getFilesystemUsage(req.VolumePath)
+		if err != nil {
+			msg := fmt.Sprintf("failed to get stats of the volume %s: %v", req.VolumeId, err)
+			glog.Error(msg)
+			return nil, status.Error(codes.Internal, msg)
+		}
+
+		if isReadOnlyFilesystem(mp) {
+			condition.Abnormal = true
+			condition.Message = fmt.Sprintf("the filesystem of the volume mounted at %s is read-only", req.VolumePath)
+			glog.Warningf("the volume %s is abnormal: %s", req.VolumeId, condition.Message)
+		}
+	}
+
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage:           usage,
+		VolumeCondition: condition,
+	}, nil
+}
+
+// getFilesystemUsage gets the bytes and inodes usage of the filesystem a path
+// is in
+func getFilesystemUsage(path string) ([]*csi.VolumeUsage, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path, &fs); err != nil {
+		return nil, err
+	}
+
+	bsize := int64(fs.Bsize)
+	usage := []*csi.VolumeUsage{
+		&csi.VolumeUsage{
+			Available: int64(fs.Bavail) * bsize,
+			Total:     int64(fs.Blocks) * bsize,
+			Used:      int64(fs.Blocks-fs.Bfree) * bsize,
+			Unit:      csi.VolumeUsage_BYTES,
+		},
+		&csi.VolumeUsage{
+			Available: int64(fs.Ffree),
+			Total:     int64(fs.Files),
+			Used:      int64(fs.Files - fs.Ffree),
+			Unit:      csi.VolumeUsage_INODES,
+		},
+	}
+
+	return usage, nil
+}
+
+// getBlockUsage gets the size of a block device
+func getBlockUsage(device string) ([]*csi.VolumeUsage, error) {
+	f, err := os.Open(device)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	return []*csi.VolumeUsage{
+		&csi.VolumeUsage{
+			Total: size,
+			Unit:  csi.VolumeUsage_BYTES,
+		},
+	}, nil
 }
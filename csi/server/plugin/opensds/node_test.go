@@ -15,10 +15,17 @@
 package opensds
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	sdsdevice "github.com/opensds/nbp/client/device"
+	"github.com/opensds/opensds/contrib/connector"
+	"github.com/opensds/opensds/pkg/model"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -62,6 +69,27 @@ func TestNodeGetCapabilities(t *testing.T) {
 				},
 			},
 		},
+		&csi.NodeServiceCapability{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+				},
+			},
+		},
+		&csi.NodeServiceCapability{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
+				},
+			},
+		},
+		&csi.NodeServiceCapability{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+				},
+			},
+		},
 	}
 
 	rs, err := fakePlugin.NodeGetCapabilities(fakeCtx, fakeReq)
@@ -148,3 +176,593 @@ func TestNodeUnpublishVolume(t *testing.T) {
 		t.Errorf("expected: %v, actual: %v\n", expectedErr, err)
 	}
 }
+
+func TestNodeGetVolumeStats(t *testing.T) {
+	var fakePlugin = &Plugin{}
+	var fakeCtx = context.Background()
+	fakeReq := csi.NodeGetVolumeStatsRequest{}
+
+	_, err := fakePlugin.NodeGetVolumeStats(fakeCtx, &fakeReq)
+	expectedErr := status.Error(codes.InvalidArgument, "Volume_id/volume_path must be specified")
+
+	if !reflect.DeepEqual(expectedErr, err) {
+		t.Errorf("expected: %v, actual: %v\n", expectedErr, err)
+	}
+
+	dir, err := ioutil.TempDir("", "volume-stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The volume path does not exist at all
+	fakeReq.VolumeId = "bd5b12a8-a101-11e7-941e-d77981b584d8"
+	fakeReq.VolumePath = filepath.Join(dir, "missing")
+	_, err = fakePlugin.NodeGetVolumeStats(fakeCtx, &fakeReq)
+	if codes.NotFound != status.Code(err) {
+		t.Errorf("expected: %v, actual: %v\n", codes.NotFound, err)
+	}
+
+	// The volume path is left without its mount
+	fakeReq.VolumePath = dir
+	rs, err := fakePlugin.NodeGetVolumeStats(fakeCtx, &fakeReq)
+	expectedCondition := &csi.VolumeCondition{Abnormal: true, Message: "the volume is not mounted at " + dir}
+	if nil != err || !reflect.DeepEqual(expectedCondition, rs.VolumeCondition) || 0 != len(rs.Usage) {
+		t.Errorf("expected: %v, actual: %v, %v\n", expectedCondition, rs, err)
+	}
+
+	fm := newFakeMounter()
+	defer useFakeMounter(fm)()
+
+	// A volume published read-only is healthy
+	mp := &MountPoint{Id: 3, ParentId: 1, Path: canonicalPath(dir), Opts: []string{"ro"}, SuperOpts: []string{"rw"}}
+	fm.mounts = append(fm.mounts, mp)
+	rs, err = fakePlugin.NodeGetVolumeStats(fakeCtx, &fakeReq)
+	if nil != err || nil == rs.VolumeCondition || rs.VolumeCondition.Abnormal || 2 != len(rs.Usage) {
+		t.Errorf("expected: a healthy volume, actual: %v, %v\n", rs, err)
+	}
+
+	// The filesystem is remounted read-only by the kernel on errors
+	mp.Opts, mp.SuperOpts = []string{"rw"}, []string{"ro", "errors=remount-ro"}
+	rs, err = fakePlugin.NodeGetVolumeStats(fakeCtx, &fakeReq)
+	if nil != err || nil == rs.VolumeCondition || !rs.VolumeCondition.Abnormal || 2 != len(rs.Usage) {
+		t.Errorf("expected: an abnormal volume, actual: %v, %v\n", rs, err)
+	}
+}
+
+func TestGetFilesystemUsage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "volume-stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	usage, err := getFilesystemUsage(dir)
+	if err != nil {
+		t.Errorf("failed to getFilesystemUsage: %v\n", err)
+	}
+
+	if 2 != len(usage) || csi.VolumeUsage_BYTES != usage[0].Unit || csi.VolumeUsage_INODES != usage[1].Unit {
+		t.Fatalf("expected bytes and inodes usage, actual: %v\n", usage)
+	}
+
+	if usage[0].Total <= 0 {
+		t.Errorf("expected a positive size, actual: %v\n", usage[0])
+	}
+
+	for _, u := range usage {
+		if u.Total < 0 || u.Used < 0 || u.Available < 0 || u.Used > u.Total || u.Available > u.Total {
+			t.Errorf("unexpected usage: %v\n", u)
+		}
+	}
+}
+
+func TestNodeExpandVolume(t *testing.T) {
+	var fakePlugin = &Plugin{}
+	var fakeCtx = context.Background()
+	fakeReq := csi.NodeExpandVolumeRequest{}
+
+	_, err := fakePlugin.NodeExpandVolume(fakeCtx, &fakeReq)
+	expectedErr := status.Error(codes.InvalidArgument, "Volume_id/volume_path must be specified")
+
+	if !reflect.DeepEqual(expectedErr, err) {
+		t.Errorf("expected: %v, actual: %v\n", expectedErr, err)
+	}
+
+	fakeReq.VolumeId = "bd5b12a8-a101-11e7-941e-d77981b584d8"
+	fakeReq.VolumePath = "/nonexistent/volume/path"
+	_, err = fakePlugin.NodeExpandVolume(fakeCtx, &fakeReq)
+
+	if codes.NotFound != status.Code(err) {
+		t.Errorf("expected: %v, actual: %v\n", codes.NotFound, err)
+	}
+}
+
+func TestNodeUnpublishBlockVolume(t *testing.T) {
+	var fakePlugin = &Plugin{}
+	var fakeCtx = context.Background()
+
+	f, err := ioutil.TempFile("", "block-target")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	fakeReq := csi.NodeUnpublishVolumeRequest{
+		VolumeId:   "bd5b12a8-a101-11e7-941e-d77981b584d8",
+		TargetPath: f.Name(),
+	}
+
+	_, err = fakePlugin.NodeUnpublishVolume(fakeCtx, &fakeReq)
+	if nil != err {
+		t.Errorf("failed to NodeUnpublishVolume: %v\n", err)
+	}
+
+	if _, err := os.Stat(f.Name()); !os.IsNotExist(err) {
+		t.Errorf("expected the target file to be removed, actual: %v\n", err)
+	}
+
+	// Unpublishing again succeeds
+	_, err = fakePlugin.NodeUnpublishVolume(fakeCtx, &fakeReq)
+	if nil != err {
+		t.Errorf("failed to NodeUnpublishVolume: %v\n", err)
+	}
+}
+
+func TestGetNodeAvailabilityZone(t *testing.T) {
+	f, err := ioutil.TempFile("", "node-labels")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	f.WriteString("kubernetes.io/hostname=\"node1\"\n" + KubernetesZoneLabel + "=\"az2\"\n")
+	f.Close()
+
+	testCases := []struct {
+		plugin   *Plugin
+		expected string
+	}{
+		{&Plugin{}, "default"},
+		{&Plugin{AvailabilityZone: "az1", NodeLabelFile: f.Name()}, "az1"},
+		{&Plugin{NodeLabelFile: f.Name()}, "az2"},
+	}
+
+	for _, tc := range testCases {
+		az, err := tc.plugin.getNodeAvailabilityZone()
+		if nil != err {
+			t.Errorf("failed to getNodeAvailabilityZone: %v\n", err)
+		}
+
+		if tc.expected != az {
+			t.Errorf("expected: %v, actual: %v\n", tc.expected, az)
+		}
+	}
+
+	_, err = (&Plugin{NodeLabelFile: "/nonexistent/labels"}).getNodeAvailabilityZone()
+	if codes.FailedPrecondition != status.Code(err) {
+		t.Errorf("expected: %v, actual: %v\n", codes.FailedPrecondition, err)
+	}
+}
+
+// fakeConnector a connector whose devices are already attached
+type fakeConnector struct {
+	// devices the device attached by each target portal
+	devices  map[string]string
+	attaches int
+	detaches int
+}
+
+// Attach implementation
+func (fc *fakeConnector) Attach(conn map[string]interface{}) (string, error) {
+	fc.attaches++
+	portal, _ := conn["targetPortal"].(string)
+	return fc.devices[portal], nil
+}
+
+// Detach implementation
+func (fc *fakeConnector) Detach(conn map[string]interface{}) error {
+	fc.detaches++
+	return nil
+}
+
+// GetInitiatorInfo implementation
+func (fc *fakeConnector) GetInitiatorInfo() (connector.InitiatorInfo, error) {
+	return connector.InitiatorInfo{}, nil
+}
+
+// hasPath checks if the paths kept in the metadata of an attachment have path
+func hasPath(attachment *model.VolumeAttachmentSpec, key string, path string) bool {
+	for _, p := range strings.Split(attachment.Metadata[key], ";") {
+		if p == path {
+			return true
+		}
+	}
+
+	return false
+}
+
+// setUpFakeNode makes the node service use a fake OpenSDS, where the volume
+// volume-1 is attached to this node as device through a fake connector, and a
+// fake mounter
+func setUpFakeNode(t *testing.T, device string, fsType string) (*fakeBackend, *fakeMounter, func()) {
+	hostName, err := connector.GetHostName()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fb := newFakeBackend()
+	fb.delay = 0
+	fb.volumes["volume-1"] = &model.VolumeSpec{
+		BaseModel: &model.BaseModel{Id: "volume-1"},
+		Name:      "volume-1",
+		Status:    model.VolumeAvailable,
+	}
+	fb.attachments["attachment-1"] = &model.VolumeAttachmentSpec{
+		BaseModel:  &model.BaseModel{Id: "attachment-1"},
+		VolumeId:   "volume-1",
+		HostInfo:   model.HostInfo{Host: hostName},
+		Mountpoint: device,
+		Metadata:   map[string]string{},
+		ConnectionInfo: model.ConnectionInfo{
+			DriverVolumeType: "fake",
+		},
+	}
+	connector.RegisterConnector("fake", &fakeConnector{})
+
+	fm := newFakeMounter()
+	fm.addDevice(device, fsType)
+
+	restoreBackend := useFakeBackend(fb)
+	restoreMounter := useFakeMounter(fm)
+	state := nodeState
+	nodeState = newNodeStateStore("")
+
+	return fb, fm, func() {
+		nodeState = state
+		restoreMounter()
+		restoreBackend()
+		connector.UnregisterConnector("fake")
+	}
+}
+
+// mountCapability a mount volume capability
+func mountCapability(fsType string, mountFlags ...string) *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{
+				FsType:     fsType,
+				MountFlags: mountFlags,
+			},
+		},
+		AccessMode: &csi.VolumeCapability_AccessMode{
+			Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		},
+	}
+}
+
+func TestNodeStageVolumeIdempotency(t *testing.T) {
+	fb, fm, tearDown := setUpFakeNode(t, "/dev/sdb", "")
+	defer tearDown()
+
+	dir, err := ioutil.TempDir("", "node-stage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var fakePlugin = &Plugin{}
+	var fakeCtx = context.Background()
+	stagingPath := filepath.Join(dir, "staging")
+	fakeReq := &csi.NodeStageVolumeRequest{
+		VolumeId:          "volume-1",
+		StagingTargetPath: stagingPath,
+		VolumeCapability:  mountCapability("ext4", "noatime"),
+		PublishContext:    map[string]string{KPublishAttachId: "attachment-1"},
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := fakePlugin.NodeStageVolume(fakeCtx, fakeReq); err != nil {
+			t.Fatalf("failed to NodeStageVolume: %v\n", err)
+		}
+	}
+
+	if 1 != fm.formats || 1 != fm.mountCalls {
+		t.Errorf("expected: formatted and mounted once, actual: %v formats, %v mounts\n", fm.formats, fm.mountCalls)
+	}
+
+	if !hasPath(fb.attachments["attachment-1"], KStagingTargetPath, stagingPath) {
+		t.Errorf("expected: %v, actual: %v\n", stagingPath, fb.attachments["attachment-1"].Metadata)
+	}
+
+	if model.VolumeInUse != fb.volumes["volume-1"].Status {
+		t.Errorf("expected: %v, actual: %v\n", model.VolumeInUse, fb.volumes["volume-1"].Status)
+	}
+
+	// Staging again with other options or another filesystem is incompatible
+	for _, capability := range []*csi.VolumeCapability{
+		mountCapability("ext4", "noexec"),
+		mountCapability("ext4", "ro"),
+	} {
+		fakeReq.VolumeCapability = capability
+		_, err := fakePlugin.NodeStageVolume(fakeCtx, fakeReq)
+		if codes.Aborted != status.Code(err) {
+			t.Errorf("expected: %v, actual: %v\n", codes.Aborted, err)
+		}
+	}
+
+	unstageReq := &csi.NodeUnstageVolumeRequest{VolumeId: "volume-1", StagingTargetPath: stagingPath}
+	for i := 0; i < 2; i++ {
+		if _, err := fakePlugin.NodeUnstageVolume(fakeCtx, unstageReq); err != nil {
+			t.Fatalf("failed to NodeUnstageVolume: %v\n", err)
+		}
+	}
+
+	if mounted, _ := isMountPoint(stagingPath); mounted {
+		t.Errorf("expected %s to be unmounted\n", stagingPath)
+	}
+}
+
+func TestNodeStageFormattedVolume(t *testing.T) {
+	_, fm, tearDown := setUpFakeNode(t, "/dev/sdb", "xfs")
+	defer tearDown()
+
+	dir, err := ioutil.TempDir("", "node-stage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var fakePlugin = &Plugin{}
+	var fakeCtx = context.Background()
+	fakeReq := &csi.NodeStageVolumeRequest{
+		VolumeId:          "volume-1",
+		StagingTargetPath: filepath.Join(dir, "staging"),
+		VolumeCapability:  mountCapability("ext4"),
+		PublishContext:    map[string]string{KPublishAttachId: "attachment-1"},
+	}
+
+	// The filesystem on the device is neither formatted again nor mounted as another one
+	_, err = fakePlugin.NodeStageVolume(fakeCtx, fakeReq)
+	if codes.Aborted != status.Code(err) {
+		t.Errorf("expected: %v, actual: %v\n", codes.Aborted, err)
+	}
+
+	fakeReq.VolumeCapability = mountCapability("")
+	if _, err := fakePlugin.NodeStageVolume(fakeCtx, fakeReq); err != nil {
+		t.Errorf("failed to NodeStageVolume: %v\n", err)
+	}
+
+	if mp, _ := getMountPoint(fakeReq.StagingTargetPath); nil == mp || "xfs" != mp.FsType || 0 != fm.formats {
+		t.Errorf("expected: xfs mounted without formatting, actual: %v, %v formats\n", mp, fm.formats)
+	}
+}
+
+func TestNodeStageVolumeOfAnotherLUN(t *testing.T) {
+	dir, err := ioutil.TempDir("", "node-stage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The by-id link of the LUN points to sdb, which is another LUN by now
+	link := filepath.Join(dir, "wwn-0x6005076810810261f800000000000a2b")
+	ioutil.WriteFile(filepath.Join(dir, "sdb"), nil, 0600)
+	if err := os.Symlink(filepath.Join(dir, "sdb"), link); err != nil {
+		t.Fatal(err)
+	}
+
+	byId, readIdentity := sdsdevice.DiskByIdDir, sdsdevice.ReadIdentity
+	defer func() {
+		sdsdevice.DiskByIdDir, sdsdevice.ReadIdentity = byId, readIdentity
+	}()
+	actual := sdsdevice.Identity{WWN: "6005076810810261f800000000000a2c"}
+	sdsdevice.DiskByIdDir = dir
+	sdsdevice.ReadIdentity = func(device string) (sdsdevice.Identity, error) {
+		return actual, nil
+	}
+
+	fb, fm, tearDown := setUpFakeNode(t, filepath.Join(dir, "sdb"), "")
+	defer tearDown()
+	fb.attachments["attachment-1"].ConnectionData = map[string]interface{}{
+		"wwn": "6005076810810261F800000000000A2B",
+	}
+	fm.addDevice(link, "")
+
+	var fakePlugin = &Plugin{}
+	var fakeCtx = context.Background()
+	fakeReq := &csi.NodeStageVolumeRequest{
+		VolumeId:          "volume-1",
+		StagingTargetPath: filepath.Join(dir, "staging"),
+		VolumeCapability:  mountCapability("ext4"),
+		PublishContext:    map[string]string{KPublishAttachId: "attachment-1"},
+	}
+
+	// Another LUN is never formatted nor mounted
+	_, err = fakePlugin.NodeStageVolume(fakeCtx, fakeReq)
+	if codes.FailedPrecondition != status.Code(err) {
+		t.Errorf("expected: %v, actual: %v\n", codes.FailedPrecondition, err)
+	}
+
+	if mp, _ := getMountPoint(fakeReq.StagingTargetPath); nil != mp || 0 != fm.formats {
+		t.Errorf("expected: nothing mounted or formatted, actual: %v, %v formats\n", mp, fm.formats)
+	}
+
+	// The LUN is staged through its by-id link, which is kept as the device
+	actual = sdsdevice.Identity{WWN: "6005076810810261f800000000000a2b"}
+	if _, err := fakePlugin.NodeStageVolume(fakeCtx, fakeReq); err != nil {
+		t.Fatalf("failed to NodeStageVolume: %v\n", err)
+	}
+
+	if attachment := fb.attachments["attachment-1"]; link != attachment.Mountpoint {
+		t.Errorf("expected: %v, actual: %v\n", link, attachment.Mountpoint)
+	}
+
+	if mp, _ := getMountPoint(fakeReq.StagingTargetPath); nil == mp || 1 != fm.formats {
+		t.Errorf("expected: the LUN formatted and mounted, actual: %v, %v formats\n", mp, fm.formats)
+	}
+}
+
+func TestNodePublishVolumeIdempotency(t *testing.T) {
+	fb, fm, tearDown := setUpFakeNode(t, "/dev/sdb", "ext4")
+	defer tearDown()
+
+	dir, err := ioutil.TempDir("", "node-publish")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var fakePlugin = &Plugin{}
+	var fakeCtx = context.Background()
+	stagingPath := filepath.Join(dir, "staging")
+	_, err = fakePlugin.NodeStageVolume(fakeCtx, &csi.NodeStageVolumeRequest{
+		VolumeId:          "volume-1",
+		StagingTargetPath: stagingPath,
+		VolumeCapability:  mountCapability("ext4"),
+		PublishContext:    map[string]string{KPublishAttachId: "attachment-1"},
+	})
+	if err != nil {
+		t.Fatalf("failed to NodeStageVolume: %v\n", err)
+	}
+
+	targetPath := filepath.Join(dir, "target")
+	fakeReq := &csi.NodePublishVolumeRequest{
+		VolumeId:          "volume-1",
+		StagingTargetPath: stagingPath,
+		TargetPath:        targetPath,
+		VolumeCapability:  mountCapability("ext4"),
+		PublishContext:    map[string]string{KPublishAttachId: "attachment-1"},
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := fakePlugin.NodePublishVolume(fakeCtx, fakeReq); err != nil {
+			t.Fatalf("failed to NodePublishVolume: %v\n", err)
+		}
+	}
+
+	mp, _ := getMountPoint(targetPath)
+	if nil == mp || 2 != fm.mountCalls {
+		t.Fatalf("expected: a bind mount at %s, actual: %v after %v mounts\n", targetPath, mp, fm.mountCalls)
+	}
+
+	if isBound, _ := isBindMountOf(mp, stagingPath); !isBound {
+		t.Errorf("expected %v to be a bind mount of %s\n", mp, stagingPath)
+	}
+
+	if !hasPath(fb.attachments["attachment-1"], KTargetPath, targetPath) {
+		t.Errorf("expected: %v, actual: %v\n", targetPath, fb.attachments["attachment-1"].Metadata)
+	}
+
+	// Publishing read-only at the same target is incompatible
+	fakeReq.Readonly = true
+	_, err = fakePlugin.NodePublishVolume(fakeCtx, fakeReq)
+	if codes.Aborted != status.Code(err) {
+		t.Errorf("expected: %v, actual: %v\n", codes.Aborted, err)
+	}
+
+	unpublishReq := &csi.NodeUnpublishVolumeRequest{VolumeId: "volume-1", TargetPath: targetPath}
+	for i := 0; i < 2; i++ {
+		if _, err := fakePlugin.NodeUnpublishVolume(fakeCtx, unpublishReq); err != nil {
+			t.Fatalf("failed to NodeUnpublishVolume: %v\n", err)
+		}
+	}
+
+	if mounted, _ := isMountPoint(targetPath); mounted {
+		t.Errorf("expected %s to be unmounted\n", targetPath)
+	}
+
+	if hasPath(fb.attachments["attachment-1"], KTargetPath, targetPath) {
+		t.Errorf("expected no target path, actual: %v\n", fb.attachments["attachment-1"].Metadata)
+	}
+}
+
+func TestNodePublishBlockVolumeIdempotency(t *testing.T) {
+	_, fm, tearDown := setUpFakeNode(t, "/dev/sdb", "")
+	defer tearDown()
+
+	dir, err := ioutil.TempDir("", "node-publish")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var fakePlugin = &Plugin{}
+	var fakeCtx = context.Background()
+	targetPath := filepath.Join(dir, "pod", "block")
+	fakeReq := &csi.NodePublishVolumeRequest{
+		VolumeId:          "volume-1",
+		StagingTargetPath: filepath.Join(dir, "staging"),
+		TargetPath:        targetPath,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Block{
+				Block: &csi.VolumeCapability_BlockVolume{},
+			},
+		},
+		PublishContext: map[string]string{KPublishAttachId: "attachment-1"},
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := fakePlugin.NodePublishVolume(fakeCtx, fakeReq); err != nil {
+			t.Fatalf("failed to NodePublishVolume: %v\n", err)
+		}
+	}
+
+	mp, _ := getMountPoint(targetPath)
+	if nil == mp || "/sdb" != mp.Root || 1 != fm.mountCalls || 0 != fm.formats {
+		t.Errorf("expected: /dev/sdb bound once at %s, actual: %v after %v mounts\n", targetPath, mp, fm.mountCalls)
+	}
+
+	if _, err := fakePlugin.NodeUnpublishVolume(fakeCtx, &csi.NodeUnpublishVolumeRequest{
+		VolumeId:   "volume-1",
+		TargetPath: targetPath,
+	}); err != nil {
+		t.Errorf("failed to NodeUnpublishVolume: %v\n", err)
+	}
+
+	if _, err := os.Stat(targetPath); !os.IsNotExist(err) {
+		t.Errorf("expected the target file to be removed, actual: %v\n", err)
+	}
+}
+
+func TestNodeStageVolumeMkfsOptions(t *testing.T) {
+	_, fm, tearDown := setUpFakeNode(t, "/dev/sdb", "")
+	defer tearDown()
+
+	dir, err := ioutil.TempDir("", "node-stage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var fakePlugin = &Plugin{}
+	var fakeCtx = context.Background()
+	fakeReq := &csi.NodeStageVolumeRequest{
+		VolumeId:          "volume-1",
+		StagingTargetPath: filepath.Join(dir, "staging"),
+		VolumeCapability:  mountCapability("xfs", "loop"),
+		PublishContext:    map[string]string{KPublishAttachId: "attachment-1"},
+		VolumeContext:     map[string]string{KVolumeMkfsOptions: "-K -L data"},
+	}
+
+	// A mount flag which is not allowed is rejected before anything is done
+	_, err = fakePlugin.NodeStageVolume(fakeCtx, fakeReq)
+	expectedErr := status.Error(codes.InvalidArgument, "mount flag loop is not allowed")
+	if !reflect.DeepEqual(expectedErr, err) || 0 != fm.formats {
+		t.Errorf("expected: %v, actual: %v\n", expectedErr, err)
+	}
+
+	fakeReq.VolumeCapability = mountCapability("xfs", "noatime", "inode64")
+	if _, err := fakePlugin.NodeStageVolume(fakeCtx, fakeReq); err != nil {
+		t.Fatalf("failed to NodeStageVolume: %v\n", err)
+	}
+
+	if expected := []string{"-K", "-L", "data"}; !reflect.DeepEqual(expected, fm.formatArgs) {
+		t.Errorf("expected: %v, actual: %v\n", expected, fm.formatArgs)
+	}
+
+	if fsType, _ := fm.GetFSType("/dev/sdb"); "xfs" != fsType {
+		t.Errorf("expected: %v, actual: %v\n", "xfs", fsType)
+	}
+}
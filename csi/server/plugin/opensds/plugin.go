@@ -22,6 +22,20 @@ const (
 
 // Plugin define
 type Plugin struct {
+	// AvailabilityZone is the AZ of the node, it takes precedence over the
+	// zone label in NodeLabelFile
+	AvailabilityZone string
+	// NodeLabelFile is a file of key=value lines with the labels of the node
+	NodeLabelFile string
+	// DefaultProfile is the name or id of the profile used when a volume or
+	// snapshot has no profile parameter
+	DefaultProfile string
+	// MetadataKeys are the StorageClass and VolumeSnapshotClass parameters
+	// recorded as labels in the metadata of volumes and snapshots
+	MetadataKeys []string
+	// NodeStateFile is the file the node service records the devices, staging
+	// paths and publish targets of the volumes of the node in
+	NodeStateFile string
 }
 
 type FakePlugin struct {
@@ -0,0 +1,303 @@
+// Copyright (c) 2018 Huawei Technologies Co., Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opensds
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/opensds/nbp/csi/util"
+	c "github.com/opensds/opensds/client"
+	"github.com/opensds/opensds/pkg/model"
+	"github.com/opensds/opensds/pkg/utils"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+//                            Profiles and Parameters                         //
+////////////////////////////////////////////////////////////////////////////////
+
+var (
+	// profileCacheTTL time the listed profiles are used for
+	profileCacheTTL = 30 * time.Second
+
+	profiles = &profileCache{}
+)
+
+// profileCache keeps the profiles listed from OpenSDS for a short time, so
+// that a profile name does not cost a ListProfiles call per request
+type profileCache struct {
+	sync.Mutex
+	profiles  []*model.ProfileSpec
+	updatedAt time.Time
+}
+
+// find returns the profile with the id or the name, the profiles are listed
+// again if they are out of date or the profile is not among them
+func (pc *profileCache) find(ctx context.Context, nameOrId string) (*model.ProfileSpec, error) {
+	pc.Lock()
+	defer pc.Unlock()
+
+	if time.Since(pc.updatedAt) < profileCacheTTL {
+		if prf, err := pc.lookup(nameOrId); prf != nil || err != nil {
+			return prf, err
+		}
+	}
+
+	var list []*model.ProfileSpec
+	err := retry(ctx, "list profiles", func(client *c.Client) (err error) {
+		list, err = client.ListProfiles()
+		return err
+	})
+	if err != nil {
+		glog.Error("List profiles failed: ", err)
+		return nil, statusError(err, "list profiles failed")
+	}
+
+	pc.profiles = list
+	pc.updatedAt = time.Now()
+
+	return pc.lookup(nameOrId)
+}
+
+// lookup returns nil if no profile has the id or the name
+func (pc *profileCache) lookup(nameOrId string) (*model.ProfileSpec, error) {
+	var found *model.ProfileSpec
+
+	for _, prf := range pc.profiles {
+		if prf == nil {
+			continue
+		}
+
+		if prf.Id == nameOrId {
+			return prf, nil
+		}
+
+		if prf.Name == nameOrId {
+			if found != nil {
+				msg := fmt.Sprintf("more than one profile is named %s, use the profile id", nameOrId)
+				return nil, status.Error(codes.InvalidArgument, msg)
+			}
+			found = prf
+		}
+	}
+
+	return found, nil
+}
+
+// resolveProfile gets a profile by its name or id
+func resolveProfile(ctx context.Context, nameOrId string) (*model.ProfileSpec, error) {
+	prf, err := profiles.find(ctx, nameOrId)
+	if err != nil {
+		return nil, err
+	}
+
+	if prf == nil {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("the profile %s is not exist", nameOrId))
+	}
+
+	return prf, nil
+}
+
+// getDefaultProfile gets the profile of the volumes and snapshots created
+// without a profile parameter
+func (p *Plugin) getDefaultProfile(ctx context.Context) (*model.ProfileSpec, error) {
+	name := p.DefaultProfile
+	if "" == name {
+		name = util.OpensdsDefaultProfile
+	}
+
+	prf, err := profiles.find(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if prf == nil {
+		return nil, status.Error(codes.FailedPrecondition, "No default profile")
+	}
+
+	return prf, nil
+}
+
+// volumeParameters the StorageClass parameters of a volume
+type volumeParameters struct {
+	profile           *model.ProfileSpec
+	az                string
+	enableReplication bool
+	secondaryAZ       string
+	mkfsOptions       string
+	multipath         bool
+	// metadata the owner of the volume and the allowed extra labels
+	metadata map[string]string
+}
+
+// snapshotParameters the VolumeSnapshotClass parameters of a snapshot
+type snapshotParameters struct {
+	profile  *model.ProfileSpec
+	metadata map[string]string
+}
+
+// volumeIdentityKeys the provisioner parameters recorded in the metadata of a
+// volume, they tell the kubernetes objects the volume is created for
+var volumeIdentityKeys = map[string]string{
+	KParamPVCName:      KMetaPVCName,
+	KParamPVCNamespace: KMetaPVCNamespace,
+	KParamPVName:       KMetaPVName,
+}
+
+// snapshotIdentityKeys the snapshotter parameters recorded in the metadata of
+// a snapshot
+var snapshotIdentityKeys = map[string]string{
+	KParamVolumeSnapshotName:        KMetaVolumeSnapshotName,
+	KParamVolumeSnapshotNamespace:   KMetaVolumeSnapshotNamespace,
+	KParamVolumeSnapshotContentName: KMetaVolumeSnapshotContentName,
+}
+
+// parseVolumeParameters parses and validates the parameters of a volume, a
+// profile given by name is resolved to the profile
+func (p *Plugin) parseVolumeParameters(ctx context.Context, params map[string]string) (*volumeParameters, error) {
+	vp := &volumeParameters{secondaryAZ: util.OpensdsDefaultSecondaryAZ}
+
+	for k, v := range params {
+		key := strings.ToLower(k)
+		if p.recordMetadata(&vp.metadata, k, v, volumeIdentityKeys) {
+			continue
+		}
+
+		if err := checkParameterValue(k, v); err != nil {
+			return nil, err
+		}
+
+		switch key {
+		case KParamProfile:
+			prf, err := resolveProfile(ctx, v)
+			if err != nil {
+				return nil, err
+			}
+			vp.profile = prf
+		case KParamAZ:
+			vp.az = v
+		case KParamEnableReplication:
+			enable, err := strconv.ParseBool(v)
+			if err != nil {
+				msg := fmt.Sprintf("the parameter %s must be true or false, not %q", k, v)
+				return nil, status.Error(codes.InvalidArgument, msg)
+			}
+			vp.enableReplication = enable
+		case KParamSecondaryAZ:
+			vp.secondaryAZ = v
+		case KParamMkfsOptions:
+			vp.mkfsOptions = v
+		case KParamMultipath:
+			multipath, err := strconv.ParseBool(v)
+			if err != nil {
+				msg := fmt.Sprintf("the parameter %s must be true or false, not %q", k, v)
+				return nil, status.Error(codes.InvalidArgument, msg)
+			}
+			vp.multipath = multipath
+		default:
+			if !isProvisionerParameter(key) {
+				return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("unknown parameter %s", k))
+			}
+		}
+	}
+
+	return vp, nil
+}
+
+// parseSnapshotParameters parses and validates the parameters of a snapshot
+func (p *Plugin) parseSnapshotParameters(ctx context.Context, params map[string]string) (*snapshotParameters, error) {
+	sp := &snapshotParameters{}
+
+	for k, v := range params {
+		key := strings.ToLower(k)
+		if p.recordMetadata(&sp.metadata, k, v, snapshotIdentityKeys) {
+			continue
+		}
+
+		if err := checkParameterValue(k, v); err != nil {
+			return nil, err
+		}
+
+		switch key {
+		case KParamProfile:
+			prf, err := resolveProfile(ctx, v)
+			if err != nil {
+				return nil, err
+			}
+			sp.profile = prf
+		default:
+			if !isProvisionerParameter(key) {
+				return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("unknown parameter %s", k))
+			}
+		}
+	}
+
+	return sp, nil
+}
+
+// recordMetadata records an identity parameter or an allowed extra label in
+// the metadata, it tells whether the parameter is one of them
+func (p *Plugin) recordMetadata(metadata *map[string]string, k string, v string, identityKeys map[string]string) bool {
+	metaKey, ok := identityKeys[strings.ToLower(k)]
+	if !ok {
+		if !utils.Contained(k, p.MetadataKeys) {
+			return false
+		}
+		metaKey = k
+	}
+
+	if nil == *metadata {
+		*metadata = make(map[string]string)
+	}
+	(*metadata)[metaKey] = v
+
+	return true
+}
+
+// describeOwner describes the kubernetes object a volume or snapshot is
+// created for, it is empty if the object is unknown
+func describeOwner(kind string, namespace string, name string) string {
+	if "" == name {
+		return ""
+	}
+
+	if "" != namespace {
+		name = namespace + "/" + name
+	}
+
+	return fmt.Sprintf("Created by %s for %s %s", PluginName, kind, name)
+}
+
+// checkParameterValue a parameter of the plugin cannot be empty
+func checkParameterValue(k string, v string) error {
+	if !isProvisionerParameter(strings.ToLower(k)) && "" == strings.TrimSpace(v) {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("the parameter %s cannot be empty", k))
+	}
+
+	return nil
+}
+
+// isProvisionerParameter the parameters added by the external provisioner and
+// snapshotter are not the plugin's ones
+func isProvisionerParameter(key string) bool {
+	return strings.HasPrefix(key, KParamProvisionerPrefix)
+}
@@ -0,0 +1,735 @@
+// Copyright (c) 2018 Huawei Technologies Co., Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opensds
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	sdsdevice "github.com/opensds/nbp/client/device"
+	c "github.com/opensds/opensds/client"
+	"github.com/opensds/opensds/contrib/connector"
+	"github.com/opensds/opensds/pkg/model"
+	"github.com/opensds/opensds/pkg/utils"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+//                            Node state                                      //
+////////////////////////////////////////////////////////////////////////////////
+
+// The node service records in a local file the device, staging path and
+// publish targets of every volume it stages or publishes. A node which
+// crashed or rebooted loses its mounts while the file and the attachments in
+// OpenSDS still tell about them, the node service reconciles them with the
+// mounts and devices of the node when it starts.
+
+var (
+	// nodeState the state of the node, it is only kept in memory until
+	// StartNode opens the state file
+	nodeState = newNodeStateStore("")
+	// reconcileRetryInterval interval of reconciling the volumes which failed
+	// to, e.g. while OpenSDS is unreachable
+	reconcileRetryInterval = 30 * time.Second
+)
+
+// volumeState the state of a volume on the node
+type volumeState struct {
+	VolumeId     string `json:"volumeId"`
+	AttachmentId string `json:"attachmentId"`
+	// DriverVolumeType and ConnectionData detach the device when the
+	// attachment is gone
+	DriverVolumeType string                 `json:"driverVolumeType"`
+	ConnectionData   map[string]interface{} `json:"connectionData,omitempty"`
+	Device           string                 `json:"device"`
+	Block            bool                   `json:"block,omitempty"`
+	StagingPath      string                 `json:"stagingPath,omitempty"`
+	TargetPaths      []string               `json:"targetPaths,omitempty"`
+}
+
+// nodeStateStore the state of the volumes of the node by their ids, it is
+// written to the file at path on every change
+type nodeStateStore struct {
+	sync.Mutex
+	path    string
+	volumes map[string]*volumeState
+}
+
+func newNodeStateStore(path string) *nodeStateStore {
+	return &nodeStateStore{
+		path:    path,
+		volumes: make(map[string]*volumeState),
+	}
+}
+
+// loadNodeState reads the state file, a file which does not exist is an
+// empty state
+func loadNodeState(path string) (*nodeStateStore, error) {
+	s := newNodeStateStore(path)
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var volumes []*volumeState
+	if err := json.Unmarshal(data, &volumes); err != nil {
+		return nil, fmt.Errorf("invalid node state file %s: %v", path, err)
+	}
+
+	for _, vs := range volumes {
+		s.volumes[vs.VolumeId] = vs
+	}
+
+	return s, nil
+}
+
+// save writes the state to a temporary file renamed to the state file, so
+// that a crash leaves either state. The caller must hold the lock.
+func (s *nodeStateStore) save() error {
+	if "" == s.path {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(s.sortedVolumes(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0750); err != nil {
+		return err
+	}
+
+	// The connection data may have the credentials of the target
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.path)
+}
+
+// sortedVolumes the volumes by id, the caller must hold the lock
+func (s *nodeStateStore) sortedVolumes() []*volumeState {
+	volumes := make([]*volumeState, 0, len(s.volumes))
+	for _, vs := range s.volumes {
+		volumes = append(volumes, vs)
+	}
+
+	sort.Slice(volumes, func(i, j int) bool {
+		return volumes[i].VolumeId < volumes[j].VolumeId
+	})
+
+	return volumes
+}
+
+// list returns a copy of the state of every volume
+func (s *nodeStateStore) list() []*volumeState {
+	s.Lock()
+	defer s.Unlock()
+
+	var volumes []*volumeState
+	for _, vs := range s.sortedVolumes() {
+		volumes = append(volumes, vs.copy())
+	}
+
+	return volumes
+}
+
+// get returns a copy of the state of a volume, it is nil if there is none
+func (s *nodeStateStore) get(volId string) *volumeState {
+	s.Lock()
+	defer s.Unlock()
+
+	if vs, ok := s.volumes[volId]; ok {
+		return vs.copy()
+	}
+
+	return nil
+}
+
+// set replaces the state of a volume
+func (s *nodeStateStore) set(vs *volumeState) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.volumes[vs.VolumeId] = vs.copy()
+	return s.save()
+}
+
+// remove drops the state of a volume
+func (s *nodeStateStore) remove(volId string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.volumes[volId]; !ok {
+		return nil
+	}
+
+	delete(s.volumes, volId)
+	return s.save()
+}
+
+// staged records a volume staged at a path with the device of the attachment
+func (s *nodeStateStore) staged(volId string, attachment *model.VolumeAttachmentSpec, stagingPath string, block bool) error {
+	s.Lock()
+	defer s.Unlock()
+
+	vs := s.volumeOf(volId, attachment)
+	vs.StagingPath = stagingPath
+	vs.Block = block
+	return s.save()
+}
+
+// unstaged drops a volume which is unstaged
+func (s *nodeStateStore) unstaged(volId string) error {
+	return s.remove(volId)
+}
+
+// published records a target a volume staged at a path is published at
+func (s *nodeStateStore) published(volId string, attachment *model.VolumeAttachmentSpec, stagingPath string, target string, block bool) error {
+	s.Lock()
+	defer s.Unlock()
+
+	// A volume staged before the state was recorded is staged at the
+	// staging path of the request
+	vs := s.volumeOf(volId, attachment)
+	if "" == vs.StagingPath {
+		vs.StagingPath = stagingPath
+	}
+	vs.Block = block
+	if !utils.Contained(target, vs.TargetPaths) {
+		vs.TargetPaths = append(vs.TargetPaths, target)
+	}
+
+	return s.save()
+}
+
+// unpublished drops a target a volume is no longer published at
+func (s *nodeStateStore) unpublished(volId string, target string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	vs, ok := s.volumes[volId]
+	if !ok {
+		return nil
+	}
+
+	for i, path := range vs.TargetPaths {
+		if path == target {
+			vs.TargetPaths = append(vs.TargetPaths[:i], vs.TargetPaths[i+1:]...)
+			return s.save()
+		}
+	}
+
+	return nil
+}
+
+// volumeOf returns the state of a volume updated with its attachment, a
+// volume staged before the state was recorded is added. The caller must hold
+// the lock.
+func (s *nodeStateStore) volumeOf(volId string, attachment *model.VolumeAttachmentSpec) *volumeState {
+	vs, ok := s.volumes[volId]
+	if !ok {
+		vs = &volumeState{VolumeId: volId}
+		s.volumes[volId] = vs
+	}
+
+	vs.AttachmentId = attachment.Id
+	vs.DriverVolumeType = attachment.DriverVolumeType
+	vs.ConnectionData = attachment.ConnectionData
+	vs.Device = attachment.Mountpoint
+	return vs
+}
+
+// copy a deep enough copy of the state of a volume
+func (vs *volumeState) copy() *volumeState {
+	c := *vs
+	c.TargetPaths = append([]string(nil), vs.TargetPaths...)
+	return &c
+}
+
+// recordNodeState reports an error recording the node state of a volume
+func recordNodeState(volId string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	msg := fmt.Sprintf("failed to record the node state of the volume %s: %v", volId, err)
+	glog.Error(msg)
+	return status.Error(codes.Internal, msg)
+}
+
+// StartNode opens the node state file and reconciles the state recorded
+// before the node service started with the node in the background
+func (p *Plugin) StartNode(ctx context.Context) error {
+	if "" == p.NodeStateFile {
+		return nil
+	}
+
+	s, err := loadNodeState(p.NodeStateFile)
+	if err != nil {
+		return err
+	}
+	nodeState = s
+
+	go func() {
+		for {
+			err := reconcileNodeState(ctx)
+			if err == nil {
+				return
+			}
+
+			glog.Errorf("failed to reconcile the node state, retrying in %v: %v", reconcileRetryInterval, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(reconcileRetryInterval):
+			}
+		}
+	}()
+
+	return nil
+}
+
+// reconcileNodeState reconciles the state of every volume recorded on the
+// node, then detaches the devices OpenSDS attached to the node for volumes
+// the state does not know about, and the sessions to the targets of OpenSDS
+// no volume uses any more
+func reconcileNodeState(ctx context.Context) error {
+	volumes := nodeState.list()
+	glog.Infof("reconciling the node state of %d volumes", len(volumes))
+
+	var failed []string
+	for _, vs := range volumes {
+		if err := reconcileVolume(ctx, vs.VolumeId); err != nil {
+			glog.Errorf("failed to reconcile the node state of the volume %s: %v", vs.VolumeId, err)
+			failed = append(failed, vs.VolumeId)
+		}
+	}
+
+	// The sessions are listed before the attachments, the attachment of a
+	// volume being attached meanwhile is listed with them then
+	sessions, err := sdsdevice.ListSessions()
+	if err != nil {
+		return fmt.Errorf("failed to list the sessions of the node: %v", err)
+	}
+
+	attachments, err := listNodeAttachments(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list the attachments of the node: %v", err)
+	}
+
+	for _, attachment := range attachments {
+		if nil != nodeState.get(attachment.VolumeId) {
+			continue
+		}
+
+		if err := reconcileUnrecordedAttachment(ctx, attachment, sessions); err != nil {
+			glog.Errorf("failed to reconcile the attachment %s of the volume %s: %v", attachment.Id, attachment.VolumeId, err)
+			failed = append(failed, attachment.VolumeId)
+		}
+	}
+
+	if err := detachLeftoverSessions(sessions, attachments); err != nil {
+		return err
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("the volumes %s are not reconciled", strings.Join(failed, ", "))
+	}
+
+	return nil
+}
+
+// reconcileVolume drops the paths of a volume which are no longer mounted
+// from the state and its attachment. A volume neither staged nor published
+// any more is detached and dropped.
+func reconcileVolume(ctx context.Context, volId string) error {
+	unlock, err := lockOperation(lockVolumeId + volId)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// The volume may have changed since the state was listed
+	vs := nodeState.get(volId)
+	if nil == vs {
+		return nil
+	}
+
+	mounts, err := mounter.List()
+	if err != nil {
+		return err
+	}
+
+	var targets []string
+	for _, target := range vs.TargetPaths {
+		if nil != findMountPoint(mounts, target) {
+			targets = append(targets, target)
+		} else {
+			glog.Infof("the volume %s is no longer published at %s", volId, target)
+		}
+	}
+	vs.TargetPaths = targets
+
+	// The staging path of a block volume is not mounted, it is staged as long
+	// as its device is there
+	if "" != vs.StagingPath && !isStaged(vs, mounts) {
+		glog.Infof("the volume %s is no longer staged at %s", volId, vs.StagingPath)
+		vs.StagingPath = ""
+	}
+
+	attachment, err := getAttachmentOfState(ctx, vs)
+	if err != nil {
+		return err
+	}
+
+	if "" == vs.StagingPath && 0 == len(vs.TargetPaths) {
+		return detachOrphan(ctx, vs, attachment)
+	}
+
+	if nil != attachment {
+		if err := syncAttachmentPaths(ctx, attachment, vs); err != nil {
+			return err
+		}
+	}
+
+	return nodeState.set(vs)
+}
+
+// listNodeAttachments lists the attachments OpenSDS has of the node
+func listNodeAttachments(ctx context.Context) ([]*model.VolumeAttachmentSpec, error) {
+	hostName, err := connector.GetHostName()
+	if err != nil {
+		return nil, err
+	}
+
+	var attachments []*model.VolumeAttachmentSpec
+	err = retry(ctx, "list volume attachments", func(client *c.Client) (err error) {
+		attachments, err = client.ListVolumeAttachments(listFilter("Host", hostName))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var found []*model.VolumeAttachmentSpec
+	for _, attachment := range attachments {
+		if nil != attachment && attachment.Host == hostName {
+			found = append(found, attachment)
+		}
+	}
+
+	return found, nil
+}
+
+// reconcileUnrecordedAttachment detaches the LUN of an attachment of the
+// node whose volume has no state, e.g. a volume the node crashed attaching
+// before its state was recorded, unless the LUN or one of the paths of the
+// attachment is mounted. The LUN is looked up by its identity or by the
+// sessions it is attached by, the device the attachment tells about is only
+// taken for a LUN which can not be looked up.
+func reconcileUnrecordedAttachment(ctx context.Context, attachment *model.VolumeAttachmentSpec, sessions []sdsdevice.Session) error {
+	unlock, err := lockOperation(lockVolumeId + attachment.VolumeId)
+	if status.Code(err) == codes.Aborted {
+		// The volume is being staged or published, it is recorded then
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if nil != nodeState.get(attachment.VolumeId) {
+		return nil
+	}
+
+	mounts, err := mounter.List()
+	if err != nil {
+		return err
+	}
+
+	device, err := sdsdevice.Resolve(attachment.DriverVolumeType, attachment.ConnectionData, attachment.Mountpoint)
+	if err == sdsdevice.ErrNotFound {
+		device = ""
+	} else if err != nil {
+		return err
+	}
+
+	var devices []string
+	if "" != device {
+		devices = append(devices, device)
+	}
+	attached := false
+	for _, s := range sdsdevice.SessionsOf(attachment.DriverVolumeType, attachment.ConnectionData) {
+		if sdsdevice.ContainsSession(sessions, s) {
+			attached = true
+			devices = append(devices, s.Devices()...)
+		}
+	}
+
+	if "" == device && !attached {
+		if "" == attachment.Mountpoint || "-" == attachment.Mountpoint {
+			// Nothing is attached yet, e.g. the volume is not staged
+			return nil
+		}
+
+		// The LUN is gone, only the attachment tells about it
+		return detachOrphan(ctx, &volumeState{VolumeId: attachment.VolumeId}, attachment)
+	}
+
+	if mp := findMountedDevice(mounts, devices); nil != mp {
+		glog.Warningf("the device %s of the attachment %s is mounted at %s while the volume %s has no state",
+			mp.Source, attachment.Id, mp.Path, attachment.VolumeId)
+		return nil
+	}
+
+	paths := append(attachmentPaths(attachment, KStagingTargetPath), attachmentPaths(attachment, KTargetPath)...)
+	for _, path := range paths {
+		if nil != findMountPoint(mounts, path) {
+			glog.Warningf("the path %s of the attachment %s is mounted while the volume %s has no state",
+				path, attachment.Id, attachment.VolumeId)
+			return nil
+		}
+	}
+
+	if "" == device {
+		// The node is still logged in to the target of a LUN which is gone
+		if err := detachPaths(attachment.DriverVolumeType, attachment.ConnectionData, ""); err != nil {
+			return fmt.Errorf("failed to detach the volume %s: %v", attachment.VolumeId, err)
+		}
+	}
+
+	return detachOrphan(ctx, &volumeState{
+		VolumeId:         attachment.VolumeId,
+		AttachmentId:     attachment.Id,
+		DriverVolumeType: attachment.DriverVolumeType,
+		ConnectionData:   attachment.ConnectionData,
+		Device:           device,
+	}, attachment)
+}
+
+// detachLeftoverSessions detaches the sessions of the node which no volume
+// attached to the node uses, e.g. those of a volume the node crashed
+// detaching after its attachment was deleted. Only the sessions to a target
+// one of the attachments of the node or a recorded volume is attached by are
+// taken as those of OpenSDS, the others are left alone.
+func detachLeftoverSessions(sessions []sdsdevice.Session, attachments []*model.VolumeAttachmentSpec) error {
+	used := make(map[sdsdevice.Session]bool)
+	for _, attachment := range attachments {
+		for _, s := range sdsdevice.SessionsOf(attachment.DriverVolumeType, attachment.ConnectionData) {
+			used[s] = true
+		}
+	}
+	for _, vs := range nodeState.list() {
+		for _, s := range sdsdevice.SessionsOf(vs.DriverVolumeType, vs.ConnectionData) {
+			used[s] = true
+		}
+	}
+
+	targets := make(map[string]bool)
+	for s := range used {
+		targets[s.Target] = true
+	}
+
+	mounts, err := mounter.List()
+	if err != nil {
+		return err
+	}
+
+	var failed []string
+	for _, s := range sessions {
+		if used[s] || !targets[s.Target] {
+			continue
+		}
+
+		if mp := findMountedDevice(mounts, s.Devices()); nil != mp {
+			glog.Warningf("the device %s of the leftover session %s is mounted at %s", mp.Source, s, mp.Path)
+			continue
+		}
+
+		glog.Infof("detaching the leftover session %s", s)
+		volConnector := connector.NewConnector(s.DriverVolumeType)
+		if nil == volConnector {
+			failed = append(failed, s.String())
+			continue
+		}
+
+		if err := volConnector.Detach(s.ConnectionData()); err != nil {
+			glog.Errorf("failed to detach the leftover session %s: %v", s, err)
+			failed = append(failed, s.String())
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("the sessions %s are not detached", strings.Join(failed, ", "))
+	}
+
+	return nil
+}
+
+// findMountedDevice finds a mount point of one of the devices
+func findMountedDevice(mounts []*MountPoint, devices []string) *MountPoint {
+	for _, mp := range mounts {
+		for _, device := range devices {
+			if isMountedFrom(mp, device) {
+				return mp
+			}
+		}
+	}
+
+	return nil
+}
+
+// isStaged checks if a volume is still staged on the node
+func isStaged(vs *volumeState, mounts []*MountPoint) bool {
+	if vs.Block {
+		_, err := os.Stat(vs.Device)
+		return err == nil
+	}
+
+	mp := findMountPoint(mounts, vs.StagingPath)
+	return nil != mp && ("" == vs.Device || isMountedFrom(mp, vs.Device))
+}
+
+// getAttachmentOfState gets the attachment of a volume, it is nil if OpenSDS
+// deleted it
+func getAttachmentOfState(ctx context.Context, vs *volumeState) (*model.VolumeAttachmentSpec, error) {
+	if "" == vs.AttachmentId {
+		return nil, nil
+	}
+
+	var attachment *model.VolumeAttachmentSpec
+	err := retry(ctx, "get volume attachment", func(client *c.Client) (err error) {
+		attachment, err = client.GetVolumeAttachment(vs.AttachmentId)
+		return err
+	})
+	if isNotFoundError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, statusError(err, "get volume attachment %s failed", vs.AttachmentId)
+	}
+
+	return attachment, nil
+}
+
+// detachOrphan detaches the device of a volume nothing uses on the node, and
+// drops its paths from its attachment and the volume from the state
+func detachOrphan(ctx context.Context, vs *volumeState, attachment *model.VolumeAttachmentSpec) error {
+	glog.Infof("detaching the orphaned device %s of the volume %s", vs.Device, vs.VolumeId)
+
+	if "" != vs.Device && "-" != vs.Device {
+		if err := detachPaths(vs.DriverVolumeType, vs.ConnectionData, vs.Device); err != nil {
+			return fmt.Errorf("failed to detach %s: %v", vs.Device, err)
+		}
+	}
+
+	if nil != attachment {
+		vs.Device = "-"
+		if err := syncAttachmentPaths(ctx, attachment, vs); err != nil {
+			return err
+		}
+	}
+
+	return nodeState.remove(vs.VolumeId)
+}
+
+// syncAttachmentPaths makes the device and the paths an attachment tells
+// about those of the state of its volume
+func syncAttachmentPaths(ctx context.Context, attachment *model.VolumeAttachmentSpec, vs *volumeState) error {
+	var stagingPaths []string
+	if "" != vs.StagingPath {
+		stagingPaths = []string{vs.StagingPath}
+	}
+
+	if vs.Device == attachment.Mountpoint &&
+		isSamePathSet(stagingPaths, attachmentPaths(attachment, KStagingTargetPath)) &&
+		isSamePathSet(vs.TargetPaths, attachmentPaths(attachment, KTargetPath)) {
+		return nil
+	}
+
+	metadata := make(map[string]string)
+	for k, v := range attachment.Metadata {
+		if KStagingTargetPath != k && KTargetPath != k {
+			metadata[k] = v
+		}
+	}
+
+	if len(stagingPaths) > 0 {
+		metadata[KStagingTargetPath] = strings.Join(stagingPaths, ";")
+	}
+	if len(vs.TargetPaths) > 0 {
+		metadata[KTargetPath] = strings.Join(vs.TargetPaths, ";")
+	}
+
+	glog.Infof("updating the attachment %s from %s, %v to %s, %v", attachment.Id,
+		attachment.Mountpoint, attachment.Metadata, vs.Device, metadata)
+	attachment.Metadata = metadata
+	attachment.Mountpoint = vs.Device
+	err := retry(ctx, "update volume attachment", func(client *c.Client) error {
+		_, err := client.UpdateVolumeAttachment(attachment.Id, attachment)
+		return err
+	})
+	lookups.forget(attachment.VolumeId)
+	if err != nil {
+		return statusError(err, "update volume attachment %s failed", attachment.Id)
+	}
+
+	return nil
+}
+
+// attachmentPaths the paths kept in the metadata of an attachment under key
+func attachmentPaths(attachment *model.VolumeAttachmentSpec, key string) []string {
+	var paths []string
+	for _, path := range strings.Split(attachment.Metadata[key], ";") {
+		if "" != path {
+			paths = append(paths, path)
+		}
+	}
+
+	return paths
+}
+
+// isSamePathSet checks if two lists have the same paths
+func isSamePathSet(a []string, b []string) bool {
+	set := make(map[string]bool)
+	for _, path := range a {
+		set[path] = true
+	}
+
+	for _, path := range b {
+		if !set[path] {
+			return false
+		}
+		delete(set, path)
+	}
+
+	return 0 == len(set)
+}
@@ -0,0 +1,510 @@
+// Copyright (c) 2018 Huawei Technologies Co., Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opensds
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	sdsdevice "github.com/opensds/nbp/client/device"
+	"github.com/opensds/opensds/contrib/connector"
+	"github.com/opensds/opensds/pkg/model"
+	"golang.org/x/net/context"
+)
+
+func TestNodeStateStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "node-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "state", "node-state.json")
+	s, err := loadNodeState(path)
+	if nil != err || 0 != len(s.list()) {
+		t.Fatalf("expected: an empty state, actual: %v, %v\n", s.list(), err)
+	}
+
+	attachment := &model.VolumeAttachmentSpec{
+		BaseModel:  &model.BaseModel{Id: "attachment-1"},
+		Mountpoint: "/dev/sdb",
+		ConnectionInfo: model.ConnectionInfo{
+			DriverVolumeType: "iscsi",
+			ConnectionData:   map[string]interface{}{"targetIqn": "iqn.2017-10.io.opensds:volume-1"},
+		},
+	}
+
+	if err := s.staged("volume-1", attachment, "/mnt/staging", false); nil != err {
+		t.Fatalf("failed to record the staged volume: %v\n", err)
+	}
+	s.published("volume-1", attachment, "/mnt/staging", "/mnt/target-1", false)
+	s.published("volume-1", attachment, "/mnt/staging", "/mnt/target-2", false)
+	s.published("volume-1", attachment, "/mnt/staging", "/mnt/target-1", false)
+	s.unpublished("volume-1", "/mnt/target-2")
+
+	// A volume staged before the state was recorded is added when it is published
+	s.published("volume-2", attachment, "/mnt/staging-2", "/mnt/target-3", true)
+
+	expected := []*volumeState{
+		{
+			VolumeId:         "volume-1",
+			AttachmentId:     "attachment-1",
+			DriverVolumeType: "iscsi",
+			ConnectionData:   map[string]interface{}{"targetIqn": "iqn.2017-10.io.opensds:volume-1"},
+			Device:           "/dev/sdb",
+			StagingPath:      "/mnt/staging",
+			TargetPaths:      []string{"/mnt/target-1"},
+		},
+		{
+			VolumeId:         "volume-2",
+			AttachmentId:     "attachment-1",
+			DriverVolumeType: "iscsi",
+			ConnectionData:   map[string]interface{}{"targetIqn": "iqn.2017-10.io.opensds:volume-1"},
+			Device:           "/dev/sdb",
+			Block:            true,
+			StagingPath:      "/mnt/staging-2",
+			TargetPaths:      []string{"/mnt/target-3"},
+		},
+	}
+
+	// The state survives a restart
+	loaded, err := loadNodeState(path)
+	if nil != err {
+		t.Fatalf("failed to loadNodeState: %v\n", err)
+	}
+
+	if !reflect.DeepEqual(expected, loaded.list()) {
+		t.Errorf("expected: %v, actual: %v\n", expected, loaded.list())
+	}
+
+	if info, err := os.Stat(path); nil != err || 0600 != info.Mode().Perm() {
+		t.Errorf("expected: a file only the plugin reads, actual: %v, %v\n", info, err)
+	}
+
+	s.unstaged("volume-1")
+	s.unstaged("volume-2")
+	loaded, _ = loadNodeState(path)
+	if 0 != len(loaded.list()) {
+		t.Errorf("expected: an empty state, actual: %v\n", loaded.list())
+	}
+
+	ioutil.WriteFile(path, []byte("{"), 0600)
+	if _, err := loadNodeState(path); nil == err {
+		t.Errorf("expected an error for an invalid state file\n")
+	}
+}
+
+func TestNodeOperationsRecordState(t *testing.T) {
+	_, _, tearDown := setUpFakeNode(t, "/dev/sdb", "ext4")
+	defer tearDown()
+
+	dir, err := ioutil.TempDir("", "node-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var fakePlugin = &Plugin{}
+	var fakeCtx = context.Background()
+	stagingPath := filepath.Join(dir, "staging")
+	targetPath := filepath.Join(dir, "target")
+
+	_, err = fakePlugin.NodeStageVolume(fakeCtx, &csi.NodeStageVolumeRequest{
+		VolumeId:          "volume-1",
+		StagingTargetPath: stagingPath,
+		VolumeCapability:  mountCapability("ext4"),
+		PublishContext:    map[string]string{KPublishAttachId: "attachment-1"},
+	})
+	if err != nil {
+		t.Fatalf("failed to NodeStageVolume: %v\n", err)
+	}
+
+	_, err = fakePlugin.NodePublishVolume(fakeCtx, &csi.NodePublishVolumeRequest{
+		VolumeId:          "volume-1",
+		StagingTargetPath: stagingPath,
+		TargetPath:        targetPath,
+		VolumeCapability:  mountCapability("ext4"),
+		PublishContext:    map[string]string{KPublishAttachId: "attachment-1"},
+	})
+	if err != nil {
+		t.Fatalf("failed to NodePublishVolume: %v\n", err)
+	}
+
+	vs := nodeState.get("volume-1")
+	if nil == vs || "/dev/sdb" != vs.Device || stagingPath != vs.StagingPath ||
+		!reflect.DeepEqual([]string{targetPath}, vs.TargetPaths) || "fake" != vs.DriverVolumeType {
+		t.Errorf("expected: volume-1 staged and published, actual: %v\n", vs)
+	}
+
+	fakePlugin.NodeUnpublishVolume(fakeCtx, &csi.NodeUnpublishVolumeRequest{VolumeId: "volume-1", TargetPath: targetPath})
+	if vs := nodeState.get("volume-1"); nil == vs || 0 != len(vs.TargetPaths) {
+		t.Errorf("expected: volume-1 staged only, actual: %v\n", vs)
+	}
+
+	fakePlugin.NodeUnstageVolume(fakeCtx, &csi.NodeUnstageVolumeRequest{VolumeId: "volume-1", StagingTargetPath: stagingPath})
+	if vs := nodeState.get("volume-1"); nil != vs {
+		t.Errorf("expected: no state of volume-1, actual: %v\n", vs)
+	}
+}
+
+func TestReconcileNodeState(t *testing.T) {
+	fb := newFakeBackend()
+	fb.delay = 0
+	for _, id := range []string{"1", "2"} {
+		fb.attachments["attachment-"+id] = &model.VolumeAttachmentSpec{
+			BaseModel:  &model.BaseModel{Id: "attachment-" + id},
+			VolumeId:   "volume-" + id,
+			Mountpoint: "/dev/sd" + id,
+			Metadata: map[string]string{
+				KStagingTargetPath: ";/mnt/staging-" + id,
+				KTargetPath:        ";/mnt/target-" + id + "a;/mnt/target-" + id + "b",
+				"other":            "kept",
+			},
+		}
+	}
+	defer useFakeBackend(fb)()
+	defer useFakeSessions(nil)()
+
+	fm := newFakeMounter()
+	for _, device := range []string{"/dev/sd1", "/dev/sd2", "/dev/sd3"} {
+		fm.addDevice(device, "ext4")
+	}
+	defer useFakeMounter(fm)()
+
+	fc := &fakeConnector{}
+	connector.RegisterConnector("fake-state", fc)
+	defer connector.UnregisterConnector("fake-state")
+
+	state := nodeState
+	nodeState = newNodeStateStore("")
+	defer func() {
+		nodeState = state
+	}()
+
+	// volume-1 is still staged and published at one of its targets, nothing
+	// is mounted for volume-2 and the attachment of volume-3 is deleted
+	fm.Mount("/dev/sd1", "/mnt/staging-1", "", nil)
+	fm.Mount("/mnt/staging-1", "/mnt/target-1a", "", []string{"bind"})
+	for _, id := range []string{"1", "2", "3"} {
+		nodeState.set(&volumeState{
+			VolumeId:         "volume-" + id,
+			AttachmentId:     "attachment-" + id,
+			DriverVolumeType: "fake-state",
+			Device:           "/dev/sd" + id,
+			StagingPath:      "/mnt/staging-" + id,
+			TargetPaths:      []string{"/mnt/target-" + id + "a", "/mnt/target-" + id + "b"},
+		})
+	}
+
+	if err := reconcileNodeState(context.Background()); nil != err {
+		t.Fatalf("failed to reconcileNodeState: %v\n", err)
+	}
+
+	expected := []*volumeState{
+		{
+			VolumeId:         "volume-1",
+			AttachmentId:     "attachment-1",
+			DriverVolumeType: "fake-state",
+			Device:           "/dev/sd1",
+			StagingPath:      "/mnt/staging-1",
+			TargetPaths:      []string{"/mnt/target-1a"},
+		},
+	}
+	if !reflect.DeepEqual(expected, nodeState.list()) {
+		t.Errorf("expected: %v, actual: %v\n", expected, nodeState.list())
+	}
+
+	expectedMetadata := map[string]string{
+		KStagingTargetPath: "/mnt/staging-1",
+		KTargetPath:        "/mnt/target-1a",
+		"other":            "kept",
+	}
+	if attachment := fb.attachments["attachment-1"]; !reflect.DeepEqual(expectedMetadata, attachment.Metadata) ||
+		"/dev/sd1" != attachment.Mountpoint {
+		t.Errorf("expected: %v, actual: %v\n", expectedMetadata, attachment)
+	}
+
+	// The orphaned devices are detached
+	expectedMetadata = map[string]string{"other": "kept"}
+	if attachment := fb.attachments["attachment-2"]; !reflect.DeepEqual(expectedMetadata, attachment.Metadata) ||
+		"-" != attachment.Mountpoint {
+		t.Errorf("expected: %v, actual: %v\n", expectedMetadata, attachment)
+	}
+
+	if 2 != fc.detaches {
+		t.Errorf("expected: %v, actual: %v\n", 2, fc.detaches)
+	}
+
+	// Reconciling again changes nothing
+	if err := reconcileNodeState(context.Background()); nil != err || 2 != fc.detaches || 1 != len(nodeState.list()) {
+		t.Errorf("expected: nothing changed, actual: %v detaches, %v\n", fc.detaches, err)
+	}
+}
+
+// useFakeSessions makes the sessions those the node lists
+func useFakeSessions(sessions []sdsdevice.Session) func() {
+	listSessions := sdsdevice.ListSessions
+	sdsdevice.ListSessions = func() ([]sdsdevice.Session, error) {
+		return sessions, nil
+	}
+
+	return func() {
+		sdsdevice.ListSessions = listSessions
+	}
+}
+
+// sessionConnector records the connection data it detaches
+type sessionConnector struct {
+	detached []map[string]interface{}
+}
+
+// Attach implementation
+func (sc *sessionConnector) Attach(conn map[string]interface{}) (string, error) {
+	return "", nil
+}
+
+// Detach implementation
+func (sc *sessionConnector) Detach(conn map[string]interface{}) error {
+	sc.detached = append(sc.detached, conn)
+	return nil
+}
+
+// GetInitiatorInfo implementation
+func (sc *sessionConnector) GetInitiatorInfo() (connector.InitiatorInfo, error) {
+	return connector.InitiatorInfo{}, nil
+}
+
+func TestReconcileUnrecordedAttachments(t *testing.T) {
+	hostName, err := connector.GetHostName()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "node-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The LUNs of volume-1 and volume-2 are found by their WWN
+	wwns := map[string]string{
+		"1": "6005076810810261f800000000000a01",
+		"2": "6005076810810261f800000000000a02",
+		"5": "6005076810810261f800000000000a05",
+		"6": "6005076810810261f800000000000a06",
+	}
+	for _, id := range []string{"1", "2"} {
+		ioutil.WriteFile(filepath.Join(dir, "sd"+id), nil, 0600)
+		if err := os.Symlink(filepath.Join(dir, "sd"+id), filepath.Join(dir, "wwn-0x"+wwns[id])); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	byId, readIdentity := sdsdevice.DiskByIdDir, sdsdevice.ReadIdentity
+	defer func() {
+		sdsdevice.DiskByIdDir, sdsdevice.ReadIdentity = byId, readIdentity
+	}()
+	sdsdevice.DiskByIdDir = dir
+	sdsdevice.ReadIdentity = func(device string) (sdsdevice.Identity, error) {
+		return sdsdevice.Identity{WWN: wwns[strings.TrimPrefix(filepath.Base(sdsdevice.Canonical(device)), "sd")]}, nil
+	}
+	defer useFakeSessions(nil)()
+
+	fb := newFakeBackend()
+	fb.delay = 0
+	for _, id := range []string{"1", "2", "3", "4", "5", "6"} {
+		fb.attachments["attachment-"+id] = &model.VolumeAttachmentSpec{
+			BaseModel:        &model.BaseModel{Id: "attachment-" + id},
+			VolumeId:         "volume-" + id,
+			Host:             hostName,
+			DriverVolumeType: "fake-state",
+			ConnectionData:   map[string]interface{}{"wwn": wwns[id]},
+			Mountpoint:       "/dev/sd" + id,
+			Metadata:         map[string]string{KStagingTargetPath: "/mnt/staging-" + id},
+		}
+	}
+	// attachment-2 tells about the device of volume-1, which is another LUN
+	// by now, attachment-4 is of another node, nothing is attached for
+	// attachment-5 yet and the LUN of attachment-6 is gone
+	fb.attachments["attachment-2"].Mountpoint = filepath.Join(dir, "sd1")
+	fb.attachments["attachment-4"].Host = "other-" + hostName
+	fb.attachments["attachment-5"].Mountpoint = ""
+	defer useFakeBackend(fb)()
+
+	fm := newFakeMounter()
+	for _, device := range []string{filepath.Join(dir, "sd1"), "/dev/sd3", "/dev/sd4"} {
+		fm.addDevice(device, "ext4")
+	}
+	defer useFakeMounter(fm)()
+
+	fc := &fakeConnector{}
+	connector.RegisterConnector("fake-state", fc)
+	defer connector.UnregisterConnector("fake-state")
+
+	state := nodeState
+	nodeState = newNodeStateStore("")
+	defer func() {
+		nodeState = state
+	}()
+
+	// volume-1 is staged without a state, nothing is mounted for volume-2 and
+	// volume-3 is recorded
+	fm.Mount(filepath.Join(dir, "sd1"), "/mnt/staging-1", "", nil)
+	fm.Mount("/dev/sd3", "/mnt/staging-3", "", nil)
+	nodeState.set(&volumeState{
+		VolumeId:         "volume-3",
+		AttachmentId:     "attachment-3",
+		DriverVolumeType: "fake-state",
+		Device:           "/dev/sd3",
+		StagingPath:      "/mnt/staging-3",
+	})
+
+	if err := reconcileNodeState(context.Background()); nil != err {
+		t.Fatalf("failed to reconcileNodeState: %v\n", err)
+	}
+
+	// Only the LUN of volume-2 is detached
+	if 1 != fc.detaches {
+		t.Errorf("expected: %v, actual: %v\n", 1, fc.detaches)
+	}
+
+	expected := map[string]string{
+		"1": "/dev/sd1",
+		"2": "-",
+		"3": "/dev/sd3",
+		"4": "/dev/sd4",
+		"5": "",
+		"6": "-",
+	}
+	for id, mountpoint := range expected {
+		if attachment := fb.attachments["attachment-"+id]; mountpoint != attachment.Mountpoint {
+			t.Errorf("expected: %v, actual: %v\n", mountpoint, attachment.Mountpoint)
+		}
+	}
+
+	if attachment := fb.attachments["attachment-2"]; 0 != len(attachment.Metadata) {
+		t.Errorf("expected: no paths, actual: %v\n", attachment.Metadata)
+	}
+
+	if 1 != len(nodeState.list()) {
+		t.Errorf("expected: %v, actual: %v\n", 1, nodeState.list())
+	}
+}
+
+func TestDetachLeftoverSessions(t *testing.T) {
+	hostName, err := connector.GetHostName()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "node-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The LUN of the session to iqn.io:volume-3 is mounted
+	ioutil.WriteFile(filepath.Join(dir, "sdc"), nil, 0600)
+	if err := os.Symlink(filepath.Join(dir, "sdc"), filepath.Join(dir, "ip-1.2.3.4:3260-iscsi-iqn.io:volume-3-lun-1")); err != nil {
+		t.Fatal(err)
+	}
+
+	byPath := sdsdevice.DiskByPathDir
+	defer func() {
+		sdsdevice.DiskByPathDir = byPath
+	}()
+	sdsdevice.DiskByPathDir = dir
+
+	session := func(target string, iqn string) sdsdevice.Session {
+		return sdsdevice.Session{DriverVolumeType: connector.IscsiDriver, Target: target, Name: iqn}
+	}
+	defer useFakeSessions([]sdsdevice.Session{
+		session("1.2.3.4:3260", "iqn.io:volume-1"),
+		session("1.2.3.4:3260", "iqn.io:volume-2"),
+		session("1.2.3.4:3260", "iqn.io:volume-3"),
+		session("1.2.3.4:3260", "iqn.io:volume-4"),
+		session("5.6.7.8:3260", "iqn.io:other"),
+	})()
+
+	connData := func(iqn string) map[string]interface{} {
+		return map[string]interface{}{"targetPortal": "1.2.3.4:3260", "targetIqn": iqn, "targetLun": 1}
+	}
+
+	fb := newFakeBackend()
+	fb.delay = 0
+	for _, id := range []string{"1", "4"} {
+		fb.attachments["attachment-"+id] = &model.VolumeAttachmentSpec{
+			BaseModel:        &model.BaseModel{Id: "attachment-" + id},
+			VolumeId:         "volume-" + id,
+			Host:             hostName,
+			DriverVolumeType: connector.IscsiDriver,
+			ConnectionData:   connData("iqn.io:volume-" + id),
+			Mountpoint:       "/dev/sd" + id,
+		}
+	}
+	defer useFakeBackend(fb)()
+
+	fm := newFakeMounter()
+	for _, device := range []string{"/dev/sd1", filepath.Join(dir, "sdc")} {
+		fm.addDevice(device, "ext4")
+	}
+	defer useFakeMounter(fm)()
+
+	sc := &sessionConnector{}
+	connector.RegisterConnector(connector.IscsiDriver, sc)
+	defer connector.UnregisterConnector(connector.IscsiDriver)
+
+	state := nodeState
+	nodeState = newNodeStateStore("")
+	defer func() {
+		nodeState = state
+	}()
+
+	// volume-1 is staged, the LUN of volume-4 is gone while the node is still
+	// logged in to its target, the attachments of volume-2 and volume-3 are
+	// deleted and the other target is not one of OpenSDS
+	fm.Mount("/dev/sd1", "/mnt/staging-1", "", nil)
+	fm.Mount(filepath.Join(dir, "sdc"), "/mnt/staging-3", "", nil)
+	nodeState.set(&volumeState{
+		VolumeId:         "volume-1",
+		AttachmentId:     "attachment-1",
+		DriverVolumeType: connector.IscsiDriver,
+		ConnectionData:   connData("iqn.io:volume-1"),
+		Device:           "/dev/sd1",
+		StagingPath:      "/mnt/staging-1",
+	})
+
+	if err := reconcileNodeState(context.Background()); nil != err {
+		t.Fatalf("failed to reconcileNodeState: %v\n", err)
+	}
+
+	var detached []string
+	for _, conn := range sc.detached {
+		detached = append(detached, conn["targetIqn"].(string))
+	}
+	expected := []string{"iqn.io:volume-4", "iqn.io:volume-2"}
+	if !reflect.DeepEqual(expected, detached) {
+		t.Errorf("expected: %v, actual: %v\n", expected, detached)
+	}
+
+	if attachment := fb.attachments["attachment-4"]; "-" != attachment.Mountpoint {
+		t.Errorf("expected: %v, actual: %v\n", "-", attachment.Mountpoint)
+	}
+}
@@ -156,6 +156,24 @@ func (s *server) ListSnapshots(
 	return s.plugin.ListSnapshots(ctx, req)
 }
 
+// ControllerExpandVolume implementation
+func (s *server) ControllerExpandVolume(
+	ctx context.Context,
+	req *csi.ControllerExpandVolumeRequest) (
+	*csi.ControllerExpandVolumeResponse, error) {
+	// Use plugin implementation
+	return s.plugin.ControllerExpandVolume(ctx, req)
+}
+
+// ControllerGetVolume implementation
+func (s *server) ControllerGetVolume(
+	ctx context.Context,
+	req *csi.ControllerGetVolumeRequest) (
+	*csi.ControllerGetVolumeResponse, error) {
+	// Use plugin implementation
+	return s.plugin.ControllerGetVolume(ctx, req)
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 //                            Node Service                                    //
 ////////////////////////////////////////////////////////////////////////////////
@@ -216,3 +234,12 @@ func (s *server) NodeGetVolumeStats(
 	*csi.NodeGetVolumeStatsResponse, error) {
 	return s.plugin.NodeGetVolumeStats(ctx, req)
 }
+
+// NodeExpandVolume implementation
+func (s *server) NodeExpandVolume(
+	ctx context.Context,
+	req *csi.NodeExpandVolumeRequest) (
+	*csi.NodeExpandVolumeResponse, error) {
+	// Use plugin implementation
+	return s.plugin.NodeExpandVolume(ctx, req)
+}
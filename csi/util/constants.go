@@ -36,6 +36,21 @@ const (
 	// CSI  environment variable whether enable the replication function, value can be true or false
 	CSIEnableReplication = "CSI_ENABLE_REPLICATION"
 
+	// Availability zone of the node environment variable name
+	NodeAvailabilityZone = "NODE_AVAILABILITY_ZONE"
+	// Node label file environment variable name
+	NodeLabelFile = "NODE_LABEL_FILE"
+	// Node state file environment variable name
+	NodeStateFile = "NODE_STATE_FILE"
+	// Opensds default AZ
+	OpensdsDefaultAZ = "default"
+	// Default profile environment variable name
+	CSIDefaultProfile = "CSI_DEFAULT_PROFILE"
+	// Opensds default profile
+	OpensdsDefaultProfile = "default"
+	// Metadata keys environment variable name
+	CSIMetadataKeys = "CSI_METADATA_KEYS"
+
 	// 1024 * 1024 * 1024
 	GiB int64 = 1073741824
 )
@@ -43,6 +43,7 @@ import (
 	"os"
 	"runtime"
 
+	sdsdevice "github.com/opensds/nbp/client/device"
 	"github.com/opensds/nbp/client/opensds"
 	"github.com/opensds/nbp/flexvolume/pkg/volume"
 	"github.com/opensds/opensds/contrib/connector"
@@ -176,6 +177,13 @@ func (plugin *OpenSDSPlugin) Attach(opts interface{}) Result {
 		return Fail(errAttach.Error())
 	}
 
+	device, errAttach = resolveDevice(attachSpec, device)
+	if errAttach != nil {
+		volConnector.Detach(attachSpec.ConnectionData)
+		rollback = true
+		return Fail(errAttach.Error())
+	}
+
 	attachSpec.Status = VOLUME_STATUS_ATTACHED
 	attachSpec.Mountpoint = device
 	_, err = client.UpdateVolumeAttachment(attachSpec.Id, attachSpec)
@@ -234,10 +242,15 @@ func (plugin *OpenSDSPlugin) MountDevice(mountDir string, device string, opts in
 	opt := opts.(*OpenSDSOptions)
 
 	act := getAttachmentByVolumeId(opt.VolumeId)
-	if act == nil || len(act.Mountpoint) == 0 || act.Mountpoint != device {
+	if act == nil || len(act.Mountpoint) == 0 || !sdsdevice.IsSameDevice(act.Mountpoint, device) {
 		return Fail(errors.New("mount device is not exist"))
 	}
 
+	//the device may be another disk since it was attached, never format or mount it then
+	if _, err := resolveDevice(act, device); err != nil {
+		return Fail(err.Error())
+	}
+
 	_, err := volume.MountVolume("", mountDir, device, opt.FsType, opt.AccessMode)
 	if err != nil {
 		return Fail(err.Error())
@@ -318,7 +331,7 @@ func (plugin *OpenSDSPlugin) WaitForAttach(device string, opts interface{}) Resu
 		return result
 	}
 
-	if len(device) != 0 && result.DevicePath != device {
+	if len(device) != 0 && !sdsdevice.IsSameDevice(result.DevicePath, device) {
 		return Fail(errors.New("the volume has attached another device."))
 	}
 
@@ -364,7 +377,7 @@ func getAttachmentByDevice(device string) *model.VolumeAttachmentSpec {
 	var act *model.VolumeAttachmentSpec = nil
 	for _, actValue := range attachments {
 		//must ensure the device used by only one volume.
-		if actValue.Mountpoint == device && actValue.Host == hostname {
+		if actValue.Host == hostname && isDeviceOf(actValue, device) {
 			act = actValue
 			break
 		}
@@ -373,6 +386,38 @@ func getAttachmentByDevice(device string) *model.VolumeAttachmentSpec {
 	return act
 }
 
+// isDeviceOf checks if a device is the one an attachment is attached as. The
+// /dev/sdX names are reused, a LUN of a known identity is checked by it.
+func isDeviceOf(act *model.VolumeAttachmentSpec, device string) bool {
+	if len(act.Mountpoint) == 0 || act.Mountpoint == "-" {
+		return false
+	}
+
+	id := sdsdevice.IdentityOf(act.ConnectionData)
+	if !id.IsEmpty() {
+		if actual, err := sdsdevice.ReadIdentity(sdsdevice.Canonical(device)); err == nil {
+			return id.Matches(actual)
+		}
+	}
+
+	return sdsdevice.IsSameDevice(act.Mountpoint, device)
+}
+
+// resolveDevice returns a stable link to the device of an attachment, which
+// must be the LUN of the attachment
+func resolveDevice(act *model.VolumeAttachmentSpec, device string) (string, error) {
+	link, err := sdsdevice.Resolve(act.DriverVolumeType, act.ConnectionData, device)
+	if err != nil {
+		return "", fmt.Errorf("failed to find the device of attachment %s: %v", act.Id, err)
+	}
+
+	if err := sdsdevice.Verify(link, sdsdevice.IdentityOf(act.ConnectionData)); err != nil {
+		return "", fmt.Errorf("refuse to use the device of attachment %s: %v", act.Id, err)
+	}
+
+	return link, nil
+}
+
 func pathExists(path string) (bool, error) {
 	_, err := os.Stat(path)
 	if err == nil {